@@ -23,6 +23,7 @@ const (
 	Status  = "activity:status"
 	Promo   = "activity:promo"
 	Video   = "activity:video"
+	Review  = "activity:review"
 )
 
 const (
@@ -116,5 +117,6 @@ func New(db models.DataBase, duration time.Duration) *Engine {
 	engine.add(Invite, 50, 2)
 	engine.add(Photo, 40, 3)
 	engine.add(Like, 30, 10)
+	engine.add(Review, 50, 3)
 	return engine
 }
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/ernado/cymedia/mediad/query"
+	. "github.com/ernado/poputchiki/models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// attachmentMessage returns message from current user with text from form,
+// checking that destination exists and did not blacklist current user.
+// Message of suspected spammer is hidden from destination.
+func attachmentMessage(context Context, destination bson.ObjectId, r *http.Request, spam *SpamFilter, moderator *Moderator) (m, toOrigin, toDestination *Message, err error) {
+	u := context.DB.Get(destination)
+	if u == nil {
+		return nil, nil, nil, ErrorUserNotFound
+	}
+	if u.InBlacklist(context.User.Id) {
+		return nil, nil, nil, ErrorBlacklisted
+	}
+	text := r.FormValue("text")
+	if !context.IsAdmin && text != "" {
+		if text, err = moderateChange(moderator, context.User.Id, ModerationMessage, text); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	m, toOrigin, toDestination = NewMessagePair(context.DB, context.User.Id, destination, "", text)
+	if !context.IsAdmin {
+		shadow, err := spam.Check(context.DB, context.User, destination, m.Text)
+		if _, ok := err.(Error); ok {
+			return nil, nil, nil, err
+		}
+		if err != nil {
+			return nil, nil, nil, BackendError(err)
+		}
+		if shadow {
+			m.Removed = []bson.ObjectId{destination}
+		}
+	}
+	return m, toOrigin, toDestination, nil
+}
+
+// sendAttachmentMessage stores message with attachment that is processing,
+// starts conversion of attachment and notifies participants; message is
+// marked as failed if conversion can't be started
+func sendAttachmentMessage(context Context, realtime AutoUpdater, updater Updater, channel RealtimeInterface, m, toOrigin, toDestination *Message, convert func() error) (int, []byte) {
+	for _, c := range []*Message{m, toOrigin, toDestination} {
+		c.Audio, c.Video = m.Audio, m.Video
+		c.Processing = true
+	}
+	if err := context.DB.AddMessage(m); err != nil {
+		return Render(BackendError(err))
+	}
+	if err := convert(); err != nil {
+		if err := context.DB.SetMessageProcessed(m.Id, true); err != nil {
+			log.Println("[messages]", "unable to mark message as failed", err)
+		}
+		return Render(BackendError(err))
+	}
+	toOrigin.Conversation = m.Conversation
+	toDestination.Conversation = m.Conversation
+	if err := realtime.Push(m.Origin, toOrigin); err != nil {
+		log.Println("[messages]", "realtime error", err)
+	}
+	if m.RemovedFor(m.Destination) {
+		return context.Render(toOrigin)
+	}
+	if err := pushToDestination(context.DB, updater, channel, toDestination); err != nil {
+		log.Println("[messages]", "realtime error", err)
+	}
+	return context.Render(toOrigin)
+}
+
+// SendAudioMessage sends message with voice note to user, that is shown
+// as processing until conversion is finished
+func SendAudioMessage(context Context, destination bson.ObjectId, r *http.Request, client query.QueryClient, realtime AutoUpdater, updater Updater, channel RealtimeInterface, spam *SpamFilter, moderator *Moderator) (int, []byte) {
+	f, _, err := r.FormFile(FORM_FILE)
+	if err != nil {
+		return Render(ValidationError(err))
+	}
+	m, toOrigin, toDestination, err := attachmentMessage(context, destination, r, spam, moderator)
+	if e, ok := err.(Error); ok {
+		return Render(e)
+	}
+	fid, _, _, err := context.Storage.Upload(f, "audio", "audio")
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	audio := &Audio{Id: bson.NewObjectId(), User: m.Origin, Time: time.Now(), Message: m.Id}
+	audio.Participants = []bson.ObjectId{m.Origin, m.Destination}
+	if _, err := context.DB.AddAudio(audio); err != nil {
+		return Render(BackendError(err))
+	}
+	m.Audio = audio.Id
+	return sendAttachmentMessage(context, realtime, updater, channel, m, toOrigin, toDestination, func() error {
+		return pushAudioConversion(client, audio.Id, fid)
+	})
+}
+
+// SendVideoMessage sends message with video to user, that is shown as
+// processing until conversion is finished
+func SendVideoMessage(context Context, destination bson.ObjectId, r *http.Request, client query.QueryClient, realtime AutoUpdater, updater Updater, channel RealtimeInterface, spam *SpamFilter, moderator *Moderator) (int, []byte) {
+	f, _, err := r.FormFile(FORM_FILE)
+	if err != nil {
+		return Render(ValidationError(err))
+	}
+	m, toOrigin, toDestination, err := attachmentMessage(context, destination, r, spam, moderator)
+	if e, ok := err.(Error); ok {
+		return Render(e)
+	}
+	fid, _, _, err := context.Storage.Upload(f, "video", "video")
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	video := &Video{Id: bson.NewObjectId(), User: m.Origin, Time: time.Now(), Message: m.Id}
+	video.Participants = []bson.ObjectId{m.Origin, m.Destination}
+	if _, err := context.DB.AddVideo(video); err != nil {
+		return Render(BackendError(err))
+	}
+	m.Video = video.Id
+	return sendAttachmentMessage(context, realtime, updater, channel, m, toOrigin, toDestination, func() error {
+		return pushVideoConversion(client, video.Id, fid)
+	})
+}
+
+// processMessageAttachment finishes processing of message attachment and
+// updates message for both participants
+func (a *Application) processMessageAttachment(id bson.ObjectId, success bool) {
+	if err := a.db.SetMessageProcessed(id, !success); err != nil {
+		log.Println("[conventer]", "message error", err)
+		return
+	}
+	message, err := a.db.GetMessage(id)
+	if err != nil {
+		log.Println("[conventer]", "message error", err)
+		return
+	}
+	context := Context{DB: a.db, Storage: a.adapter}
+	for _, user := range []bson.ObjectId{message.Origin, message.Destination} {
+		if user == message.Destination && message.RemovedFor(user) {
+			continue
+		}
+		c := message.For(user)
+		if err := c.Prepare(context); err != nil {
+			log.Println("[conventer]", "prepare error", err)
+		}
+		if err := a.realtime.Push(NewUpdate(user, message.Origin, UpdateMessageAttachment, c)); err != nil {
+			log.Println("[conventer]", "realtime error", err)
+		}
+	}
+}
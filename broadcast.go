@@ -0,0 +1,185 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	. "github.com/ernado/poputchiki/models"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	broadcastBatch = 100
+	broadcastCount = 20
+)
+
+// Broadcaster delivers admin announcements to users through realtime,
+// updates, push notifications and email, throttling delivery to rate
+// users per second. Emails are passed to digests, so users get news with
+// their digest period.
+type Broadcaster struct {
+	db       DataBase
+	realtime RealtimeInterface
+	push     Updater
+	email    Updater
+	rate     int
+}
+
+func (br *Broadcaster) save(b *Broadcast) {
+	if err := br.db.SetBroadcastProgress(b); err != nil {
+		log.Println("[broadcast]", "progress error", err)
+	}
+}
+
+// deliver stores update about news for user and sends push notification,
+// also sending email to offline users that are subscribed to news. Global
+// broadcasts are pushed to realtime once for all users.
+func (br *Broadcaster) deliver(b *Broadcast, news *News, u *User) error {
+	update := NewUpdate(u.Id, b.Author, UpdateNews, news)
+	if _, err := br.db.AddUpdateDirect(&update); err != nil {
+		return err
+	}
+	if !b.Global() && u.Notifies(SubscriptionNews, NotifyInApp) {
+		if err := br.realtime.Push(update); err != nil {
+			log.Println("[broadcast]", "realtime error", err)
+		}
+	}
+	if err := br.push.Push(update); err != nil {
+		log.Println("[broadcast]", "push error", err)
+	}
+	if u.Online || u.Email == "" || br.email == nil {
+		return nil
+	}
+	if !u.Notifies(SubscriptionNews, NotifyEmail) {
+		return nil
+	}
+	return br.email.Push(update)
+}
+
+// Run delivers broadcast to all recipients, saving progress after each
+// batch of users. Running broadcast is resumed after last saved batch.
+func (br *Broadcaster) Run(b *Broadcast) {
+	log.Println("[broadcast]", b.Id.Hex(), "started for", b.Total, "users")
+	resumed := b.State == BroadcastRunning
+	b.State = BroadcastRunning
+	br.save(b)
+	q, err := b.Query()
+	if err != nil {
+		log.Println("[broadcast]", "segment error", err)
+		b.State = BroadcastFailed
+		b.Finished = time.Now()
+		br.save(b)
+		return
+	}
+	news := b.News()
+	if b.Global() && !resumed {
+		if err := br.realtime.PushGlobal(NewUpdate("", b.Author, UpdateNews, news)); err != nil {
+			log.Println("[broadcast]", "realtime error", err)
+		}
+	}
+	var interval time.Duration
+	if br.rate > 0 {
+		interval = time.Second / time.Duration(br.rate)
+	}
+	for {
+		users, err := br.db.GetBroadcastRecipients(q, b.After, broadcastBatch)
+		if err != nil {
+			log.Println("[broadcast]", "recipients error", err)
+			b.State = BroadcastFailed
+			b.Finished = time.Now()
+			br.save(b)
+			return
+		}
+		if len(users) == 0 {
+			break
+		}
+		for _, u := range users {
+			if err := br.deliver(b, news, u); err != nil {
+				log.Println("[broadcast]", "delivery to", u.Id.Hex(), "failed:", err)
+				b.Failed++
+			} else {
+				b.Sent++
+			}
+			time.Sleep(interval)
+		}
+		b.After = users[len(users)-1].Id
+		br.save(b)
+	}
+	b.State = BroadcastFinished
+	b.Finished = time.Now()
+	br.save(b)
+	log.Println("[broadcast]", b.Id.Hex(), "finished:", b.Sent, "sent,", b.Failed, "failed")
+}
+
+// ResumeBroadcasts continues delivery of broadcasts that were interrupted
+// by restart of application
+func (a *Application) ResumeBroadcasts() {
+	broadcasts, err := a.db.GetUnfinishedBroadcasts()
+	if err != nil {
+		log.Println("[broadcast]", "error", err)
+		return
+	}
+	for _, b := range broadcasts {
+		log.Println("[broadcast]", b.Id.Hex(), "resuming after", b.Sent+b.Failed, "users")
+		a.broadcaster.Run(b)
+	}
+}
+
+// CreateBroadcast starts delivery of announcement to all users or to
+// segment of users
+func CreateBroadcast(context Context, parser Parser, broadcaster *Broadcaster) (int, []byte) {
+	b := new(Broadcast)
+	if err := parser.Parse(b); err != nil {
+		return Render(ValidationError(err))
+	}
+	if err := b.Validate(); err != nil {
+		return Render(ValidationError(err))
+	}
+	q, _ := b.Query()
+	total, err := context.DB.CountBroadcastRecipients(q)
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	b.Id = bson.NewObjectId()
+	b.Author = context.User.Id
+	b.State = BroadcastQueued
+	b.Total = total
+	b.Sent, b.Failed = 0, 0
+	b.Time = time.Now()
+	b.Finished = time.Time{}
+	if err := context.DB.AddBroadcast(b); err != nil {
+		return Render(BackendError(err))
+	}
+	// delivery works on its own copy, so response is not changed concurrently
+	running := *b
+	go broadcaster.Run(&running)
+	return context.Render(b)
+}
+
+// GetBroadcasts returns broadcasts with progress of delivery
+func GetBroadcasts(context Context, pagination Pagination) (int, []byte) {
+	if pagination.Count == 0 {
+		pagination.Count = broadcastCount
+	}
+	broadcasts, count, err := context.DB.GetBroadcasts(pagination)
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	if err := Broadcasts(broadcasts).Prepare(context); err != nil {
+		return Render(BackendError(err))
+	}
+	return context.Render(SearchResult{Result: broadcasts, Count: count})
+}
+
+// GetBroadcast returns progress of delivery of broadcast
+func GetBroadcast(context Context, id bson.ObjectId) (int, []byte) {
+	b, err := context.DB.GetBroadcast(id)
+	if err == mgo.ErrNotFound {
+		return Render(ErrorObjectNotFound)
+	}
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	return context.Render(b)
+}
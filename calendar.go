@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ernado/gotok"
+	. "github.com/ernado/poputchiki/models"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	calendarKeyParm = "key"
+	calendarUrl     = "http://poputchiki.ru/api/user/%s/trips.ics?%s=%s"
+	calendarName    = "Попутчики: поездки"
+)
+
+type CalendarLink struct {
+	Token string `json:"token"`
+	Url   string `json:"url"`
+}
+
+func newCalendarLink(id bson.ObjectId, token string) CalendarLink {
+	return CalendarLink{token, fmt.Sprintf(calendarUrl, id.Hex(), calendarKeyParm, token)}
+}
+
+// tripsCalendar returns calendar with events for trips, loading owners
+// and participants of trips
+func tripsCalendar(db DataBase, name string, trips []*Trip) *Calendar {
+	users := map[bson.ObjectId]*User{}
+	load := func(id bson.ObjectId) {
+		if _, ok := users[id]; !ok {
+			users[id] = db.Get(id)
+		}
+	}
+	calendar := &Calendar{Name: name}
+	for _, trip := range trips {
+		load(trip.User)
+		for _, id := range trip.Participants {
+			load(id)
+		}
+		calendar.Events = append(calendar.Events, NewTripEvent(trip, users))
+	}
+	return calendar
+}
+
+// GetCalendarLink returns link to trips feed of user, generating secret token if needed
+func GetCalendarLink(db DataBase, id bson.ObjectId) (int, []byte) {
+	user := db.Get(id)
+	if user == nil {
+		return Render(ErrorUserNotFound)
+	}
+	if user.CalendarToken != "" {
+		return Render(newCalendarLink(id, user.CalendarToken))
+	}
+	return ResetCalendarLink(db, id)
+}
+
+// ResetCalendarLink generates new secret token, invalidating previous feed link
+func ResetCalendarLink(db DataBase, id bson.ObjectId) (int, []byte) {
+	token := gotok.Generate(id).Token
+	if err := db.SetCalendarToken(id, token); err != nil {
+		return Render(BackendError(err))
+	}
+	return Render(newCalendarLink(id, token))
+}
+
+// GetUserTripsCalendar returns iCalendar feed with own trips of user and trips
+// where user is participant. Feed is secured with per-user token instead of auth.
+func GetUserTripsCalendar(db DataBase, id bson.ObjectId, r *http.Request, w http.ResponseWriter) (int, []byte) {
+	user := db.Get(id)
+	if user == nil {
+		return Render(ErrorUserNotFound)
+	}
+	key := r.URL.Query().Get(calendarKeyParm)
+	if user.CalendarToken == "" || subtle.ConstantTimeCompare([]byte(key), []byte(user.CalendarToken)) != 1 {
+		return Render(ErrorNotAllowed)
+	}
+	trips, err := db.GetUserTrips(id)
+	if err != nil && err != mgo.ErrNotFound {
+		return Render(BackendError(err))
+	}
+	participant, err := db.GetParticipantTrips(id)
+	if err != nil && err != mgo.ErrNotFound {
+		return Render(BackendError(err))
+	}
+	trips = append(trips, participant...)
+	w.Header().Set(ContentTypeHeader, CalendarContentType)
+	return http.StatusOK, tripsCalendar(db, calendarName, trips).Bytes(time.Now())
+}
+
+// GetTripCalendar returns trip as .ics attachment
+func GetTripCalendar(context Context, id bson.ObjectId, w http.ResponseWriter) (int, []byte) {
+	trip, err := getTrip(context, id)
+	if err == mgo.ErrNotFound {
+		return Render(ErrorObjectNotFound)
+	}
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	w.Header().Set(ContentTypeHeader, CalendarContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="trip-%s.ics"`, id.Hex()))
+	return http.StatusOK, tripsCalendar(context.DB, calendarName, []*Trip{trip}).Bytes(time.Now())
+}
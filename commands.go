@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/codegangsta/inject"
+	. "github.com/ernado/poputchiki/models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// realtimeCommand is a handler of http api that is called for command,
+// with command target mapped as bson.ObjectId if target is required
+type realtimeCommand struct {
+	handler interface{}
+	target  bool
+}
+
+var realtimeCommands = map[string]realtimeCommand{
+	CommandSendMessage: {SendMessage, true},
+	CommandReadMessage: {MarkReadMessage, true},
+	CommandReadUpdate:  {SetUpdateRead, true},
+	CommandReadUpdates: {SetUpdatesRead, false},
+	CommandTyping:      {SendTyping, true},
+}
+
+// commandRequest returns request that is parsed by handlers like http
+// request with params as query and payload as json body
+func commandRequest(r *http.Request, cmd *Command) *http.Request {
+	q := url.Values{}
+	for k, v := range cmd.Params {
+		q.Set(k, v)
+	}
+	u := *r.URL
+	u.RawQuery = q.Encode()
+	req, _ := http.NewRequest("POST", u.String(), bytes.NewReader(cmd.Payload))
+	req.Header.Set(ContentTypeHeader, "application/json")
+	return req
+}
+
+// executeCommand calls handler of command with dependencies of realtime
+// connection and returns its response
+func executeCommand(injector inject.Injector, context Context, cmd *Command) (int, []byte) {
+	if cmd.Version != RealtimeProtocol {
+		return Render(ErrorBadRequest)
+	}
+	if cmd.Type == CommandPing {
+		return Render("pong")
+	}
+	command, ok := realtimeCommands[cmd.Type]
+	if !ok {
+		return Render(ErrorBadRequest)
+	}
+	if command.target && !cmd.Target.Valid() {
+		return Render(ErrorBadId)
+	}
+	req := commandRequest(context.Request, cmd)
+	parser := NewParser(req)
+	context.Request = req
+	context.Parser = parser
+	inj := inject.New()
+	inj.SetParent(injector)
+	inj.Map(req)
+	inj.Map(parser)
+	inj.Map(context)
+	if command.target {
+		inj.Map(cmd.Target)
+	}
+	values, err := inj.Invoke(command.handler)
+	if err != nil {
+		log.Println("[realtime]", "command", cmd.Type, "error", err)
+		return Render(BackendError(err))
+	}
+	return int(values[0].Int()), values[1].Bytes()
+}
+
+// subscribeCommand adds users from comma-separated id param to connection,
+// which is allowed only for admins
+func subscribeCommand(hub *Hub, c *HubConn, context Context, cmd *Command) (int, []byte) {
+	if !context.IsAdmin {
+		return Render(ErrorNotAllowed)
+	}
+	var users []bson.ObjectId
+	if cmd.Target.Valid() {
+		users = append(users, cmd.Target)
+	}
+	if ids := cmd.Params["id"]; ids != "" {
+		for _, id := range strings.Split(ids, ",") {
+			if !bson.IsObjectIdHex(id) {
+				return Render(ErrorBadId)
+			}
+			users = append(users, bson.ObjectIdHex(id))
+		}
+	}
+	if len(users) == 0 {
+		return Render(ErrorBadRequest)
+	}
+	if err := hub.Extend(c, users...); err != nil {
+		return Render(BackendError(err))
+	}
+	return Render(users)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/codegangsta/inject"
+	. "github.com/ernado/poputchiki/models"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestRealtimeCommands(t *testing.T) {
+	Convey("Realtime commands", t, func() {
+		r, _ := http.NewRequest("GET", "/api/realtime", nil)
+		context := Context{Request: r}
+		injector := inject.New()
+		target := bson.NewObjectId()
+		realtimeCommands["echo"] = realtimeCommand{func(parser Parser, id bson.ObjectId, r *http.Request) (int, []byte) {
+			v := new(MessageText)
+			if err := parser.Parse(v); err != nil {
+				return Render(ValidationError(err))
+			}
+			return Render([]string{id.Hex(), v.Text, r.URL.Query().Get("type")})
+		}, true}
+		Reset(func() {
+			delete(realtimeCommands, "echo")
+		})
+		Convey("Handler should receive target, params and payload", func() {
+			cmd := &Command{Version: RealtimeProtocol, Id: "1", Type: "echo", Target: target, Params: map[string]string{"type": "messages"}, Payload: json.RawMessage(`{"text": "привет"}`)}
+			code, data := executeCommand(injector, context, cmd)
+			So(code, ShouldEqual, http.StatusOK)
+			var result []string
+			So(json.Unmarshal(data, &result), ShouldBeNil)
+			So(result, ShouldResemble, []string{target.Hex(), "привет", "messages"})
+		})
+		Convey("Target should be required", func() {
+			code, _ := executeCommand(injector, context, &Command{Version: RealtimeProtocol, Id: "2", Type: "echo"})
+			So(code, ShouldEqual, ErrorBadId.Code)
+		})
+		Convey("Ping should be answered", func() {
+			code, data := executeCommand(injector, context, &Command{Version: RealtimeProtocol, Id: "3", Type: CommandPing})
+			So(code, ShouldEqual, http.StatusOK)
+			So(string(data), ShouldEqual, `"pong"`)
+		})
+		Convey("Unknown commands and versions should be rejected", func() {
+			code, _ := executeCommand(injector, context, &Command{Version: RealtimeProtocol, Type: "unknown"})
+			So(code, ShouldEqual, http.StatusBadRequest)
+			code, _ = executeCommand(injector, context, &Command{Version: RealtimeProtocol + 1, Type: CommandPing})
+			So(code, ShouldEqual, http.StatusBadRequest)
+		})
+		Convey("Subscribe should be allowed only for admins", func() {
+			pubsub := newMemoryPubSub()
+			hub := NewHub(pubsub, nil, "test", 2, HubDropSlow)
+			c, err := hub.Subscribe(target)
+			So(err, ShouldBeNil)
+			other := bson.NewObjectId()
+			cmd := &Command{Version: RealtimeProtocol, Type: CommandSubscribe, Params: map[string]string{"id": other.Hex()}}
+			code, _ := subscribeCommand(hub, c, context, cmd)
+			So(code, ShouldEqual, ErrorNotAllowed.Code)
+			context.IsAdmin = true
+			code, _ = subscribeCommand(hub, c, context, cmd)
+			So(code, ShouldEqual, http.StatusOK)
+			So(hub.Publish(NewUpdate(other, target, "test", nil)), ShouldBeNil)
+			So((<-c.Updates()).Destination, ShouldEqual, other)
+			hub.Unsubscribe(c)
+			So(pubsub.count(), ShouldEqual, 0)
+		})
+	})
+}
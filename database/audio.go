@@ -13,10 +13,15 @@ func (db *DB) GetAudio(id bson.ObjectId) *models.Audio {
 	return a
 }
 
+// AddAudio stores audio and sets it as audio of user profile, if audio
+// is not an attachment of message
 func (db *DB) AddAudio(audio *models.Audio) (*models.Audio, error) {
 	if err := db.audio.Insert(audio); err != nil {
 		return nil, err
 	}
+	if audio.Message.Valid() {
+		return audio, nil
+	}
 	return audio, db.users.UpdateId(audio.User, bson.M{"$set": bson.M{"audio": audio.Id}})
 }
 
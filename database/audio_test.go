@@ -48,6 +48,12 @@ func TestAudio(t *testing.T) {
 				So(db.GetAudio(a.Id), ShouldBeNil)
 				Integrity(db, u)
 			})
+			Convey("Attachment should not change profile", func() {
+				attachment := &models.Audio{Id: bson.NewObjectId(), User: u.Id, Message: bson.NewObjectId()}
+				_, err := db.AddAudio(attachment)
+				So(err, ShouldBeNil)
+				So(db.Get(u.Id).Audio, ShouldEqual, a.Id)
+			})
 			Convey("Remove secure", func() {
 				So(db.RemoveAudioSecure(a.User, a.Id), ShouldBeNil)
 				So(db.GetAudio(a.Id), ShouldBeNil)
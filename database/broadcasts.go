@@ -0,0 +1,70 @@
+package database
+
+import (
+	"github.com/ernado/poputchiki/models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func (db *DB) AddBroadcast(b *models.Broadcast) error {
+	return db.broadcasts.Insert(b)
+}
+
+func (db *DB) GetBroadcast(id bson.ObjectId) (*models.Broadcast, error) {
+	b := &models.Broadcast{}
+	return b, db.broadcasts.FindId(id).One(b)
+}
+
+// GetBroadcasts returns broadcasts, newest first
+func (db *DB) GetBroadcasts(pagination models.Pagination) ([]*models.Broadcast, int, error) {
+	broadcasts := []*models.Broadcast{}
+	count, err := db.broadcasts.Count()
+	if err != nil {
+		return broadcasts, 0, err
+	}
+	err = db.broadcasts.Find(nil).Sort("-time").Skip(pagination.Offset).Limit(pagination.Count).All(&broadcasts)
+	return broadcasts, count, err
+}
+
+// GetUnfinishedBroadcasts returns queued and running broadcasts, oldest
+// first
+func (db *DB) GetUnfinishedBroadcasts() ([]*models.Broadcast, error) {
+	broadcasts := []*models.Broadcast{}
+	query := bson.M{"state": bson.M{"$in": []string{models.BroadcastQueued, models.BroadcastRunning}}}
+	return broadcasts, db.broadcasts.Find(query).Sort("time").All(&broadcasts)
+}
+
+// SetBroadcastProgress saves state, counters and cursor of broadcast
+func (db *DB) SetBroadcastProgress(b *models.Broadcast) error {
+	update := bson.M{"state": b.State, "total": b.Total, "sent": b.Sent, "failed": b.Failed}
+	if b.After.Valid() {
+		update["after"] = b.After
+	}
+	if !b.Finished.IsZero() {
+		update["finished"] = b.Finished
+	}
+	return db.broadcasts.UpdateId(b.Id, bson.M{"$set": update})
+}
+
+func broadcastQuery(q *models.SearchQuery) bson.M {
+	if q == nil {
+		return bson.M{}
+	}
+	return q.ToBson()
+}
+
+// CountBroadcastRecipients returns amount of users matching query, or of
+// all users if query is nil
+func (db *DB) CountBroadcastRecipients(q *models.SearchQuery) (int, error) {
+	return db.users.Find(broadcastQuery(q)).Count()
+}
+
+// GetBroadcastRecipients returns users matching query, or all users if
+// query is nil, with ids greater than after, ordered by id
+func (db *DB) GetBroadcastRecipients(q *models.SearchQuery, after bson.ObjectId, count int) ([]*models.User, error) {
+	users := []*models.User{}
+	query := broadcastQuery(q)
+	if after.Valid() {
+		query = bson.M{"$and": []bson.M{query, {"_id": bson.M{"$gt": after}}}}
+	}
+	return users, db.users.Find(query).Sort("_id").Limit(count).All(&users)
+}
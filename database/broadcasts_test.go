@@ -0,0 +1,66 @@
+package database
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/ernado/poputchiki/models"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestBroadcasts(t *testing.T) {
+	db := TestDatabase()
+	Convey("Broadcasts", t, func() {
+		Reset(db.Drop)
+		for i := 0; i < 5; i++ {
+			sex := models.SexMale
+			if i%2 == 0 {
+				sex = models.SexFemale
+			}
+			So(db.Add(&models.User{Id: bson.NewObjectId(), Sex: sex}), ShouldBeNil)
+		}
+		Convey("Recipients", func() {
+			n, err := db.CountBroadcastRecipients(nil)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 5)
+			q, err := models.NewQuery(url.Values{"sex": {models.SexFemale}})
+			So(err, ShouldBeNil)
+			n, err = db.CountBroadcastRecipients(q)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 3)
+			first, err := db.GetBroadcastRecipients(nil, "", 2)
+			So(err, ShouldBeNil)
+			So(len(first), ShouldEqual, 2)
+			rest, err := db.GetBroadcastRecipients(nil, first[1].Id, 10)
+			So(err, ShouldBeNil)
+			So(len(rest), ShouldEqual, 3)
+			So(rest[0].Id > first[1].Id, ShouldBeTrue)
+			women, err := db.GetBroadcastRecipients(q, first[0].Id, 10)
+			So(err, ShouldBeNil)
+			for _, u := range women {
+				So(u.Sex, ShouldEqual, models.SexFemale)
+				So(u.Id > first[0].Id, ShouldBeTrue)
+			}
+		})
+		Convey("Progress", func() {
+			b := &models.Broadcast{Id: bson.NewObjectId(), Title: "Новости", Text: "Текст", State: models.BroadcastQueued, Time: time.Now()}
+			So(db.AddBroadcast(b), ShouldBeNil)
+			b.State = models.BroadcastFinished
+			b.Total, b.Sent, b.Failed = 5, 4, 1
+			b.Finished = time.Now()
+			So(db.SetBroadcastProgress(b), ShouldBeNil)
+			saved, err := db.GetBroadcast(b.Id)
+			So(err, ShouldBeNil)
+			So(saved.State, ShouldEqual, models.BroadcastFinished)
+			So(saved.Sent, ShouldEqual, 4)
+			So(saved.Failed, ShouldEqual, 1)
+			So(saved.Finished.IsZero(), ShouldBeFalse)
+			broadcasts, count, err := db.GetBroadcasts(models.Pagination{})
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 1)
+			So(broadcasts[0].Id, ShouldEqual, b.Id)
+		})
+	})
+}
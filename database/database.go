@@ -17,7 +17,7 @@ var (
 	citiesCollection        = "cities"
 	countriesCollection     = "countries"
 	guestsCollection        = "guests"
-	messagesCollection      = "messages"
+	messagesCollection      = "conversation_messages"
 	statusesCollection      = "statuses"
 	photoCollection         = "photo"
 	albumsCollection        = "albums"
@@ -32,6 +32,17 @@ var (
 	presentsCollection      = "presents"
 	adsCollection           = "advertisements"
 	presentEventsCollection = "present_events"
+	tripsCollection         = "trips"
+	invitationsCollection   = "invitations"
+	groupChatsCollection    = "group_chats"
+	groupMembersCollection  = "group_members"
+	groupMessagesCollection = "group_messages"
+	reviewsCollection       = "reviews"
+	conversationsCollection = "conversations"
+	oldMessagesCollection   = "messages"
+	moderationCollection    = "moderation"
+	broadcastsCollection    = "broadcasts"
+	digestsCollection       = "digests"
 )
 
 type DB struct {
@@ -53,6 +64,17 @@ type DB struct {
 	presents       *mgo.Collection
 	presentEvents  *mgo.Collection
 	advertisements *mgo.Collection
+	trips          *mgo.Collection
+	invitations    *mgo.Collection
+	groupChats     *mgo.Collection
+	groupMembers   *mgo.Collection
+	groupMessages  *mgo.Collection
+	reviews        *mgo.Collection
+	conversations  *mgo.Collection
+	oldMessages    *mgo.Collection
+	moderation     *mgo.Collection
+	broadcasts     *mgo.Collection
+	digests        *mgo.Collection
 	salt           string
 	offlineTimeout time.Duration
 }
@@ -68,7 +90,9 @@ func TestDatabase() *DB {
 // Drop all collections of database
 func (db *DB) Drop() {
 	collections := []*mgo.Collection{db.users, db.guests, db.messages, db.statuses, db.photo,
-		db.files, db.video, db.audio, db.stripe, db.conftokens, db.activities, db.updates, db.presents, db.presentEvents, db.advertisements}
+		db.files, db.video, db.audio, db.stripe, db.conftokens, db.activities, db.updates, db.presents, db.presentEvents, db.advertisements,
+		db.trips, db.invitations, db.groupChats, db.groupMembers, db.groupMessages, db.reviews,
+		db.conversations, db.oldMessages, db.moderation, db.broadcasts, db.digests}
 
 	for k := range collections {
 		collections[k].DropCollection()
@@ -100,11 +124,10 @@ func (database *DB) Init() {
 	}
 	must(db.C(guestsCollection).EnsureIndex(index))
 
-	// photo, guest, messages: hashed user index
+	// photo, guest: hashed user index
 	index = mgo.Index{
 		Key: []string{"$hashed:user"},
 	}
-	must(db.C(messagesCollection).EnsureIndex(index))
 	must(db.C(guestsCollection).EnsureIndex(index))
 	must(db.C(photoCollection).EnsureIndex(index))
 	must(db.C(statusesCollection).EnsureIndex(index))
@@ -139,6 +162,36 @@ func (database *DB) Init() {
 	index = mgo.Index{Key: []string{"type", "time", "destination"}}
 	must(db.C(presentEventsCollection).EnsureIndex(index))
 	must(db.C(presentsCollection).EnsureIndexKey("title"))
+	must(db.C(tripsCollection).EnsureIndexKey("user"))
+	index = mgo.Index{Key: []string{"destinations", "start", "end"}}
+	must(db.C(tripsCollection).EnsureIndex(index))
+	must(db.C(invitationsCollection).EnsureIndexKey("origin", "state"))
+	must(db.C(invitationsCollection).EnsureIndexKey("destination", "state"))
+	must(db.C(invitationsCollection).EnsureIndexKey("state", "expires"))
+	index = mgo.Index{Key: []string{"trip"}, Unique: true, Sparse: true}
+	must(db.C(groupChatsCollection).EnsureIndex(index))
+	index = mgo.Index{Key: []string{"chat", "user"}, Unique: true}
+	must(db.C(groupMembersCollection).EnsureIndex(index))
+	must(db.C(groupMembersCollection).EnsureIndexKey("user"))
+	must(db.C(groupMessagesCollection).EnsureIndexKey("chat", "time"))
+	index = mgo.Index{Key: []string{"author", "target", "travel"}, Unique: true}
+	must(db.C(reviewsCollection).EnsureIndex(index))
+	must(db.C(reviewsCollection).EnsureIndexKey("target", "revealed", "time"))
+	must(db.C(reviewsCollection).EnsureIndexKey("revealed", "reveal_time"))
+	must(db.C(reviewsCollection).EnsureIndexKey("disputed"))
+	index = mgo.Index{Key: []string{"key"}, Unique: true}
+	must(db.C(conversationsCollection).EnsureIndex(index))
+	must(db.C(conversationsCollection).EnsureIndexKey("participants", "-time"))
+	must(db.C(conversationsCollection).EnsureIndexKey("states.user", "-states.pinned"))
+	must(db.C(messagesCollection).EnsureIndexKey("conversation", "time"))
+	must(db.C(messagesCollection).EnsureIndexKey("destination", "read"))
+	index = mgo.Index{Key: []string{"$text:text"}, DefaultLanguage: "russian"}
+	must(db.C(messagesCollection).EnsureIndex(index))
+	index = mgo.Index{Key: []string{"spam_flag.time"}, Sparse: true}
+	must(db.C(collection).EnsureIndex(index))
+	must(db.C(moderationCollection).EnsureIndexKey("state", "time"))
+	must(db.C(broadcastsCollection).EnsureIndexKey("-time"))
+	must(db.C(digestsCollection).EnsureIndexKey("user", "time"))
 }
 
 func New(name, salt string, timeout time.Duration, session *mgo.Session) *DB {
@@ -165,6 +218,17 @@ func New(name, salt string, timeout time.Duration, session *mgo.Session) *DB {
 	database.presents = db.C(presentsCollection)
 	database.presentEvents = db.C(presentEventsCollection)
 	database.advertisements = db.C(adsCollection)
+	database.trips = db.C(tripsCollection)
+	database.invitations = db.C(invitationsCollection)
+	database.groupChats = db.C(groupChatsCollection)
+	database.groupMembers = db.C(groupMembersCollection)
+	database.groupMessages = db.C(groupMessagesCollection)
+	database.reviews = db.C(reviewsCollection)
+	database.conversations = db.C(conversationsCollection)
+	database.oldMessages = db.C(oldMessagesCollection)
+	database.moderation = db.C(moderationCollection)
+	database.broadcasts = db.C(broadcastsCollection)
+	database.digests = db.C(digestsCollection)
 	database.Init()
 	return database
 }
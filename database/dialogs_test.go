@@ -0,0 +1,135 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ernado/poputchiki/models"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestDialogs(t *testing.T) {
+	db := TestDatabase()
+	Convey("Dialogs", t, func() {
+		Reset(db.Drop)
+		user := &models.User{Id: bson.NewObjectId(), Name: "Alex"}
+		So(db.Add(user), ShouldBeNil)
+		var peers []bson.ObjectId
+		now := time.Now()
+		for i := 0; i < 4; i++ {
+			peer := &models.User{Id: bson.NewObjectId(), Name: "Peer"}
+			So(db.Add(peer), ShouldBeNil)
+			peers = append(peers, peer.Id)
+			m := models.NewMessage(peer.Id, user.Id, "", "Привет")
+			m.Time = now.Add(time.Duration(i) * time.Second)
+			So(db.AddMessage(m), ShouldBeNil)
+		}
+		all := &models.DialogFilter{}
+		Convey("Pagination", func() {
+			dialogs, count, err := db.GetDialogs(user.Id, all, models.Pagination{Count: 3})
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 4)
+			So(len(dialogs), ShouldEqual, 3)
+			So(dialogs[0].Id, ShouldEqual, peers[3])
+			So(dialogs[0].User, ShouldNotBeNil)
+			dialogs, _, err = db.GetDialogs(user.Id, all, models.Pagination{Count: 3, Offset: 3})
+			So(err, ShouldBeNil)
+			So(len(dialogs), ShouldEqual, 1)
+			So(dialogs[0].Id, ShouldEqual, peers[0])
+		})
+		Convey("Pinned dialogs should be first", func() {
+			So(db.SetConversationState(user.Id, peers[0], models.ConversationPinned, true), ShouldBeNil)
+			dialogs, _, err := db.GetDialogs(user.Id, all, models.Pagination{})
+			So(err, ShouldBeNil)
+			So(dialogs[0].Id, ShouldEqual, peers[0])
+			So(dialogs[0].Pinned, ShouldBeTrue)
+			So(dialogs[1].Id, ShouldEqual, peers[3])
+			Convey("Only for user who pinned", func() {
+				dialogs, _, err := db.GetDialogs(peers[0], all, models.Pagination{})
+				So(err, ShouldBeNil)
+				So(dialogs[0].Pinned, ShouldBeFalse)
+			})
+		})
+		Convey("Archived dialogs should be hidden", func() {
+			So(db.SetConversationState(user.Id, peers[3], models.ConversationArchived, true), ShouldBeNil)
+			dialogs, count, err := db.GetDialogs(user.Id, all, models.Pagination{})
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 3)
+			So(dialogs[0].Id, ShouldEqual, peers[2])
+			dialogs, count, err = db.GetDialogs(user.Id, &models.DialogFilter{Archived: true}, models.Pagination{})
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 1)
+			So(dialogs[0].Archived, ShouldBeTrue)
+			chats, err := db.GetChats(user.Id)
+			So(err, ShouldBeNil)
+			So(len(chats), ShouldEqual, 4)
+		})
+		Convey("Unread filter should be consistent with unread count", func() {
+			So(db.SetReadMessagesFromUser(user.Id, peers[1]), ShouldBeNil)
+			So(db.SetConversationState(user.Id, peers[2], models.ConversationArchived, true), ShouldBeNil)
+			dialogs, count, err := db.GetDialogs(user.Id, &models.DialogFilter{Unread: true, All: true}, models.Pagination{})
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 3)
+			total := 0
+			for _, d := range dialogs {
+				So(d.Id, ShouldNotEqual, peers[1])
+				total += d.Unread
+			}
+			n, err := db.GetUnreadCount(user.Id)
+			So(err, ShouldBeNil)
+			So(total, ShouldEqual, n)
+		})
+		Convey("Favorites filter", func() {
+			So(db.AddToFavorites(user.Id, peers[1]), ShouldBeNil)
+			dialogs, count, err := db.GetDialogs(user.Id, &models.DialogFilter{Favorites: true}, models.Pagination{})
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 1)
+			So(dialogs[0].Id, ShouldEqual, peers[1])
+		})
+		Convey("Invites filter", func() {
+			So(db.AddInvite(models.NewInvite(user.Id, peers[2])), ShouldBeNil)
+			dialogs, count, err := db.GetDialogs(user.Id, &models.DialogFilter{Invites: true}, models.Pagination{})
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 1)
+			So(dialogs[0].Id, ShouldEqual, peers[2])
+		})
+		Convey("Dialogs should be sorted and counted by visible messages", func() {
+			shadowed := models.NewMessage(peers[0], user.Id, "", "Спам")
+			shadowed.Time = now.Add(time.Minute)
+			shadowed.Removed = []bson.ObjectId{user.Id}
+			So(db.AddMessage(shadowed), ShouldBeNil)
+			stranger := &models.User{Id: bson.NewObjectId(), Name: "Stranger"}
+			So(db.Add(stranger), ShouldBeNil)
+			unsent := models.NewMessage(stranger.Id, user.Id, "", "Пока")
+			So(db.AddMessage(unsent), ShouldBeNil)
+			So(db.UnsendMessage(unsent.Id), ShouldBeNil)
+			dialogs, count, err := db.GetDialogs(user.Id, all, models.Pagination{Count: 2})
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 4)
+			So(len(dialogs), ShouldEqual, 2)
+			So(dialogs[0].Id, ShouldEqual, peers[3])
+			So(dialogs[1].Id, ShouldEqual, peers[2])
+			dialogs, count, err = db.GetDialogs(user.Id, all, models.Pagination{Count: 2, Offset: 2})
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 4)
+			So(len(dialogs), ShouldEqual, 2)
+			So(dialogs[1].Id, ShouldEqual, peers[0])
+		})
+		Convey("Cleared dialogs should be hidden", func() {
+			So(db.RemoveChat(user.Id, peers[0]), ShouldBeNil)
+			_, count, err := db.GetDialogs(user.Id, all, models.Pagination{})
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 3)
+		})
+		Convey("Mute", func() {
+			So(db.SetConversationState(user.Id, peers[0], models.ConversationMuted, true), ShouldBeNil)
+			c, err := db.GetConversation(user.Id, peers[0])
+			So(err, ShouldBeNil)
+			So(c.MutedBy(user.Id), ShouldBeTrue)
+			So(c.MutedBy(peers[0]), ShouldBeFalse)
+			So(db.SetConversationState(user.Id, bson.NewObjectId(), models.ConversationMuted, true), ShouldEqual, mgo.ErrNotFound)
+		})
+	})
+}
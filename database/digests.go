@@ -0,0 +1,37 @@
+package database
+
+import (
+	"github.com/ernado/poputchiki/models"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// AddDigestItem buffers update for digest, ignoring updates that are
+// already buffered
+func (db *DB) AddDigestItem(item *models.DigestItem) error {
+	err := db.digests.Insert(item)
+	if mgo.IsDup(err) {
+		return nil
+	}
+	return err
+}
+
+// GetDigestUsers returns users that have buffered updates
+func (db *DB) GetDigestUsers() ([]bson.ObjectId, error) {
+	users := []bson.ObjectId{}
+	return users, db.digests.Find(nil).Distinct("user", &users)
+}
+
+// GetDigestItems returns buffered updates of user, oldest first
+func (db *DB) GetDigestItems(user bson.ObjectId) ([]*models.DigestItem, error) {
+	items := []*models.DigestItem{}
+	return items, db.digests.Find(bson.M{"user": user}).Sort("time").All(&items)
+}
+
+func (db *DB) RemoveDigestItems(ids []bson.ObjectId) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	_, err := db.digests.RemoveAll(bson.M{"_id": bson.M{"$in": ids}})
+	return err
+}
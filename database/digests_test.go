@@ -0,0 +1,40 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/ernado/poputchiki/models"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestDigests(t *testing.T) {
+	db := TestDatabase()
+	Convey("Digests", t, func() {
+		Reset(db.Drop)
+		user, other := bson.NewObjectId(), bson.NewObjectId()
+		first := models.NewUpdate(user, other, models.UpdateGuests, nil)
+		second := models.NewUpdate(user, other, models.UpdateGuests, nil)
+		So(db.AddDigestItem(models.NewDigestItem(first)), ShouldBeNil)
+		So(db.AddDigestItem(models.NewDigestItem(second)), ShouldBeNil)
+		So(db.AddDigestItem(models.NewDigestItem(first)), ShouldBeNil)
+		So(db.AddDigestItem(models.NewDigestItem(models.NewUpdate(other, user, models.UpdateGuests, nil))), ShouldBeNil)
+		users, err := db.GetDigestUsers()
+		So(err, ShouldBeNil)
+		So(len(users), ShouldEqual, 2)
+		items, err := db.GetDigestItems(user)
+		So(err, ShouldBeNil)
+		So(len(items), ShouldEqual, 2)
+		So(items[0].Id, ShouldEqual, first.Id)
+		So(items[0].Type, ShouldEqual, models.SubscriptionGuests)
+		Convey("Sent items should be removed", func() {
+			So(db.RemoveDigestItems([]bson.ObjectId{first.Id, second.Id}), ShouldBeNil)
+			items, err := db.GetDigestItems(user)
+			So(err, ShouldBeNil)
+			So(items, ShouldBeEmpty)
+			users, err := db.GetDigestUsers()
+			So(err, ShouldBeNil)
+			So(users, ShouldResemble, []bson.ObjectId{other})
+		})
+	})
+}
@@ -0,0 +1,111 @@
+package database
+
+import (
+	"time"
+
+	"github.com/ernado/poputchiki/models"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// AddGroupChat creates new chat. Only one chat can exist for trip, so
+// mgo.IsDup error is returned on attempt to create second one.
+func (db *DB) AddGroupChat(chat *models.GroupChat) (*models.GroupChat, error) {
+	chat.Id = bson.NewObjectId()
+	chat.Time = time.Now()
+	chat.Updated = chat.Time
+	return chat, db.groupChats.Insert(chat)
+}
+
+func (db *DB) GetGroupChat(id bson.ObjectId) (*models.GroupChat, error) {
+	chat := new(models.GroupChat)
+	return chat, db.groupChats.FindId(id).One(chat)
+}
+
+func (db *DB) GetTripGroupChat(trip bson.ObjectId) (*models.GroupChat, error) {
+	chat := new(models.GroupChat)
+	return chat, db.groupChats.Find(bson.M{"trip": trip}).One(chat)
+}
+
+// AddGroupMember adds user to chat or updates role of existing member
+func (db *DB) AddGroupMember(chat, user bson.ObjectId, role string) error {
+	query := bson.M{"chat": chat, "user": user}
+	update := bson.M{
+		"$set":         bson.M{"role": role},
+		"$setOnInsert": bson.M{"_id": bson.NewObjectId(), "time": time.Now(), "unread": 0, "muted": false},
+	}
+	_, err := db.groupMembers.Upsert(query, update)
+	return err
+}
+
+func (db *DB) RemoveGroupMember(chat, user bson.ObjectId) error {
+	return db.groupMembers.Remove(bson.M{"chat": chat, "user": user})
+}
+
+func (db *DB) GetGroupMember(chat, user bson.ObjectId) (*models.GroupMember, error) {
+	member := new(models.GroupMember)
+	return member, db.groupMembers.Find(bson.M{"chat": chat, "user": user}).One(member)
+}
+
+func (db *DB) GetGroupMembers(chat bson.ObjectId) ([]*models.GroupMember, error) {
+	members := []*models.GroupMember{}
+	return members, db.groupMembers.Find(bson.M{"chat": chat}).Sort("time").All(&members)
+}
+
+func (db *DB) SetGroupMemberMuted(chat, user bson.ObjectId, muted bool) error {
+	return db.groupMembers.Update(bson.M{"chat": chat, "user": user}, bson.M{"$set": bson.M{"muted": muted}})
+}
+
+// GetUserGroupChats returns chats where user is member, recently updated first
+func (db *DB) GetUserGroupChats(user bson.ObjectId) ([]*models.GroupChat, error) {
+	chats := []*models.GroupChat{}
+	members := []*models.GroupMember{}
+	if err := db.groupMembers.Find(bson.M{"user": user}).All(&members); err != nil {
+		return chats, err
+	}
+	ids := make([]bson.ObjectId, len(members))
+	membership := make(map[bson.ObjectId]*models.GroupMember)
+	for k, m := range members {
+		ids[k] = m.Chat
+		membership[m.Chat] = m
+	}
+	if err := db.groupChats.Find(bson.M{"_id": bson.M{"$in": ids}}).Sort("-updated").All(&chats); err != nil {
+		return chats, err
+	}
+	for _, chat := range chats {
+		chat.SetMember(membership[chat.Id])
+	}
+	return chats, nil
+}
+
+// AddGroupMessage saves message, updates chat preview and increments unread
+// counters of other members
+func (db *DB) AddGroupMessage(m *models.GroupMessage) error {
+	m.Id = bson.NewObjectId()
+	m.Time = time.Now()
+	if err := db.groupMessages.Insert(m); err != nil {
+		return err
+	}
+	update := bson.M{"$set": bson.M{"updated": m.Time, "last_message": m.Text}}
+	if err := db.groupChats.UpdateId(m.Chat, update); err != nil {
+		return err
+	}
+	query := bson.M{"chat": m.Chat, "user": bson.M{"$ne": m.Origin}}
+	_, err := db.groupMembers.UpdateAll(query, bson.M{"$inc": bson.M{"unread": 1}})
+	return err
+}
+
+func (db *DB) GetGroupMessages(chat bson.ObjectId, pagination models.Pagination) ([]*models.GroupMessage, error) {
+	messages := []*models.GroupMessage{}
+	query := db.groupMessages.Find(bson.M{"chat": chat}).Sort("-time").Skip(pagination.Offset).Limit(pagination.Count)
+	return messages, query.All(&messages)
+}
+
+// SetGroupChatRead resets unread counter of member
+func (db *DB) SetGroupChatRead(chat, user bson.ObjectId) error {
+	err := db.groupMembers.Update(bson.M{"chat": chat, "user": user}, bson.M{"$set": bson.M{"unread": 0}})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,72 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/ernado/poputchiki/models"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestGroupChats(t *testing.T) {
+	db := TestDatabase()
+	Convey("Group chats", t, func() {
+		Reset(db.Drop)
+		owner, member := bson.NewObjectId(), bson.NewObjectId()
+		trip := &models.Trip{Id: bson.NewObjectId(), User: owner, Destinations: []string{"Москва"}}
+		chat, err := db.AddGroupChat(models.NewTripGroupChat(trip))
+		So(err, ShouldBeNil)
+		So(db.AddGroupMember(chat.Id, owner, models.GroupRoleOwner), ShouldBeNil)
+		So(db.AddGroupMember(chat.Id, member, models.GroupRoleMember), ShouldBeNil)
+		Convey("Trip chat is unique", func() {
+			_, err := db.AddGroupChat(models.NewTripGroupChat(trip))
+			So(mgo.IsDup(err), ShouldBeTrue)
+			c, err := db.GetTripGroupChat(trip.Id)
+			So(err, ShouldBeNil)
+			So(c.Id, ShouldEqual, chat.Id)
+		})
+		Convey("Members", func() {
+			members, err := db.GetGroupMembers(chat.Id)
+			So(err, ShouldBeNil)
+			So(len(members), ShouldEqual, 2)
+			So(db.AddGroupMember(chat.Id, member, models.GroupRoleMember), ShouldBeNil)
+			members, err = db.GetGroupMembers(chat.Id)
+			So(err, ShouldBeNil)
+			So(len(members), ShouldEqual, 2)
+			Convey("Leave", func() {
+				So(db.RemoveGroupMember(chat.Id, member), ShouldBeNil)
+				_, err := db.GetGroupMember(chat.Id, member)
+				So(err, ShouldEqual, mgo.ErrNotFound)
+			})
+			Convey("Mute", func() {
+				So(db.SetGroupMemberMuted(chat.Id, member, true), ShouldBeNil)
+				m, err := db.GetGroupMember(chat.Id, member)
+				So(err, ShouldBeNil)
+				So(m.Muted, ShouldBeTrue)
+			})
+		})
+		Convey("Messages", func() {
+			m := &models.GroupMessage{Chat: chat.Id, Origin: owner, Text: "привет"}
+			So(db.AddGroupMessage(m), ShouldBeNil)
+			messages, err := db.GetGroupMessages(chat.Id, models.Pagination{})
+			So(err, ShouldBeNil)
+			So(len(messages), ShouldEqual, 1)
+			chats, err := db.GetUserGroupChats(member)
+			So(err, ShouldBeNil)
+			So(len(chats), ShouldEqual, 1)
+			So(chats[0].Unread, ShouldEqual, 1)
+			So(chats[0].LastMessage, ShouldEqual, "привет")
+			chats, err = db.GetUserGroupChats(owner)
+			So(err, ShouldBeNil)
+			So(chats[0].Unread, ShouldEqual, 0)
+			So(chats[0].Role, ShouldEqual, models.GroupRoleOwner)
+			Convey("Read", func() {
+				So(db.SetGroupChatRead(chat.Id, member), ShouldBeNil)
+				m, err := db.GetGroupMember(chat.Id, member)
+				So(err, ShouldBeNil)
+				So(m.Unread, ShouldEqual, 0)
+			})
+		})
+	})
+}
@@ -0,0 +1,67 @@
+package database
+
+import (
+	"time"
+
+	"github.com/ernado/poputchiki/models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func (db *DB) AddInvitation(i *models.Invitation) (*models.Invitation, error) {
+	i.Id = bson.NewObjectId()
+	return i, db.invitations.Insert(i)
+}
+
+func (db *DB) GetInvitation(id bson.ObjectId) (*models.Invitation, error) {
+	i := new(models.Invitation)
+	return i, db.invitations.FindId(id).One(i)
+}
+
+// GetInvitations returns invitations of user filtered by query, newest first
+func (db *DB) GetInvitations(user bson.ObjectId, q *models.InvitationQuery, pagination models.Pagination) ([]*models.Invitation, int, error) {
+	invitations := []*models.Invitation{}
+	query := db.invitations.Find(q.ToBson(user))
+	count, err := query.Count()
+	if err != nil {
+		return invitations, 0, err
+	}
+	return invitations, count, query.Sort("-time").Skip(pagination.Offset).Limit(pagination.Count).All(&invitations)
+}
+
+// HasPendingInvitation returns true if origin already invited destination
+// to the trip (or to any ad-hoc travel if trip is blank)
+func (db *DB) HasPendingInvitation(origin, destination, trip bson.ObjectId) (bool, error) {
+	query := bson.M{"origin": origin, "destination": destination, "state": models.InvitationPending}
+	if trip.Valid() {
+		query["trip"] = trip
+	} else {
+		query["trip"] = bson.M{"$exists": false}
+	}
+	count, err := db.invitations.Find(query).Count()
+	return count > 0, err
+}
+
+// SetInvitationState changes state of pending invitation, returning
+// mgo.ErrNotFound if invitation is not pending anymore
+func (db *DB) SetInvitationState(id bson.ObjectId, state string, t time.Time) error {
+	query := bson.M{"_id": id, "state": models.InvitationPending}
+	return db.invitations.Update(query, bson.M{"$set": bson.M{"state": state, "updated": t}})
+}
+
+// RevertInvitationState changes invitation with provided state back to
+// pending, returning mgo.ErrNotFound if state was changed concurrently
+func (db *DB) RevertInvitationState(id bson.ObjectId, state string, t time.Time) error {
+	query := bson.M{"_id": id, "state": state}
+	return db.invitations.Update(query, bson.M{"$set": bson.M{"state": models.InvitationPending, "updated": t}})
+}
+
+func (db *DB) SetInvitationTrip(id, trip bson.ObjectId) error {
+	return db.invitations.UpdateId(id, bson.M{"$set": bson.M{"trip": trip}})
+}
+
+// GetExpiredInvitations returns pending invitations that expired before t
+func (db *DB) GetExpiredInvitations(t time.Time) ([]*models.Invitation, error) {
+	invitations := []*models.Invitation{}
+	query := bson.M{"state": models.InvitationPending, "expires": bson.M{"$lte": t}}
+	return invitations, db.invitations.Find(query).All(&invitations)
+}
@@ -0,0 +1,76 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ernado/poputchiki/models"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestInvitations(t *testing.T) {
+	db := TestDatabase()
+	Convey("Invitations", t, func() {
+		Reset(db.Drop)
+		origin, destination := bson.NewObjectId(), bson.NewObjectId()
+		now := time.Now()
+		i := &models.Invitation{Origin: origin, Destination: destination}
+		So(i.Normalize(nil, now), ShouldBeNil)
+		_, err := db.AddInvitation(i)
+		So(err, ShouldBeNil)
+		Convey("Pending", func() {
+			pending, err := db.HasPendingInvitation(origin, destination, "")
+			So(err, ShouldBeNil)
+			So(pending, ShouldBeTrue)
+			pending, err = db.HasPendingInvitation(origin, destination, bson.NewObjectId())
+			So(err, ShouldBeNil)
+			So(pending, ShouldBeFalse)
+		})
+		Convey("List", func() {
+			q := &models.InvitationQuery{Type: models.InvitationsIncoming}
+			invitations, count, err := db.GetInvitations(destination, q, models.Pagination{})
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 1)
+			So(invitations[0].Id, ShouldEqual, i.Id)
+			invitations, count, err = db.GetInvitations(origin, q, models.Pagination{})
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 0)
+		})
+		Convey("State", func() {
+			So(db.SetInvitationState(i.Id, models.InvitationAccepted, now), ShouldBeNil)
+			So(db.SetInvitationState(i.Id, models.InvitationDeclined, now), ShouldEqual, mgo.ErrNotFound)
+			invitation, err := db.GetInvitation(i.Id)
+			So(err, ShouldBeNil)
+			So(invitation.State, ShouldEqual, models.InvitationAccepted)
+			Convey("Revert", func() {
+				So(db.RevertInvitationState(i.Id, models.InvitationDeclined, now), ShouldEqual, mgo.ErrNotFound)
+				So(db.RevertInvitationState(i.Id, models.InvitationAccepted, now), ShouldBeNil)
+				invitation, err := db.GetInvitation(i.Id)
+				So(err, ShouldBeNil)
+				So(invitation.State, ShouldEqual, models.InvitationPending)
+			})
+		})
+		Convey("Expired", func() {
+			invitations, err := db.GetExpiredInvitations(now)
+			So(err, ShouldBeNil)
+			So(len(invitations), ShouldEqual, 0)
+			invitations, err = db.GetExpiredInvitations(i.Expires.Add(time.Second))
+			So(err, ShouldBeNil)
+			So(len(invitations), ShouldEqual, 1)
+		})
+		Convey("Participant", func() {
+			trip := &models.Trip{User: origin, Destinations: []string{"Москва"}}
+			_, err := db.AddTrip(trip)
+			So(err, ShouldBeNil)
+			So(db.AddTripParticipant(trip.Id, destination), ShouldBeNil)
+			trip, err = db.GetTrip(trip.Id)
+			So(err, ShouldBeNil)
+			So(trip.HasParticipant(destination), ShouldBeTrue)
+			trips, err := db.GetParticipantTrips(destination)
+			So(err, ShouldBeNil)
+			So(len(trips), ShouldEqual, 1)
+		})
+	})
+}
@@ -2,40 +2,241 @@ package database
 
 import (
 	"fmt"
+	"time"
+
 	"github.com/ernado/poputchiki/models"
+	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
-	"sort"
 )
 
+// GetConversation returns conversation between two users
+func (db *DB) GetConversation(a, b bson.ObjectId) (*models.Conversation, error) {
+	c := new(models.Conversation)
+	return c, db.conversations.Find(bson.M{"key": models.ConversationKey(a, b)}).One(c)
+}
+
+// conversation returns conversation between two users, creating it if needed
+func (db *DB) conversation(a, b bson.ObjectId) (*models.Conversation, error) {
+	c, err := db.GetConversation(a, b)
+	if err != mgo.ErrNotFound {
+		return c, err
+	}
+	c = models.NewConversation(a, b)
+	c.Id = bson.NewObjectId()
+	err = db.conversations.Insert(c)
+	if mgo.IsDup(err) {
+		return db.GetConversation(a, b)
+	}
+	return c, err
+}
+
+// visibleMessages returns query for messages of conversation that are
+// not removed or cleared by user
+func visibleMessages(c *models.Conversation, user bson.ObjectId) bson.M {
+	query := bson.M{"conversation": c.Id, "removed": bson.M{"$ne": user}}
+	if s := c.State(user); s != nil && !s.Cleared.IsZero() {
+		query["time"] = bson.M{"$gt": s.Cleared}
+	}
+	return query
+}
+
+// lastVisibleMessage returns last message of conversation that is visible
+// for user, or nil if there is no such message
+func (db *DB) lastVisibleMessage(c *models.Conversation, user bson.ObjectId) (*models.DialogMessage, error) {
+	message := new(models.Message)
+	err := db.messages.Find(visibleMessages(c, user)).Sort("-time").One(message)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return models.NewDialogMessage(message, user), nil
+}
+
+// refreshLastMessages recalculates last visible messages of participants,
+// whose last message is message with provided id, after it was changed
+func (db *DB) refreshLastMessages(conversation, id bson.ObjectId) error {
+	c := new(models.Conversation)
+	if err := db.conversations.FindId(conversation).One(c); err != nil {
+		return err
+	}
+	for _, s := range c.States {
+		if s.Last == nil || s.Last.Id != id {
+			continue
+		}
+		last, err := db.lastVisibleMessage(c, s.User)
+		if err != nil {
+			return err
+		}
+		update := bson.M{"$set": bson.M{"states.$.last": last}}
+		if last == nil {
+			update = bson.M{"$unset": bson.M{"states.$.last": ""}}
+		}
+		if err := db.conversations.Update(bson.M{"_id": c.Id, "states.user": s.User}, update); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *DB) countUnread(c *models.Conversation, user bson.ObjectId) (int, error) {
+	query := visibleMessages(c, user)
+	query["destination"] = user
+	query["read"] = false
+	return db.messages.Find(query).Count()
+}
+
 func (db *DB) GetMessagesFromUser(userReciever bson.ObjectId, userOrigin bson.ObjectId, pagination models.Pagination) (messages models.Messages, err error) {
-	err = db.messages.Find(bson.M{"user": userReciever, "chat": userOrigin}).Sort("time").Skip(pagination.Offset).Limit(pagination.Count).All(&messages)
+	c, err := db.GetConversation(userReciever, userOrigin)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = db.messages.Find(visibleMessages(c, userReciever)).Sort("time").Skip(pagination.Offset).Limit(pagination.Count).All(&messages)
+	for i := range messages {
+		messages[i] = messages[i].For(userReciever)
+	}
 	return messages, err
 }
 
+// RemoveChat clears conversation for user, hiding all current messages
 func (db *DB) RemoveChat(userReciever bson.ObjectId, userOrigin bson.ObjectId) error {
-	_, err := db.messages.RemoveAll(bson.M{"user": userReciever, "chat": userOrigin})
-	return err
+	c, err := db.GetConversation(userReciever, userOrigin)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	set := bson.M{"states.$.cleared": time.Now(), "states.$.unread": 0}
+	if c.LastMessage.Valid() {
+		set["states.$.last_read"] = c.LastMessage
+	}
+	update := bson.M{"$set": set, "$unset": bson.M{"states.$.last": ""}}
+	return db.conversations.Update(bson.M{"_id": c.Id, "states.user": userReciever}, update)
 }
 
+// GetLastMessageIdFromUser returns id of the last message of conversation
+// that is visible for reciever
 func (db *DB) GetLastMessageIdFromUser(userReciever bson.ObjectId, userOrigin bson.ObjectId) (id bson.ObjectId, err error) {
+	c, err := db.GetConversation(userReciever, userOrigin)
+	if err != nil {
+		return
+	}
 	message := new(models.Message)
-	if err = db.messages.Find(bson.M{"user": userReciever, "chat": userOrigin}).Sort("time").One(message); err != nil {
+	if err = db.messages.Find(visibleMessages(c, userReciever)).Sort("-time").One(message); err != nil {
 		return
 	}
 	id = message.Id
 	return
 }
 
+// AddMessage stores message in conversation of its origin and destination,
+// makes it last message for participants it is visible for and increments
+// unread counter of destination
 func (db *DB) AddMessage(m *models.Message) error {
-	return db.messages.Insert(m)
+	c, err := db.conversation(m.Origin, m.Destination)
+	if err != nil {
+		return err
+	}
+	m.Conversation = c.Id
+	stored := *m
+	stored.Chat, stored.User = "", ""
+	if err := db.messages.Insert(&stored); err != nil {
+		return err
+	}
+	set := bson.M{"last_message": m.Id, "time": m.Time}
+	update := bson.M{"$set": set}
+	for i, s := range c.States {
+		// message can be hidden from destination
+		if m.RemovedFor(s.User) {
+			continue
+		}
+		set[fmt.Sprintf("states.%d.last", i)] = models.NewDialogMessage(m, s.User)
+		if s.User == m.Destination {
+			update["$inc"] = bson.M{fmt.Sprintf("states.%d.unread", i): 1}
+		}
+	}
+	return db.conversations.UpdateId(c.Id, update)
 }
 
 func (db *DB) AddInvite(i *models.Invite) error {
-	return db.messages.Insert(i)
+	return db.AddMessage((*models.Message)(i))
+}
+
+// RemoveMessage hides message from user, keeping it for the other participant
+func (db *DB) RemoveMessage(user, id bson.ObjectId) error {
+	if err := db.SetRead(user, id); err != nil {
+		return err
+	}
+	query := bson.M{"_id": id, "$or": []bson.M{{"origin": user}, {"destination": user}}}
+	message := new(models.Message)
+	change := mgo.Change{Update: bson.M{"$addToSet": bson.M{"removed": user}}}
+	if _, err := db.messages.Find(query).Apply(change, message); err != nil {
+		return err
+	}
+	return db.refreshLastMessages(message.Conversation, id)
+}
+
+// EditMessage stores edited text and history of message, updating text of
+// notifications about it that are not read yet. Returns mgo.ErrNotFound if
+// message was changed concurrently.
+func (db *DB) EditMessage(m *models.Message, previous string) error {
+	query := bson.M{"_id": m.Id, "text": previous, "unsent": bson.M{"$ne": true}}
+	update := bson.M{"$set": bson.M{"text": m.Text, "edited": true, "history": m.History}}
+	if err := db.messages.Update(query, update); err != nil {
+		return err
+	}
+	if err := db.refreshLastMessages(m.Conversation, m.Id); err != nil {
+		return err
+	}
+	selector := bson.M{"type": models.UpdateMessages, "target._id": m.Id, "read": false}
+	_, err := db.updates.UpdateAll(selector, bson.M{"$set": bson.M{"target.text": m.Text}})
+	return err
+}
+
+// UnsendMessage removes message for both participants and suppresses
+// notifications about it that are not read yet
+func (db *DB) UnsendMessage(id bson.ObjectId) error {
+	message := new(models.Message)
+	if err := db.messages.FindId(id).One(message); err != nil {
+		return err
+	}
+	query := bson.M{"_id": id, "unsent": bson.M{"$ne": true}}
+	removed := bson.M{"$each": []bson.ObjectId{message.Origin, message.Destination}}
+	update := bson.M{"$set": bson.M{"unsent": true}, "$addToSet": bson.M{"removed": removed}}
+	change := mgo.Change{Update: update}
+	if _, err := db.messages.Find(query).Apply(change, message); err != nil {
+		return err
+	}
+	if !message.Read {
+		state := bson.M{"$elemMatch": bson.M{"user": message.Destination, "unread": bson.M{"$gt": 0}}}
+		err := db.conversations.Update(bson.M{"_id": message.Conversation, "states": state}, bson.M{"$inc": bson.M{"states.$.unread": -1}})
+		if err != nil && err != mgo.ErrNotFound {
+			return err
+		}
+	}
+	if err := db.refreshLastMessages(message.Conversation, id); err != nil {
+		return err
+	}
+	_, err := db.updates.RemoveAll(bson.M{"type": models.UpdateMessages, "target._id": id, "read": false})
+	return err
 }
 
-func (db *DB) RemoveMessage(id bson.ObjectId) error {
-	return db.messages.RemoveId(id)
+// SetMessageProcessed marks conversion of message attachment as finished,
+// removing attachment if conversion failed
+func (db *DB) SetMessageProcessed(id bson.ObjectId, failed bool) error {
+	update := bson.M{"$set": bson.M{"processing": false}}
+	if failed {
+		update = bson.M{
+			"$set":   bson.M{"processing": false, "failed": true},
+			"$unset": bson.M{"audio": "", "video": ""},
+		}
+	}
+	return db.messages.UpdateId(id, update)
 }
 
 func (db *DB) GetMessage(id bson.ObjectId) (*models.Message, error) {
@@ -43,69 +244,228 @@ func (db *DB) GetMessage(id bson.ObjectId) (*models.Message, error) {
 	err := db.messages.FindId(id).One(message)
 	return message, err
 }
-func (db *DB) setRead(query bson.M) error {
-	_, err := db.messages.UpdateAll(query, bson.M{"$set": bson.M{"read": true}})
-	return err
-}
 
+// SetRead marks message to user as read, decrementing unread counter
 func (db *DB) SetRead(user, id bson.ObjectId) error {
-	query := bson.M{"_id": id, "user": user}
-	return db.setRead(query)
+	message := new(models.Message)
+	change := mgo.Change{Update: bson.M{"$set": bson.M{"read": true}}}
+	_, err := db.messages.Find(bson.M{"_id": id, "destination": user, "read": false}).Apply(change, message)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	state := bson.M{"$elemMatch": bson.M{"user": user, "unread": bson.M{"$gt": 0}}}
+	update := bson.M{"$inc": bson.M{"states.$.unread": -1}, "$max": bson.M{"states.$.last_read": id}}
+	err = db.conversations.Update(bson.M{"_id": message.Conversation, "states": state}, update)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
 }
 
 func (db *DB) SetReadMessagesFromUser(userReciever bson.ObjectId, userOrigin bson.ObjectId) error {
-	query := bson.M{"destination": userReciever, "origin": userOrigin}
 	selector := bson.M{"destination": userReciever, "user": userOrigin, "type": "messages", "read": false}
 	update := bson.M{"$set": bson.M{"read": true}}
 	_, err := db.updates.UpdateAll(selector, update)
 	if err != nil {
 		return err
 	}
-	return db.setRead(query)
+	c, err := db.GetConversation(userReciever, userOrigin)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	query := bson.M{"conversation": c.Id, "destination": userReciever, "read": false}
+	if _, err := db.messages.UpdateAll(query, update); err != nil {
+		return err
+	}
+	set := bson.M{"states.$.unread": 0}
+	if c.LastMessage.Valid() {
+		set["states.$.last_read"] = c.LastMessage
+	}
+	return db.conversations.Update(bson.M{"_id": c.Id, "states.user": userReciever}, bson.M{"$set": set})
 }
 
-func (db *DB) GetUnreadCount(id bson.ObjectId) (int, error) {
-	query := bson.M{"user": id, "read": false, "destination": id}
-	return db.messages.Find(query).Count()
+// neighbourMessage returns id of visible for user message of conversation
+// that is next to provided one in direction of sort
+func (db *DB) neighbourMessage(c *models.Conversation, user bson.ObjectId, m *models.Message, sort string) (bson.ObjectId, error) {
+	query := visibleMessages(c, user)
+	condition := "$gt"
+	if sort == "-time" {
+		condition = "$lt"
+	}
+	if t, ok := query["time"].(bson.M); ok {
+		t[condition] = m.Time
+	} else {
+		query["time"] = bson.M{condition: m.Time}
+	}
+	neighbour := new(models.Message)
+	err := db.messages.Find(query).Sort(sort).Select(bson.M{"_id": 1}).One(neighbour)
+	if err == mgo.ErrNotFound {
+		return "", nil
+	}
+	return neighbour.Id, err
+}
+
+// SearchMessages returns messages visible for user that match text query,
+// in conversation with peer or in all conversations if peer is empty.
+// Results are sorted by relevance and contain ids of neighbouring messages.
+func (db *DB) SearchMessages(user, peer bson.ObjectId, q string, pagination models.Pagination) ([]*models.MessageSearchResult, int, error) {
+	results := []*models.MessageSearchResult{}
+	conversations := []*models.Conversation{}
+	selector := bson.M{"participants": user}
+	if peer.Valid() {
+		selector["key"] = models.ConversationKey(user, peer)
+	}
+	if err := db.conversations.Find(selector).All(&conversations); err != nil {
+		return results, 0, err
+	}
+	if len(conversations) == 0 {
+		return results, 0, nil
+	}
+	byId := make(map[bson.ObjectId]*models.Conversation)
+	visible := make([]bson.M, 0, len(conversations))
+	for _, c := range conversations {
+		byId[c.Id] = c
+		visible = append(visible, visibleMessages(c, user))
+	}
+	query := db.messages.Find(bson.M{"$text": bson.M{"$search": q, "$language": "russian"}, "$or": visible})
+	count, err := query.Count()
+	if err != nil {
+		return results, 0, err
+	}
+	messages := []*models.Message{}
+	query = query.Select(bson.M{"score": bson.M{"$meta": "textScore"}}).Sort("$textScore:score", "-time")
+	if err := query.Skip(pagination.Offset).Limit(pagination.Count).All(&messages); err != nil {
+		return results, 0, err
+	}
+	for _, m := range messages {
+		c := byId[m.Conversation]
+		r := &models.MessageSearchResult{Message: m.For(user)}
+		if r.Previous, err = db.neighbourMessage(c, user, m, "-time"); err != nil {
+			return results, 0, err
+		}
+		if r.Next, err = db.neighbourMessage(c, user, m, "time"); err != nil {
+			return results, 0, err
+		}
+		results = append(results, r)
+	}
+	return results, count, nil
 }
 
-type Dialogs []*models.Dialog
+// GetUnreadCount returns total amount of unread messages in conversations of user
+func (db *DB) GetUnreadCount(id bson.ObjectId) (int, error) {
+	result := new(models.UnreadCount)
+	pipeline := []bson.M{
+		{"$match": bson.M{"participants": id}},
+		{"$unwind": "$states"},
+		{"$match": bson.M{"states.user": id}},
+		{"$group": bson.M{"_id": nil, "count": bson.M{"$sum": "$states.unread"}}},
+	}
+	err := db.conversations.Pipe(pipeline).One(result)
+	if err == mgo.ErrNotFound {
+		return 0, nil
+	}
+	return result.Count, err
+}
 
-func (a Dialogs) Len() int {
-	return len(a)
+// GetChats returns all dialogs of user, including archived ones
+func (db *DB) GetChats(id bson.ObjectId) ([]*models.Dialog, error) {
+	dialogs, _, err := db.GetDialogs(id, &models.DialogFilter{All: true}, models.Pagination{})
+	return dialogs, err
 }
 
-func (a Dialogs) Swap(i, j int) {
-	a[i], a[j] = a[j], a[i]
+// dialogRow is a conversation with state of one participant
+type dialogRow struct {
+	Id           bson.ObjectId             `bson:"_id"`
+	Participants []bson.ObjectId           `bson:"participants"`
+	State        *models.ConversationState `bson:"states"`
 }
 
-func (a Dialogs) Less(i, j int) bool {
-	return a[j].Time.Before(a[i].Time)
+// dialogsPipeline returns aggregation pipeline that selects conversations
+// of user matching filter, that have messages visible for user
+func (db *DB) dialogsPipeline(id bson.ObjectId, filter *models.DialogFilter) ([]bson.M, error) {
+	match := []bson.M{{"participants": id}}
+	if filter.Favorites {
+		var favorites []bson.ObjectId
+		if err := db.users.FindId(id).Distinct("favorites", &favorites); err != nil {
+			return nil, err
+		}
+		match = append(match, bson.M{"participants": bson.M{"$in": favorites}})
+	}
+	if filter.Invites {
+		var conversations []bson.ObjectId
+		query := bson.M{"invite": true, "$or": []bson.M{{"origin": id}, {"destination": id}}}
+		if err := db.messages.Find(query).Distinct("conversation", &conversations); err != nil {
+			return nil, err
+		}
+		match = append(match, bson.M{"_id": bson.M{"$in": conversations}})
+	}
+	state := bson.M{"states.user": id, "states.last": bson.M{"$exists": true}}
+	if filter.Unread {
+		state["states.unread"] = bson.M{"$gt": 0}
+	}
+	if filter.Archived {
+		state["states.archived"] = true
+	} else if !filter.All {
+		state["states.archived"] = bson.M{"$ne": true}
+	}
+	return []bson.M{
+		{"$match": bson.M{"$and": match}},
+		{"$unwind": "$states"},
+		{"$match": state},
+		{"$project": bson.M{"participants": 1, "states": 1}},
+	}, nil
 }
 
-func (db *DB) GetChats(id bson.ObjectId) ([]*models.Dialog, error) {
+// GetDialogs returns page of dialogs of user matching filter, pinned
+// first, then most recent, and total amount of matching dialogs
+func (db *DB) GetDialogs(id bson.ObjectId, filter *models.DialogFilter, pagination models.Pagination) ([]*models.Dialog, int, error) {
 	var users []*models.User
 	var ids []bson.ObjectId
-	var result []*models.Dialog
-
-	first := func(key string) bson.M {
-		return bson.M{"$first": fmt.Sprintf("$%s", key)}
-	}
-	// preparing query
-	match := bson.M{"$match": bson.M{"user": id}}
-	s := bson.M{"$sort": bson.M{"time": -1}}
-	group := bson.M{"$group": bson.M{"_id": bson.M{"chat": "$chat"}, "time": first("time"), "text": first("text"), "origin": first("origin")}}
-	project := bson.M{"$project": bson.M{"_id": "$_id.chat", "time": "$time", "text": "$text", "origin": "$origin"}}
-	pipeline := []bson.M{match, s, group, project}
-	pipe := db.messages.Pipe(pipeline)
-	iter := pipe.Iter()
-	iter.All(&result)
-	for i := range result {
-		ids = append(ids, result[i].Id)
-		ids = append(ids, result[i].Origin)
+	result := []*models.Dialog{}
+
+	pipeline, err := db.dialogsPipeline(id, filter)
+	if err != nil {
+		return nil, 0, err
+	}
+	counting := append(pipeline[:len(pipeline):len(pipeline)], bson.M{"$group": bson.M{"_id": nil, "count": bson.M{"$sum": 1}}})
+	pipeline = append(pipeline, bson.M{"$sort": bson.D{{Name: "states.pinned", Value: -1}, {Name: "states.last.time", Value: -1}}})
+	pipeline = append(pipeline, bson.M{"$skip": pagination.Offset})
+	if pagination.Count > 0 {
+		pipeline = append(pipeline, bson.M{"$limit": pagination.Count})
+	}
+	rows := []*dialogRow{}
+	if err := db.conversations.Pipe(pipeline).All(&rows); err != nil {
+		return nil, 0, err
+	}
+	count := new(struct{ Count int })
+	// dialogs are counted separately only if page is not the only one
+	if pagination.Offset == 0 && (pagination.Count == 0 || len(rows) < pagination.Count) {
+		count.Count = len(rows)
+	} else if err := db.conversations.Pipe(counting).One(count); err != nil && err != mgo.ErrNotFound {
+		return nil, 0, err
+	}
+	for _, row := range rows {
+		last := row.State.Last
+		c := &models.Conversation{Id: row.Id, Participants: row.Participants}
+		dialog := &models.Dialog{Id: c.Peer(id), Time: last.Time, Text: last.Text, Origin: last.Origin}
+		dialog.Unread = row.State.Unread
+		dialog.Archived = row.State.Archived
+		dialog.Muted = row.State.Muted
+		dialog.Pinned = row.State.Pinned
+		result = append(result, dialog)
+		ids = append(ids, dialog.Id, dialog.Origin)
+	}
+	if len(result) == 0 {
+		return result, count.Count, nil
 	}
 	if err := db.users.Find(bson.M{"_id": bson.M{"$in": ids}}).All(&users); err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	usersMap := make(map[bson.ObjectId]*models.User)
@@ -117,13 +477,18 @@ func (db *DB) GetChats(id bson.ObjectId) ([]*models.Dialog, error) {
 	for i := range result {
 		result[i].User = usersMap[result[i].Id]
 		result[i].OriginUser = usersMap[result[i].Origin]
-		count, err := db.messages.Find(bson.M{"read": false, "user": id, "destination": id, "chat": result[i].Id}).Count()
-		if err != nil {
-			return nil, err
-		}
-		result[i].Unread = count
 	}
 
-	sort.Sort(Dialogs(result))
-	return result, nil
+	return result, count.Count, nil
+}
+
+// SetConversationState switches archived, muted or pinned field of state
+// of conversation with peer for user
+func (db *DB) SetConversationState(user, peer bson.ObjectId, field string, value bool) error {
+	c, err := db.GetConversation(user, peer)
+	if err != nil {
+		return err
+	}
+	query := bson.M{"_id": c.Id, "states.user": user}
+	return db.conversations.Update(query, bson.M{"$set": bson.M{"states.$." + field: value}})
 }
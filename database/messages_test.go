@@ -3,9 +3,11 @@ package database
 import (
 	"log"
 	"testing"
+	"time"
 
 	"github.com/ernado/poputchiki/models"
 	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
@@ -25,11 +27,10 @@ func TestMessages(t *testing.T) {
 		Integrity(db, uOrigin)
 		Integrity(db, uDestination)
 		Convey("Add message", func() {
-			mOrigin, mDestination := models.NewMessagePair(db, origin, destination, photo, text)
+			m, mOrigin, mDestination := models.NewMessagePair(db, origin, destination, photo, text)
 			idOrigin := mOrigin.Id
 			idDestination := mDestination.Id
-			So(db.AddMessage(mOrigin), ShouldBeNil)
-			So(db.AddMessage(mDestination), ShouldBeNil)
+			So(db.AddMessage(m), ShouldBeNil)
 			Integrity(db, uOrigin)
 			Integrity(db, uDestination)
 			Convey("Add notification", func() {
@@ -98,9 +99,8 @@ func TestMessages(t *testing.T) {
 			})
 			Convey("Add new message", func() {
 				text2 := "hehehe"
-				mOrigin, mDestination := models.NewMessagePair(db, origin, destination, photo, text2)
-				So(db.AddMessage(mOrigin), ShouldBeNil)
-				So(db.AddMessage(mDestination), ShouldBeNil)
+				m, _, _ := models.NewMessagePair(db, origin, destination, photo, text2)
+				So(db.AddMessage(m), ShouldBeNil)
 				Integrity(db, uOrigin)
 				Integrity(db, uDestination)
 				Convey("Set read origin", func() {
@@ -114,7 +114,7 @@ func TestMessages(t *testing.T) {
 					})
 				})
 				Convey("Remove", func() {
-					So(db.RemoveMessage(idOrigin), ShouldBeNil)
+					So(db.RemoveMessage(origin, idOrigin), ShouldBeNil)
 					Integrity(db, uOrigin)
 					Integrity(db, uDestination)
 					Convey("Destination chats", func() {
@@ -165,9 +165,8 @@ func TestMessages(t *testing.T) {
 				})
 				Convey("Add new message", func() {
 					text3 := "hehehe"
-					mOrigin, mDestination := models.NewMessagePair(db, origin, destination, photo, text3)
-					So(db.AddMessage(mOrigin), ShouldBeNil)
-					So(db.AddMessage(mDestination), ShouldBeNil)
+					m, _, _ := models.NewMessagePair(db, origin, destination, photo, text3)
+					So(db.AddMessage(m), ShouldBeNil)
 					Integrity(db, uOrigin)
 					Integrity(db, uDestination)
 					Convey("Destination chats", func() {
@@ -210,6 +209,114 @@ func TestMessages(t *testing.T) {
 				So(n, ShouldEqual, 1)
 				So(err, ShouldBeNil)
 			})
+			Convey("Edit", func() {
+				_, err := db.AddUpdate(destination, origin, "messages", mDestination)
+				So(err, ShouldBeNil)
+				edited, err := db.GetMessage(m.Id)
+				So(err, ShouldBeNil)
+				edited.Edit("Пока", time.Now())
+				So(db.EditMessage(edited, text), ShouldBeNil)
+				So(db.EditMessage(edited, text), ShouldEqual, mgo.ErrNotFound)
+				stored, err := db.GetMessage(m.Id)
+				So(err, ShouldBeNil)
+				So(stored.Text, ShouldEqual, "Пока")
+				So(stored.Edited, ShouldBeTrue)
+				So(len(stored.History), ShouldEqual, 1)
+				So(stored.History[0].Text, ShouldEqual, text)
+				chats, err := db.GetChats(destination)
+				So(err, ShouldBeNil)
+				So(len(chats), ShouldEqual, 1)
+				So(chats[0].Text, ShouldEqual, "Пока")
+				updates, err := db.GetUpdates(destination, "messages", models.Pagination{})
+				So(err, ShouldBeNil)
+				So(len(updates), ShouldEqual, 1)
+				So(updates[0].Target.(bson.M)["text"], ShouldEqual, "Пока")
+			})
+			Convey("Unsend", func() {
+				_, err := db.AddUpdate(destination, origin, "messages", mDestination)
+				So(err, ShouldBeNil)
+				So(db.UnsendMessage(m.Id), ShouldBeNil)
+				So(db.UnsendMessage(m.Id), ShouldEqual, mgo.ErrNotFound)
+				n, err := db.GetUnreadCount(destination)
+				So(err, ShouldBeNil)
+				So(n, ShouldEqual, 0)
+				chats, err := db.GetChats(destination)
+				So(err, ShouldBeNil)
+				So(len(chats), ShouldEqual, 0)
+				messages, err := db.GetMessagesFromUser(origin, destination, pagination)
+				So(err, ShouldBeNil)
+				So(len(messages), ShouldEqual, 0)
+				updates, err := db.GetUpdates(destination, "messages", models.Pagination{})
+				So(err, ShouldBeNil)
+				So(len(updates), ShouldEqual, 0)
+			})
+			Convey("Unsend last", func() {
+				second, _, _ := models.NewMessagePair(db, origin, destination, "", "Ой")
+				second.Time = m.Time.Add(time.Second)
+				So(db.AddMessage(second), ShouldBeNil)
+				So(db.UnsendMessage(second.Id), ShouldBeNil)
+				for _, user := range []bson.ObjectId{origin, destination} {
+					chats, err := db.GetChats(user)
+					So(err, ShouldBeNil)
+					So(len(chats), ShouldEqual, 1)
+					So(chats[0].Text, ShouldEqual, text)
+				}
+				Convey("Remove previous", func() {
+					So(db.RemoveMessage(destination, m.Id), ShouldBeNil)
+					chats, err := db.GetChats(destination)
+					So(err, ShouldBeNil)
+					So(len(chats), ShouldEqual, 0)
+					chats, err = db.GetChats(origin)
+					So(err, ShouldBeNil)
+					So(len(chats), ShouldEqual, 1)
+				})
+			})
+			Convey("Search", func() {
+				second, _, _ := models.NewMessagePair(db, destination, origin, "", "Поедем в Москву?")
+				second.Time = m.Time.Add(time.Second)
+				So(db.AddMessage(second), ShouldBeNil)
+				third, _, _ := models.NewMessagePair(db, origin, destination, "", "Давай")
+				third.Time = m.Time.Add(time.Second * 2)
+				So(db.AddMessage(third), ShouldBeNil)
+				results, count, err := db.SearchMessages(origin, destination, "москва", pagination)
+				So(err, ShouldBeNil)
+				So(count, ShouldEqual, 1)
+				So(len(results), ShouldEqual, 1)
+				So(results[0].Message.Id, ShouldEqual, second.Id)
+				So(results[0].Message.Chat, ShouldEqual, destination)
+				So(results[0].Previous, ShouldEqual, m.Id)
+				So(results[0].Next, ShouldEqual, third.Id)
+				Convey("In all conversations", func() {
+					results, count, err := db.SearchMessages(destination, "", "Москве", pagination)
+					So(err, ShouldBeNil)
+					So(count, ShouldEqual, 1)
+					So(results[0].Message.Chat, ShouldEqual, origin)
+				})
+				Convey("Without removed messages", func() {
+					So(db.RemoveMessage(origin, second.Id), ShouldBeNil)
+					_, count, err := db.SearchMessages(origin, destination, "москва", pagination)
+					So(err, ShouldBeNil)
+					So(count, ShouldEqual, 0)
+				})
+			})
+			Convey("Attachment", func() {
+				a, _, _ := models.NewMessagePair(db, origin, destination, "", "")
+				a.Audio = bson.NewObjectId()
+				a.Processing = true
+				So(db.AddMessage(a), ShouldBeNil)
+				So(db.SetMessageProcessed(a.Id, false), ShouldBeNil)
+				stored, err := db.GetMessage(a.Id)
+				So(err, ShouldBeNil)
+				So(stored.Processing, ShouldBeFalse)
+				So(stored.Audio, ShouldEqual, a.Audio)
+				Convey("Failed", func() {
+					So(db.SetMessageProcessed(a.Id, true), ShouldBeNil)
+					stored, err := db.GetMessage(a.Id)
+					So(err, ShouldBeNil)
+					So(stored.Failed, ShouldBeTrue)
+					So(stored.HasAttachment(), ShouldBeFalse)
+				})
+			})
 			Convey("Read destination", func() {
 				m, err := db.GetMessage(idOrigin)
 				So(err, ShouldBeNil)
@@ -0,0 +1,110 @@
+package database
+
+import (
+	"fmt"
+
+	"github.com/ernado/poputchiki/models"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// rebuildConversation recalculates last messages and state counters of
+// conversation from its messages
+func (db *DB) rebuildConversation(id bson.ObjectId) error {
+	c := new(models.Conversation)
+	if err := db.conversations.FindId(id).One(c); err != nil {
+		return err
+	}
+	last := new(models.Message)
+	if err := db.messages.Find(bson.M{"conversation": id}).Sort("-time").One(last); err != nil {
+		return err
+	}
+	set := bson.M{"last_message": last.Id, "time": last.Time}
+	unset := bson.M{}
+	for i, s := range c.States {
+		visible, err := db.lastVisibleMessage(c, s.User)
+		if err != nil {
+			return err
+		}
+		if visible != nil {
+			set[fmt.Sprintf("states.%d.last", i)] = visible
+		} else {
+			unset[fmt.Sprintf("states.%d.last", i)] = ""
+		}
+		unread, err := db.countUnread(c, s.User)
+		if err != nil {
+			return err
+		}
+		set[fmt.Sprintf("states.%d.unread", i)] = unread
+		read := new(models.Message)
+		query := bson.M{"conversation": id, "destination": s.User, "read": true}
+		err = db.messages.Find(query).Sort("-time").One(read)
+		if err == nil {
+			set[fmt.Sprintf("states.%d.last_read", i)] = read.Id
+		} else if err != mgo.ErrNotFound {
+			return err
+		}
+	}
+	update := bson.M{"$set": set}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	return db.conversations.UpdateId(id, update)
+}
+
+// MigrateMessages moves messages from the old collection, where message was
+// stored in copy for each participant, to conversations and returns amount
+// of migrated messages. Migration can be safely run several times.
+func (db *DB) MigrateMessages() (int, error) {
+	index := mgo.Index{Key: []string{"origin", "destination", "time"}, Background: true}
+	if err := db.oldMessages.EnsureIndex(index); err != nil {
+		return 0, err
+	}
+	var (
+		copies  []*models.Message
+		count   int
+		touched = make(map[bson.ObjectId]bool)
+	)
+	flush := func() error {
+		if len(copies) == 0 {
+			return nil
+		}
+		m := models.MergeMessageCopies(copies)
+		copies = nil
+		c, err := db.conversation(m.Origin, m.Destination)
+		if err != nil {
+			return err
+		}
+		m.Conversation = c.Id
+		if _, err := db.messages.UpsertId(m.Id, m); err != nil {
+			return err
+		}
+		touched[c.Id] = true
+		count++
+		return nil
+	}
+	iter := db.oldMessages.Find(nil).Sort("origin", "destination", "time").Iter()
+	m := new(models.Message)
+	for iter.Next(m) {
+		if len(copies) > 0 && !models.SameMessage(copies[0], m) {
+			if err := flush(); err != nil {
+				iter.Close()
+				return count, err
+			}
+		}
+		copies = append(copies, m)
+		m = new(models.Message)
+	}
+	if err := iter.Close(); err != nil {
+		return count, err
+	}
+	if err := flush(); err != nil {
+		return count, err
+	}
+	for id := range touched {
+		if err := db.rebuildConversation(id); err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
@@ -0,0 +1,59 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ernado/poputchiki/models"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestMigrateMessages(t *testing.T) {
+	db := TestDatabase()
+	Convey("Migrate messages", t, func() {
+		Reset(db.Drop)
+		origin, destination := bson.NewObjectId(), bson.NewObjectId()
+		now := time.Now().Truncate(time.Millisecond)
+		old := func(user bson.ObjectId, text string, t time.Time, read bool) *models.Message {
+			chat := destination
+			if user == destination {
+				chat = origin
+			}
+			return &models.Message{Id: bson.NewObjectId(), User: user, Chat: chat, Origin: origin,
+				Destination: destination, Text: text, Time: t, Read: read}
+		}
+		// first message is read, second is removed by origin
+		So(db.oldMessages.Insert(old(origin, "first", now, true), old(destination, "first", now, true),
+			old(destination, "second", now.Add(time.Second), false)), ShouldBeNil)
+		count, err := db.MigrateMessages()
+		So(err, ShouldBeNil)
+		So(count, ShouldEqual, 2)
+		Convey("Messages", func() {
+			messages, err := db.GetMessagesFromUser(destination, origin, models.Pagination{})
+			So(err, ShouldBeNil)
+			So(len(messages), ShouldEqual, 2)
+			So(messages[1].Chat, ShouldEqual, origin)
+			messages, err = db.GetMessagesFromUser(origin, destination, models.Pagination{})
+			So(err, ShouldBeNil)
+			So(len(messages), ShouldEqual, 1)
+		})
+		Convey("Unread", func() {
+			n, err := db.GetUnreadCount(destination)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 1)
+			chats, err := db.GetChats(destination)
+			So(err, ShouldBeNil)
+			So(len(chats), ShouldEqual, 1)
+			So(chats[0].Text, ShouldEqual, "second")
+		})
+		Convey("Repeat", func() {
+			count, err := db.MigrateMessages()
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 2)
+			n, err := db.GetUnreadCount(destination)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 1)
+		})
+	})
+}
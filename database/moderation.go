@@ -0,0 +1,44 @@
+package database
+
+import (
+	"github.com/ernado/poputchiki/models"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// AddModerationItem puts held text to admin review queue
+func (db *DB) AddModerationItem(item *models.ModerationItem) error {
+	return db.moderation.Insert(item)
+}
+
+// GetModerationQueue returns pending items of review queue, oldest first
+func (db *DB) GetModerationQueue(pagination models.Pagination) ([]*models.ModerationItem, int, error) {
+	items := []*models.ModerationItem{}
+	query := db.moderation.Find(bson.M{"state": models.ModerationPending})
+	count, err := query.Count()
+	if err != nil {
+		return items, 0, err
+	}
+	err = query.Sort("time").Skip(pagination.Offset).Limit(pagination.Count).All(&items)
+	return items, count, err
+}
+
+// GetModerationItem returns pending item, returning mgo.ErrNotFound if
+// item does not exist or is already resolved
+func (db *DB) GetModerationItem(id bson.ObjectId) (*models.ModerationItem, error) {
+	item := &models.ModerationItem{}
+	query := bson.M{"_id": id, "state": models.ModerationPending}
+	return item, db.moderation.Find(query).One(item)
+}
+
+// SetModerationState resolves pending item, returning mgo.ErrNotFound if
+// item does not exist or is already resolved
+func (db *DB) SetModerationState(id bson.ObjectId, state string) (*models.ModerationItem, error) {
+	item := &models.ModerationItem{}
+	change := mgo.Change{Update: bson.M{"$set": bson.M{"state": state}}, ReturnNew: true}
+	query := bson.M{"_id": id, "state": models.ModerationPending}
+	if _, err := db.moderation.Find(query).Apply(change, item); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
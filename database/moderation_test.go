@@ -0,0 +1,48 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ernado/poputchiki/models"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestModerationQueue(t *testing.T) {
+	db := TestDatabase()
+	Convey("Moderation queue", t, func() {
+		Reset(db.Drop)
+		user := bson.NewObjectId()
+		result := models.ModerationResult{Action: models.ModerationHold, Rules: []string{models.ModerationPhone}, Text: "звони 89123456789"}
+		first := models.NewModerationItem(user, models.ModerationStatus, "", result)
+		second := models.NewModerationItem(user, models.ModerationMessage, bson.NewObjectId(), result)
+		second.Time = first.Time.Add(time.Second)
+		So(db.AddModerationItem(first), ShouldBeNil)
+		So(db.AddModerationItem(second), ShouldBeNil)
+		items, count, err := db.GetModerationQueue(models.Pagination{})
+		So(err, ShouldBeNil)
+		So(count, ShouldEqual, 2)
+		So(items[0].Id, ShouldEqual, first.Id)
+		So(items[0].Rules, ShouldResemble, []string{models.ModerationPhone})
+		So(items[1].Target, ShouldEqual, second.Target)
+		Convey("Resolve", func() {
+			item, err := db.GetModerationItem(first.Id)
+			So(err, ShouldBeNil)
+			So(item.State, ShouldEqual, models.ModerationPending)
+			item, err = db.SetModerationState(first.Id, models.ModerationApproved)
+			So(err, ShouldBeNil)
+			So(item.State, ShouldEqual, models.ModerationApproved)
+			So(item.Text, ShouldEqual, first.Text)
+			_, err = db.SetModerationState(first.Id, models.ModerationRejected)
+			So(err, ShouldEqual, mgo.ErrNotFound)
+			_, err = db.GetModerationItem(first.Id)
+			So(err, ShouldEqual, mgo.ErrNotFound)
+			items, count, err := db.GetModerationQueue(models.Pagination{})
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 1)
+			So(items[0].Id, ShouldEqual, second.Id)
+		})
+	})
+}
@@ -0,0 +1,109 @@
+package database
+
+import (
+	"time"
+
+	"github.com/ernado/poputchiki/models"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func (db *DB) AddReview(r *models.Review) (*models.Review, error) {
+	r.Id = bson.NewObjectId()
+	return r, db.reviews.Insert(r)
+}
+
+func (db *DB) GetReview(id bson.ObjectId) (*models.Review, error) {
+	r := new(models.Review)
+	return r, db.reviews.FindId(id).One(r)
+}
+
+// GetCounterReview returns review written by target of review about its
+// author for the same travel
+func (db *DB) GetCounterReview(r *models.Review) (*models.Review, error) {
+	counter := new(models.Review)
+	query := bson.M{"author": r.Target, "target": r.Author, "travel": r.Travel}
+	return counter, db.reviews.Find(query).One(counter)
+}
+
+// RevealReview makes review public, returning mgo.ErrNotFound if review
+// is already revealed
+func (db *DB) RevealReview(id bson.ObjectId, t time.Time) error {
+	query := bson.M{"_id": id, "revealed": false}
+	return db.reviews.Update(query, bson.M{"$set": bson.M{"revealed": true, "reveal_time": t}})
+}
+
+// GetUnrevealedReviews returns hidden reviews that must be revealed before t
+func (db *DB) GetUnrevealedReviews(t time.Time) ([]*models.Review, error) {
+	reviews := []*models.Review{}
+	query := bson.M{"revealed": false, "reveal_time": bson.M{"$lte": t}}
+	return reviews, db.reviews.Find(query).All(&reviews)
+}
+
+// GetUserReviews returns revealed reviews about user, newest first
+func (db *DB) GetUserReviews(user bson.ObjectId, pagination models.Pagination) ([]*models.Review, int, error) {
+	reviews := []*models.Review{}
+	query := db.reviews.Find(bson.M{"target": user, "revealed": true})
+	count, err := query.Count()
+	if err != nil {
+		return reviews, 0, err
+	}
+	return reviews, count, query.Sort("-time").Skip(pagination.Offset).Limit(pagination.Count).All(&reviews)
+}
+
+// GetAuthorReviews returns all reviews written by user, newest first
+func (db *DB) GetAuthorReviews(user bson.ObjectId, pagination models.Pagination) ([]*models.Review, int, error) {
+	reviews := []*models.Review{}
+	query := db.reviews.Find(bson.M{"author": user})
+	count, err := query.Count()
+	if err != nil {
+		return reviews, 0, err
+	}
+	return reviews, count, query.Sort("-time").Skip(pagination.Offset).Limit(pagination.Count).All(&reviews)
+}
+
+// GetDisputedReviews returns reviews disputed by reviewed users, oldest first
+func (db *DB) GetDisputedReviews(pagination models.Pagination) ([]*models.Review, int, error) {
+	reviews := []*models.Review{}
+	query := db.reviews.Find(bson.M{"disputed": true})
+	count, err := query.Count()
+	if err != nil {
+		return reviews, 0, err
+	}
+	return reviews, count, query.Sort("time").Skip(pagination.Offset).Limit(pagination.Count).All(&reviews)
+}
+
+// GetReviewStats returns aggregated rating of user by revealed reviews
+func (db *DB) GetReviewStats(user bson.ObjectId) (*models.ReviewStats, error) {
+	stats := new(models.ReviewStats)
+	pipeline := []bson.M{
+		{"$match": bson.M{"target": user, "revealed": true}},
+		{"$group": bson.M{
+			"_id":      nil,
+			"count":    bson.M{"$sum": 1},
+			"rating":   bson.M{"$avg": "$rating"},
+			"positive": bson.M{"$sum": bson.M{"$cond": []interface{}{bson.M{"$gte": []interface{}{"$rating", 4}}, 1, 0}}},
+			"negative": bson.M{"$sum": bson.M{"$cond": []interface{}{bson.M{"$lte": []interface{}{"$rating", 2}}, 1, 0}}},
+		}},
+	}
+	err := db.reviews.Pipe(pipeline).One(stats)
+	if err == mgo.ErrNotFound {
+		return stats, nil
+	}
+	return stats, err
+}
+
+// SetReviewDispute marks review about user as disputed with provided reason
+func (db *DB) SetReviewDispute(id, user bson.ObjectId, reason string) error {
+	query := bson.M{"_id": id, "target": user}
+	return db.reviews.Update(query, bson.M{"$set": bson.M{"disputed": true, "dispute_reason": reason}})
+}
+
+// ResolveReviewDispute removes dispute mark from review
+func (db *DB) ResolveReviewDispute(id bson.ObjectId) error {
+	return db.reviews.UpdateId(id, bson.M{"$set": bson.M{"disputed": false}})
+}
+
+func (db *DB) RemoveReview(id bson.ObjectId) error {
+	return db.reviews.RemoveId(id)
+}
@@ -0,0 +1,93 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ernado/poputchiki/models"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestReviews(t *testing.T) {
+	db := TestDatabase()
+	Convey("Reviews", t, func() {
+		Reset(db.Drop)
+		author, target := bson.NewObjectId(), bson.NewObjectId()
+		now := time.Now()
+		trip := &models.Trip{Id: bson.NewObjectId(), User: author, Participants: []bson.ObjectId{target},
+			Start: now.AddDate(0, 0, -10), End: now.AddDate(0, 0, -2)}
+		r := &models.Review{Author: author, Target: target, Rating: 5, Text: "Отлично"}
+		So(r.Normalize(trip, nil, now), ShouldBeNil)
+		_, err := db.AddReview(r)
+		So(err, ShouldBeNil)
+		Convey("Duplicate", func() {
+			d := &models.Review{Author: author, Target: target, Rating: 1}
+			So(d.Normalize(trip, nil, now), ShouldBeNil)
+			_, err := db.AddReview(d)
+			So(mgo.IsDup(err), ShouldBeTrue)
+			i := &models.Invitation{Id: bson.NewObjectId(), Origin: author, Destination: target, Trip: trip.Id,
+				State: models.InvitationAccepted, End: trip.End}
+			d = &models.Review{Author: author, Target: target, Rating: 1}
+			So(d.Normalize(nil, i, now), ShouldBeNil)
+			_, err = db.AddReview(d)
+			So(mgo.IsDup(err), ShouldBeTrue)
+		})
+		Convey("Hidden", func() {
+			reviews, count, err := db.GetUserReviews(target, models.Pagination{})
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 0)
+			So(len(reviews), ShouldEqual, 0)
+			reviews, count, err = db.GetAuthorReviews(author, models.Pagination{})
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 1)
+		})
+		Convey("Counterpart", func() {
+			_, err := db.GetCounterReview(r)
+			So(err, ShouldEqual, mgo.ErrNotFound)
+			c := &models.Review{Author: target, Target: author, Rating: 2}
+			So(c.Normalize(trip, nil, now), ShouldBeNil)
+			_, err = db.AddReview(c)
+			So(err, ShouldBeNil)
+			counter, err := db.GetCounterReview(r)
+			So(err, ShouldBeNil)
+			So(counter.Id, ShouldEqual, c.Id)
+		})
+		Convey("Reveal", func() {
+			reviews, err := db.GetUnrevealedReviews(now)
+			So(err, ShouldBeNil)
+			So(len(reviews), ShouldEqual, 0)
+			reviews, err = db.GetUnrevealedReviews(r.RevealTime.Add(time.Second))
+			So(err, ShouldBeNil)
+			So(len(reviews), ShouldEqual, 1)
+			So(db.RevealReview(r.Id, now), ShouldBeNil)
+			So(db.RevealReview(r.Id, now), ShouldEqual, mgo.ErrNotFound)
+			_, count, err := db.GetUserReviews(target, models.Pagination{})
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 1)
+			stats, err := db.GetReviewStats(target)
+			So(err, ShouldBeNil)
+			So(stats.Count, ShouldEqual, 1)
+			So(stats.Rating, ShouldEqual, 5)
+			So(stats.Positive, ShouldEqual, 1)
+			Convey("Dispute", func() {
+				So(db.SetReviewDispute(r.Id, author, "Неправда"), ShouldEqual, mgo.ErrNotFound)
+				So(db.SetReviewDispute(r.Id, target, "Неправда"), ShouldBeNil)
+				reviews, count, err := db.GetDisputedReviews(models.Pagination{})
+				So(err, ShouldBeNil)
+				So(count, ShouldEqual, 1)
+				So(reviews[0].DisputeReason, ShouldEqual, "Неправда")
+				So(db.ResolveReviewDispute(r.Id), ShouldBeNil)
+				_, count, err = db.GetDisputedReviews(models.Pagination{})
+				So(err, ShouldBeNil)
+				So(count, ShouldEqual, 0)
+			})
+		})
+		Convey("Empty stats", func() {
+			stats, err := db.GetReviewStats(author)
+			So(err, ShouldBeNil)
+			So(stats.Count, ShouldEqual, 0)
+		})
+	})
+}
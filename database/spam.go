@@ -0,0 +1,34 @@
+package database
+
+import (
+	"github.com/ernado/poputchiki/models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// SetSpamFlag shadow-limits user, flagging it to admins
+func (db *DB) SetSpamFlag(id bson.ObjectId, flag *models.SpamFlag) error {
+	return db.users.UpdateId(id, bson.M{"$set": bson.M{"spam_flag": flag}})
+}
+
+// RemoveSpamFlag lifts shadow limit of user
+func (db *DB) RemoveSpamFlag(id bson.ObjectId) error {
+	return db.users.UpdateId(id, bson.M{"$unset": bson.M{"spam_flag": ""}})
+}
+
+// GetSpamReports returns users flagged for spam, newest first
+func (db *DB) GetSpamReports(pagination models.Pagination) ([]*models.SpamReport, int, error) {
+	reports := []*models.SpamReport{}
+	users := []*models.User{}
+	query := db.users.Find(bson.M{"spam_flag": bson.M{"$exists": true}})
+	count, err := query.Count()
+	if err != nil {
+		return reports, 0, err
+	}
+	if err := query.Sort("-spam_flag.time").Skip(pagination.Offset).Limit(pagination.Count).All(&users); err != nil {
+		return reports, 0, err
+	}
+	for _, u := range users {
+		reports = append(reports, &models.SpamReport{User: u, Flag: u.SpamFlag})
+	}
+	return reports, count, nil
+}
@@ -0,0 +1,47 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ernado/poputchiki/models"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestSpamFlags(t *testing.T) {
+	db := TestDatabase()
+	Convey("Spam flags", t, func() {
+		Reset(db.Drop)
+		u := &models.User{Id: bson.NewObjectId(), Name: "Spammer"}
+		So(db.Add(u), ShouldBeNil)
+		So(db.Get(u.Id).ShadowLimited(), ShouldBeFalse)
+		flag := &models.SpamFlag{Reason: models.SpamReasonDuplicates, Time: time.Now()}
+		So(db.SetSpamFlag(u.Id, flag), ShouldBeNil)
+		So(db.Get(u.Id).ShadowLimited(), ShouldBeTrue)
+		reports, count, err := db.GetSpamReports(models.Pagination{})
+		So(err, ShouldBeNil)
+		So(count, ShouldEqual, 1)
+		So(reports[0].User.Id, ShouldEqual, u.Id)
+		So(reports[0].Flag.Reason, ShouldEqual, models.SpamReasonDuplicates)
+		Convey("Remove", func() {
+			So(db.RemoveSpamFlag(u.Id), ShouldBeNil)
+			So(db.Get(u.Id).ShadowLimited(), ShouldBeFalse)
+			_, count, err := db.GetSpamReports(models.Pagination{})
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 0)
+		})
+		Convey("Hidden message should not be counted as unread", func() {
+			destination := bson.NewObjectId()
+			m := models.NewMessage(u.Id, destination, "", "Привет")
+			m.Removed = []bson.ObjectId{destination}
+			So(db.AddMessage(m), ShouldBeNil)
+			n, err := db.GetUnreadCount(destination)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 0)
+			chats, err := db.GetChats(destination)
+			So(err, ShouldBeNil)
+			So(len(chats), ShouldEqual, 0)
+		})
+	})
+}
@@ -0,0 +1,72 @@
+package database
+
+import (
+	"time"
+
+	"github.com/ernado/poputchiki/models"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func (db *DB) AddTrip(trip *models.Trip) (*models.Trip, error) {
+	trip.Id = bson.NewObjectId()
+	trip.Time = time.Now()
+	return trip, db.trips.Insert(trip)
+}
+
+func (db *DB) GetTrip(id bson.ObjectId) (*models.Trip, error) {
+	trip := new(models.Trip)
+	return trip, db.trips.FindId(id).One(trip)
+}
+
+// GetUserTrips returns all trips of user, nearest first
+func (db *DB) GetUserTrips(user bson.ObjectId) ([]*models.Trip, error) {
+	trips := []*models.Trip{}
+	return trips, db.trips.Find(bson.M{"user": user}).Sort("start").All(&trips)
+}
+
+// GetParticipantTrips returns trips of other users where user is participant
+func (db *DB) GetParticipantTrips(user bson.ObjectId) ([]*models.Trip, error) {
+	trips := []*models.Trip{}
+	return trips, db.trips.Find(bson.M{"participants": user}).Sort("start").All(&trips)
+}
+
+// UpdateTripSecure updates trip ensuring ownership
+func (db *DB) UpdateTripSecure(user, id bson.ObjectId, trip *models.Trip) (*models.Trip, error) {
+	updated := new(models.Trip)
+	fields := bson.M{
+		"destinations": trip.Destinations,
+		"start":        trip.Start,
+		"end":          trip.End,
+		"flexible":     trip.Flexible,
+		"month":        trip.Month,
+		"year":         trip.Year,
+		"budget":       trip.Budget,
+		"transport":    trip.Transport,
+		"companions":   trip.Companions,
+		"visibility":   trip.Visibility,
+		"status":       trip.Status,
+		"description":  trip.Description,
+	}
+	change := mgo.Change{Update: bson.M{"$set": fields}, ReturnNew: true}
+	query := bson.M{"_id": id, "user": user}
+	_, err := db.trips.Find(query).Apply(change, updated)
+	return updated, err
+}
+
+// RemoveTripSecure removes trip ensuring ownership
+func (db *DB) RemoveTripSecure(user, id bson.ObjectId) error {
+	return db.trips.Remove(bson.M{"_id": id, "user": user})
+}
+
+// SearchTrips returns trips of other users overlapping with query
+func (db *DB) SearchTrips(query *models.TripQuery, user bson.ObjectId) ([]*models.Trip, error) {
+	trips := []*models.Trip{}
+	q := db.trips.Find(query.ToBson(user)).Sort("start").Limit(models.TripSearchLimit)
+	return trips, q.All(&trips)
+}
+
+// AddTripParticipant adds user to participants of trip
+func (db *DB) AddTripParticipant(id, user bson.ObjectId) error {
+	return db.trips.UpdateId(id, bson.M{"$addToSet": bson.M{"participants": user}})
+}
@@ -0,0 +1,73 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ernado/poputchiki/models"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestTrips(t *testing.T) {
+	db := TestDatabase()
+	Convey("Trips", t, func() {
+		Reset(db.Drop)
+		user := bson.NewObjectId()
+		start := time.Date(2015, time.July, 1, 0, 0, 0, 0, time.UTC)
+		trip := &models.Trip{User: user, Destinations: []string{"Москва"}, Start: start, End: start.AddDate(0, 0, 7),
+			Status: models.TripPlanned, Visibility: models.TripPublic}
+		Convey("Add", func() {
+			t, err := db.AddTrip(trip)
+			So(err, ShouldBeNil)
+			So(t.Id.Valid(), ShouldBeTrue)
+			Convey("Get", func() {
+				t, err := db.GetTrip(trip.Id)
+				So(err, ShouldBeNil)
+				So(t.User, ShouldEqual, user)
+				So(t.Destinations[0], ShouldEqual, "Москва")
+			})
+			Convey("User trips", func() {
+				trips, err := db.GetUserTrips(user)
+				So(err, ShouldBeNil)
+				So(len(trips), ShouldEqual, 1)
+				So(trips[0].Id, ShouldEqual, trip.Id)
+			})
+			Convey("Update", func() {
+				update := *trip
+				update.Description = "На море"
+				t, err := db.UpdateTripSecure(user, trip.Id, &update)
+				So(err, ShouldBeNil)
+				So(t.Description, ShouldEqual, "На море")
+				Convey("Wrong user", func() {
+					_, err := db.UpdateTripSecure(bson.NewObjectId(), trip.Id, &update)
+					So(err, ShouldNotBeNil)
+				})
+			})
+			Convey("Search", func() {
+				other := bson.NewObjectId()
+				q := &models.TripQuery{Destinations: []string{"Москва"}, Start: start.AddDate(0, 0, 5), End: start.AddDate(0, 0, 20)}
+				trips, err := db.SearchTrips(q, other)
+				So(err, ShouldBeNil)
+				So(len(trips), ShouldEqual, 1)
+				Convey("Own trips", func() {
+					trips, err := db.SearchTrips(q, user)
+					So(err, ShouldBeNil)
+					So(len(trips), ShouldEqual, 0)
+				})
+				Convey("No overlap", func() {
+					q.Start = start.AddDate(0, 0, 10)
+					trips, err := db.SearchTrips(q, other)
+					So(err, ShouldBeNil)
+					So(len(trips), ShouldEqual, 0)
+				})
+			})
+			Convey("Remove", func() {
+				So(db.RemoveTripSecure(bson.NewObjectId(), trip.Id), ShouldNotBeNil)
+				So(db.RemoveTripSecure(user, trip.Id), ShouldBeNil)
+				_, err := db.GetTrip(trip.Id)
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
@@ -32,6 +32,17 @@ func (db *DB) GetUpdates(destination bson.ObjectId, t string, pagination models.
 	return s, db.updates.Find(bson.M{"destination": destination, "type": t}).Sort("-time").Skip(pagination.Offset).Limit(pagination.Count).All(&s)
 }
 
+// GetUpdatesAfter returns updates of destinations that were added after
+// update with provided id or all updates if id is blank, oldest first
+func (db *DB) GetUpdatesAfter(destinations []bson.ObjectId, after bson.ObjectId, count int) ([]*models.Update, error) {
+	s := []*models.Update{}
+	query := bson.M{"destination": bson.M{"$in": destinations}}
+	if after.Valid() {
+		query["_id"] = bson.M{"$gt": after}
+	}
+	return s, db.updates.Find(query).Sort("_id").Limit(count).All(&s)
+}
+
 func (db *DB) SetUpdatesRead(destination bson.ObjectId, t string) error {
 	selector := bson.M{"destination": destination}
 	if t != "" {
@@ -42,6 +53,17 @@ func (db *DB) SetUpdatesRead(destination bson.ObjectId, t string) error {
 	return err
 }
 
+// GetUnreadUpdateIds returns ids of provided updates that still exist and
+// are not read yet
+func (db *DB) GetUnreadUpdateIds(ids []bson.ObjectId) ([]bson.ObjectId, error) {
+	unread := []bson.ObjectId{}
+	if len(ids) == 0 {
+		return unread, nil
+	}
+	query := bson.M{"_id": bson.M{"$in": ids}, "read": false}
+	return unread, db.updates.Find(query).Distinct("_id", &unread)
+}
+
 func (db *DB) IsUpdateDublicate(origin, destination bson.ObjectId, t string, duration time.Duration) (bool, error) {
 	fromTime := time.Now().Add(-duration)
 	query := bson.M{"time": bson.M{"$gte": fromTime}, "type": t, "user": origin, "destination": destination}
@@ -71,3 +71,31 @@ func TestUpdates(t *testing.T) {
 		})
 	})
 }
+
+func TestUpdatesAfter(t *testing.T) {
+	db := TestDatabase()
+	Convey("Updates after id", t, func() {
+		Reset(db.Drop)
+		origin := bson.NewObjectId()
+		destination := bson.NewObjectId()
+		var ids []bson.ObjectId
+		for i := 0; i < 3; i++ {
+			u, err := db.AddUpdate(destination, origin, models.UpdateGuests, nil)
+			So(err, ShouldBeNil)
+			ids = append(ids, u.Id)
+		}
+		_, err := db.AddUpdate(origin, destination, models.UpdateGuests, nil)
+		So(err, ShouldBeNil)
+		updates, err := db.GetUpdatesAfter([]bson.ObjectId{destination}, ids[0], 10)
+		So(err, ShouldBeNil)
+		So(len(updates), ShouldEqual, 2)
+		So(updates[0].Id, ShouldEqual, ids[1])
+		So(updates[1].Id, ShouldEqual, ids[2])
+		Convey("Count should be limited", func() {
+			updates, err := db.GetUpdatesAfter([]bson.ObjectId{destination}, "", 1)
+			So(err, ShouldBeNil)
+			So(len(updates), ShouldEqual, 1)
+			So(updates[0].Id, ShouldEqual, ids[0])
+		})
+	})
+}
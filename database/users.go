@@ -255,6 +255,11 @@ func (db *DB) SetOffline(id bson.ObjectId) error {
 	return db.SetOnlineStatus(id, false)
 }
 
+// SetPresence saves online status of user and time of last activity
+func (db *DB) SetPresence(id bson.ObjectId, online bool, lastAction time.Time) error {
+	return db.users.UpdateId(id, bson.M{"$set": bson.M{"online": online, "lastaction": lastAction}})
+}
+
 func (db *DB) ChangeBalance(id bson.ObjectId, delta int) error {
 	change := mgo.Change{Update: bson.M{"$inc": bson.M{"balance": delta}}}
 
@@ -281,6 +286,10 @@ func (db *DB) SetLastActionNow(id bson.ObjectId) error {
 	return err
 }
 
+func (db *DB) SetCalendarToken(id bson.ObjectId, token string) error {
+	return db.users.UpdateId(id, bson.M{"$set": bson.M{"calendar_token": token}})
+}
+
 func (db *DB) SetAvatar(user, avatar bson.ObjectId) error {
 	change := mgo.Change{Update: bson.M{"$set": bson.M{"avatar": avatar}}}
 	_, err := db.users.FindId(user).Apply(change, &bson.M{})
@@ -364,9 +373,31 @@ func (db *DB) NormalizeRating() (*mgo.ChangeInfo, error) {
 	return info, nil
 }
 
+// SetNotifications saves preferences of user for event types of matrix,
+// leaving other event types unchanged
+func (db *DB) SetNotifications(id bson.ObjectId, notifications Notifications) error {
+	if len(notifications) == 0 {
+		return nil
+	}
+	update := bson.M{}
+	for event, channels := range notifications {
+		update["notifications."+event] = channels
+	}
+	return db.users.UpdateId(id, bson.M{"$set": update})
+}
+
+func (db *DB) SetDigestPeriod(id bson.ObjectId, period string) error {
+	return db.users.UpdateId(id, bson.M{"$set": bson.M{"digest": period}})
+}
+
+// SetDigestSent saves time of last digest of user
+func (db *DB) SetDigestSent(id bson.ObjectId, t time.Time) error {
+	return db.users.UpdateId(id, bson.M{"$set": bson.M{"digest_sent": t}})
+}
+
 func (db *DB) UserIsSubscribed(id bson.ObjectId, subscription string) (bool, error) {
 	var found bool
-	for _, v := range Subscriptions {
+	for _, v := range append(Subscriptions, OptInSubscriptions...) {
 		if v == subscription {
 			found = true
 		}
@@ -253,6 +253,18 @@ func TestUsers(t *testing.T) {
 				So(db.SetLastActionNow(id), ShouldBeNil)
 				Integrity(db, u)
 			})
+			Convey("Presence", func() {
+				u.Online = true
+				u.LastAction = time.Now()
+				So(db.SetPresence(id, true, u.LastAction), ShouldBeNil)
+				Integrity(db, u)
+				Convey("Offline", func() {
+					u.Online = false
+					u.LastAction = time.Now().Add(-time.Minute)
+					So(db.SetPresence(id, false, u.LastAction), ShouldBeNil)
+					Integrity(db, u)
+				})
+			})
 			Convey("Set avatar", func() {
 				u.Avatar = bson.NewObjectId()
 				So(db.SetAvatar(id, u.Avatar), ShouldBeNil)
@@ -31,7 +31,9 @@ func (db *DB) RemoveVideo(user bson.ObjectId, id bson.ObjectId) error {
 
 func (db *DB) GetUserVideo(id bson.ObjectId) ([]*models.Video, error) {
 	v := []*models.Video{}
-	return v, db.video.Find(bson.M{"user": id}).Sort("-time").All(&v)
+	// attachments of messages are not shown in profile
+	query := bson.M{"user": id, "message": bson.M{"$exists": false}}
+	return v, db.video.Find(query).Sort("-time").All(&v)
 }
 
 func (db *DB) GetAllVideo() ([]*models.Video, error) {
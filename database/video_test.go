@@ -33,6 +33,14 @@ func TestVideo(t *testing.T) {
 				So(err, ShouldBeNil)
 				So(len(v), ShouldEqual, 1)
 				So(v[0].Id, ShouldEqual, a.Id)
+				Convey("Without attachments of messages", func() {
+					attachment := &models.Video{Id: bson.NewObjectId(), User: a.User, Message: bson.NewObjectId()}
+					_, err := db.AddVideo(attachment)
+					So(err, ShouldBeNil)
+					v, err := db.GetUserVideo(a.User)
+					So(err, ShouldBeNil)
+					So(len(v), ShouldEqual, 1)
+				})
 			})
 			Convey("Add like", func() {
 				So(db.AddLikeVideo(a.User, a.Id), ShouldBeNil)
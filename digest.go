@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	. "github.com/ernado/poputchiki/models"
+	"github.com/go-martini/martini"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	digestTick     = time.Minute * 5
+	digestTemplate = "digest.html"
+)
+
+// DigestSender sends digest email to user
+type DigestSender interface {
+	SendDigest(digest *Digest) error
+}
+
+// DigestUpdater buffers updates that user wants to receive by email and
+// sends them in digests, or sends email at once if user wants instant
+// emails
+type DigestUpdater struct {
+	db     DataBase
+	email  Updater
+	sender DigestSender
+}
+
+func (d *DigestUpdater) Push(update Update) error {
+	user := d.db.Get(update.Destination)
+	if user == nil || !user.NotifiesUpdate(update, NotifyEmail) {
+		return nil
+	}
+	if user.DigestPeriod() == DigestInstant {
+		return d.email.Push(update)
+	}
+	return d.db.AddDigestItem(NewDigestItem(update))
+}
+
+// Send sends digests to users whose period of digests passed, removing
+// sent updates from buffer, and returns amount of sent digests. Updates
+// that were read or removed since buffering are dropped.
+func (d *DigestUpdater) Send(now time.Time) (int, error) {
+	users, err := d.db.GetDigestUsers()
+	if err != nil {
+		return 0, err
+	}
+	sent := 0
+	for _, id := range users {
+		user := d.db.Get(id)
+		if user != nil && !user.DigestDue(now) {
+			continue
+		}
+		items, err := d.db.GetDigestItems(id)
+		if err != nil {
+			return sent, err
+		}
+		buffered := make([]bson.ObjectId, len(items))
+		for i, item := range items {
+			buffered[i] = item.Id
+		}
+		if items, err = d.unread(items, buffered); err != nil {
+			return sent, err
+		}
+		digest := NewDigest(user, items, d.names(items))
+		// buffered updates of removed users are dropped
+		if user != nil && user.Email != "" && len(items) != 0 {
+			if err := d.sender.SendDigest(digest); err != nil {
+				log.Println("[digest]", "send error", err)
+				continue
+			}
+			if err := d.db.SetDigestSent(id, now); err != nil {
+				return sent, err
+			}
+			sent++
+		}
+		if err := d.db.RemoveDigestItems(buffered); err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
+
+// unread returns items whose updates are not read yet
+func (d *DigestUpdater) unread(items []*DigestItem, ids []bson.ObjectId) ([]*DigestItem, error) {
+	unread, err := d.db.GetUnreadUpdateIds(ids)
+	if err != nil {
+		return nil, err
+	}
+	keep := make(map[bson.ObjectId]bool)
+	for _, id := range unread {
+		keep[id] = true
+	}
+	result := []*DigestItem{}
+	for _, item := range items {
+		if keep[item.Id] {
+			result = append(result, item)
+		}
+	}
+	return result, nil
+}
+
+// names returns names of users that caused events of items
+func (d *DigestUpdater) names(items []*DigestItem) map[bson.ObjectId]string {
+	names := make(map[bson.ObjectId]string)
+	for _, item := range items {
+		if _, ok := names[item.Origin]; ok {
+			continue
+		}
+		if u := d.db.Get(item.Origin); u != nil {
+			names[item.Origin] = u.Name
+		}
+	}
+	return names
+}
+
+func (e *EmailUpdater) SendDigest(digest *Digest) error {
+	template, err := e.templates.String(digestTemplate)
+	if err != nil {
+		log.Println("[email] template error", err)
+		return err
+	}
+	email := fmt.Sprintf("Попутчики <%s>", "noreply@"+mailDomain)
+	message, err := NewMail(template, email, digest.User.Email, digest.Theme(), digest)
+	if err != nil {
+		return err
+	}
+	_, err = e.client.Send(message)
+	return err
+}
+
+// SetDigestPeriod changes how often user receives digests
+func SetDigestPeriod(db DataBase, parm martini.Params, context Context) (int, []byte) {
+	period := parm["period"]
+	if !ValidDigestPeriod(period) {
+		return Render(ValidationError(fmt.Errorf("bad digest period <%s>", period)))
+	}
+	if err := db.SetDigestPeriod(context.User.Id, period); err != nil {
+		return Render(BackendError(err))
+	}
+	return context.Render(db.Get(context.User.Id))
+}
+
+func (a *Application) DigestCycle() {
+	a.newCycle("digest", digestTick, func(_ chan bool) {
+		n, err := a.digest.Send(time.Now())
+		if err != nil {
+			log.Println("[digest]", "error", err)
+			return
+		}
+		if n != 0 {
+			log.Println("[digest]", "digests sent:", n)
+		}
+	})
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"log"
+
+	. "github.com/ernado/poputchiki/models"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	groupMessagesCount = 50
+)
+
+// tripGroupChat returns chat of trip creating it with owner of trip if needed
+func tripGroupChat(db DataBase, trip *Trip) (*GroupChat, error) {
+	chat, err := db.GetTripGroupChat(trip.Id)
+	if err != mgo.ErrNotFound {
+		return chat, err
+	}
+	chat, err = db.AddGroupChat(NewTripGroupChat(trip))
+	if mgo.IsDup(err) {
+		// created concurrently
+		return db.GetTripGroupChat(trip.Id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return chat, db.AddGroupMember(chat.Id, trip.User, GroupRoleOwner)
+}
+
+// joinTripGroupChat adds participant of trip to the trip chat
+func joinTripGroupChat(db DataBase, id, user bson.ObjectId) error {
+	trip, err := db.GetTrip(id)
+	if err != nil {
+		return err
+	}
+	chat, err := tripGroupChat(db, trip)
+	if err != nil {
+		return err
+	}
+	return db.AddGroupMember(chat.Id, user, GroupRoleMember)
+}
+
+// getGroupMember returns chat and membership of current user in it
+func getGroupMember(context Context, id bson.ObjectId) (*GroupChat, *GroupMember, error) {
+	chat, err := context.DB.GetGroupChat(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	member, err := context.DB.GetGroupMember(id, context.User.Id)
+	if err != nil {
+		return nil, nil, err
+	}
+	chat.SetMember(member)
+	return chat, member, nil
+}
+
+func GetGroupChats(context Context) (int, []byte) {
+	chats, err := context.DB.GetUserGroupChats(context.User.Id)
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	return context.Render(GroupChats(chats))
+}
+
+func GetGroupChat(context Context, id bson.ObjectId) (int, []byte) {
+	chat, _, err := getGroupMember(context, id)
+	if err == mgo.ErrNotFound {
+		return Render(ErrorObjectNotFound)
+	}
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	chat.Members, err = context.DB.GetGroupMembers(id)
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	return context.Render(chat)
+}
+
+// JoinGroupChat adds current user to chat if he is owner or participant of the chat trip
+func JoinGroupChat(context Context, id bson.ObjectId) (int, []byte) {
+	db := context.DB
+	chat, err := db.GetGroupChat(id)
+	if err == mgo.ErrNotFound {
+		return Render(ErrorObjectNotFound)
+	}
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	if !chat.Trip.Valid() {
+		return Render(ErrorNotAllowed)
+	}
+	trip, err := db.GetTrip(chat.Trip)
+	if err == mgo.ErrNotFound {
+		return Render(ErrorNotAllowed)
+	}
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	user := context.User.Id
+	role := GroupRoleMember
+	if trip.User == user {
+		role = GroupRoleOwner
+	} else if !trip.HasParticipant(user) {
+		return Render(ErrorNotAllowed)
+	}
+	if err := db.AddGroupMember(id, user, role); err != nil {
+		return Render(BackendError(err))
+	}
+	return GetGroupChat(context, id)
+}
+
+func LeaveGroupChat(context Context, id bson.ObjectId) (int, []byte) {
+	_, member, err := getGroupMember(context, id)
+	if err == mgo.ErrNotFound {
+		return Render(ErrorObjectNotFound)
+	}
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	if member.Role == GroupRoleOwner {
+		return Render(ErrorNotAllowed)
+	}
+	if err := context.DB.RemoveGroupMember(id, member.User); err != nil {
+		return Render(BackendError(err))
+	}
+	return Render("ok")
+}
+
+func setGroupChatMuted(context Context, id bson.ObjectId, muted bool) (int, []byte) {
+	err := context.DB.SetGroupMemberMuted(id, context.User.Id, muted)
+	if err == mgo.ErrNotFound {
+		return Render(ErrorObjectNotFound)
+	}
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	return Render("ok")
+}
+
+func MuteGroupChat(context Context, id bson.ObjectId) (int, []byte) {
+	return setGroupChatMuted(context, id, true)
+}
+
+func UnmuteGroupChat(context Context, id bson.ObjectId) (int, []byte) {
+	return setGroupChatMuted(context, id, false)
+}
+
+// GetGroupMessages returns messages of chat, newest first, marking chat as read
+func GetGroupMessages(context Context, id bson.ObjectId, pagination Pagination) (int, []byte) {
+	_, member, err := getGroupMember(context, id)
+	if err == mgo.ErrNotFound {
+		return Render(ErrorObjectNotFound)
+	}
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	if pagination.Count == 0 {
+		pagination.Count = groupMessagesCount
+	}
+	messages, err := context.DB.GetGroupMessages(id, pagination)
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	if err := context.DB.SetGroupChatRead(id, member.User); err != nil {
+		return Render(BackendError(err))
+	}
+	return context.Render(GroupMessages(messages))
+}
+
+// SendGroupMessage saves message and delivers it to other members: muted
+// members get only realtime event, others also get notifications
+func SendGroupMessage(context Context, id bson.ObjectId, parser Parser, realtime RealtimeInterface, u Updater) (int, []byte) {
+	db := context.DB
+	_, member, err := getGroupMember(context, id)
+	if err == mgo.ErrNotFound {
+		return Render(ErrorObjectNotFound)
+	}
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	text := &MessageText{}
+	if err := parser.Parse(text); err != nil {
+		return Render(ValidationError(err))
+	}
+	message := &GroupMessage{Chat: id, Origin: member.User, Text: text.Text}
+	if text.ImageId.Valid() {
+		p, err := db.GetPhoto(text.ImageId)
+		if err != nil {
+			return Render(ErrorObjectNotFound)
+		}
+		message.Photo = p.ImageJpeg
+	}
+	if err := message.Validate(); err != nil {
+		return Render(ValidationError(err))
+	}
+	if err := db.AddGroupMessage(message); err != nil {
+		return Render(BackendError(err))
+	}
+	members, err := db.GetGroupMembers(id)
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	go func(m GroupMessage) {
+		for _, v := range members {
+			if v.User == m.Origin {
+				continue
+			}
+			update := NewUpdate(v.User, m.Origin, UpdateGroupMessages, &m)
+			var err error
+			if v.Muted {
+				err = realtime.Push(update)
+			} else {
+				err = u.Push(update)
+			}
+			if err != nil {
+				log.Println("[groups]", "update error", err)
+			}
+		}
+	}(*message)
+	return context.Render(message)
+}
@@ -108,6 +108,11 @@ func GetUser(db DataBase, t *gotok.Token, id bson.ObjectId, context Context, u U
 			u.Push(NewUpdate(id, t.Id, UpdateGuests, user))
 		}()
 	}
+	if stats, err := db.GetReviewStats(id); err == nil {
+		user.Reviews = stats
+	} else {
+		log.Println("[reviews]", "stats error", err)
+	}
 	return context.Render(user)
 }
 
@@ -375,7 +380,7 @@ func Register(db DataBase, r *http.Request, w http.ResponseWriter, tokens gotok.
 }
 
 // Update updates user information with provided key-value document
-func UpdateUser(db DataBase, id bson.ObjectId, parser Parser, context Context) (int, []byte) {
+func UpdateUser(db DataBase, id bson.ObjectId, parser Parser, context Context, moderator *Moderator) (int, []byte) {
 	user := new(User)
 	query, err := parser.Query(user)
 
@@ -415,6 +420,18 @@ func UpdateUser(db DataBase, id bson.ObjectId, parser Parser, context Context) (
 		user.Password = getHash(user.Password, context.DB.Salt())
 	}
 
+	// about is published after moderation
+	if _, ok := query["about"]; ok && user.About != "" && !bool(context.IsAdmin) {
+		text, held, err := moderate(db, moderator, id, ModerationAbout, "", user.About)
+		if e, ok := err.(Error); ok {
+			return Render(e)
+		}
+		user.About = text
+		if held != nil {
+			delete(query, "about")
+		}
+	}
+
 	// encoding back to query object
 	// marshalling to bson
 	newQuery := bson.M{}
@@ -438,9 +455,11 @@ func UpdateUser(db DataBase, id bson.ObjectId, parser Parser, context Context) (
 		}
 	}
 	// updating user
-	_, err = context.DB.Update(id, newQuery)
-	if err != nil {
-		return context.Render(BackendError(err))
+	if len(newQuery) > 0 {
+		_, err = context.DB.Update(id, newQuery)
+		if err != nil {
+			return context.Render(BackendError(err))
+		}
 	}
 	// returning updated user
 	updated := context.DB.Get(id)
@@ -460,7 +479,7 @@ type MessageText struct {
 	Photo   string        `json:"photo"`
 }
 
-func SendMessage(context Context, db DataBase, parser Parser, destination bson.ObjectId, r *http.Request, t *gotok.Token, realtime AutoUpdater, admin IsAdmin) (int, []byte) {
+func SendMessage(context Context, db DataBase, parser Parser, destination bson.ObjectId, r *http.Request, t *gotok.Token, realtime AutoUpdater, updater Updater, admin IsAdmin, spam *SpamFilter, moderator *Moderator, channel RealtimeInterface) (int, []byte) {
 	message := &MessageText{}
 	err := parser.Parse(message)
 	if err != nil {
@@ -495,13 +514,14 @@ func SendMessage(context Context, db DataBase, parser Parser, destination bson.O
 		photo = p.ImageJpeg
 	}
 
-	m1, m2 := NewMessagePair(db, origin, destination, photo, text)
+	m, m1, m2 := NewMessagePair(db, origin, destination, photo, text)
 	if len(message.ImageId.Hex()) > 0 {
 		p, err := db.GetPhoto(message.ImageId)
 		if err != nil {
 			errorText := fmt.Sprintf("Photo with id %s not found", message.ImageId.Hex())
 			return Render(ValidationError(errors.New(errorText)))
 		}
+		m.Photo = p.ImageJpeg
 		m1.Photo = p.ImageJpeg
 		m2.Photo = p.ImageJpeg
 	}
@@ -516,44 +536,115 @@ func SendMessage(context Context, db DataBase, parser Parser, destination bson.O
 			return Render(ErrorBlacklisted)
 		}
 	}
-	if err := realtime.Push(origin, m1); err != nil {
-		Render(BackendError(err))
+	// messages of suspected spammers are silently hidden from destination
+	shadow := false
+	if !admin {
+		shadow, err = spam.Check(db, context.User, destination, m.Text)
+		if e, ok := err.(Error); ok {
+			return Render(e)
+		}
+		if err != nil {
+			return Render(BackendError(err))
+		}
 	}
-	if err := realtime.Push(destination, m2); err != nil {
-		Render(BackendError(err))
+	if !admin && m.Text != "" {
+		item := NewModerationItem(origin, ModerationMessage, destination, ModerationResult{})
+		item.Photo = m.Photo
+		text, held, err := moderateItem(db, moderator, item, m.Text)
+		if e, ok := err.(Error); ok {
+			return Render(e)
+		}
+		if held != nil {
+			return context.Render(held)
+		}
+		m.Text, m1.Text, m2.Text = text, text, text
+	}
+	if shadow {
+		m.Removed = []bson.ObjectId{destination}
+	}
+	if err := db.AddMessage(m); err != nil {
+		return Render(BackendError(err))
 	}
-	if err := db.AddMessage(m1); err != nil {
+	m1.Conversation = m.Conversation
+	m2.Conversation = m.Conversation
+	if err := realtime.Push(origin, m1); err != nil {
 		Render(BackendError(err))
 	}
-	if err := db.AddMessage(m2); err != nil {
+	if shadow {
+		return context.Render(m1)
+	}
+	if err := pushToDestination(db, updater, channel, m2); err != nil {
 		Render(BackendError(err))
 	}
 	return context.Render(m1)
 }
 
-func SendInvite(db DataBase, parser Parser, engine activities.Handler, destination bson.ObjectId, r *http.Request, t *gotok.Token, realtime AutoUpdater) (int, []byte) {
-	textDestination := "Вас пригласили в путешествие"
-	textOrigin := "Вы отправили приглашение в путешествие"
+// pushToDestination notifies destination about message, only through
+// realtime channel if destination muted conversation
+func pushToDestination(db DataBase, updater Updater, channel RealtimeInterface, m *Message) error {
+	c, err := db.GetConversation(m.Origin, m.Destination)
+	if err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+	if err == nil && c.MutedBy(m.Destination) {
+		return channel.Push(NewUpdate(m.Destination, m.Origin, UpdateMessages, m))
+	}
+	return updater.Push(NewUpdate(m.Destination, m.Origin, UpdateMessages, m))
+}
+
+func SendInvite(context Context, db DataBase, parser Parser, engine activities.Handler, destination bson.ObjectId, t *gotok.Token, updater Updater) (int, []byte) {
 	origin := t.Id
-	toOrigin, toDestination := NewInvites(db, origin, destination, textOrigin, textDestination)
+	invitation := new(Invitation)
+	if err := parser.Parse(invitation); err != nil {
+		return Render(ValidationError(err))
+	}
+	if origin == destination {
+		return Render(ErrorBadRequest)
+	}
 	u := db.Get(destination)
 	if u == nil {
 		return Render(ErrorUserNotFound)
 	}
 	// check blacklist of destination
-	for _, id := range u.Blacklist {
-		if id == origin {
-			return Render(ErrorBlacklisted)
+	if u.InBlacklist(origin) {
+		return Render(ErrorBlacklisted)
+	}
+	var trip *Trip
+	if invitation.Trip.Valid() {
+		var err error
+		trip, err = db.GetTrip(invitation.Trip)
+		if err == mgo.ErrNotFound {
+			return Render(ErrorObjectNotFound)
+		}
+		if err != nil {
+			return Render(BackendError(err))
 		}
+		if trip.User != origin {
+			return Render(ErrorNotAllowed)
+		}
+	}
+	invitation.Origin = origin
+	invitation.Destination = destination
+	if err := invitation.Normalize(trip, time.Now()); err != nil {
+		return Render(ValidationError(err))
+	}
+	pending, err := db.HasPendingInvitation(origin, destination, invitation.Trip)
+	if err != nil {
+		return Render(BackendError(err))
 	}
-	// Must(realtime.Push(origin, toOrigin))
-	Must(realtime.Push(destination, toDestination))
+	if pending {
+		return Render(ValidationError(errors.New("Приглашение уже отправлено")))
+	}
+	if _, err := db.AddInvitation(invitation); err != nil {
+		return Render(BackendError(err))
+	}
+	pushed := *invitation
+	go updater.Push(NewUpdate(destination, origin, UpdateInvites, &pushed))
 
-	Must(db.AddInvite(toOrigin))
-	Must(db.AddInvite(toDestination))
+	Must(db.AddInvite(NewInvite(origin, destination)))
 	engine.Handle(activities.Invite)
 
-	return Render("message sent")
+	return context.Render(invitation)
 }
 
 func RemoveMessage(db DataBase, id bson.ObjectId, r *http.Request, t *gotok.Token) (int, []byte) {
@@ -561,20 +652,142 @@ func RemoveMessage(db DataBase, id bson.ObjectId, r *http.Request, t *gotok.Toke
 	if err != nil {
 		return Render(BackendError(err))
 	}
-	if message.User != t.Id {
+	if message.Origin != t.Id && message.Destination != t.Id {
 		return Render(ErrorNotAllowed)
 	}
 	go func() {
-		Must(db.RemoveMessage(id))
+		Must(db.RemoveMessage(t.Id, id))
 	}()
 	return Render("message removed")
 }
 
-func MarkReadMessage(db DataBase, id bson.ObjectId, t *gotok.Token) (int, []byte) {
-	err := db.SetRead(t.Id, id)
+// pushMessageChange notifies participants about edited or unsent message,
+// skipping destination that message is hidden from
+func pushMessageChange(realtime RealtimeInterface, updateType string, m *Message) {
+	for _, user := range []bson.ObjectId{m.Origin, m.Destination} {
+		if user == m.Destination && m.RemovedFor(user) {
+			continue
+		}
+		c := m.For(user)
+		c.History = nil
+		if err := realtime.Push(NewUpdate(user, m.Origin, updateType, c)); err != nil {
+			log.Println("[messages]", "realtime error", err)
+		}
+	}
+}
+
+// EditMessage changes text of message sent by current user, if it was
+// sent not earlier than messageEditWindow ago
+func EditMessage(context Context, id bson.ObjectId, parser Parser, realtime RealtimeInterface, spam *SpamFilter, moderator *Moderator) (int, []byte) {
+	edit := new(MessageText)
+	if err := parser.Parse(edit); err != nil {
+		return Render(ValidationError(err))
+	}
+	if edit.Text == "" {
+		return Render(ValidationError(errors.New("Blank text provided")))
+	}
+	message, err := context.DB.GetMessage(id)
+	if err == mgo.ErrNotFound {
+		return Render(ErrorObjectNotFound)
+	}
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	if message.Origin != context.User.Id {
+		return Render(ErrorNotAllowed)
+	}
+	if err := message.CanChange(time.Now(), messageEditWindow); err != nil {
+		return Render(ValidationError(err))
+	}
+	// edited text is checked as new message, so edits can't bypass filters
+	shadow := false
+	if !context.IsAdmin {
+		edit.Text, err = moderateChange(moderator, context.User.Id, ModerationMessage, edit.Text)
+		if err != nil {
+			return Render(err)
+		}
+		shadow, err = spam.Check(context.DB, context.User, message.Destination, edit.Text)
+		if e, ok := err.(Error); ok {
+			return Render(e)
+		}
+		if err != nil {
+			return Render(BackendError(err))
+		}
+	}
+	previous := message.Text
+	message.Edit(edit.Text, time.Now())
+	err = context.DB.EditMessage(message, previous)
+	if err == mgo.ErrNotFound {
+		return Render(ValidationError(ErrMessageNotChangeable))
+	}
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	if shadow && !message.RemovedFor(message.Destination) {
+		if err := context.DB.RemoveMessage(message.Destination, id); err != nil {
+			return Render(BackendError(err))
+		}
+		// message disappears for destination as if it was unsent
+		c := message.For(message.Destination)
+		c.History = nil
+		c.Unsent = true
+		if err := realtime.Push(NewUpdate(message.Destination, message.Origin, UpdateMessageUnsend, c)); err != nil {
+			log.Println("[messages]", "realtime error", err)
+		}
+		if err := pushCounters(context.DB, message.Destination, realtime); err != nil {
+			log.Println("[messages]", "counters error", err)
+		}
+		message.Removed = append(message.Removed, message.Destination)
+	}
+	pushMessageChange(realtime, UpdateMessageEdit, message)
+	return context.Render(message.For(context.User.Id))
+}
+
+// UnsendMessage removes message sent by current user for both participants,
+// if it was sent not earlier than messageEditWindow ago
+func UnsendMessage(context Context, id bson.ObjectId, realtime RealtimeInterface) (int, []byte) {
+	message, err := context.DB.GetMessage(id)
+	if err == mgo.ErrNotFound {
+		return Render(ErrorObjectNotFound)
+	}
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	if message.Origin != context.User.Id {
+		return Render(ErrorNotAllowed)
+	}
+	if err := message.CanChange(time.Now(), messageEditWindow); err != nil {
+		return Render(ValidationError(err))
+	}
+	err = context.DB.UnsendMessage(id)
+	if err == mgo.ErrNotFound {
+		return Render(ValidationError(ErrMessageNotChangeable))
+	}
 	if err != nil {
 		return Render(BackendError(err))
 	}
+	message.Unsent = true
+	pushMessageChange(realtime, UpdateMessageUnsend, message)
+	if err := pushCounters(context.DB, message.Destination, realtime); err != nil {
+		log.Println("[messages]", "counters error", err)
+	}
+	return Render("message unsent")
+}
+
+func MarkReadMessage(context Context, id bson.ObjectId, realtime RealtimeInterface, limiter *EventLimiter) (int, []byte) {
+	db := context.DB
+	message, err := db.GetMessage(id)
+	if err != nil && err != mgo.ErrNotFound {
+		return Render(BackendError(err))
+	}
+	if err := db.SetRead(context.User.Id, id); err != nil {
+		return Render(BackendError(err))
+	}
+	if err == nil && !message.Read && message.Destination == context.User.Id {
+		receipt := NewReadReceipt(message.Conversation, context.User.Id, id)
+		receipt.Message = id
+		pushReadReceipt(db, realtime, limiter, context.User, message.Origin, receipt)
+	}
 	return Render("message marked as read")
 }
 
@@ -586,7 +799,7 @@ func GetUnreadCount(db DataBase, t *gotok.Token) (int, []byte) {
 	return Render(UnreadCount{n})
 }
 
-func GetMessagesFromUser(origin bson.ObjectId, context Context, pagination Pagination, realtime RealtimeInterface) (int, []byte) {
+func GetMessagesFromUser(origin bson.ObjectId, context Context, pagination Pagination, realtime RealtimeInterface, limiter *EventLimiter) (int, []byte) {
 	db := context.DB
 	messages, err := db.GetMessagesFromUser(context.User.Id, origin, pagination)
 	if err != nil && err != mgo.ErrNotFound {
@@ -595,15 +808,54 @@ func GetMessagesFromUser(origin bson.ObjectId, context Context, pagination Pagin
 	if messages == nil {
 		return Render([]interface{}{})
 	}
+	conversation, err := db.GetConversation(context.User.Id, origin)
+	if err != nil && err != mgo.ErrNotFound {
+		return Render(BackendError(err))
+	}
 	if err := db.SetReadMessagesFromUser(context.User.Id, origin); err != nil {
 		return Render(BackendError(err))
 	}
+	if err == nil {
+		if state := conversation.State(context.User.Id); state != nil && state.Unread > 0 {
+			receipt := NewReadReceipt(conversation.Id, context.User.Id, conversation.LastMessage)
+			pushReadReceipt(db, realtime, limiter, context.User, origin, receipt)
+		}
+	}
 	if err := sendCounters(db, context.Token, realtime); err != nil {
 		return Render(BackendError(err))
 	}
 	return context.Render(messages)
 }
 
+const messagesSearchCount = 20
+
+// SearchMessages searches messages of current user with user with provided
+// id, or with all users if provided id is id of current user
+func SearchMessages(context Context, id bson.ObjectId, pagination Pagination) (int, []byte) {
+	q := strings.TrimSpace(context.Request.URL.Query().Get("q"))
+	if len(QueryTerms(q)) == 0 {
+		return Render(ValidationError(ErrBlankQuery))
+	}
+	peer := id
+	if id == context.User.Id {
+		peer = ""
+	}
+	if pagination.Count == 0 {
+		pagination.Count = messagesSearchCount
+	}
+	results, count, err := context.DB.SearchMessages(context.User.Id, peer, q, pagination)
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	for _, r := range results {
+		r.Snippet = MessageSnippet(r.Message.Text, q)
+	}
+	if err := MessageSearchResults(results).Prepare(context); err != nil {
+		return Render(BackendError(err))
+	}
+	return context.Render(SearchResult{Result: results, Count: count})
+}
+
 func GetChat(db DataBase, pagination Pagination, context Context, parms martini.Params) (int, []byte) {
 	if !bson.IsObjectIdHex(parms["user"]) {
 		return Render(ErrorBadId)
@@ -635,12 +887,10 @@ func RemoveChat(db DataBase, origin bson.ObjectId, t *gotok.Token) (int, []byte)
 	return Render("ok")
 }
 
-// GetChats returns all user chats
-func GetChats(db DataBase, id bson.ObjectId, context Context) (int, []byte) {
-	dialogs, err := db.GetChats(id)
-	if err != nil {
-		return Render(BackendError(err))
-	}
+const dialogsCount = 50
+
+// prepareDialogs prepares users of dialogs, hiding their private fields
+func prepareDialogs(context Context, dialogs []*Dialog) {
 	for k := range dialogs {
 		if dialogs[k].User != nil {
 			dialogs[k].User.Prepare(context)
@@ -651,12 +901,83 @@ func GetChats(db DataBase, id bson.ObjectId, context Context) (int, []byte) {
 			dialogs[k].OriginUser.CleanPrivate()
 		}
 	}
+}
+
+// GetChats returns all user chats
+func GetChats(db DataBase, id bson.ObjectId, context Context) (int, []byte) {
+	if id != context.User.Id {
+		return Render(ErrorNotAllowed)
+	}
+	dialogs, err := db.GetChats(id)
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	prepareDialogs(context, dialogs)
 	if len(dialogs) == 0 {
 		return Render([]interface{}{})
 	}
 	return Render(dialogs)
 }
 
+// GetDialogs returns page of user dialogs matching filter, with total
+// amount of unread messages
+func GetDialogs(db DataBase, id bson.ObjectId, context Context, pagination Pagination) (int, []byte) {
+	if id != context.User.Id {
+		return Render(ErrorNotAllowed)
+	}
+	if pagination.Count == 0 {
+		pagination.Count = dialogsCount
+	}
+	filter := NewDialogFilter(context.Request.URL.Query())
+	dialogs, count, err := db.GetDialogs(id, filter, pagination)
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	unread, err := db.GetUnreadCount(id)
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	prepareDialogs(context, dialogs)
+	return Render(DialogList{Result: dialogs, Count: count, Unread: unread})
+}
+
+// setConversationState switches state of conversation with user with
+// provided id for current user
+func setConversationState(context Context, id bson.ObjectId, field string, value bool) (int, []byte) {
+	err := context.DB.SetConversationState(context.User.Id, id, field, value)
+	if err == mgo.ErrNotFound {
+		return Render(ErrorObjectNotFound)
+	}
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	return Render("ok")
+}
+
+func PinChat(context Context, id bson.ObjectId) (int, []byte) {
+	return setConversationState(context, id, ConversationPinned, true)
+}
+
+func UnpinChat(context Context, id bson.ObjectId) (int, []byte) {
+	return setConversationState(context, id, ConversationPinned, false)
+}
+
+func ArchiveChat(context Context, id bson.ObjectId) (int, []byte) {
+	return setConversationState(context, id, ConversationArchived, true)
+}
+
+func UnarchiveChat(context Context, id bson.ObjectId) (int, []byte) {
+	return setConversationState(context, id, ConversationArchived, false)
+}
+
+func MuteChat(context Context, id bson.ObjectId) (int, []byte) {
+	return setConversationState(context, id, ConversationMuted, true)
+}
+
+func UnmuteChat(context Context, id bson.ObjectId) (int, []byte) {
+	return setConversationState(context, id, ConversationMuted, false)
+}
+
 // reads data from io.Reader, uploads it with type/format and returs fid, purl and error
 func uploadToWeed(adapter StorageAdapter, reader io.Reader, t, format string) (string, string, int64, error) {
 	fid, purl, size, err := adapter.Upload(reader, t, format)
@@ -780,7 +1101,21 @@ func UploadPhotoHidden(r *http.Request, context Context) (int, []byte) {
 	return context.Render(photo)
 }
 
-func AddStatus(db DataBase, r *http.Request, t *gotok.Token, parser Parser, engine activities.Handler, context Context) (int, []byte) {
+// statusesLimitReached reports whether user added all statuses that are
+// allowed per day
+func statusesLimitReached(db DataBase, u *User) (bool, error) {
+	count, err := db.GetLastDayStatusesAmount(u.Id)
+	if err != nil {
+		return false, err
+	}
+	allowed := statusesPerDay
+	if u.Vip {
+		allowed = statusesPerDayVip
+	}
+	return count >= allowed, nil
+}
+
+func AddStatus(db DataBase, r *http.Request, t *gotok.Token, parser Parser, engine activities.Handler, context Context, moderator *Moderator) (int, []byte) {
 	status := new(Status)
 	if err := parser.Parse(status); err != nil {
 		return Render(ValidationError(err))
@@ -790,20 +1125,21 @@ func AddStatus(db DataBase, r *http.Request, t *gotok.Token, parser Parser, engi
 		return Render(ValidationError(errors.New("Отправлен пустой статус")))
 	}
 
-	count, err := db.GetLastDayStatusesAmount(t.Id)
+	reached, err := statusesLimitReached(db, context.User)
 	if err != nil {
 		return context.Render(BackendError(err))
 	}
-
-	allowed := statusesPerDay
-	u := context.User
-	if u.Vip {
-		allowed = statusesPerDayVip
-	}
-	if count >= allowed {
+	if reached {
 		return context.Render(ErrorInsufficentFunds)
 	}
-	status, err = db.AddStatus(t.Id, status.Text)
+	text, held, err := moderate(db, moderator, t.Id, ModerationStatus, "", status.Text)
+	if e, ok := err.(Error); ok {
+		return Render(e)
+	}
+	if held != nil {
+		return context.Render(held)
+	}
+	status, err = db.AddStatus(t.Id, text)
 	if err != nil {
 		go db.IncBalance(t.Id, PromoCost)
 		return context.Render(BackendError(err))
@@ -843,12 +1179,26 @@ func GetCurrentStatus(db DataBase, t *gotok.Token, id bson.ObjectId) (int, []byt
 	return Render(status)
 }
 
-func UpdateStatus(db DataBase, id bson.ObjectId, r *http.Request, t *gotok.Token, parser Parser) (int, []byte) {
+func UpdateStatus(db DataBase, id bson.ObjectId, r *http.Request, t *gotok.Token, parser Parser, context Context, moderator *Moderator) (int, []byte) {
 	status := &Status{}
 	if err := parser.Parse(status); err != nil {
 		return Render(ValidationError(err))
 	}
-	status, err := db.UpdateStatusSecure(t.Id, id, status.Text)
+	current, err := db.GetStatus(id)
+	if err == mgo.ErrNotFound || (err == nil && current.User != t.Id) {
+		return Render(ErrorObjectNotFound)
+	}
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	text, held, err := moderate(db, moderator, t.Id, ModerationStatus, id, status.Text)
+	if e, ok := err.(Error); ok {
+		return Render(e)
+	}
+	if held != nil {
+		return context.Render(held)
+	}
+	status, err = db.UpdateStatusSecure(t.Id, id, text)
 	if err != nil {
 		return Render(BackendError(err))
 	}
@@ -1080,7 +1430,7 @@ func addStripeItem(db DataBase, request *StripeItemRequest, user *User) (*Stripe
 	switch request.Type {
 	case "video":
 		video := db.GetVideo(request.Id)
-		if video == nil {
+		if video == nil || video.Message.Valid() {
 			return nil, ErrObjectNotFound
 		}
 		i.ImageJpeg = video.ThumbnailJpeg
@@ -1088,7 +1438,7 @@ func addStripeItem(db DataBase, request *StripeItemRequest, user *User) (*Stripe
 		media = video
 	case "audio":
 		audio := db.GetAudio(request.Id)
-		if audio == nil {
+		if audio == nil || audio.Message.Valid() {
 			audio = db.GetAudio(user.Audio)
 		}
 		if audio == nil {
@@ -1357,13 +1707,26 @@ func TopUp(db DataBase, parser Parser, handler *TransactionHandler, t *gotok.Tok
 	return Render(transaction)
 }
 
+// likeableVideo returns video with provided id, hiding attachments of
+// messages that can't be liked
+func likeableVideo(db DataBase, id bson.ObjectId) (*Video, error) {
+	v := db.GetVideo(id)
+	if v == nil || v.Message.Valid() {
+		return nil, ErrorObjectNotFound
+	}
+	return v, nil
+}
+
 func LikeVideo(t *gotok.Token, id bson.ObjectId, db DataBase, engine activities.Handler, u Updater) (int, []byte) {
-	err := db.AddLikeVideo(t.Id, id)
+	v, err := likeableVideo(db, id)
 	if err != nil {
+		return Render(err)
+	}
+	if err := db.AddLikeVideo(t.Id, id); err != nil {
 		return Render(BackendError(err))
 	}
 	engine.Handle(activities.Like)
-	v := db.GetVideo(id)
+	v = db.GetVideo(id)
 	if v.User != t.Id {
 		go u.Push(NewUpdate(v.User, t.Id, UpdateLikes, v))
 		go func() {
@@ -1374,6 +1737,9 @@ func LikeVideo(t *gotok.Token, id bson.ObjectId, db DataBase, engine activities.
 }
 
 func RestoreLikeVideo(t *gotok.Token, id bson.ObjectId, db DataBase) (int, []byte) {
+	if _, err := likeableVideo(db, id); err != nil {
+		return Render(err)
+	}
 	err := db.RemoveLikeVideo(t.Id, id)
 	if err != nil {
 		return Render(BackendError(err))
@@ -1382,6 +1748,9 @@ func RestoreLikeVideo(t *gotok.Token, id bson.ObjectId, db DataBase) (int, []byt
 }
 
 func GetLikersVideo(id bson.ObjectId, db DataBase, context Context) (int, []byte) {
+	if _, err := likeableVideo(db, id); err != nil {
+		return Render(err)
+	}
 	likers := db.GetLikesVideo(id)
 	// check for existance
 	if likers == nil {
@@ -1795,18 +2164,9 @@ func AdminLogin(id bson.ObjectId, t *gotok.Token, db DataBase, w http.ResponseWr
 	http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
 }
 
-func UploadVideoFile(r *http.Request, client query.QueryClient, db DataBase, adapter StorageAdapter, t *gotok.Token) (int, []byte) {
-	id := bson.NewObjectId()
-	video := &Video{Id: id, User: t.Id, Time: time.Now()}
-	f, _, err := r.FormFile(FORM_FILE)
-	if err != nil {
-		return Render(BackendError(err))
-	}
-	_, err = db.AddVideo(video)
-	if err != nil {
-		return Render(BackendError(err))
-	}
-
+// pushVideoConversion pushes jobs for thumbnail and video conversion of
+// uploaded file with provided fid
+func pushVideoConversion(client query.QueryClient, id bson.ObjectId, fid string) error {
 	optsMpeg := new(conv.VideoOptions)
 	optsMpeg.Audio.Format = "aac"
 	optsMpeg.Video.Format = "h264"
@@ -1828,17 +2188,44 @@ func UploadVideoFile(r *http.Request, client query.QueryClient, db DataBase, ada
 	optsWebm.Video.Width = VIDEO_SIZE
 	optsThmb := new(conv.ThumbnailOptions)
 	optsThmb.Format = "png"
-	fid, _, _, err := adapter.Upload(f, "video", "video")
+	if err := client.Push(id.Hex(), fid, conv.ThumbnailType, optsThmb); err != nil {
+		return err
+	}
+	if err := client.Push(id.Hex(), fid, conv.VideoType, optsWebm); err != nil {
+		return err
+	}
+	return client.Push(id.Hex(), fid, conv.VideoType, optsMpeg)
+}
+
+// pushAudioConversion pushes jobs for audio conversion of uploaded file
+// with provided fid
+func pushAudioConversion(client query.QueryClient, id bson.ObjectId, fid string) error {
+	optsAac := &conv.AudioOptions{Bitrate: AUDIO_BITRATE, Format: "mp3"}
+	optsAac.Duration = 15
+	optsVorbis := &conv.AudioOptions{Bitrate: AUDIO_BITRATE, Format: "libvorbis"}
+	optsVorbis.Duration = 15
+	if err := client.Push(id.Hex(), fid, conv.AudioType, optsAac); err != nil {
+		return err
+	}
+	return client.Push(id.Hex(), fid, conv.AudioType, optsVorbis)
+}
+
+func UploadVideoFile(r *http.Request, client query.QueryClient, db DataBase, adapter StorageAdapter, t *gotok.Token) (int, []byte) {
+	id := bson.NewObjectId()
+	video := &Video{Id: id, User: t.Id, Time: time.Now()}
+	f, _, err := r.FormFile(FORM_FILE)
 	if err != nil {
 		return Render(BackendError(err))
 	}
-	if err := client.Push(id.Hex(), fid, conv.ThumbnailType, optsThmb); err != nil {
+	_, err = db.AddVideo(video)
+	if err != nil {
 		return Render(BackendError(err))
 	}
-	if err := client.Push(id.Hex(), fid, conv.VideoType, optsWebm); err != nil {
+	fid, _, _, err := adapter.Upload(f, "video", "video")
+	if err != nil {
 		return Render(BackendError(err))
 	}
-	if err := client.Push(id.Hex(), fid, conv.VideoType, optsMpeg); err != nil {
+	if err := pushVideoConversion(client, id, fid); err != nil {
 		return Render(BackendError(err))
 	}
 	return Render(video)
@@ -1871,6 +2258,10 @@ func GetVideo(db DataBase, id bson.ObjectId, context Context) (int, []byte) {
 	if v == nil {
 		return Render(ErrorObjectNotFound)
 	}
+	// attachments of messages are accessible only for participants
+	if !bool(context.IsAdmin) && !v.AccessibleBy(context.User.Id) {
+		return Render(ErrorObjectNotFound)
+	}
 	return context.Render(v)
 }
 
@@ -1894,18 +2285,11 @@ func UploadAudio(r *http.Request, client query.QueryClient, db DataBase, adapter
 	if err != nil {
 		return Render(BackendError(err))
 	}
-	optsAac := &conv.AudioOptions{Bitrate: AUDIO_BITRATE, Format: "mp3"}
-	optsAac.Duration = 15
-	optsVorbis := &conv.AudioOptions{Bitrate: AUDIO_BITRATE, Format: "libvorbis"}
-	optsVorbis.Duration = 15
 	fid, _, _, err := adapter.Upload(f, "audio", "audio")
 	if err != nil {
 		return Render(BackendError(err))
 	}
-	if err := client.Push(id.Hex(), fid, conv.AudioType, optsAac); err != nil {
-		return Render(BackendError(err))
-	}
-	if err := client.Push(id.Hex(), fid, conv.AudioType, optsVorbis); err != nil {
+	if err := pushAudioConversion(client, id, fid); err != nil {
 		return Render(BackendError(err))
 	}
 	return Render(audio)
@@ -1943,11 +2327,16 @@ func GetUpdates(db DataBase, token *gotok.Token, pagination Pagination, context
 }
 
 func sendCounters(db DataBase, token *gotok.Token, realtime RealtimeInterface) error {
-	counters, err := db.GetUpdatesCount(token.Id)
+	return pushCounters(db, token.Id, realtime)
+}
+
+// pushCounters sends actual counters of unread updates to user
+func pushCounters(db DataBase, id bson.ObjectId, realtime RealtimeInterface) error {
+	counters, err := db.GetUpdatesCount(id)
 	if err != nil {
 		return err
 	}
-	update := NewUpdate(token.Id, token.Id, "counters", Counters(counters))
+	update := NewUpdate(id, id, "counters", Counters(counters))
 	return realtime.Push(update)
 }
 
@@ -0,0 +1,552 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ernado/poputchiki/models"
+	"github.com/garyburd/redigo/redis"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// HubDropSlow drops events for connections with full send queue
+	HubDropSlow = "drop"
+	// HubDisconnectSlow closes connections with full send queue
+	HubDisconnectSlow = "disconnect"
+
+	memoryBufferExpireRate = 1000
+)
+
+// PubSub publishes messages to channels and delivers messages of channels
+// to subscribers
+type PubSub interface {
+	Publish(channel string, data []byte) error
+	// Subscribe calls handler for every message of channel until returned
+	// subscription is closed. Failed is called if subscription is lost.
+	Subscribe(channel string, handler func(data []byte), failed func(err error)) (io.Closer, error)
+}
+
+// EventBuffer keeps recent events of channels for short time, so clients
+// can receive events that were published while they were disconnected
+type EventBuffer interface {
+	Add(channel string, data []byte) error
+	// Range returns events of channel added since provided time, oldest first
+	Range(channel string, since time.Time) ([][]byte, error)
+}
+
+// redisPubSub is a PubSub on redis PUBLISH and SUBSCRIBE commands, that
+// holds one connection per subscription
+type redisPubSub struct {
+	pool *redis.Pool
+}
+
+type redisSubscription struct {
+	conn redis.PubSubConn
+}
+
+func (p *redisPubSub) Publish(channel string, data []byte) error {
+	conn := p.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("PUBLISH", channel, data)
+	return err
+}
+
+func (p *redisPubSub) Subscribe(channel string, handler func(data []byte), failed func(err error)) (io.Closer, error) {
+	s := &redisSubscription{redis.PubSubConn{Conn: p.pool.Get()}}
+	if err := s.conn.Subscribe(channel); err != nil {
+		s.conn.Close()
+		return nil, err
+	}
+	// waiting for confirmation, so messages published after return are
+	// delivered
+	if err, ok := s.conn.Receive().(error); ok {
+		s.conn.Close()
+		return nil, err
+	}
+	go func() {
+		defer s.conn.Close()
+		for {
+			switch v := s.conn.Receive().(type) {
+			case redis.Message:
+				handler(v.Data)
+			case redis.Subscription:
+				if v.Count == 0 {
+					// unsubscribed
+					return
+				}
+			case error:
+				failed(v)
+				return
+			}
+		}
+	}()
+	return s, nil
+}
+
+// Close unsubscribes, so receiving goroutine releases connection
+func (s *redisSubscription) Close() error {
+	if err := s.conn.Unsubscribe(); err != nil {
+		return s.conn.Close()
+	}
+	return nil
+}
+
+// redisEventBuffer is an EventBuffer on capped redis streams that expire
+// if there are no new events
+type redisEventBuffer struct {
+	pool *redis.Pool
+	size int
+	ttl  time.Duration
+}
+
+func (b *redisEventBuffer) key(channel string) string {
+	return strings.Join([]string{channel, REALTIME_BUFFER_KEY}, REDIS_SEPARATOR)
+}
+
+func (b *redisEventBuffer) Add(channel string, data []byte) error {
+	conn := b.pool.Get()
+	defer conn.Close()
+	key := b.key(channel)
+	conn.Send("MULTI")
+	conn.Send("XADD", key, "MAXLEN", "~", b.size, "*", "event", data)
+	conn.Send("PEXPIRE", key, int64(b.ttl/time.Millisecond))
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+func (b *redisEventBuffer) Range(channel string, since time.Time) ([][]byte, error) {
+	conn := b.pool.Get()
+	defer conn.Close()
+	start := since.UnixNano() / int64(time.Millisecond)
+	entries, err := redis.Values(conn.Do("XRANGE", b.key(channel), start, "+"))
+	if err != nil {
+		return nil, err
+	}
+	var events [][]byte
+	for _, entry := range entries {
+		// entry is a pair of id and list of field-value pairs
+		v, err := redis.Values(entry, nil)
+		if err != nil || len(v) != 2 {
+			return nil, errors.New("bad stream entry")
+		}
+		fields, err := redis.ByteSlices(v[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		for i := 1; i < len(fields); i += 2 {
+			events = append(events, fields[i])
+		}
+	}
+	return events, nil
+}
+
+// memoryPubSub is a PubSub of current process, that delivers messages to
+// subscribers synchronously in order of publishing
+type memoryPubSub struct {
+	mu   sync.Mutex
+	subs map[string]map[*memorySubscription]bool
+}
+
+type memorySubscription struct {
+	pubsub  *memoryPubSub
+	channel string
+	handler func(data []byte)
+}
+
+func newMemoryPubSub() *memoryPubSub {
+	return &memoryPubSub{subs: make(map[string]map[*memorySubscription]bool)}
+}
+
+func (p *memoryPubSub) Publish(channel string, data []byte) error {
+	p.mu.Lock()
+	var handlers []func([]byte)
+	for s := range p.subs[channel] {
+		handlers = append(handlers, s.handler)
+	}
+	p.mu.Unlock()
+	// handlers are called without lock, so they can close subscriptions
+	for _, handler := range handlers {
+		handler(data)
+	}
+	return nil
+}
+
+func (p *memoryPubSub) Subscribe(channel string, handler func(data []byte), failed func(err error)) (io.Closer, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := &memorySubscription{p, channel, handler}
+	if p.subs[channel] == nil {
+		p.subs[channel] = make(map[*memorySubscription]bool)
+	}
+	p.subs[channel][s] = true
+	return s, nil
+}
+
+func (s *memorySubscription) Close() error {
+	s.pubsub.mu.Lock()
+	defer s.pubsub.mu.Unlock()
+	delete(s.pubsub.subs[s.channel], s)
+	if len(s.pubsub.subs[s.channel]) == 0 {
+		delete(s.pubsub.subs, s.channel)
+	}
+	return nil
+}
+
+type bufferedEvent struct {
+	time time.Time
+	data []byte
+}
+
+// memoryEventBuffer is an EventBuffer of current process that keeps up to
+// size last events of channel for ttl
+type memoryEventBuffer struct {
+	mu     sync.Mutex
+	size   int
+	ttl    time.Duration
+	added  int
+	events map[string][]bufferedEvent
+}
+
+func newMemoryEventBuffer(size int, ttl time.Duration) *memoryEventBuffer {
+	return &memoryEventBuffer{size: size, ttl: ttl, events: make(map[string][]bufferedEvent)}
+}
+
+// expire removes events that are older than ttl
+func (b *memoryEventBuffer) expire(channel string, now time.Time) []bufferedEvent {
+	events := b.events[channel]
+	for len(events) > 0 && now.Sub(events[0].time) > b.ttl {
+		events = events[1:]
+	}
+	if len(events) == 0 {
+		delete(b.events, channel)
+		return nil
+	}
+	b.events[channel] = events
+	return events
+}
+
+func (b *memoryEventBuffer) Add(channel string, data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	// channels of users without new events are also expired sometimes
+	b.added++
+	if b.added%memoryBufferExpireRate == 0 {
+		for c := range b.events {
+			b.expire(c, now)
+		}
+	}
+	events := append(b.expire(channel, now), bufferedEvent{now, data})
+	if len(events) > b.size {
+		events = events[len(events)-b.size:]
+	}
+	b.events[channel] = events
+	return nil
+}
+
+func (b *memoryEventBuffer) Range(channel string, since time.Time) ([][]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var result [][]byte
+	for _, event := range b.expire(channel, time.Now()) {
+		if !event.time.Before(since) {
+			result = append(result, event.data)
+		}
+	}
+	return result, nil
+}
+
+// HubConn is a connection of client to hub, that receives events of one
+// or more users and global events through bounded queue
+type HubConn struct {
+	users  []bson.ObjectId
+	send   chan models.Update
+	done   chan struct{}
+	closed sync.Once
+}
+
+// Updates returns queue of events for connection
+func (c *HubConn) Updates() <-chan models.Update {
+	return c.send
+}
+
+// Done is closed when connection is closed by hub or unsubscribed
+func (c *HubConn) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *HubConn) close() {
+	c.closed.Do(func() { close(c.done) })
+}
+
+// hubSubscription is a pubsub subscription shared by connections
+type hubSubscription struct {
+	sub   io.Closer
+	conns map[*HubConn]bool
+}
+
+// Hub delivers events from pubsub channels to connections, keeping single
+// subscription for channel while there are connections for it
+type Hub struct {
+	pubsub PubSub
+	buffer EventBuffer
+	prefix string
+	queue  int
+	policy string
+
+	mu     sync.Mutex
+	users  map[bson.ObjectId]*hubSubscription
+	global *hubSubscription
+
+	published    int64
+	delivered    int64
+	dropped      int64
+	disconnected int64
+}
+
+// NewHub returns hub with channels named by prefix and user id, queue of
+// provided size for each connection and policy for slow connections.
+// Events of users are also added to buffer if it is not nil.
+func NewHub(pubsub PubSub, buffer EventBuffer, prefix string, queue int, policy string) *Hub {
+	return &Hub{
+		pubsub: pubsub,
+		buffer: buffer,
+		prefix: prefix,
+		queue:  queue,
+		policy: policy,
+		users:  make(map[bson.ObjectId]*hubSubscription),
+	}
+}
+
+func (h *Hub) channel(name string) string {
+	return h.prefix + REDIS_SEPARATOR + name
+}
+
+// Publish sends update to channel of its destination
+func (h *Hub) Publish(update models.Update) error {
+	data, err := h.publish(update.Destination.Hex(), update)
+	if err != nil || h.buffer == nil {
+		return err
+	}
+	return h.buffer.Add(h.channel(update.Destination.Hex()), data)
+}
+
+// PublishGlobal sends update to all connections. Global events are not
+// buffered, because they are persisted for each user.
+func (h *Hub) PublishGlobal(update models.Update) error {
+	_, err := h.publish(REALTIME_GOLBAL, update)
+	return err
+}
+
+func (h *Hub) publish(name string, update models.Update) ([]byte, error) {
+	data, err := json.Marshal(update)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.pubsub.Publish(h.channel(name), data); err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&h.published, 1)
+	return data, nil
+}
+
+// Buffered returns events of users from buffer that were published after
+// update with provided id, oldest first
+func (h *Hub) Buffered(users []bson.ObjectId, after bson.ObjectId) ([]*models.Update, error) {
+	var updates []*models.Update
+	if h.buffer == nil || !after.Valid() {
+		return updates, nil
+	}
+	// stream ids are set by redis clock, that can differ from clock of id
+	since := after.Time().Add(-time.Second)
+	for _, user := range users {
+		events, err := h.buffer.Range(h.channel(user.Hex()), since)
+		if err != nil {
+			return nil, err
+		}
+		for _, data := range events {
+			u := new(models.Update)
+			if err := json.Unmarshal(data, u); err != nil {
+				log.Println("[realtime]", "bad event", err)
+				continue
+			}
+			if u.Id > after {
+				updates = append(updates, u)
+			}
+		}
+	}
+	return updates, nil
+}
+
+// Subscribe registers new connection for events of users, subscribing to
+// channels that have no connections yet
+func (h *Hub) Subscribe(users ...bson.ObjectId) (*HubConn, error) {
+	c := &HubConn{users: users, send: make(chan models.Update, h.queue), done: make(chan struct{})}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.global == nil {
+		s, err := h.subscribe(REALTIME_GOLBAL, "")
+		if err != nil {
+			return nil, err
+		}
+		h.global = s
+	}
+	h.global.conns[c] = true
+	for _, user := range users {
+		s, ok := h.users[user]
+		if !ok {
+			var err error
+			if s, err = h.subscribe(user.Hex(), user); err != nil {
+				// releasing subscriptions made for connection
+				h.removeLocked(c)
+				return nil, err
+			}
+			h.users[user] = s
+		}
+		s.conns[c] = true
+	}
+	return c, nil
+}
+
+// Extend adds events of users to connection, so admins can watch events
+// of other users on already opened connection
+func (h *Hub) Extend(c *HubConn, users ...bson.ObjectId) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	select {
+	case <-c.done:
+		return nil
+	default:
+	}
+	for _, user := range users {
+		s, ok := h.users[user]
+		if ok && s.conns[c] {
+			continue
+		}
+		if !ok {
+			var err error
+			if s, err = h.subscribe(user.Hex(), user); err != nil {
+				return err
+			}
+			h.users[user] = s
+		}
+		s.conns[c] = true
+		c.users = append(c.users, user)
+	}
+	return nil
+}
+
+func (h *Hub) subscribe(name string, user bson.ObjectId) (*hubSubscription, error) {
+	s := &hubSubscription{conns: make(map[*HubConn]bool)}
+	handler := func(data []byte) {
+		h.dispatch(s, data)
+	}
+	failed := func(err error) {
+		log.Println("[realtime]", "subscription", name, "lost:", err)
+		h.fail(s, user)
+	}
+	sub, err := h.pubsub.Subscribe(h.channel(name), handler, failed)
+	if err != nil {
+		return nil, err
+	}
+	s.sub = sub
+	return s, nil
+}
+
+// dispatch sends event to every connection of subscription without
+// blocking, applying policy to connections with full queue
+func (h *Hub) dispatch(s *hubSubscription, data []byte) {
+	update := models.Update{}
+	if err := json.Unmarshal(data, &update); err != nil {
+		log.Println("[realtime]", "bad event", err)
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range s.conns {
+		select {
+		case c.send <- update:
+			atomic.AddInt64(&h.delivered, 1)
+			continue
+		default:
+		}
+		atomic.AddInt64(&h.dropped, 1)
+		if h.policy == HubDisconnectSlow {
+			atomic.AddInt64(&h.disconnected, 1)
+			h.removeLocked(c)
+		}
+	}
+}
+
+// fail closes connections of lost subscription, so clients reconnect
+func (h *Hub) fail(s *hubSubscription, user bson.ObjectId) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range s.conns {
+		h.removeLocked(c)
+	}
+	// subscription is removed by removeLocked if it had connections
+	if user.Valid() && h.users[user] == s {
+		delete(h.users, user)
+	}
+	if !user.Valid() && h.global == s {
+		h.global = nil
+	}
+}
+
+// Unsubscribe closes connection, releasing subscriptions that have no
+// other connections
+func (h *Hub) Unsubscribe(c *HubConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.removeLocked(c)
+}
+
+func (h *Hub) release(s *hubSubscription, c *HubConn) bool {
+	if s == nil || !s.conns[c] {
+		return false
+	}
+	delete(s.conns, c)
+	if len(s.conns) > 0 {
+		return false
+	}
+	if err := s.sub.Close(); err != nil {
+		log.Println("[realtime]", "unsubscribe error", err)
+	}
+	return true
+}
+
+func (h *Hub) removeLocked(c *HubConn) {
+	c.close()
+	for _, user := range c.users {
+		if h.release(h.users[user], c) {
+			delete(h.users, user)
+		}
+	}
+	if h.release(h.global, c) {
+		h.global = nil
+	}
+}
+
+// Metrics returns current state and counters of hub
+func (h *Hub) Metrics() models.RealtimeMetrics {
+	h.mu.Lock()
+	m := models.RealtimeMetrics{Subscriptions: len(h.users)}
+	if h.global != nil {
+		m.Connections = len(h.global.conns)
+		m.Subscriptions++
+	}
+	h.mu.Unlock()
+	m.Published = atomic.LoadInt64(&h.published)
+	m.Delivered = atomic.LoadInt64(&h.delivered)
+	m.Dropped = atomic.LoadInt64(&h.dropped)
+	m.Disconnected = atomic.LoadInt64(&h.disconnected)
+	return m
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/ernado/poputchiki/models"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// failingPubSub is a PubSub that can not subscribe
+type failingPubSub struct {
+	PubSub
+}
+
+func (p failingPubSub) Subscribe(channel string, handler func([]byte), failed func(error)) (io.Closer, error) {
+	return nil, errors.New("subscription failed")
+}
+
+func (p *memoryPubSub) count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for _, subs := range p.subs {
+		n += len(subs)
+	}
+	return n
+}
+
+func TestHub(t *testing.T) {
+	Convey("Hub", t, func() {
+		pubsub := newMemoryPubSub()
+		hub := NewHub(pubsub, nil, "test", 2, HubDisconnectSlow)
+		user := bson.NewObjectId()
+		update := NewUpdate(user, bson.NewObjectId(), "test", nil)
+		Convey("Should deliver events of user and global events", func() {
+			c, err := hub.Subscribe(user)
+			So(err, ShouldBeNil)
+			So(hub.Publish(update), ShouldBeNil)
+			So(hub.PublishGlobal(NewUpdate("", user, UpdateNews, nil)), ShouldBeNil)
+			So((<-c.Updates()).Type, ShouldEqual, "test")
+			So((<-c.Updates()).Type, ShouldEqual, UpdateNews)
+			m := hub.Metrics()
+			So(m.Connections, ShouldEqual, 1)
+			So(m.Subscriptions, ShouldEqual, 2)
+			So(m.Published, ShouldEqual, 2)
+			So(m.Delivered, ShouldEqual, 2)
+		})
+		Convey("Should share subscription between connections", func() {
+			a, err := hub.Subscribe(user)
+			So(err, ShouldBeNil)
+			b, err := hub.Subscribe(user)
+			So(err, ShouldBeNil)
+			So(pubsub.count(), ShouldEqual, 2)
+			So(hub.Publish(update), ShouldBeNil)
+			So((<-a.Updates()).Type, ShouldEqual, "test")
+			So((<-b.Updates()).Type, ShouldEqual, "test")
+			hub.Unsubscribe(a)
+			So(pubsub.count(), ShouldEqual, 2)
+			hub.Unsubscribe(b)
+			hub.Unsubscribe(b)
+			So(pubsub.count(), ShouldEqual, 0)
+			So(hub.Metrics().Connections, ShouldEqual, 0)
+			So(hub.Metrics().Subscriptions, ShouldEqual, 0)
+		})
+		Convey("Should disconnect slow connections", func() {
+			c, err := hub.Subscribe(user)
+			So(err, ShouldBeNil)
+			for i := 0; i < 3; i++ {
+				So(hub.Publish(update), ShouldBeNil)
+			}
+			<-c.Done()
+			So(pubsub.count(), ShouldEqual, 0)
+			m := hub.Metrics()
+			So(m.Dropped, ShouldEqual, 1)
+			So(m.Disconnected, ShouldEqual, 1)
+		})
+		Convey("Should drop events for slow connections", func() {
+			hub.policy = HubDropSlow
+			c, err := hub.Subscribe(user)
+			So(err, ShouldBeNil)
+			for i := 0; i < 3; i++ {
+				So(hub.Publish(update), ShouldBeNil)
+			}
+			So(len(c.Updates()), ShouldEqual, 2)
+			select {
+			case <-c.Done():
+				t.Error("connection closed")
+			default:
+			}
+			So(hub.Metrics().Dropped, ShouldEqual, 1)
+			hub.Unsubscribe(c)
+		})
+		Convey("Should release subscriptions on error", func() {
+			hub.pubsub = failingPubSub{pubsub}
+			_, err := hub.Subscribe(user)
+			So(err, ShouldNotBeNil)
+			So(pubsub.count(), ShouldEqual, 0)
+		})
+		Convey("Should handle concurrent connections", func() {
+			users := []bson.ObjectId{bson.NewObjectId(), bson.NewObjectId(), bson.NewObjectId()}
+			var wg sync.WaitGroup
+			for i := 0; i < 50; i++ {
+				wg.Add(2)
+				go func(i int) {
+					defer wg.Done()
+					c, err := hub.Subscribe(users[i%len(users)])
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					hub.Unsubscribe(c)
+				}(i)
+				go func(i int) {
+					defer wg.Done()
+					hub.Publish(NewUpdate(users[i%len(users)], user, "test", nil))
+				}(i)
+			}
+			wg.Wait()
+			So(pubsub.count(), ShouldEqual, 0)
+			So(hub.Metrics().Connections, ShouldEqual, 0)
+			So(hub.Metrics().Published, ShouldEqual, 50)
+		})
+		Convey("Should buffer events of users", func() {
+			hub.buffer = newMemoryEventBuffer(10, time.Minute)
+			first := NewUpdate(user, user, UpdateTyping, nil)
+			So(hub.Publish(first), ShouldBeNil)
+			second := NewUpdate(user, user, UpdateTyping, nil)
+			So(hub.Publish(second), ShouldBeNil)
+			So(hub.Publish(NewUpdate(bson.NewObjectId(), user, UpdateTyping, nil)), ShouldBeNil)
+			So(hub.PublishGlobal(NewUpdate("", user, UpdateNews, nil)), ShouldBeNil)
+			updates, err := hub.Buffered([]bson.ObjectId{user}, first.Id)
+			So(err, ShouldBeNil)
+			So(len(updates), ShouldEqual, 1)
+			So(updates[0].Id, ShouldEqual, second.Id)
+			updates, err = hub.Buffered([]bson.ObjectId{user}, "")
+			So(err, ShouldBeNil)
+			So(updates, ShouldBeEmpty)
+		})
+	})
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	. "github.com/ernado/poputchiki/models"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	invitationsCount      = 20
+	invitationsExpireTick = time.Minute
+)
+
+// pushInvitation sends update about invitation state to user
+func pushInvitation(u Updater, destination, actor bson.ObjectId, invitation *Invitation) {
+	pushed := *invitation
+	if err := u.Push(NewUpdate(destination, actor, UpdateInvites, &pushed)); err != nil {
+		log.Println("[invitations]", "update error", err)
+	}
+}
+
+// joinTrip adds user to participants and to the group chat of trip
+func joinTrip(db DataBase, id, user bson.ObjectId) error {
+	if err := db.AddTripParticipant(id, user); err != nil {
+		return err
+	}
+	return joinTripGroupChat(db, id, user)
+}
+
+// acceptInvitation adds destination user to participants and to the group
+// chat of invited trip if companions limit allows, creating trip of origin
+// user for ad-hoc invitation, that is removed if user can't be added
+func acceptInvitation(db DataBase, invitation *Invitation) error {
+	if invitation.Trip.Valid() {
+		trip, err := db.GetTrip(invitation.Trip)
+		if err != nil {
+			return err
+		}
+		if trip.Full(invitation.Destination) {
+			return ErrInvitationTripFull
+		}
+		return joinTrip(db, trip.Id, invitation.Destination)
+	}
+	if len(invitation.Destinations) == 0 {
+		return nil
+	}
+	trip := &Trip{User: invitation.Origin, Destinations: invitation.Destinations,
+		Start: invitation.Start, End: invitation.End}
+	if err := trip.Normalize(time.Now()); err != nil {
+		return err
+	}
+	if _, err := db.AddTrip(trip); err != nil {
+		return err
+	}
+	err := joinTrip(db, trip.Id, invitation.Destination)
+	if err == nil {
+		err = db.SetInvitationTrip(invitation.Id, trip.Id)
+	}
+	if err != nil {
+		if removeErr := db.RemoveTripSecure(trip.User, trip.Id); removeErr != nil {
+			log.Println("[invitations]", "trip remove error", removeErr)
+		}
+		return err
+	}
+	invitation.Trip = trip.Id
+	return nil
+}
+
+func changeInvitationState(context Context, id bson.ObjectId, u Updater, state string) (int, []byte) {
+	db := context.DB
+	user := context.User.Id
+	invitation, err := db.GetInvitation(id)
+	if err == mgo.ErrNotFound {
+		return Render(ErrorObjectNotFound)
+	}
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	if invitation.Origin != user && invitation.Destination != user {
+		return Render(ErrorObjectNotFound)
+	}
+	now := time.Now()
+	if err := invitation.Transition(user, state, now); err == ErrInvitationNotAllowed {
+		return Render(ErrorNotAllowed)
+	} else if err != nil {
+		return Render(ValidationError(err))
+	}
+	err = db.SetInvitationState(id, state, now)
+	if err == mgo.ErrNotFound {
+		return Render(ValidationError(ErrInvitationNotPending))
+	}
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	if state == InvitationAccepted {
+		// invitation stays pending if user can't be added to trip
+		if err := acceptInvitation(db, invitation); err != nil {
+			if revertErr := db.RevertInvitationState(id, state, time.Now()); revertErr != nil {
+				log.Println("[invitations]", "revert error", revertErr)
+			}
+			if err == mgo.ErrNotFound {
+				return Render(ErrorObjectNotFound)
+			}
+			if err == ErrInvitationTripFull {
+				return Render(ValidationError(err))
+			}
+			return Render(BackendError(err))
+		}
+	}
+	go pushInvitation(u, invitation.Other(user), user, invitation)
+	return context.Render(invitation)
+}
+
+func AcceptInvitation(context Context, id bson.ObjectId, u Updater) (int, []byte) {
+	return changeInvitationState(context, id, u, InvitationAccepted)
+}
+
+func DeclineInvitation(context Context, id bson.ObjectId, u Updater) (int, []byte) {
+	return changeInvitationState(context, id, u, InvitationDeclined)
+}
+
+func WithdrawInvitation(context Context, id bson.ObjectId, u Updater) (int, []byte) {
+	return changeInvitationState(context, id, u, InvitationWithdrawn)
+}
+
+func GetInvitation(context Context, id bson.ObjectId) (int, []byte) {
+	invitation, err := context.DB.GetInvitation(id)
+	if err == mgo.ErrNotFound {
+		return Render(ErrorObjectNotFound)
+	}
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	user := context.User.Id
+	if invitation.Origin != user && invitation.Destination != user && !context.IsAdmin {
+		return Render(ErrorObjectNotFound)
+	}
+	return context.Render(invitation)
+}
+
+// GetInvitations returns invitations of current user filtered by state and type
+func GetInvitations(context Context, pagination Pagination, r *http.Request) (int, []byte) {
+	query, err := NewInvitationQuery(r.URL.Query())
+	if err != nil {
+		return Render(ValidationError(err))
+	}
+	if err := query.Validate(); err != nil {
+		return Render(ValidationError(err))
+	}
+	if pagination.Count == 0 {
+		pagination.Count = invitationsCount
+	}
+	invitations, count, err := context.DB.GetInvitations(context.User.Id, query, pagination)
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	if err := Invitations(invitations).Prepare(context); err != nil {
+		return Render(BackendError(err))
+	}
+	return context.Render(SearchResult{Result: invitations, Count: count})
+}
+
+// InvitationsCycle expires pending invitations and notifies both sides
+func (a *Application) InvitationsCycle() {
+	a.newCycle("invitations", invitationsExpireTick, func(_ chan bool) {
+		now := time.Now()
+		invitations, err := a.db.GetExpiredInvitations(now)
+		if err != nil {
+			log.Println("[invitations]", "error", err)
+			return
+		}
+		for _, invitation := range invitations {
+			if err := invitation.Transition("", InvitationExpired, now); err != nil {
+				log.Println("[invitations]", "error", err)
+				continue
+			}
+			if err := a.db.SetInvitationState(invitation.Id, InvitationExpired, now); err != nil {
+				log.Println("[invitations]", "error", err)
+				continue
+			}
+			pushInvitation(a.updater, invitation.Origin, invitation.Destination, invitation)
+			pushInvitation(a.updater, invitation.Destination, invitation.Origin, invitation)
+		}
+	})
+}
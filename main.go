@@ -77,6 +77,20 @@ var (
 	OfflineTimeout                 = 20 * time.Minute
 	OfflineUpdateTick              = 5 * time.Second
 	DublicateUpdatesTimeout        = 5 * time.Minute
+	messageEditWindow              = 15 * time.Minute
+	moderationPolicy               = ""
+	broadcastRate                  = 50
+	realtimeBackendName            = RealtimeBackendRedis
+	realtimePolicy                 = HubDisconnectSlow
+	realtimeOrigins                = ""
+	realtimeBufferSize             = 100
+	realtimeBufferTTL              = 5 * time.Minute
+	apnsKey                        = ""
+	apnsKeyId                      = ""
+	apnsTeamId                     = ""
+	apnsTopic                      = ""
+	apnsProduction                 = false
+	fcmCredentialsFile             = ""
 	PromoCost                 uint = 50
 	mobile                         = flag.Bool("mobile", false, "is mobile api")
 	development                    = flag.Bool("dev", false, "is in development")
@@ -104,7 +118,11 @@ type Application struct {
 	db           models.DataBase
 	adapter      *weed.Adapter
 	updater      models.Updater
+	realtime     models.RealtimeInterface
 	emailUpdater *EmailUpdater
+	digest       *DigestUpdater
+	presence     *Presence
+	broadcaster  *Broadcaster
 	done         chan bool
 }
 
@@ -134,6 +152,7 @@ func NewTestApp() *Application {
 	*development = true
 	redisName = "poputchiki-test"
 	dbName = "poputchiki-test"
+	realtimeBackendName = RealtimeBackendMemory
 	return NewApp()
 }
 
@@ -177,7 +196,11 @@ func NewApp() *Application {
 	db = NewDatabase(session)
 	p := newPool()
 	tokenStorage = gotok.New(session.DB(dbName).C(tokenCollection))
-	realtime = &RealtimeRedis{p, make(map[bson.ObjectId]ReltChannel)}
+	realtimeBackend, err := NewRealtime(realtimeBackendName, p, realtimePolicy, realtimeBufferSize, realtimeBufferTTL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	realtime = realtimeBackend
 	m := martini.Classic()
 
 	if production {
@@ -228,9 +251,27 @@ func NewApp() *Application {
 	// m.Map(weedAdapter)
 	m.Map(adapter)
 	m.Map(realtime)
+	m.Map(&EventLimiter{p})
+	m.Map(&SpamFilter{p})
+	moderator, err := NewModeratorFromFile(moderationPolicy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	m.Map(moderator)
 	m.Use(AutoUpdaterWrapper)
 	emailUpdater := &EmailUpdater{db, mailgunClient, templates, weedAdapter}
-	updater := &RealtimeUpdater{db, realtime, emailUpdater, &PushNotificationsUpdater{db, weedAdapter}}
+	iosSender, androidSender, err := newPushSenders()
+	if err != nil {
+		log.Fatal(err)
+	}
+	pushUpdater := NewPushNotificationsUpdater(db, weedAdapter, iosSender, androidSender)
+	digestUpdater := &DigestUpdater{db, emailUpdater, emailUpdater}
+	updater := &RealtimeUpdater{db, realtime, digestUpdater, pushUpdater}
+	presence := NewPresence(p, db, realtime, pushUpdater)
+	realtimeBackend.presence = presence
+	m.Map(presence)
+	broadcaster := &Broadcaster{db, realtime, pushUpdater, digestUpdater, broadcastRate}
+	m.Map(broadcaster)
 	m.MapTo(updater, (*models.Updater)(nil))
 	m.Map(db)
 	m.Use(activityEngine.Wrapper)
@@ -259,6 +300,8 @@ func NewApp() *Application {
 	})
 	m.Get(root, Index)
 	m.Get(root+"/system", GetSystemStatus)
+	// realtime authenticates connections itself, allowing token in first frame
+	m.Get(root+"/realtime", realtime.RealtimeHandler)
 	m.Group(root, func(r martini.Router) {
 		r.Get("/cities", GetCities)
 		r.Get("/places", GetPlaces)
@@ -274,12 +317,26 @@ func NewApp() *Application {
 			r.Get("/login", NeedAdmin, AdminLogin)
 			r.Put("/messages", NeedAuth, SendMessage)
 			r.Get("/messages", GetMessagesFromUser)
+			r.Get("/messages/search", NeedAuth, SearchMessages)
 			r.Delete("/messages", NeedAuth, RemoveChat)
+			r.Post("/typing", NeedAuth, SendTyping)
+			r.Post("/messages/audio", NeedAuth, SendAudioMessage)
+			r.Post("/messages/video", NeedAuth, SendVideoMessage)
+			r.Post("/messages/pin", NeedAuth, PinChat)
+			r.Delete("/messages/pin", NeedAuth, UnpinChat)
+			r.Post("/messages/archive", NeedAuth, ArchiveChat)
+			r.Delete("/messages/archive", NeedAuth, UnarchiveChat)
+			r.Post("/messages/mute", NeedAuth, MuteChat)
+			r.Delete("/messages/mute", NeedAuth, UnmuteChat)
 			r.Post("/invite", NeedAuth, SendInvite)
-			r.Get("/chats", GetChats)
+			r.Get("/chats", NeedAuth, GetChats)
+			r.Get("/dialogs", NeedAuth, GetDialogs)
 			r.Get("/photo", GetUserPhoto)
 			r.Get("/video", GetUserVideo)
 			r.Get("/media", GetUserMedia)
+			r.Get("/trips", GetUserTrips)
+			r.Get("/trips.ics", GetUserTripsCalendar)
+			r.Get("/reviews", GetUserReviews)
 			r.Group("", func(d martini.Router) {
 				d.Patch("", UpdateUser)
 				d.Put("", UpdateUser)
@@ -303,6 +360,9 @@ func NewApp() *Application {
 				d.Get("/unread", GetUnreadCount)
 				d.Get("/followers", GetFollowers)
 
+				d.Get("/calendar", GetCalendarLink)
+				d.Post("/calendar", ResetCalendarLink)
+
 			}, NeedAuth, IdEqualityRequired)
 
 		}, IdWrapper)
@@ -317,6 +377,15 @@ func NewApp() *Application {
 		r.Get("/admin/photo", NeedAdmin, PhotoView)
 		r.Get("/admin/messages", NeedAdmin, AdminMessages)
 		r.Get("/admin/presents", NeedAdmin, AdminPresents)
+		r.Get("/admin/spam", NeedAdmin, GetSpamReports)
+		r.Delete("/admin/spam/:id", NeedAdmin, IdWrapper, RemoveSpamFlag)
+		r.Get("/admin/moderation", NeedAdmin, GetModerationQueue)
+		r.Post("/admin/moderation/:id/approve", NeedAdmin, IdWrapper, ApproveModerationItem)
+		r.Post("/admin/moderation/:id/reject", NeedAdmin, IdWrapper, RejectModerationItem)
+		r.Post("/admin/broadcast", NeedAdmin, CreateBroadcast)
+		r.Get("/admin/broadcast", NeedAdmin, GetBroadcasts)
+		r.Get("/admin/broadcast/:id", NeedAdmin, IdWrapper, GetBroadcast)
+		r.Get("/admin/realtime", NeedAdmin, GetRealtimeMetrics)
 		r.Get("/confirm/phone/start", ConfirmPhoneStart)
 		r.Get("/confirm/phone/:token", ConfirmPhone)
 		r.Post("/feedback", Feedback)
@@ -334,6 +403,10 @@ func NewApp() *Application {
 		r.Post("/vip/:duration", EnableVip)
 
 		r.Get("/user", GetCurrentUser)
+		r.Get("/notifications", GetNotifications)
+		r.Post("/notifications", UpdateNotifications)
+		r.Patch("/notifications", UpdateNotifications)
+		r.Post("/notifications/digest/:period", SetDigestPeriod)
 
 		r.Get("/chat/:user/:chat", NeedAdmin, GetChat)
 		r.Get("/users/:email", NeedAdmin, GetUsersByEmail)
@@ -364,7 +437,51 @@ func NewApp() *Application {
 			r.Delete("/like", RestoreLikeStatus)
 		}, IdWrapper)
 
+		r.Put("/trip", AddTrip)
+		r.Post("/trip", AddTrip)
+		r.Get("/trip/search", SearchTrips)
+		r.Group("/trip/:id", func(r martini.Router) {
+			r.Get("", GetTrip)
+			r.Put("", UpdateTrip)
+			r.Post("", UpdateTrip)
+			r.Delete("", RemoveTrip)
+			r.Get("/trip.ics", GetTripCalendar)
+		}, IdWrapper)
+
+		r.Get("/invite", GetInvitations)
+		r.Group("/invite/:id", func(r martini.Router) {
+			r.Get("", GetInvitation)
+			r.Post("/accept", AcceptInvitation)
+			r.Post("/decline", DeclineInvitation)
+			r.Post("/withdraw", WithdrawInvitation)
+		}, IdWrapper)
+
+		r.Put("/review", AddReview)
+		r.Post("/review", AddReview)
+		r.Get("/review", GetReviews)
+		r.Get("/review/disputed", NeedAdmin, GetDisputedReviews)
+		r.Group("/review/:id", func(r martini.Router) {
+			r.Get("", GetReview)
+			r.Delete("", NeedAdmin, RemoveReview)
+			r.Post("/dispute", DisputeReview)
+			r.Post("/resolve", NeedAdmin, ResolveReviewDispute)
+		}, IdWrapper)
+
+		r.Get("/group", GetGroupChats)
+		r.Group("/group/:id", func(r martini.Router) {
+			r.Get("", GetGroupChat)
+			r.Post("/join", JoinGroupChat)
+			r.Post("/leave", LeaveGroupChat)
+			r.Post("/mute", MuteGroupChat)
+			r.Delete("/mute", UnmuteGroupChat)
+			r.Get("/messages", GetGroupMessages)
+			r.Put("/messages", SendGroupMessage)
+			r.Post("/messages", SendGroupMessage)
+		}, IdWrapper)
+
 		r.Delete("/message/:id", IdWrapper, RemoveMessage)
+		r.Patch("/message/:id", IdWrapper, EditMessage)
+		r.Post("/message/:id/unsend", IdWrapper, UnsendMessage)
 		r.Post("/message/:id/read", IdWrapper, MarkReadMessage)
 		r.Post("/video", UploadVideoFile)
 		r.Post("/audio", UploadAudio)
@@ -377,7 +494,8 @@ func NewApp() *Application {
 		r.Get("/photo/:id", IdWrapper, GetPhoto)
 		r.Post("/photo", UploadPhoto)
 		r.Post("/photo-hidden", UploadPhotoHidden)
-		r.Get("/realtime", realtime.RealtimeHandler)
+		r.Get("/realtime/sse", realtime.EventStreamHandler)
+		r.Get("/realtime/poll", realtime.PollHandler)
 		r.Get("/search", SearchPeople)
 		r.Get("/photo", SearchPhoto)
 		r.Get("/photo-all", AllPhoto)
@@ -387,7 +505,7 @@ func NewApp() *Application {
 		r.Delete("/photo/:id", IdWrapper, RemovePhoto)
 	}, NeedAuth, SetOnlineWrapper)
 
-	a := &Application{session, p, m, db, weedAdapter, updater, emailUpdater, make(chan bool)}
+	a := &Application{session, p, m, db, weedAdapter, updater, realtime, emailUpdater, digestUpdater, presence, broadcaster, make(chan bool)}
 	a.InitDatabase()
 	return a
 }
@@ -424,13 +542,13 @@ func (a *Application) newCycle(name string, d time.Duration, callback func(chan
 
 func (a *Application) StatusCycle() {
 	callback := func(_ chan bool) {
-		i, err := a.db.UpdateAllStatuses()
+		n, err := a.presence.Sweep()
 		if err != nil {
 			log.Println("[status]", "status update error", err)
 			time.Sleep(time.Second * 5)
 		} else {
-			if i.Updated != 0 {
-				log.Println("[status]", "statuses updated: ", i.Updated)
+			if n != 0 {
+				log.Println("[status]", "statuses updated: ", n)
 			}
 		}
 	}
@@ -518,6 +636,15 @@ func (a *Application) processConvertResult(resp mmodels.Responce) (err error) {
 			err = db.UpdateAudioAAC(id, fid)
 			audio.AudioAac = fid
 		}
+		if audio.Message.Valid() {
+			if !resp.Success || (len(audio.AudioAac) > 0 && len(audio.AudioOgg) > 0) {
+				a.processMessageAttachment(audio.Message, resp.Success)
+			}
+			if !resp.Success {
+				db.RemoveAudio(id)
+			}
+			return err
+		}
 		if !resp.Success || (len(audio.AudioAac) > 0 && len(audio.AudioOgg) > 0) {
 			log.Printf("Sending audio %+v", audio)
 			u := models.NewUpdate(audio.User, audio.User, "audio", audio)
@@ -542,6 +669,15 @@ func (a *Application) processConvertResult(resp mmodels.Responce) (err error) {
 			err = db.UpdateVideoMpeg(id, fid)
 			video.VideoMpeg = fid
 		}
+		if video.Message.Valid() {
+			if !resp.Success || (len(video.VideoWebm) > 0 && len(video.VideoMpeg) > 0) {
+				a.processMessageAttachment(video.Message, resp.Success)
+			}
+			if !resp.Success {
+				db.RemoveVideo(video.User, id)
+			}
+			return err
+		}
 		if !resp.Success || (len(video.VideoWebm) > 0 && len(video.VideoMpeg) > 0) {
 			log.Printf("Sending video %+v", video)
 			u := models.NewUpdate(video.User, video.User, "video", video)
@@ -607,6 +743,10 @@ func (a *Application) Run() {
 	go a.ConvertResultListener()
 	go a.RatingDegradatingCycle()
 	go a.NormalizeRatingCycle()
+	go a.InvitationsCycle()
+	go a.ReviewsCycle()
+	go a.DigestCycle()
+	go a.ResumeBroadcasts()
 	// go a.PromoCycle()
 	a.m.Run()
 }
@@ -737,6 +877,20 @@ func main() {
 	flag.StringVar(&etcdHost, "etcd", etcdHost, "etcd host")
 	flag.StringVar(&selectelKey, "selectel.key", selectelKey, "Selectel key")
 	flag.StringVar(&selectelUser, "selectel.user", selectelUser, "Selectel user")
+	flag.DurationVar(&messageEditWindow, "message.window", messageEditWindow, "window for editing and unsending messages")
+	flag.StringVar(&moderationPolicy, "moderation.policy", moderationPolicy, "json file with moderation policy")
+	flag.StringVar(&realtimeBackendName, "realtime.backend", realtimeBackendName, "realtime backend: redis or memory")
+	flag.StringVar(&realtimeOrigins, "realtime.origins", realtimeOrigins, "comma-separated origins allowed to open websockets, same host if blank")
+	flag.StringVar(&realtimePolicy, "realtime.slow", realtimePolicy, "policy for slow realtime clients: drop or disconnect")
+	flag.IntVar(&realtimeBufferSize, "realtime.buffer", realtimeBufferSize, "recent realtime events of user that are replayed on reconnect")
+	flag.DurationVar(&realtimeBufferTTL, "realtime.buffer.ttl", realtimeBufferTTL, "time of keeping recent realtime events")
+	flag.StringVar(&apnsKey, "apns.key", apnsKey, ".p8 key file of apple push notifications, disabled if blank")
+	flag.StringVar(&apnsKeyId, "apns.key.id", apnsKeyId, "id of apple push notifications key")
+	flag.StringVar(&apnsTeamId, "apns.team", apnsTeamId, "apple developer team id")
+	flag.StringVar(&apnsTopic, "apns.topic", apnsTopic, "bundle id of ios application")
+	flag.BoolVar(&apnsProduction, "apns.production", apnsProduction, "use production apple push notifications")
+	flag.StringVar(&fcmCredentialsFile, "fcm.credentials", fcmCredentialsFile, "json key of firebase service account, disabled if blank")
+	flag.IntVar(&broadcastRate, "broadcast.rate", broadcastRate, "users per second that receive broadcasts")
 	// flag.Parse()
 	conf, err := globalconf.New("poputchiki")
 	if err != nil {
@@ -190,6 +190,20 @@ func TestTemplates(t *testing.T) {
 		So(s, ShouldContainSubstring, name)
 		So(s, ShouldContainSubstring, goUrl)
 	})
+	Convey("Invitation template", t, func() {
+		user := &User{Name: "Username"}
+		invitation := &Invitation{State: InvitationAccepted}
+		update := NewUpdate(bson.NewObjectId(), bson.NewObjectId(), UpdateInvites, invitation)
+		update.UserObject = user
+		src, err := a.emailUpdater.GetTemplate(update)
+		So(err, ShouldBeNil)
+		t, err := template.New("template").Parse(src)
+		So(err, ShouldBeNil)
+		buff := new(bytes.Buffer)
+		So(t.Execute(buff, update), ShouldBeNil)
+		So(buff.String(), ShouldContainSubstring, "принял ваше приглашение")
+		So(update.Theme(), ShouldContainSubstring, "принял ваше приглашение")
+	})
 }
 
 func TestUpdates(t *testing.T) {
@@ -280,6 +294,16 @@ func TestUpdates(t *testing.T) {
 			})
 		})
 
+		Convey("Typing", func() {
+			link := fmt.Sprintf("/api/user/%s/typing", token1.Id.Hex())
+			So(a.Process(token2, "POST", link, nil, nil), ShouldBeNil)
+			So(a.Process(token2, "POST", link, nil, nil), ShouldNotBeNil)
+			So(a.Process(token3, "POST", link, nil, nil), ShouldBeNil)
+			updates, err := a.db.GetUpdates(token1.Id, UpdateTyping, Pagination{})
+			So(err, ShouldBeNil)
+			So(len(updates), ShouldEqual, 0)
+		})
+
 		Convey("Invites", func() {
 			link := fmt.Sprintf("/api/user/%s/invite", token1.Id.Hex())
 			So(a.Process(token2, "POST", link, nil, nil), ShouldBeNil)
@@ -307,6 +331,77 @@ func TestUpdates(t *testing.T) {
 					log.Println(update)
 				}
 			})
+			Convey("Accept", func() {
+				result := new(SearchResult)
+				invitations := Invitations{}
+				result.Result = &invitations
+				link := fmt.Sprintf("/api/invite?state=%s&type=%s", InvitationPending, InvitationsIncoming)
+				So(a.Process(token1, "GET", link, nil, result), ShouldBeNil)
+				So(result.Count, ShouldEqual, 2)
+				invitation := invitations[0]
+				link = fmt.Sprintf("/api/invite/%s/accept", invitation.Id.Hex())
+				So(a.Process(token1, "POST", link, nil, invitation), ShouldBeNil)
+				So(invitation.State, ShouldEqual, InvitationAccepted)
+				So(a.Process(token1, "POST", link, nil, nil), ShouldNotBeNil)
+				time.Sleep(time.Millisecond * 100)
+				updates, err := a.db.GetUpdates(invitation.Origin, "invites", Pagination{})
+				So(err, ShouldBeNil)
+				So(len(updates), ShouldEqual, 1)
+			})
+		})
+	})
+}
+
+func TestCalendar(t *testing.T) {
+	a := NewTestApp()
+	defer a.Close()
+	Convey("Trips calendar", t, func() {
+		Reset(a.Reset)
+		token := new(gotok.Token)
+		So(a.Process(nil, "POST", "/api/auth/register/", LoginCredentials{"lalka", "kopalka"}, token), ShouldBeNil)
+		link := new(CalendarLink)
+		So(a.Process(token, "GET", fmt.Sprintf("/api/user/%s/calendar", token.Id.Hex()), nil, link), ShouldBeNil)
+		So(link.Token, ShouldNotBeBlank)
+		So(a.Process(nil, "GET", link.Url, nil, nil), ShouldBeNil)
+		So(a.Process(nil, "GET", fmt.Sprintf("/api/user/%s/trips.ics?key=bad", token.Id.Hex()), nil, nil), ShouldNotBeNil)
+		Convey("Reset", func() {
+			newLink := new(CalendarLink)
+			So(a.Process(token, "POST", fmt.Sprintf("/api/user/%s/calendar", token.Id.Hex()), nil, newLink), ShouldBeNil)
+			So(newLink.Token, ShouldNotEqual, link.Token)
+			So(a.Process(nil, "GET", link.Url, nil, nil), ShouldNotBeNil)
+		})
+	})
+}
+
+func TestNotificationsSettings(t *testing.T) {
+	a := NewTestApp()
+	defer a.Close()
+	Convey("Notification settings", t, func() {
+		Reset(a.Reset)
+		token := new(gotok.Token)
+		So(a.Process(nil, "POST", "/api/auth/register/", LoginCredentials{"lalka", "kopalka"}, token), ShouldBeNil)
+		matrix := make(Notifications)
+		So(a.Process(token, "GET", "/api/notifications", nil, &matrix), ShouldBeNil)
+		So(len(matrix), ShouldEqual, len(DefaultNotifications))
+		So(matrix[SubscriptionMessages].Push, ShouldBeTrue)
+		Convey("Should be changed for event type", func() {
+			changes := Notifications{SubscriptionMessages: {InApp: true, Email: true}}
+			So(a.Process(token, "PATCH", "/api/notifications", changes, &matrix), ShouldBeNil)
+			So(matrix[SubscriptionMessages], ShouldResemble, changes[SubscriptionMessages])
+			So(matrix[SubscriptionInvites].Push, ShouldBeTrue)
+			u := a.db.Get(token.Id)
+			So(u.NotifiesUpdate(NewUpdate(u.Id, u.Id, UpdateMessages, new(Message)), NotifyPush), ShouldBeFalse)
+		})
+		Convey("Unknown event types should be rejected", func() {
+			So(a.Process(token, "PATCH", "/api/notifications", Notifications{"bad": {}}, nil), ShouldNotBeNil)
+		})
+		Convey("Form requests should be rejected", func() {
+			res := httptest.NewRecorder()
+			req, _ := http.NewRequest("PATCH", "/api/notifications?token="+token.Token, nil)
+			req.PostForm = url.Values{SubscriptionMessages: {"true"}}
+			req.Header.Add(ContentTypeHeader, "x-www-form-urlencoded")
+			a.ServeHTTP(res, req)
+			So(res.Code, ShouldEqual, http.StatusBadRequest)
 		})
 	})
 }
@@ -356,13 +451,17 @@ func TestUpload(t *testing.T) {
 func TestRealtime(t *testing.T) {
 	redisName = "poputchiki_test_realtime"
 	pool := newPool()
-	realtime := &RealtimeRedis{pool, make(map[bson.ObjectId]ReltChannel)}
+	realtime := NewRealtimeRedis(pool, HubDisconnectSlow, realtimeBufferSize, realtimeBufferTTL)
 	id := bson.NewObjectId()
 	event := "test"
-	c := realtime.GetWSChannel(id)
+	c, err := realtime.hub.Subscribe(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer realtime.hub.Unsubscribe(c)
 	e := NewUpdate(id, bson.NewObjectId(), "string", &event)
-	err := realtime.Push(e)
-	eventRec := <-c.channel
+	err = realtime.Push(e)
+	eventRec := <-c.Updates()
 	Convey("Push ok", t, func() {
 		So(err, ShouldEqual, nil)
 		Convey("And event should be delivered", func() {
@@ -371,6 +470,128 @@ func TestRealtime(t *testing.T) {
 	})
 }
 
+func TestEventBuffer(t *testing.T) {
+	redisName = "poputchiki_test_realtime"
+	buffer := &redisEventBuffer{newPool(), 2, time.Minute}
+	Convey("Buffer should keep recent events", t, func() {
+		channel := bson.NewObjectId().Hex()
+		start := time.Now()
+		for _, event := range []string{"a", "b", "c"} {
+			So(buffer.Add(channel, []byte(event)), ShouldBeNil)
+		}
+		events, err := buffer.Range(channel, start.Add(-time.Second))
+		So(err, ShouldBeNil)
+		So(len(events), ShouldBeBetweenOrEqual, 2, 3)
+		So(string(events[len(events)-1]), ShouldEqual, "c")
+		Convey("And skip events before time", func() {
+			events, err := buffer.Range(channel, time.Now().Add(time.Minute))
+			So(err, ShouldBeNil)
+			So(events, ShouldBeEmpty)
+		})
+	})
+}
+
+func TestPresence(t *testing.T) {
+	a := NewTestApp()
+	defer a.Close()
+	db := a.db
+	presence := NewPresence(a.p, db, new(recordingUpdater), nil)
+	Convey("Presence", t, func() {
+		Reset(db.Drop)
+		u := &User{Id: bson.NewObjectId(), Name: "Петя"}
+		So(db.Add(u), ShouldBeNil)
+		follower := &User{Id: bson.NewObjectId(), Name: "Вася", Favorites: []bson.ObjectId{u.Id}, Subscriptions: []string{SubscriptionOnline}}
+		So(db.Add(follower), ShouldBeNil)
+		other := &User{Id: bson.NewObjectId(), Name: "Маша", Favorites: []bson.ObjectId{u.Id}}
+		So(db.Add(other), ShouldBeNil)
+		realtime := new(recordingUpdater)
+		presence.realtime = realtime
+		Convey("User should be online while any device is alive", func() {
+			So(presence.Touch(u.Id, "first", time.Minute), ShouldBeNil)
+			So(presence.Touch(u.Id, "second", time.Minute), ShouldBeNil)
+			So(db.Get(u.Id).Online, ShouldBeTrue)
+			Convey("And subscribed followers should be notified once", func() {
+				So(len(realtime.updates), ShouldEqual, 1)
+				So(realtime.updates[0].Destination, ShouldEqual, follower.Id)
+				So(realtime.updates[0].Type, ShouldEqual, UpdateOnline)
+			})
+			So(presence.Remove(u.Id, "first"), ShouldBeNil)
+			So(db.Get(u.Id).Online, ShouldBeTrue)
+			So(presence.Remove(u.Id, "second"), ShouldBeNil)
+			So(db.Get(u.Id).Online, ShouldBeFalse)
+		})
+		Convey("Expired users should be swept", func() {
+			So(presence.Touch(u.Id, "device", time.Millisecond*10), ShouldBeNil)
+			time.Sleep(time.Millisecond * 50)
+			n, err := presence.Sweep()
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 1)
+			user := db.Get(u.Id)
+			So(user.Online, ShouldBeFalse)
+			So(time.Since(user.LastAction), ShouldBeLessThan, time.Second)
+		})
+	})
+}
+
+func TestEventLimiter(t *testing.T) {
+	redisName = "poputchiki_test_realtime"
+	limiter := &EventLimiter{newPool()}
+	Convey("Limiter should allow events up to limit", t, func() {
+		key := bson.NewObjectId().Hex()
+		for i := 0; i < 2; i++ {
+			allowed, err := limiter.Allow(key, 2, time.Second)
+			So(err, ShouldBeNil)
+			So(allowed, ShouldBeTrue)
+		}
+		allowed, err := limiter.Allow(key, 2, time.Second)
+		So(err, ShouldBeNil)
+		So(allowed, ShouldBeFalse)
+		Convey("And reset counter after period", func() {
+			time.Sleep(time.Second + time.Millisecond*100)
+			allowed, err := limiter.Allow(key, 2, time.Second)
+			So(err, ShouldBeNil)
+			So(allowed, ShouldBeTrue)
+		})
+	})
+}
+
+func TestSpamFilter(t *testing.T) {
+	redisName = "poputchiki_test_realtime"
+	filter := &SpamFilter{newPool()}
+	Convey("Spam filter", t, func() {
+		user := bson.NewObjectId()
+		Convey("Should count distinct contacts per day", func() {
+			now := time.Now()
+			destination := bson.NewObjectId()
+			n, err := filter.countContact(user, destination, now)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 1)
+			n, err = filter.countContact(user, destination, now)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 1)
+			n, err = filter.countContact(user, bson.NewObjectId(), now)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 2)
+			n, err = filter.countContact(user, destination, now.Add(time.Hour*24))
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 1)
+		})
+		Convey("Should count recipients of near-identical texts", func() {
+			hash, ok := Simhash("Привет, поехали со мной на море этим летом")
+			So(ok, ShouldBeTrue)
+			for i := 0; i < 3; i++ {
+				n, err := filter.similarRecipients(user, bson.NewObjectId(), hash)
+				So(err, ShouldBeNil)
+				So(n, ShouldEqual, i)
+			}
+			other, _ := Simhash("Добрый день, видел вашу анкету и тоже хочу в Грузию")
+			n, err := filter.similarRecipients(user, bson.NewObjectId(), other)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 0)
+		})
+	})
+}
+
 func TestGeoSearch(t *testing.T) {
 	a := NewTestApp()
 	Convey("Register", t, func() {
@@ -1159,3 +1380,248 @@ func TestMethods(t *testing.T) {
 		})
 	})
 }
+
+type recordingUpdater struct {
+	updates []Update
+}
+
+func (r *recordingUpdater) Push(update Update) error {
+	r.updates = append(r.updates, update)
+	return nil
+}
+
+func TestAttachmentMessage(t *testing.T) {
+	a := NewTestApp()
+	defer a.Close()
+	Convey("Attachment message", t, func() {
+		Reset(a.Reset)
+		origin := &User{Id: bson.NewObjectId(), Email: "origin@" + mailDomain}
+		destination := &User{Id: bson.NewObjectId(), Email: "destination@" + mailDomain}
+		So(a.db.Add(origin), ShouldBeNil)
+		So(a.db.Add(destination), ShouldBeNil)
+		context := Context{DB: a.db, User: origin}
+		token := &gotok.Token{Id: origin.Id}
+		updater := new(recordingUpdater)
+		m, toOrigin, toDestination := NewMessagePair(a.db, origin.Id, destination.Id, "", "")
+		m.Audio = bson.NewObjectId()
+		Convey("Should be marked as failed if conversion is not started", func() {
+			code, _ := sendAttachmentMessage(context, &autoUpdater{updater, token}, updater, a.realtime, m, toOrigin, toDestination, func() error {
+				return io.ErrUnexpectedEOF
+			})
+			So(code, ShouldEqual, http.StatusInternalServerError)
+			saved, err := a.db.GetMessage(m.Id)
+			So(err, ShouldBeNil)
+			So(saved.Processing, ShouldBeFalse)
+			So(saved.Failed, ShouldBeTrue)
+			So(saved.Audio, ShouldEqual, "")
+			So(len(updater.updates), ShouldEqual, 0)
+		})
+	})
+}
+
+func TestBroadcaster(t *testing.T) {
+	a := NewTestApp()
+	defer a.Close()
+	Convey("Broadcaster", t, func() {
+		Reset(a.Reset)
+		admin := bson.NewObjectId()
+		var women, users []bson.ObjectId
+		for i := 0; i < 4; i++ {
+			u := &User{Id: bson.NewObjectId(), Sex: SexMale, Email: fmt.Sprintf("user%d@%s", i, mailDomain)}
+			users = append(users, u.Id)
+			u.Subscriptions = []string{SubscriptionNews}
+			if i%2 == 0 {
+				u.Sex = SexFemale
+				women = append(women, u.Id)
+			}
+			So(a.db.Add(u), ShouldBeNil)
+		}
+		push, email := new(recordingUpdater), new(recordingUpdater)
+		broadcaster := &Broadcaster{a.db, a.realtime, push, email, 0}
+		b := &Broadcast{Id: bson.NewObjectId(), Author: admin, Title: "Новости", Text: "Текст", State: BroadcastQueued}
+		Convey("Segment", func() {
+			b.Segment = "sex=female"
+			So(a.db.AddBroadcast(b), ShouldBeNil)
+			broadcaster.Run(b)
+			saved, err := a.db.GetBroadcast(b.Id)
+			So(err, ShouldBeNil)
+			So(saved.State, ShouldEqual, BroadcastFinished)
+			So(saved.Sent, ShouldEqual, len(women))
+			So(len(push.updates), ShouldEqual, len(women))
+			So(len(email.updates), ShouldEqual, len(women))
+			for _, id := range women {
+				updates, err := a.db.GetUpdates(id, UpdateNews, Pagination{})
+				So(err, ShouldBeNil)
+				So(len(updates), ShouldEqual, 1)
+			}
+		})
+		Convey("Preferences", func() {
+			So(a.db.SetNotifications(women[0], Notifications{SubscriptionNews: {InApp: true}}), ShouldBeNil)
+			b.Segment = "sex=female"
+			So(a.db.AddBroadcast(b), ShouldBeNil)
+			broadcaster.Run(b)
+			So(len(email.updates), ShouldEqual, len(women)-1)
+		})
+		Convey("Global", func() {
+			So(a.db.AddBroadcast(b), ShouldBeNil)
+			broadcaster.Run(b)
+			saved, err := a.db.GetBroadcast(b.Id)
+			So(err, ShouldBeNil)
+			So(saved.Sent, ShouldEqual, 4)
+			So(len(push.updates), ShouldEqual, 4)
+		})
+		Convey("Resume", func() {
+			b.State, b.After, b.Sent = BroadcastRunning, users[1], 2
+			So(a.db.AddBroadcast(b), ShouldBeNil)
+			a.broadcaster = broadcaster
+			a.ResumeBroadcasts()
+			saved, err := a.db.GetBroadcast(b.Id)
+			So(err, ShouldBeNil)
+			So(saved.State, ShouldEqual, BroadcastFinished)
+			So(saved.Sent, ShouldEqual, 4)
+			So(saved.After, ShouldEqual, users[3])
+			So(len(push.updates), ShouldEqual, 2)
+			So(push.updates[0].Destination, ShouldEqual, users[2])
+		})
+		Convey("Digest", func() {
+			sender := new(recordingDigestSender)
+			broadcaster.email = &DigestUpdater{a.db, email, sender}
+			b.Segment = "sex=female"
+			So(a.db.AddBroadcast(b), ShouldBeNil)
+			broadcaster.Run(b)
+			So(email.updates, ShouldBeEmpty)
+			items, err := a.db.GetDigestItems(women[0])
+			So(err, ShouldBeNil)
+			So(len(items), ShouldEqual, 1)
+		})
+		Convey("Template", func() {
+			update := NewUpdate(women[0], admin, UpdateNews, b.News())
+			src, err := a.emailUpdater.GetTemplate(update)
+			So(err, ShouldBeNil)
+			t, err := template.New("template").Parse(src)
+			So(err, ShouldBeNil)
+			buff := new(bytes.Buffer)
+			So(t.Execute(buff, update), ShouldBeNil)
+			So(buff.String(), ShouldContainSubstring, b.Text)
+		})
+	})
+}
+
+type recordingDigestSender struct {
+	digests []*Digest
+}
+
+func (r *recordingDigestSender) SendDigest(digest *Digest) error {
+	r.digests = append(r.digests, digest)
+	return nil
+}
+
+func TestDigestUpdater(t *testing.T) {
+	a := NewTestApp()
+	defer a.Close()
+	Convey("Digest updater", t, func() {
+		Reset(a.Reset)
+		user := &User{Id: bson.NewObjectId(), Name: "Вася", Email: "vasya@" + mailDomain}
+		anna := &User{Id: bson.NewObjectId(), Name: "Анна"}
+		So(a.db.Add(user), ShouldBeNil)
+		So(a.db.Add(anna), ShouldBeNil)
+		email, sender := new(recordingUpdater), new(recordingDigestSender)
+		digest := &DigestUpdater{a.db, email, sender}
+		// updates are stored before they are passed to digests
+		push := func(update Update) error {
+			if _, err := a.db.AddUpdateDirect(&update); err != nil {
+				return err
+			}
+			return digest.Push(update)
+		}
+		for i := 0; i < 3; i++ {
+			So(push(NewUpdate(user.Id, anna.Id, UpdateGuests, nil)), ShouldBeNil)
+		}
+		So(push(NewUpdate(user.Id, anna.Id, UpdateMessages, new(Message))), ShouldBeNil)
+		So(email.updates, ShouldBeEmpty)
+		Convey("Should send digest once per period", func() {
+			now := time.Now()
+			n, err := digest.Send(now)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 1)
+			So(len(sender.digests), ShouldEqual, 1)
+			So(sender.digests[0].Theme(), ShouldEqual, "У вас 3 новых гостя, 1 сообщение от пользователя Анна")
+			So(push(NewUpdate(user.Id, anna.Id, UpdateGuests, nil)), ShouldBeNil)
+			n, err = digest.Send(now.Add(time.Minute))
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 0)
+			n, err = digest.Send(now.Add(time.Hour))
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 1)
+			So(len(sender.digests[1].Items), ShouldEqual, 1)
+		})
+		Convey("Should skip read and removed updates", func() {
+			So(a.db.SetUpdatesRead(user.Id, UpdateGuests), ShouldBeNil)
+			n, err := digest.Send(time.Now())
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 1)
+			So(sender.digests[0].Theme(), ShouldEqual, "У вас 1 сообщение от пользователя Анна")
+			So(push(NewUpdate(user.Id, anna.Id, UpdateGuests, nil)), ShouldBeNil)
+			So(a.db.SetUpdatesRead(user.Id, ""), ShouldBeNil)
+			n, err = digest.Send(time.Now().Add(time.Hour))
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 0)
+			items, err := a.db.GetDigestItems(user.Id)
+			So(err, ShouldBeNil)
+			So(items, ShouldBeEmpty)
+		})
+		Convey("Should send email at once for instant period", func() {
+			So(a.db.SetDigestPeriod(user.Id, DigestInstant), ShouldBeNil)
+			So(push(NewUpdate(user.Id, anna.Id, UpdateGuests, nil)), ShouldBeNil)
+			So(len(email.updates), ShouldEqual, 1)
+		})
+		Convey("Should honour preferences", func() {
+			So(a.db.SetNotifications(user.Id, Notifications{SubscriptionInvites: {}}), ShouldBeNil)
+			So(push(NewUpdate(user.Id, anna.Id, UpdateInvites, new(Invitation))), ShouldBeNil)
+			items, err := a.db.GetDigestItems(user.Id)
+			So(err, ShouldBeNil)
+			So(len(items), ShouldEqual, 4)
+		})
+	})
+}
+
+func TestPushNotificationsUpdater(t *testing.T) {
+	a := NewTestApp()
+	defer a.Close()
+	Convey("Push notifications updater", t, func() {
+		Reset(a.Reset)
+		origin := &User{Id: bson.NewObjectId(), Name: "Анна"}
+		user := &User{Id: bson.NewObjectId(), Name: "Вася", IOsTokens: []string{"ios", "ios-old"}, AndroidTokens: []string{"android"}}
+		// guests are not pushed by default
+		user.Notifications = Notifications{SubscriptionGuests: {InApp: true, Push: true}}
+		So(a.db.Add(origin), ShouldBeNil)
+		So(a.db.Add(user), ShouldBeNil)
+		ios := &recordingPushSender{invalid: map[string]bool{"ios-old": true}}
+		android := &recordingPushSender{}
+		updater := &PushNotificationsUpdater{a.db, a.adapter, ios, android, make(chan Update, 1)}
+		update := NewUpdate(user.Id, origin.Id, UpdateGuests, nil)
+		_, err := a.db.AddUpdateDirect(&update)
+		So(err, ShouldBeNil)
+		So(updater.Send(update), ShouldBeNil)
+		So(ios.tokens, ShouldResemble, []string{"ios"})
+		So(android.tokens, ShouldResemble, []string{"android"})
+		message := ios.messages[0]
+		So(message.Badge, ShouldEqual, 1)
+		So(message.Link, ShouldEqual, "poputchiki://user/"+origin.Id.Hex())
+		So(message.CollapseKey, ShouldEqual, UpdateGuests+":"+origin.Id.Hex())
+		Convey("Invalid tokens should be removed", func() {
+			So(a.db.Get(user.Id).IOsTokens, ShouldResemble, []string{"ios"})
+		})
+		Convey("Preferences should be honoured", func() {
+			So(a.db.SetNotifications(user.Id, Notifications{SubscriptionGuests: {InApp: true}}), ShouldBeNil)
+			So(updater.Send(update), ShouldBeNil)
+			So(len(ios.messages), ShouldEqual, 1)
+		})
+		Convey("Push should only queue notification", func() {
+			So(updater.Push(update), ShouldBeNil)
+			So(updater.Push(update), ShouldEqual, ErrPushQueueFull)
+			So(len(ios.messages), ShouldEqual, 1)
+			So((<-updater.queue).Id, ShouldEqual, update.Id)
+		})
+	})
+}
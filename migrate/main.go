@@ -0,0 +1,34 @@
+package main
+
+import (
+	"flag"
+	"github.com/ernado/poputchiki/database"
+	"gopkg.in/mgo.v2"
+	"log"
+	"time"
+)
+
+var (
+	dbName = "poputchiki"
+	dbHost = "localhost"
+	dbSalt = "salt"
+)
+
+func main() {
+	flag.StringVar(&dbName, "db.name", dbName, "Database name")
+	flag.StringVar(&dbHost, "db.host", dbHost, "Mongo host")
+	flag.StringVar(&dbSalt, "db.salt", dbSalt, "Database salt")
+	flag.Parse()
+	log.Println("connecting to db...")
+	session, err := mgo.Dial(dbHost)
+	if err != nil {
+		log.Fatal(err)
+	}
+	db := database.New(dbName, dbSalt, time.Second, session)
+	log.Println("migrating messages to conversations...")
+	count, err := db.MigrateMessages()
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("migrated", count, "messages")
+}
@@ -6,14 +6,21 @@ import (
 )
 
 type Audio struct {
-	Id          bson.ObjectId `json:"id,omitempty"          bson:"_id,omitempty"`
-	User        bson.ObjectId `json:"user"                  bson:"user"`
-	AudioAac    string        `json:"-"                     bson:"audio_aac"`
-	AudioOgg    string        `json:"-"                     bson:"audio_ogg"`
-	AudioUrl    string        `json:"url"                   bson:"-"`
-	Description string        `json:"description,omitempty" bson:"description,omitempty"`
-	Time        time.Time     `json:"time"                  bson:"time"`
-	Duration    int64         `json:"duration"              bson:"duration"`
+	Id           bson.ObjectId   `json:"id,omitempty"          bson:"_id,omitempty"`
+	User         bson.ObjectId   `json:"user"                  bson:"user"`
+	AudioAac     string          `json:"-"                     bson:"audio_aac"`
+	AudioOgg     string          `json:"-"                     bson:"audio_ogg"`
+	AudioUrl     string          `json:"url"                   bson:"-"`
+	Description  string          `json:"description,omitempty" bson:"description,omitempty"`
+	Time         time.Time       `json:"time"                  bson:"time"`
+	Duration     int64           `json:"duration"              bson:"duration"`
+	Message      bson.ObjectId   `json:"message,omitempty"     bson:"message,omitempty"`
+	Participants []bson.ObjectId `json:"-"                     bson:"participants,omitempty"`
+}
+
+// AccessibleBy returns true if audio can be accessed by user with provided id
+func (audio *Audio) AccessibleBy(id bson.ObjectId) bool {
+	return len(audio.Participants) == 0 || containsId(audio.Participants, id)
 }
 
 func (audio *Audio) Prepare(context Context) error {
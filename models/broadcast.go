@@ -0,0 +1,109 @@
+package models
+
+import (
+	"errors"
+	"net/url"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	BroadcastQueued   = "queued"
+	BroadcastRunning  = "running"
+	BroadcastFinished = "finished"
+	BroadcastFailed   = "failed"
+
+	broadcastTitleMax = 200
+	broadcastTextMax  = 5000
+)
+
+var (
+	ErrBroadcastBlank   = errors.New("Не указан заголовок или текст объявления")
+	ErrBroadcastTooLong = errors.New("Слишком длинное объявление")
+)
+
+// Broadcast is an announcement from admins, that is delivered to all
+// users or to users matching segment, which is url-encoded SearchQuery.
+// Counters of broadcast show progress of delivery, and After is the last
+// user that delivery is resumed from.
+type Broadcast struct {
+	Id       bson.ObjectId `json:"id"                 bson:"_id"`
+	Author   bson.ObjectId `json:"author"             bson:"author"`
+	Title    string        `json:"title"              bson:"title"`
+	Text     string        `json:"text"               bson:"text"`
+	Segment  string        `json:"segment,omitempty"  bson:"segment,omitempty"`
+	State    string        `json:"state"              bson:"state"`
+	Total    int           `json:"total"              bson:"total"`
+	Sent     int           `json:"sent"               bson:"sent"`
+	Failed   int           `json:"failed"             bson:"failed"`
+	Progress float64       `json:"progress"           bson:"-"`
+	After    bson.ObjectId `json:"-"                  bson:"after,omitempty"`
+	Time     time.Time     `json:"time"               bson:"time"`
+	Finished time.Time     `json:"finished,omitempty" bson:"finished,omitempty"`
+}
+
+type Broadcasts []*Broadcast
+
+func (broadcasts Broadcasts) Prepare(context Context) error {
+	for _, b := range broadcasts {
+		if err := b.Prepare(context); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Prepare sets progress of delivery from 0 to 1
+func (b *Broadcast) Prepare(context Context) error {
+	b.Progress = 0
+	if b.Total > 0 {
+		b.Progress = float64(b.Sent+b.Failed) / float64(b.Total)
+	}
+	// users registered during delivery are also counted
+	if b.State == BroadcastFinished || b.Progress > 1 {
+		b.Progress = 1
+	}
+	return nil
+}
+
+// Global returns true if broadcast is delivered to all users
+func (b *Broadcast) Global() bool {
+	return b.Segment == ""
+}
+
+// Query returns search query of segment, or nil for global broadcast
+func (b *Broadcast) Query() (*SearchQuery, error) {
+	if b.Global() {
+		return nil, nil
+	}
+	values, err := url.ParseQuery(b.Segment)
+	if err != nil {
+		return nil, err
+	}
+	return NewQuery(values)
+}
+
+func (b *Broadcast) Validate() error {
+	if b.Title == "" || b.Text == "" {
+		return ErrBroadcastBlank
+	}
+	if len([]rune(b.Title)) > broadcastTitleMax || len([]rune(b.Text)) > broadcastTextMax {
+		return ErrBroadcastTooLong
+	}
+	_, err := b.Query()
+	return err
+}
+
+// News returns announcement of broadcast as it is shown to users
+func (b *Broadcast) News() *News {
+	return &News{Broadcast: b.Id, Title: b.Title, Text: b.Text, Time: b.Time}
+}
+
+// News is a target of update about admin announcement
+type News struct {
+	Broadcast bson.ObjectId `json:"broadcast" bson:"broadcast"`
+	Title     string        `json:"title"     bson:"title"`
+	Text      string        `json:"text"      bson:"text"`
+	Time      time.Time     `json:"time"      bson:"time"`
+}
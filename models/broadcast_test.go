@@ -0,0 +1,47 @@
+package models
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBroadcast(t *testing.T) {
+	Convey("Broadcast", t, func() {
+		b := &Broadcast{Title: "Новости", Text: "Мы запустили мобильное приложение"}
+		So(b.Validate(), ShouldBeNil)
+		So(b.Global(), ShouldBeTrue)
+		q, err := b.Query()
+		So(err, ShouldBeNil)
+		So(q, ShouldBeNil)
+		Convey("Segment", func() {
+			b.Segment = "sex=female&city=Москва"
+			So(b.Validate(), ShouldBeNil)
+			So(b.Global(), ShouldBeFalse)
+			q, err := b.Query()
+			So(err, ShouldBeNil)
+			So(q.Sex, ShouldEqual, SexFemale)
+			So(q.City, ShouldEqual, "Москва")
+			b.Segment = "%zz"
+			So(b.Validate(), ShouldNotBeNil)
+		})
+		Convey("Blank", func() {
+			b.Text = ""
+			So(b.Validate(), ShouldEqual, ErrBroadcastBlank)
+		})
+		Convey("Progress", func() {
+			b.Total, b.Sent, b.Failed = 10, 4, 1
+			So(b.Prepare(Context{}), ShouldBeNil)
+			So(b.Progress, ShouldAlmostEqual, 0.5)
+			b.Sent = 12
+			So(b.Prepare(Context{}), ShouldBeNil)
+			So(b.Progress, ShouldEqual, 1)
+		})
+		Convey("News", func() {
+			update := NewUpdate("", "", UpdateNews, b.News())
+			So(update.TargetType, ShouldEqual, "news")
+			So(update.Theme(), ShouldEqual, b.Title)
+			So(GetEventType(update.Type, update.Target), ShouldEqual, SubscriptionNews)
+		})
+	})
+}
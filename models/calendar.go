@@ -0,0 +1,161 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	CalendarContentType = "text/calendar; charset=utf-8"
+	calendarProdId      = "-//poputchiki.ru//Trips//RU"
+	calendarDomain      = "poputchiki.ru"
+	calendarDateFormat  = "20060102"
+	calendarTimeFormat  = "20060102T150405Z"
+	calendarLineMax     = 75 // octets, RFC 5545 3.1
+	calendarUserUrl     = "http://poputchiki.ru/user/%s/"
+
+	CalendarConfirmed = "CONFIRMED"
+	CalendarTentative = "TENTATIVE"
+	CalendarCancelled = "CANCELLED"
+)
+
+// CalendarPerson is an organizer or attendee of calendar event
+type CalendarPerson struct {
+	Name string
+	Url  string
+}
+
+// CalendarEvent is a VEVENT of iCalendar feed
+type CalendarEvent struct {
+	Uid         string
+	Summary     string
+	Description string
+	Url         string
+	Status      string
+	Start       time.Time // first day of event
+	End         time.Time // last day of event, inclusive
+	Modified    time.Time
+	Organizer   *CalendarPerson
+	Attendees   []*CalendarPerson
+}
+
+// Calendar is an iCalendar (RFC 5545) object with events
+type Calendar struct {
+	Name   string
+	Events []*CalendarEvent
+}
+
+func newCalendarPerson(u *User) *CalendarPerson {
+	return &CalendarPerson{u.Name, fmt.Sprintf(calendarUserUrl, u.Id.Hex())}
+}
+
+// NewTripEvent returns calendar event for trip with owner as organizer
+// and participants as attendees. Users must contain owner and participants.
+func NewTripEvent(trip *Trip, users map[bson.ObjectId]*User) *CalendarEvent {
+	e := &CalendarEvent{
+		Uid:      fmt.Sprintf("trip-%s@%s", trip.Id.Hex(), calendarDomain),
+		Summary:  fmt.Sprintf("Поездка: %s", strings.Join(trip.Destinations, ", ")),
+		Start:    trip.Start,
+		End:      trip.End,
+		Modified: trip.Time,
+		Status:   CalendarConfirmed,
+	}
+	e.Description = trip.Description
+	if trip.Flexible {
+		e.Status = CalendarTentative
+	}
+	if trip.Status == TripCancelled {
+		e.Status = CalendarCancelled
+	}
+	if owner, ok := users[trip.User]; ok && owner != nil {
+		e.Organizer = newCalendarPerson(owner)
+		e.Url = e.Organizer.Url
+	}
+	for _, id := range trip.Participants {
+		if u, ok := users[id]; ok && u != nil {
+			e.Attendees = append(e.Attendees, newCalendarPerson(u))
+		}
+	}
+	return e
+}
+
+// calendarEscape escapes TEXT value, RFC 5545 3.3.11
+func calendarEscape(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`, "\r", `\n`)
+	return r.Replace(s)
+}
+
+// calendarParam quotes parameter value, RFC 5545 3.2
+func calendarParam(s string) string {
+	return `"` + strings.Replace(s, `"`, "'", -1) + `"`
+}
+
+// writeCalendarLine writes content line folded to 75 octets without
+// splitting utf-8 sequences
+func writeCalendarLine(b *bytes.Buffer, line string) {
+	limit := calendarLineMax
+	for len(line) > limit {
+		i := limit
+		// do not split multibyte characters
+		for i > 0 && line[i]&0xC0 == 0x80 {
+			i--
+		}
+		b.WriteString(line[:i])
+		b.WriteString("\r\n ")
+		line = line[i:]
+		limit = calendarLineMax - 1
+	}
+	b.WriteString(line)
+	b.WriteString("\r\n")
+}
+
+func (e *CalendarEvent) write(b *bytes.Buffer, now time.Time) {
+	writeCalendarLine(b, "BEGIN:VEVENT")
+	writeCalendarLine(b, "UID:"+e.Uid)
+	writeCalendarLine(b, "DTSTAMP:"+now.UTC().Format(calendarTimeFormat))
+	if !e.Modified.IsZero() {
+		writeCalendarLine(b, "LAST-MODIFIED:"+e.Modified.UTC().Format(calendarTimeFormat))
+	}
+	writeCalendarLine(b, "DTSTART;VALUE=DATE:"+e.Start.Format(calendarDateFormat))
+	// DTEND of all-day event is exclusive
+	writeCalendarLine(b, "DTEND;VALUE=DATE:"+e.End.AddDate(0, 0, 1).Format(calendarDateFormat))
+	writeCalendarLine(b, "SUMMARY:"+calendarEscape(e.Summary))
+	if e.Description != "" {
+		writeCalendarLine(b, "DESCRIPTION:"+calendarEscape(e.Description))
+	}
+	if e.Url != "" {
+		writeCalendarLine(b, "URL:"+e.Url)
+	}
+	writeCalendarLine(b, "STATUS:"+e.Status)
+	writeCalendarLine(b, "TRANSP:TRANSPARENT")
+	if e.Organizer != nil {
+		writeCalendarLine(b, fmt.Sprintf("ORGANIZER;CN=%s:%s", calendarParam(e.Organizer.Name), e.Organizer.Url))
+	}
+	for _, a := range e.Attendees {
+		writeCalendarLine(b, fmt.Sprintf("ATTENDEE;CN=%s;ROLE=REQ-PARTICIPANT;PARTSTAT=ACCEPTED:%s",
+			calendarParam(a.Name), a.Url))
+	}
+	writeCalendarLine(b, "END:VEVENT")
+}
+
+// Bytes returns serialized calendar with provided timestamp
+func (c *Calendar) Bytes(now time.Time) []byte {
+	b := new(bytes.Buffer)
+	writeCalendarLine(b, "BEGIN:VCALENDAR")
+	writeCalendarLine(b, "VERSION:2.0")
+	writeCalendarLine(b, "PRODID:"+calendarProdId)
+	writeCalendarLine(b, "CALSCALE:GREGORIAN")
+	writeCalendarLine(b, "METHOD:PUBLISH")
+	if c.Name != "" {
+		writeCalendarLine(b, "X-WR-CALNAME:"+calendarEscape(c.Name))
+	}
+	for _, e := range c.Events {
+		e.write(b, now)
+	}
+	writeCalendarLine(b, "END:VCALENDAR")
+	return b.Bytes()
+}
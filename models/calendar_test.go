@@ -0,0 +1,54 @@
+package models
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCalendar(t *testing.T) {
+	now := time.Date(2015, time.June, 10, 15, 0, 0, 0, time.UTC)
+	owner := &User{Id: bson.NewObjectId(), Name: "Владимир"}
+	participant := &User{Id: bson.NewObjectId(), Name: "Анна"}
+	users := map[bson.ObjectId]*User{owner.Id: owner, participant.Id: participant}
+	trip := &Trip{Id: bson.NewObjectId(), User: owner.Id, Destinations: []string{"Москва", "Париж"},
+		Start: time.Date(2015, time.July, 1, 0, 0, 0, 0, time.UTC), End: time.Date(2015, time.July, 10, 0, 0, 0, 0, time.UTC),
+		Status: TripPlanned, Participants: []bson.ObjectId{participant.Id}, Description: "Море; солнце, пляж"}
+	Convey("Trip event", t, func() {
+		e := NewTripEvent(trip, users)
+		So(e.Status, ShouldEqual, CalendarConfirmed)
+		So(e.Organizer.Name, ShouldEqual, owner.Name)
+		So(len(e.Attendees), ShouldEqual, 1)
+		Convey("Cancelled", func() {
+			trip.Status = TripCancelled
+			So(NewTripEvent(trip, users).Status, ShouldEqual, CalendarCancelled)
+			trip.Status = TripPlanned
+		})
+		Convey("Flexible", func() {
+			trip.Flexible = true
+			So(NewTripEvent(trip, users).Status, ShouldEqual, CalendarTentative)
+			trip.Flexible = false
+		})
+	})
+	Convey("Calendar serialization", t, func() {
+		c := &Calendar{Name: "Поездки", Events: []*CalendarEvent{NewTripEvent(trip, users)}}
+		s := string(c.Bytes(now))
+		So(s, ShouldStartWith, "BEGIN:VCALENDAR\r\n")
+		So(s, ShouldEndWith, "END:VCALENDAR\r\n")
+		So(s, ShouldContainSubstring, "DTSTART;VALUE=DATE:20150701\r\n")
+		So(s, ShouldContainSubstring, "DTEND;VALUE=DATE:20150711\r\n")
+		So(s, ShouldContainSubstring, "DTSTAMP:20150610T150000Z\r\n")
+		So(s, ShouldContainSubstring, `DESCRIPTION:Море\; солнце\, пляж`)
+		So(s, ShouldContainSubstring, "STATUS:CONFIRMED")
+		Convey("Lines are folded", func() {
+			for _, line := range strings.Split(s, "\r\n") {
+				So(len(line), ShouldBeLessThanOrEqualTo, calendarLineMax)
+			}
+		})
+	})
+	Convey("Escaping", t, func() {
+		So(calendarEscape("a\\b;c,d\ne"), ShouldEqual, `a\\b\;c\,d\ne`)
+	})
+}
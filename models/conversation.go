@@ -0,0 +1,191 @@
+package models
+
+import (
+	"net/url"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Conversation is a private dialog of two users. Messages of conversation
+// are stored in single copy, state of each participant is stored in States.
+type Conversation struct {
+	Id           bson.ObjectId        `json:"id"                     bson:"_id"`
+	Key          string               `json:"-"                      bson:"key"`
+	Participants []bson.ObjectId      `json:"participants"           bson:"participants"`
+	States       []*ConversationState `json:"states"                 bson:"states"`
+	LastMessage  bson.ObjectId        `json:"last_message,omitempty" bson:"last_message,omitempty"`
+	Time         time.Time            `json:"time"                   bson:"time"`
+}
+
+// ConversationState is a state of conversation for one of participants
+type ConversationState struct {
+	User     bson.ObjectId  `json:"user"                bson:"user"`
+	LastRead bson.ObjectId  `json:"last_read,omitempty" bson:"last_read,omitempty"`
+	Last     *DialogMessage `json:"last,omitempty"      bson:"last,omitempty"`
+	Cleared  time.Time      `json:"cleared"             bson:"cleared"`
+	Archived bool           `json:"archived"            bson:"archived"`
+	Muted    bool           `json:"muted"               bson:"muted"`
+	Pinned   bool           `json:"pinned"              bson:"pinned"`
+	Unread   int            `json:"unread"              bson:"unread"`
+}
+
+// DialogMessage is the last message of conversation that is visible for
+// participant, as it is shown to participant
+type DialogMessage struct {
+	Id     bson.ObjectId `json:"id"     bson:"_id"`
+	Origin bson.ObjectId `json:"origin" bson:"origin"`
+	Text   string        `json:"text"   bson:"text"`
+	Time   time.Time     `json:"time"   bson:"time"`
+}
+
+// NewDialogMessage returns last message of dialog for user
+func NewDialogMessage(m *Message, user bson.ObjectId) *DialogMessage {
+	c := m.For(user)
+	return &DialogMessage{c.Id, c.Origin, c.Text, c.Time}
+}
+
+// fields of conversation state that are switched by participant
+const (
+	ConversationArchived = "archived"
+	ConversationMuted    = "muted"
+	ConversationPinned   = "pinned"
+)
+
+const (
+	DialogFilterUnread    = "unread"
+	DialogFilterFavorites = "favorites"
+	DialogFilterInvites   = "invites"
+	DialogFilterArchived  = "archived"
+)
+
+// DialogFilter selects dialogs of user. Archived dialogs are shown only
+// if Archived is set, unless All is set.
+type DialogFilter struct {
+	Unread    bool
+	Favorites bool
+	Invites   bool
+	Archived  bool
+	All       bool
+}
+
+// NewDialogFilter returns filter from comma-separated list of filters in
+// "filter" url param
+func NewDialogFilter(q url.Values) *DialogFilter {
+	f := new(DialogFilter)
+	for _, name := range strings.Split(q.Get("filter"), ",") {
+		switch strings.TrimSpace(name) {
+		case DialogFilterUnread:
+			f.Unread = true
+		case DialogFilterFavorites:
+			f.Favorites = true
+		case DialogFilterInvites:
+			f.Invites = true
+		case DialogFilterArchived:
+			f.Archived = true
+		}
+	}
+	return f
+}
+
+// DialogList is a page of dialogs of user with total amount of dialogs
+// matching filter and total amount of unread messages
+type DialogList struct {
+	Result []*Dialog `json:"result"`
+	Count  int       `json:"count"`
+	Unread int       `json:"unread"`
+}
+
+// ConversationKey returns key of conversation between two users that
+// does not depend on order of users
+func ConversationKey(a, b bson.ObjectId) string {
+	if b.Hex() < a.Hex() {
+		a, b = b, a
+	}
+	return a.Hex() + ":" + b.Hex()
+}
+
+// NewConversation returns conversation between two users
+func NewConversation(a, b bson.ObjectId) *Conversation {
+	c := &Conversation{Key: ConversationKey(a, b), Participants: []bson.ObjectId{a, b}}
+	c.States = []*ConversationState{{User: a}, {User: b}}
+	return c
+}
+
+// State returns state of conversation for user or nil if user is not
+// a participant of conversation
+func (c *Conversation) State(user bson.ObjectId) *ConversationState {
+	for _, s := range c.States {
+		if s.User == user {
+			return s
+		}
+	}
+	return nil
+}
+
+// MutedBy returns true if user muted notifications about conversation
+func (c *Conversation) MutedBy(user bson.ObjectId) bool {
+	s := c.State(user)
+	return s != nil && s.Muted
+}
+
+// Peer returns id of the other participant for user
+func (c *Conversation) Peer(user bson.ObjectId) bson.ObjectId {
+	for _, id := range c.Participants {
+		if id != user {
+			return id
+		}
+	}
+	return user
+}
+
+// SameMessage returns true if both messages are copies of the same message
+// stored for different participants by old storage model
+func SameMessage(a, b *Message) bool {
+	if a.Origin != b.Origin || a.Destination != b.Destination || !a.Time.Equal(b.Time) {
+		return false
+	}
+	if a.Invite || b.Invite {
+		// invite copies have different texts for origin and destination
+		return a.Invite == b.Invite
+	}
+	return a.Text == b.Text && a.Photo == b.Photo
+}
+
+// MergeMessageCopies returns single message from copies of message stored
+// for each participant by old storage model. Participants without copy are
+// considered to remove the message.
+func MergeMessageCopies(copies []*Message) *Message {
+	var fromOrigin, fromDestination *Message
+	for _, c := range copies {
+		switch c.User {
+		case c.Origin:
+			fromOrigin = c
+		case c.Destination:
+			fromDestination = c
+		}
+	}
+	base := copies[0]
+	if fromOrigin != nil {
+		base = fromOrigin
+	} else if fromDestination != nil {
+		base = fromDestination
+	}
+	m := *base
+	m.Chat, m.User = "", ""
+	m.Removed = nil
+	if fromDestination != nil {
+		m.Read = fromDestination.Read
+	}
+	if fromOrigin == nil {
+		m.Removed = append(m.Removed, m.Origin)
+	}
+	if fromDestination == nil && m.Destination != m.Origin {
+		m.Removed = append(m.Removed, m.Destination)
+	}
+	if m.Invite {
+		m.Text = ""
+	}
+	return &m
+}
@@ -0,0 +1,114 @@
+package models
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestConversation(t *testing.T) {
+	a, b := bson.NewObjectId(), bson.NewObjectId()
+	Convey("Conversation", t, func() {
+		So(ConversationKey(a, b), ShouldEqual, ConversationKey(b, a))
+		c := NewConversation(a, b)
+		So(c.State(a).User, ShouldEqual, a)
+		So(c.State(bson.NewObjectId()), ShouldBeNil)
+		So(c.Peer(a), ShouldEqual, b)
+		So(c.Peer(b), ShouldEqual, a)
+		So(c.MutedBy(a), ShouldBeFalse)
+		c.State(a).Muted = true
+		So(c.MutedBy(a), ShouldBeTrue)
+		So(c.MutedBy(b), ShouldBeFalse)
+	})
+	Convey("Dialog filter", t, func() {
+		f := NewDialogFilter(url.Values{"filter": {"unread, invites"}})
+		So(f.Unread, ShouldBeTrue)
+		So(f.Invites, ShouldBeTrue)
+		So(f.Favorites, ShouldBeFalse)
+		So(f.Archived, ShouldBeFalse)
+		f = NewDialogFilter(url.Values{})
+		So(*f, ShouldResemble, DialogFilter{})
+	})
+	Convey("Message changes", t, func() {
+		now := time.Now()
+		m := NewMessage(a, b, "", "Привет")
+		m.Time = now.Add(-time.Minute)
+		So(m.CanChange(now, time.Minute*5), ShouldBeNil)
+		So(m.CanChange(now, time.Second), ShouldEqual, ErrMessageWindowExpired)
+		m.Edit("Пока", now)
+		So(m.Text, ShouldEqual, "Пока")
+		So(m.Edited, ShouldBeTrue)
+		So(len(m.History), ShouldEqual, 1)
+		So(m.History[0].Text, ShouldEqual, "Привет")
+		Convey("History should be hidden from non-admins", func() {
+			So(m.Prepare(Context{IsAdmin: true}), ShouldBeNil)
+			So(len(m.History), ShouldEqual, 1)
+			So(m.Prepare(Context{}), ShouldBeNil)
+			So(m.History, ShouldBeNil)
+		})
+		Convey("Unsent messages and invites should not be changed", func() {
+			m.Unsent = true
+			So(m.CanChange(now, time.Minute*5), ShouldEqual, ErrMessageNotChangeable)
+			i := (*Message)(NewInvite(a, b))
+			So(i.CanChange(i.Time, time.Minute*5), ShouldEqual, ErrMessageNotChangeable)
+		})
+	})
+	Convey("Attachments", t, func() {
+		m := NewMessage(a, b, "", "")
+		So(m.HasAttachment(), ShouldBeFalse)
+		m.Video = bson.NewObjectId()
+		So(m.HasAttachment(), ShouldBeTrue)
+		video := &Video{Id: m.Video, User: a, Message: m.Id, Participants: []bson.ObjectId{a, b}}
+		So(video.AccessibleBy(a), ShouldBeTrue)
+		So(video.AccessibleBy(b), ShouldBeTrue)
+		So(video.AccessibleBy(bson.NewObjectId()), ShouldBeFalse)
+		audio := &Audio{Id: bson.NewObjectId(), User: a}
+		So(audio.AccessibleBy(bson.NewObjectId()), ShouldBeTrue)
+	})
+	Convey("Message copies", t, func() {
+		m := NewMessage(a, b, "", "Привет")
+		So(m.For(a).Chat, ShouldEqual, b)
+		So(m.For(b).Chat, ShouldEqual, a)
+		So(m.For(b).User, ShouldEqual, b)
+		Convey("Invite", func() {
+			i := (*Message)(NewInvite(a, b))
+			So(i.For(a).Text, ShouldEqual, InviteTextOrigin)
+			So(i.For(b).Text, ShouldEqual, InviteTextDestination)
+		})
+	})
+	Convey("Merge old message copies", t, func() {
+		now := time.Now()
+		toOrigin := &Message{Id: bson.NewObjectId(), User: a, Chat: b, Origin: a, Destination: b, Text: "Привет", Time: now}
+		toDestination := &Message{Id: bson.NewObjectId(), User: b, Chat: a, Origin: a, Destination: b, Text: "Привет",
+			Time: now, Read: true}
+		So(SameMessage(toOrigin, toDestination), ShouldBeTrue)
+		Convey("Both copies", func() {
+			m := MergeMessageCopies([]*Message{toDestination, toOrigin})
+			So(m.Id, ShouldEqual, toOrigin.Id)
+			So(m.Read, ShouldBeTrue)
+			So(m.Chat.Valid(), ShouldBeFalse)
+			So(len(m.Removed), ShouldEqual, 0)
+		})
+		Convey("Removed by origin", func() {
+			m := MergeMessageCopies([]*Message{toDestination})
+			So(m.Id, ShouldEqual, toDestination.Id)
+			So(m.RemovedFor(a), ShouldBeTrue)
+			So(m.RemovedFor(b), ShouldBeFalse)
+		})
+		Convey("Different messages", func() {
+			other := *toDestination
+			other.Text = "Пока"
+			So(SameMessage(toOrigin, &other), ShouldBeFalse)
+		})
+		Convey("Invites", func() {
+			toOrigin.Invite, toDestination.Invite = true, true
+			toOrigin.Text, toDestination.Text = InviteTextOrigin, InviteTextDestination
+			So(SameMessage(toOrigin, toDestination), ShouldBeTrue)
+			m := MergeMessageCopies([]*Message{toOrigin, toDestination})
+			So(m.Text, ShouldEqual, "")
+			So(m.For(b).Text, ShouldEqual, InviteTextDestination)
+		})
+	})
+}
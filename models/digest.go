@@ -0,0 +1,192 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	DigestInstant = "instant"
+	DigestHourly  = "hourly"
+	DigestDaily   = "daily"
+)
+
+var digestPeriods = map[string]time.Duration{
+	DigestInstant: 0,
+	DigestHourly:  time.Hour,
+	DigestDaily:   time.Hour * 24,
+}
+
+// digestNouns are plural forms of event types for one, few and many events
+var digestNouns = map[string][3]string{
+	SubscriptionMessages:    {"сообщение", "сообщения", "сообщений"},
+	SubscriptionInvites:     {"приглашение", "приглашения", "приглашений"},
+	SubscriptionGuests:      {"новый гость", "новых гостя", "новых гостей"},
+	SubscriptionLikesPhoto:  {"лайк к фото", "лайка к фото", "лайков к фото"},
+	SubscriptionLikesStatus: {"лайк к статусу", "лайка к статусу", "лайков к статусу"},
+	SubscriptionLikesVideo:  {"лайк к видео", "лайка к видео", "лайков к видео"},
+	SubscriptionNews:        {"новость", "новости", "новостей"},
+	SubscriptionTrips:       {"новый попутчик", "новых попутчика", "новых попутчиков"},
+	SubscriptionReviews:     {"отзыв", "отзыва", "отзывов"},
+}
+
+var (
+	digestDefaultNoun = [3]string{"уведомление", "уведомления", "уведомлений"}
+	digestUsersNoun   = [3]string{"пользователя", "пользователей", "пользователей"}
+	// digestPersonal are event types that are summarized with names of users
+	digestPersonal = []string{SubscriptionMessages, SubscriptionInvites, SubscriptionReviews}
+)
+
+// plural returns form of noun for amount n by rules of russian language
+func plural(n int, forms [3]string) string {
+	switch {
+	case n%10 == 1 && n%100 != 11:
+		return forms[0]
+	case n%10 >= 2 && n%10 <= 4 && (n%100 < 10 || n%100 >= 20):
+		return forms[1]
+	}
+	return forms[2]
+}
+
+// DigestItem is update that is waiting to be sent to user in digest email
+type DigestItem struct {
+	Id     bson.ObjectId `json:"id"     bson:"_id"`
+	User   bson.ObjectId `json:"user"   bson:"user"`
+	Origin bson.ObjectId `json:"origin" bson:"origin"`
+	Type   string        `json:"type"   bson:"type"`
+	Time   time.Time     `json:"time"   bson:"time"`
+}
+
+// NewDigestItem returns digest item of update with id of update, so
+// update is buffered only once
+func NewDigestItem(update Update) *DigestItem {
+	return &DigestItem{update.Id, update.Destination, update.User, GetEventType(update.Type, update.Target), update.Time}
+}
+
+// ValidDigestPeriod returns true if digests can be sent with period
+func ValidDigestPeriod(period string) bool {
+	_, ok := digestPeriods[period]
+	return ok
+}
+
+// DigestPeriod returns how often user wants to receive digests
+func (u *User) DigestPeriod() string {
+	if ValidDigestPeriod(u.Digest) {
+		return u.Digest
+	}
+	return DigestHourly
+}
+
+// DigestDue returns true if period of digests passed since last digest
+func (u *User) DigestDue(now time.Time) bool {
+	return now.Sub(u.DigestSent) >= digestPeriods[u.DigestPeriod()]
+}
+
+// DigestGroup summarizes events of same type
+type DigestGroup struct {
+	Type    string
+	Count   int
+	Origins []bson.ObjectId
+	Names   []string
+}
+
+func (g *DigestGroup) personal() bool {
+	for _, v := range digestPersonal {
+		if v == g.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns summary of group like "3 сообщения от Анна"
+func (g *DigestGroup) String() string {
+	noun, ok := digestNouns[g.Type]
+	if !ok {
+		noun = digestDefaultNoun
+	}
+	summary := fmt.Sprintf("%d %s", g.Count, plural(g.Count, noun))
+	if !g.personal() || len(g.Names) == 0 {
+		return summary
+	}
+	switch {
+	case len(g.Origins) == 1:
+		return fmt.Sprintf("%s от пользователя %s", summary, g.Names[0])
+	case len(g.Origins) == 2 && len(g.Names) == 2:
+		return fmt.Sprintf("%s от пользователей %s и %s", summary, g.Names[0], g.Names[1])
+	}
+	return fmt.Sprintf("%s от %d %s", summary, len(g.Origins), plural(len(g.Origins), digestUsersNoun))
+}
+
+type digestGroups []*DigestGroup
+
+func (g digestGroups) Len() int {
+	return len(g)
+}
+
+func (g digestGroups) Swap(i, j int) {
+	g[i], g[j] = g[j], g[i]
+}
+
+func (g digestGroups) Less(i, j int) bool {
+	if g[i].Count == g[j].Count {
+		return g[i].Type < g[j].Type
+	}
+	return g[i].Count > g[j].Count
+}
+
+// Digest is email with summary of events that happened since last digest
+type Digest struct {
+	User   *User
+	Groups []*DigestGroup
+	Items  []bson.ObjectId
+	Since  time.Time
+}
+
+// NewDigest groups items by event type, largest groups first, using names
+// of users that caused events
+func NewDigest(user *User, items []*DigestItem, names map[bson.ObjectId]string) *Digest {
+	d := &Digest{User: user}
+	groups := make(map[string]*DigestGroup)
+	for _, item := range items {
+		d.Items = append(d.Items, item.Id)
+		if d.Since.IsZero() || item.Time.Before(d.Since) {
+			d.Since = item.Time
+		}
+		g, ok := groups[item.Type]
+		if !ok {
+			g = &DigestGroup{Type: item.Type}
+			groups[item.Type] = g
+			d.Groups = append(d.Groups, g)
+		}
+		g.Count++
+		known := false
+		for _, origin := range g.Origins {
+			if origin == item.Origin {
+				known = true
+			}
+		}
+		if known {
+			continue
+		}
+		g.Origins = append(g.Origins, item.Origin)
+		if name, ok := names[item.Origin]; ok {
+			g.Names = append(g.Names, name)
+		}
+	}
+	sort.Sort(digestGroups(d.Groups))
+	return d
+}
+
+// Theme returns subject of digest email
+func (d *Digest) Theme() string {
+	summaries := make([]string, len(d.Groups))
+	for i, g := range d.Groups {
+		summaries[i] = g.String()
+	}
+	return "У вас " + strings.Join(summaries, ", ")
+}
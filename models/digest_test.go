@@ -0,0 +1,64 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestDigest(t *testing.T) {
+	Convey("Digest", t, func() {
+		user := &User{Id: bson.NewObjectId()}
+		anna, maria := bson.NewObjectId(), bson.NewObjectId()
+		names := map[bson.ObjectId]string{anna: "Анна", maria: "Мария"}
+		var items []*DigestItem
+		add := func(origin bson.ObjectId, updateType string, media interface{}) {
+			items = append(items, NewDigestItem(NewUpdate(user.Id, origin, updateType, media)))
+		}
+		Convey("Should group events by type", func() {
+			for i := 0; i < 5; i++ {
+				add(bson.NewObjectId(), UpdateGuests, nil)
+			}
+			for i := 0; i < 3; i++ {
+				add(anna, UpdateMessages, new(Message))
+			}
+			add(anna, UpdateLikes, new(Photo))
+			d := NewDigest(user, items, names)
+			So(len(d.Groups), ShouldEqual, 3)
+			So(len(d.Items), ShouldEqual, 9)
+			So(d.Since, ShouldResemble, items[0].Time)
+			So(d.Theme(), ShouldEqual, "У вас 5 новых гостей, 3 сообщения от пользователя Анна, 1 лайк к фото")
+		})
+		Convey("Should name users of personal events", func() {
+			add(anna, UpdateMessages, new(Message))
+			add(maria, UpdateMessages, new(Message))
+			So(NewDigest(user, items, names).Groups[0].String(), ShouldEqual, "2 сообщения от пользователей Анна и Мария")
+			add(bson.NewObjectId(), UpdateMessages, new(Message))
+			So(NewDigest(user, items, names).Groups[0].String(), ShouldEqual, "3 сообщения от 3 пользователей")
+		})
+		Convey("Should use plural forms", func() {
+			forms := [3]string{"гость", "гостя", "гостей"}
+			So(plural(1, forms), ShouldEqual, "гость")
+			So(plural(21, forms), ShouldEqual, "гость")
+			So(plural(3, forms), ShouldEqual, "гостя")
+			So(plural(11, forms), ShouldEqual, "гостей")
+			So(plural(14, forms), ShouldEqual, "гостей")
+			So(plural(25, forms), ShouldEqual, "гостей")
+		})
+		Convey("Should be due after period", func() {
+			now := time.Now()
+			So(user.DigestPeriod(), ShouldEqual, DigestHourly)
+			So(user.DigestDue(now), ShouldBeTrue)
+			user.DigestSent = now.Add(-time.Minute)
+			So(user.DigestDue(now), ShouldBeFalse)
+			user.Digest = DigestInstant
+			So(user.DigestDue(now), ShouldBeTrue)
+			user.Digest = DigestDaily
+			user.DigestSent = now.Add(-time.Hour * 2)
+			So(user.DigestDue(now), ShouldBeFalse)
+			So(ValidDigestPeriod("weekly"), ShouldBeFalse)
+		})
+	})
+}
@@ -27,6 +27,7 @@ var (
 	ErrorInsufficentFunds      = Error{http.StatusPaymentRequired, "Insufficent funds"}
 	ErrorBackend               = Error{http.StatusInternalServerError, "Internal server error"}
 	ErrorUserAlreadyRegistered = Error{http.StatusBadRequest, "User already registered"}
+	ErrorTooManyRequests       = Error{http.StatusTooManyRequests, "Too many requests"}
 )
 
 func ValidationError(err error) Error {
@@ -0,0 +1,144 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	GroupRoleOwner  = "owner"
+	GroupRoleMember = "member"
+
+	groupTitleMax = 100
+)
+
+var (
+	ErrGroupTitleTooLong = fmt.Errorf("Название чата не должно превышать %d символов", groupTitleMax)
+	ErrGroupBlankMessage = errors.New("Пустое сообщение")
+)
+
+// GroupChat is a conversation of several users, for example trip participants
+type GroupChat struct {
+	Id          bson.ObjectId  `json:"id"                     bson:"_id"`
+	Title       string         `json:"title"                  bson:"title"`
+	Trip        bson.ObjectId  `json:"trip,omitempty"         bson:"trip,omitempty"`
+	Owner       bson.ObjectId  `json:"owner"                  bson:"owner"`
+	LastMessage string         `json:"last_message,omitempty" bson:"last_message,omitempty"`
+	Time        time.Time      `json:"time"                   bson:"time"`
+	Updated     time.Time      `json:"updated"                bson:"updated"`
+	Members     []*GroupMember `json:"members,omitempty"      bson:"-"`
+
+	// state of current user
+	Role   string `json:"role,omitempty" bson:"-"`
+	Muted  bool   `json:"muted"          bson:"-"`
+	Unread int    `json:"unread"         bson:"-"`
+}
+
+type GroupChats []*GroupChat
+
+// GroupMember is a membership of user in group chat
+type GroupMember struct {
+	Id         bson.ObjectId `json:"-"                     bson:"_id"`
+	Chat       bson.ObjectId `json:"chat"                  bson:"chat"`
+	User       bson.ObjectId `json:"user"                  bson:"user"`
+	UserObject *User         `json:"user_object,omitempty" bson:"-"`
+	Role       string        `json:"role"                  bson:"role"`
+	Muted      bool          `json:"muted"                 bson:"muted"`
+	Unread     int           `json:"unread"                bson:"unread"`
+	Time       time.Time     `json:"time"                  bson:"time"`
+}
+
+// GroupMessage is a message in group chat, stored in single copy
+type GroupMessage struct {
+	Id       bson.ObjectId `json:"id"                  bson:"_id"`
+	Chat     bson.ObjectId `json:"chat"                bson:"chat"`
+	Origin   bson.ObjectId `json:"origin"              bson:"origin"`
+	Text     string        `json:"text"                bson:"text"`
+	Photo    string        `json:"photo,omitempty"     bson:"photo,omitempty"`
+	PhotoUrl string        `json:"photo_url,omitempty" bson:"-"`
+	Time     time.Time     `json:"time"                bson:"time"`
+}
+
+type GroupMessages []*GroupMessage
+
+// NewTripGroupChat returns group chat for participants of trip
+func NewTripGroupChat(trip *Trip) *GroupChat {
+	chat := &GroupChat{Trip: trip.Id, Owner: trip.User}
+	chat.Title = strings.Join(trip.Destinations, ", ")
+	if len([]rune(chat.Title)) > groupTitleMax {
+		chat.Title = string([]rune(chat.Title)[:groupTitleMax])
+	}
+	return chat
+}
+
+// Validate checks title of group chat
+func (c *GroupChat) Validate() error {
+	if len([]rune(c.Title)) > groupTitleMax {
+		return ErrGroupTitleTooLong
+	}
+	return nil
+}
+
+// SetMember sets state of current user in chat from membership
+func (c *GroupChat) SetMember(m *GroupMember) {
+	c.Role = m.Role
+	c.Muted = m.Muted
+	c.Unread = m.Unread
+}
+
+// Validate checks that message is not blank
+func (m *GroupMessage) Validate() error {
+	if strings.TrimSpace(m.Text) == "" && m.Photo == "" {
+		return ErrGroupBlankMessage
+	}
+	return nil
+}
+
+func (c *GroupChat) Prepare(context Context) error {
+	for _, m := range c.Members {
+		if err := m.Prepare(context); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (chats GroupChats) Prepare(context Context) error {
+	for _, c := range chats {
+		if err := c.Prepare(context); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *GroupMember) Prepare(context Context) error {
+	m.UserObject = preparedUser(context, m.UserObject, m.User)
+	return nil
+}
+
+// Prepare sets the url for attachment photo
+func (m *GroupMessage) Prepare(context Context) error {
+	if len(m.Photo) == 0 {
+		return nil
+	}
+	url, err := context.Storage.URL(m.Photo)
+	if err != nil {
+		return err
+	}
+	m.PhotoUrl = url
+	return nil
+}
+
+func (messages GroupMessages) Prepare(context Context) error {
+	for _, m := range messages {
+		if err := m.Prepare(context); err != nil {
+			return err
+		}
+	}
+	return nil
+}
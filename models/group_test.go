@@ -0,0 +1,40 @@
+package models
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+	"strings"
+	"testing"
+)
+
+func TestGroupChat(t *testing.T) {
+	Convey("Trip group chat", t, func() {
+		trip := &Trip{Id: bson.NewObjectId(), User: bson.NewObjectId(), Destinations: []string{"Москва", "Париж"}}
+		chat := NewTripGroupChat(trip)
+		So(chat.Trip, ShouldEqual, trip.Id)
+		So(chat.Owner, ShouldEqual, trip.User)
+		So(chat.Title, ShouldEqual, "Москва, Париж")
+		So(chat.Validate(), ShouldBeNil)
+		Convey("Long title", func() {
+			trip.Destinations = []string{"Москва", strings.Repeat("а", groupTitleMax*2)}
+			chat := NewTripGroupChat(trip)
+			So(chat.Validate(), ShouldBeNil)
+			So(len([]rune(chat.Title)), ShouldEqual, groupTitleMax)
+			So(chat.Title, ShouldStartWith, "Москва, ")
+			So(chat.Title, ShouldEndWith, strings.Repeat("а", groupTitleMax-len([]rune("Москва, "))))
+		})
+	})
+	Convey("Group message", t, func() {
+		m := &GroupMessage{Text: "  "}
+		So(m.Validate(), ShouldEqual, ErrGroupBlankMessage)
+		m.Text = "привет"
+		So(m.Validate(), ShouldBeNil)
+	})
+	Convey("Group member state", t, func() {
+		chat := new(GroupChat)
+		chat.SetMember(&GroupMember{Role: GroupRoleMember, Muted: true, Unread: 3})
+		So(chat.Role, ShouldEqual, GroupRoleMember)
+		So(chat.Muted, ShouldBeTrue)
+		So(chat.Unread, ShouldEqual, 3)
+	})
+}
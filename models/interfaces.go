@@ -187,12 +187,37 @@ type DataBase interface {
 	AddInvite(i *Invite) error
 	GetMessagesFromUser(userReciever bson.ObjectId, userOrigin bson.ObjectId, paginaton Pagination) (messages Messages, err error)
 	GetMessage(id bson.ObjectId) (message *Message, err error)
-	RemoveMessage(id bson.ObjectId) error
+	RemoveMessage(user, id bson.ObjectId) error
+	EditMessage(m *Message, previous string) error
+	UnsendMessage(id bson.ObjectId) error
+	SetMessageProcessed(id bson.ObjectId, failed bool) error
+	SearchMessages(user, peer bson.ObjectId, q string, pagination Pagination) ([]*MessageSearchResult, int, error)
 	GetChats(id bson.ObjectId) ([]*Dialog, error)
+	GetDialogs(id bson.ObjectId, filter *DialogFilter, pagination Pagination) ([]*Dialog, int, error)
+	SetConversationState(user, peer bson.ObjectId, field string, value bool) error
 	SetRead(user, id bson.ObjectId) error
 	SetReadMessagesFromUser(userReciever bson.ObjectId, userOrigin bson.ObjectId) error
 	GetUnreadCount(id bson.ObjectId) (int, error)
 	RemoveChat(userReciever bson.ObjectId, userOrigin bson.ObjectId) error
+	GetConversation(a, b bson.ObjectId) (*Conversation, error)
+	MigrateMessages() (int, error)
+
+	SetSpamFlag(id bson.ObjectId, flag *SpamFlag) error
+	RemoveSpamFlag(id bson.ObjectId) error
+	GetSpamReports(pagination Pagination) ([]*SpamReport, int, error)
+
+	AddModerationItem(item *ModerationItem) error
+	GetModerationQueue(pagination Pagination) ([]*ModerationItem, int, error)
+	GetModerationItem(id bson.ObjectId) (*ModerationItem, error)
+	SetModerationState(id bson.ObjectId, state string) (*ModerationItem, error)
+
+	AddBroadcast(b *Broadcast) error
+	GetBroadcast(id bson.ObjectId) (*Broadcast, error)
+	GetBroadcasts(pagination Pagination) ([]*Broadcast, int, error)
+	GetUnfinishedBroadcasts() ([]*Broadcast, error)
+	SetBroadcastProgress(b *Broadcast) error
+	CountBroadcastRecipients(q *SearchQuery) (int, error)
+	GetBroadcastRecipients(q *SearchQuery, after bson.ObjectId, count int) ([]*User, error)
 
 	AddToBlacklist(id bson.ObjectId, blacklisted bson.ObjectId) error
 	RemoveFromBlacklist(id bson.ObjectId, blacklisted bson.ObjectId) error
@@ -208,6 +233,7 @@ type DataBase interface {
 	RegisteredCount(duration time.Duration) int
 	SetOnline(id bson.ObjectId) error
 	SetOffline(id bson.ObjectId) error
+	SetPresence(id bson.ObjectId, online bool, lastAction time.Time) error
 
 	SetRating(id bson.ObjectId, rating float64) error
 	ChangeRating(id bson.ObjectId, delta float64) error
@@ -295,11 +321,20 @@ type DataBase interface {
 	GetActivityCount(user bson.ObjectId, key string, duration time.Duration) (count int, err error)
 	AddActivity(user bson.ObjectId, key string) error
 	UserIsSubscribed(id bson.ObjectId, subscription string) (bool, error)
+	SetNotifications(id bson.ObjectId, notifications Notifications) error
+	SetDigestPeriod(id bson.ObjectId, period string) error
+	SetDigestSent(id bson.ObjectId, t time.Time) error
+	AddDigestItem(item *DigestItem) error
+	GetDigestUsers() ([]bson.ObjectId, error)
+	GetDigestItems(user bson.ObjectId) ([]*DigestItem, error)
+	RemoveDigestItems(ids []bson.ObjectId) error
 	AddUpdateDirect(u *Update) (*Update, error)
 	GetUpdatesCount(destination bson.ObjectId) ([]*UpdateCounter, error)
 	GetUpdates(destination bson.ObjectId, t string, pagination Pagination) ([]*Update, error)
+	GetUpdatesAfter(destinations []bson.ObjectId, after bson.ObjectId, count int) ([]*Update, error)
 	SetUpdateRead(destination, id bson.ObjectId) error
 	SetUpdatesRead(destination bson.ObjectId, t string) error
+	GetUnreadUpdateIds(ids []bson.ObjectId) ([]bson.ObjectId, error)
 	IsUpdateDublicate(origin, destination bson.ObjectId, t string, duration time.Duration) (bool, error)
 	GetLastMessageIdFromUser(userReciever bson.ObjectId, userOrigin bson.ObjectId) (id bson.ObjectId, err error)
 
@@ -324,6 +359,67 @@ type DataBase interface {
 
 	ActiveCount(duration time.Duration) int
 
+	// trips
+	// api/trip/:id
+	AddTrip(trip *Trip) (*Trip, error)
+	GetTrip(id bson.ObjectId) (*Trip, error)
+	UpdateTripSecure(user, id bson.ObjectId, trip *Trip) (*Trip, error)
+	RemoveTripSecure(user, id bson.ObjectId) error
+	// api/user/:id/trips
+	GetUserTrips(user bson.ObjectId) ([]*Trip, error)
+	GetParticipantTrips(user bson.ObjectId) ([]*Trip, error)
+	// api/user/:id/calendar
+	SetCalendarToken(id bson.ObjectId, token string) error
+	// api/trip/search
+	SearchTrips(query *TripQuery, user bson.ObjectId) ([]*Trip, error)
+	AddTripParticipant(id, user bson.ObjectId) error
+
+	// invitations
+	// api/invite/:id
+	AddInvitation(i *Invitation) (*Invitation, error)
+	GetInvitation(id bson.ObjectId) (*Invitation, error)
+	HasPendingInvitation(origin, destination, trip bson.ObjectId) (bool, error)
+	SetInvitationState(id bson.ObjectId, state string, t time.Time) error
+	RevertInvitationState(id bson.ObjectId, state string, t time.Time) error
+	SetInvitationTrip(id, trip bson.ObjectId) error
+	GetExpiredInvitations(t time.Time) ([]*Invitation, error)
+	// api/invite
+	GetInvitations(user bson.ObjectId, q *InvitationQuery, pagination Pagination) ([]*Invitation, int, error)
+
+	// group chats
+	// api/group/:id
+	AddGroupChat(chat *GroupChat) (*GroupChat, error)
+	GetGroupChat(id bson.ObjectId) (*GroupChat, error)
+	GetTripGroupChat(trip bson.ObjectId) (*GroupChat, error)
+	AddGroupMember(chat, user bson.ObjectId, role string) error
+	RemoveGroupMember(chat, user bson.ObjectId) error
+	GetGroupMember(chat, user bson.ObjectId) (*GroupMember, error)
+	GetGroupMembers(chat bson.ObjectId) ([]*GroupMember, error)
+	SetGroupMemberMuted(chat, user bson.ObjectId, muted bool) error
+	// api/group/:id/messages
+	AddGroupMessage(m *GroupMessage) error
+	GetGroupMessages(chat bson.ObjectId, pagination Pagination) ([]*GroupMessage, error)
+	SetGroupChatRead(chat, user bson.ObjectId) error
+	// api/group
+	GetUserGroupChats(user bson.ObjectId) ([]*GroupChat, error)
+
+	// reviews
+	// api/review/:id
+	AddReview(r *Review) (*Review, error)
+	GetReview(id bson.ObjectId) (*Review, error)
+	GetCounterReview(r *Review) (*Review, error)
+	RevealReview(id bson.ObjectId, t time.Time) error
+	GetUnrevealedReviews(t time.Time) ([]*Review, error)
+	SetReviewDispute(id, user bson.ObjectId, reason string) error
+	ResolveReviewDispute(id bson.ObjectId) error
+	RemoveReview(id bson.ObjectId) error
+	// api/review
+	GetAuthorReviews(user bson.ObjectId, pagination Pagination) ([]*Review, int, error)
+	GetDisputedReviews(pagination Pagination) ([]*Review, int, error)
+	// api/user/:id/reviews
+	GetUserReviews(user bson.ObjectId, pagination Pagination) ([]*Review, int, error)
+	GetReviewStats(user bson.ObjectId) (*ReviewStats, error)
+
 	// all
 	GetAllAudio() ([]*Audio, error)
 	GetAllVideo() ([]*Video, error)
@@ -331,8 +427,11 @@ type DataBase interface {
 
 type RealtimeInterface interface {
 	Updater
-	RealtimeHandler(w http.ResponseWriter, context Context) (int, []byte)
-	// PushAll(update Update) error
+	RealtimeHandler(w http.ResponseWriter, context Context, injector martini.Context) (int, []byte)
+	EventStreamHandler(w http.ResponseWriter, context Context)
+	PollHandler(context Context) (int, []byte)
+	PushGlobal(update Update) error
+	Metrics() RealtimeMetrics
 }
 
 type Updater interface {
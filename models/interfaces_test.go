@@ -34,7 +34,21 @@ func TestImplementation(t *testing.T) {
 		ShouldPrepare(VideoSlice{})
 		ShouldPrepare(&Status{})
 		ShouldPrepare(&Message{})
+		ShouldPrepare(MessageSearchResults{})
+		ShouldPrepare(SpamReports{})
+		ShouldPrepare(&Broadcast{})
+		ShouldPrepare(Broadcasts{})
 		ShouldPrepare(&StripeItem{})
 		ShouldPrepare(&Update{})
+		ShouldPrepare(&Trip{})
+		ShouldPrepare(Trips{})
+		ShouldPrepare(&Invitation{})
+		ShouldPrepare(Invitations{})
+		ShouldPrepare(&GroupChat{})
+		ShouldPrepare(GroupChats{})
+		ShouldPrepare(&GroupMember{})
+		ShouldPrepare(GroupMessages{})
+		ShouldPrepare(&Review{})
+		ShouldPrepare(Reviews{})
 	})
 }
@@ -0,0 +1,220 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	InvitationPending   = "pending"
+	InvitationAccepted  = "accepted"
+	InvitationDeclined  = "declined"
+	InvitationExpired   = "expired"
+	InvitationWithdrawn = "withdrawn"
+
+	InvitationsIncoming = "incoming"
+	InvitationsOutgoing = "outgoing"
+
+	InvitationTTL     = time.Hour * 24 * 30
+	invitationNoteMax = 500
+)
+
+var (
+	InvitationStates = []string{InvitationPending, InvitationAccepted, InvitationDeclined, InvitationExpired,
+		InvitationWithdrawn}
+	ErrInvitationNotPending = errors.New("Приглашение уже не активно")
+	ErrInvitationNotAllowed = errors.New("Недостаточно прав для изменения приглашения")
+	ErrInvitationTripEnded  = errors.New("Поездка уже закончилась")
+	ErrInvitationTripFull   = errors.New("В поездке нет свободных мест")
+)
+
+// Invitation is an invitation of user to a trip of other user or to an ad-hoc
+// travel with provided destinations and dates
+type Invitation struct {
+	Id                bson.ObjectId `json:"id"                           bson:"_id"`
+	Origin            bson.ObjectId `json:"origin"                       bson:"origin"`
+	OriginObject      *User         `json:"origin_object,omitempty"      bson:"-"`
+	Destination       bson.ObjectId `json:"destination"                  bson:"destination"`
+	DestinationObject *User         `json:"destination_object,omitempty" bson:"-"`
+	Trip              bson.ObjectId `json:"trip,omitempty"               bson:"trip,omitempty"`
+	TripObject        *Trip         `json:"trip_object,omitempty"        bson:"-"`
+	Destinations      []string      `json:"destinations,omitempty"       bson:"destinations,omitempty"`
+	Start             time.Time     `json:"start,omitempty"              bson:"start,omitempty"`
+	End               time.Time     `json:"end,omitempty"                bson:"end,omitempty"`
+	Month             int           `json:"month,omitempty"              bson:"-"`
+	Year              int           `json:"year,omitempty"               bson:"-"`
+	Note              string        `json:"note,omitempty"               bson:"note,omitempty"`
+	State             string        `json:"state"                        bson:"state"`
+	Time              time.Time     `json:"time"                         bson:"time"`
+	Updated           time.Time     `json:"updated"                      bson:"updated"`
+	Expires           time.Time     `json:"expires"                      bson:"expires"`
+}
+
+type Invitations []*Invitation
+
+// InvitationQuery represents filter of user invitations
+type InvitationQuery struct {
+	State string `json:"state"`
+	Type  string `json:"type"`
+}
+
+// NewInvitationQuery returns invitation query with parsed fields from url params
+func NewInvitationQuery(q url.Values) (*InvitationQuery, error) {
+	query := &InvitationQuery{}
+	return query, mapToStructValue(q, query)
+}
+
+func (q *InvitationQuery) Validate() error {
+	if q.State != "" && !contains(InvitationStates, q.State) {
+		return fmt.Errorf("Неизвестное состояние приглашения %s", q.State)
+	}
+	if q.Type != "" && q.Type != InvitationsIncoming && q.Type != InvitationsOutgoing {
+		return fmt.Errorf("Неизвестный тип приглашений %s", q.Type)
+	}
+	return nil
+}
+
+// ToBson generates mongo query for invitations of user
+func (q *InvitationQuery) ToBson(user bson.ObjectId) bson.M {
+	var query bson.M
+	switch q.Type {
+	case InvitationsIncoming:
+		query = bson.M{"destination": user}
+	case InvitationsOutgoing:
+		query = bson.M{"origin": user}
+	default:
+		query = bson.M{"$or": []bson.M{{"origin": user}, {"destination": user}}}
+	}
+	if q.State != "" {
+		query["state"] = q.State
+	}
+	return query
+}
+
+// Normalize checks ad-hoc trip fields and sets state and expiration time
+// of new invitation. The trip must be provided if invitation references it.
+// Invitation expires at start of trip, or at its end if trip has started.
+func (i *Invitation) Normalize(trip *Trip, now time.Time) error {
+	if len([]rune(i.Note)) > invitationNoteMax {
+		return fmt.Errorf("Длина сообщения не должна превышать %d символов", invitationNoteMax)
+	}
+	if trip != nil {
+		i.Trip = trip.Id
+		i.Destinations = trip.Destinations
+		i.Start = trip.Start
+		i.End = trip.End
+	} else if len(i.Destinations) > 0 {
+		t := &Trip{Destinations: i.Destinations, Start: i.Start, End: i.End, Month: i.Month, Year: i.Year}
+		if err := t.Normalize(now); err != nil {
+			return err
+		}
+		i.Start, i.End = t.Start, t.End
+	}
+	if !i.End.IsZero() && !i.End.After(now) {
+		return ErrInvitationTripEnded
+	}
+	i.State = InvitationPending
+	i.Time = now
+	i.Updated = now
+	i.Expires = now.Add(InvitationTTL)
+	switch {
+	case i.Start.After(now) && i.Start.Before(i.Expires):
+		i.Expires = i.Start
+	case !i.Start.After(now) && !i.End.IsZero() && i.End.Before(i.Expires):
+		i.Expires = i.End
+	}
+	return nil
+}
+
+// Transition checks that user can change state of invitation to provided
+// one and changes it
+func (i *Invitation) Transition(user bson.ObjectId, state string, now time.Time) error {
+	if i.State != InvitationPending {
+		return ErrInvitationNotPending
+	}
+	switch state {
+	case InvitationAccepted, InvitationDeclined:
+		if user != i.Destination {
+			return ErrInvitationNotAllowed
+		}
+	case InvitationWithdrawn:
+		if user != i.Origin {
+			return ErrInvitationNotAllowed
+		}
+	case InvitationExpired:
+		if now.Before(i.Expires) {
+			return ErrInvitationNotAllowed
+		}
+	default:
+		return fmt.Errorf("Неизвестное состояние приглашения %s", state)
+	}
+	i.State = state
+	i.Updated = now
+	return nil
+}
+
+// Other returns id of the other side of invitation for user
+func (i *Invitation) Other(user bson.ObjectId) bson.ObjectId {
+	if user == i.Origin {
+		return i.Destination
+	}
+	return i.Origin
+}
+
+// Theme returns subject of notification about invitation for destination
+// of notification, where name is name of user on the other side
+func (i *Invitation) Theme(destination bson.ObjectId, name string) string {
+	switch i.State {
+	case InvitationAccepted:
+		return fmt.Sprintf("Пользователь %s принял ваше приглашение", name)
+	case InvitationDeclined:
+		return fmt.Sprintf("Пользователь %s отклонил ваше приглашение", name)
+	case InvitationWithdrawn:
+		return fmt.Sprintf("Пользователь %s отозвал приглашение", name)
+	case InvitationExpired:
+		if destination == i.Origin {
+			return fmt.Sprintf("Истек срок вашего приглашения пользователю %s", name)
+		}
+		return fmt.Sprintf("Истек срок приглашения от пользователя %s", name)
+	}
+	return fmt.Sprintf("Пользователь %s пригласил вас в путешествие", name)
+}
+
+// preparedUser loads user if needed and prepares it for public output
+func preparedUser(context Context, u *User, id bson.ObjectId) *User {
+	if u == nil {
+		u = context.DB.Get(id)
+	}
+	if u == nil {
+		return nil
+	}
+	u.Prepare(context)
+	u.CleanPrivate()
+	return u
+}
+
+// Prepare sets user and trip objects of invitation
+func (i *Invitation) Prepare(context Context) error {
+	i.OriginObject = preparedUser(context, i.OriginObject, i.Origin)
+	i.DestinationObject = preparedUser(context, i.DestinationObject, i.Destination)
+	if i.Trip.Valid() && i.TripObject == nil {
+		trip, err := context.DB.GetTrip(i.Trip)
+		if err == nil {
+			i.TripObject = trip
+		}
+	}
+	return nil
+}
+
+func (invitations Invitations) Prepare(context Context) error {
+	for _, i := range invitations {
+		if err := i.Prepare(context); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package models
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+	"time"
+)
+
+func TestInvitation(t *testing.T) {
+	now := time.Date(2015, time.June, 10, 15, 0, 0, 0, time.UTC)
+	origin, destination := bson.NewObjectId(), bson.NewObjectId()
+	Convey("Normalize invitation", t, func() {
+		i := &Invitation{Origin: origin, Destination: destination}
+		Convey("Without trip", func() {
+			So(i.Normalize(nil, now), ShouldBeNil)
+			So(i.State, ShouldEqual, InvitationPending)
+			So(i.Expires, ShouldResemble, now.Add(InvitationTTL))
+		})
+		Convey("Ad-hoc", func() {
+			i.Destinations = []string{"Москва"}
+			i.Month = 6
+			So(i.Normalize(nil, now), ShouldBeNil)
+			So(i.Start, ShouldResemble, time.Date(2015, time.June, 1, 0, 0, 0, 0, time.UTC))
+			So(i.Expires, ShouldResemble, i.End)
+		})
+		Convey("Ad-hoc in future", func() {
+			i.Destinations = []string{"Москва"}
+			i.Month = 7
+			So(i.Normalize(nil, now), ShouldBeNil)
+			So(i.Expires, ShouldResemble, i.Start)
+		})
+		Convey("Trip", func() {
+			trip := &Trip{Id: bson.NewObjectId(), Destinations: []string{"Москва"},
+				Start: now.AddDate(0, 0, 5), End: now.AddDate(0, 0, 10)}
+			So(i.Normalize(trip, now), ShouldBeNil)
+			So(i.Trip, ShouldEqual, trip.Id)
+			So(i.Expires, ShouldResemble, trip.Start)
+		})
+		Convey("Started trip", func() {
+			trip := &Trip{Id: bson.NewObjectId(), Destinations: []string{"Москва"},
+				Start: now.AddDate(0, 0, -5), End: now.AddDate(0, 0, 10)}
+			So(i.Normalize(trip, now), ShouldBeNil)
+			So(i.Expires, ShouldResemble, trip.End)
+		})
+		Convey("Ended trip", func() {
+			trip := &Trip{Id: bson.NewObjectId(), Destinations: []string{"Москва"},
+				Start: now.AddDate(0, 0, -10), End: now.AddDate(0, 0, -5)}
+			So(i.Normalize(trip, now), ShouldEqual, ErrInvitationTripEnded)
+		})
+	})
+	Convey("Invitation transitions", t, func() {
+		i := &Invitation{Origin: origin, Destination: destination}
+		So(i.Normalize(nil, now), ShouldBeNil)
+		Convey("Accept", func() {
+			So(i.Transition(origin, InvitationAccepted, now), ShouldEqual, ErrInvitationNotAllowed)
+			So(i.Transition(destination, InvitationAccepted, now), ShouldBeNil)
+			So(i.State, ShouldEqual, InvitationAccepted)
+			So(i.Transition(destination, InvitationDeclined, now), ShouldEqual, ErrInvitationNotPending)
+		})
+		Convey("Withdraw", func() {
+			So(i.Transition(destination, InvitationWithdrawn, now), ShouldEqual, ErrInvitationNotAllowed)
+			So(i.Transition(origin, InvitationWithdrawn, now), ShouldBeNil)
+		})
+		Convey("Expire", func() {
+			So(i.Transition("", InvitationExpired, now), ShouldEqual, ErrInvitationNotAllowed)
+			So(i.Transition("", InvitationExpired, i.Expires), ShouldBeNil)
+			So(i.Theme(origin, "Анна"), ShouldEqual, "Истек срок вашего приглашения пользователю Анна")
+			So(i.Theme(destination, "Иван"), ShouldEqual, "Истек срок приглашения от пользователя Иван")
+		})
+		Convey("Unknown", func() {
+			So(i.Transition(origin, "lol", now), ShouldNotBeNil)
+		})
+	})
+	Convey("Invitation query", t, func() {
+		user := bson.NewObjectId()
+		q := &InvitationQuery{State: InvitationPending, Type: InvitationsIncoming}
+		So(q.Validate(), ShouldBeNil)
+		query := q.ToBson(user)
+		So(query["destination"], ShouldEqual, user)
+		So(query["state"], ShouldEqual, InvitationPending)
+		q.State = "lol"
+		So(q.Validate(), ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,154 @@
+package models
+
+import (
+	"bytes"
+	"errors"
+	"html"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	SnippetHighlightStart = "<b>"
+	SnippetHighlightEnd   = "</b>"
+	SnippetEllipsis       = "…"
+
+	// snippetRadius is amount of words shown before and after first match
+	snippetRadius = 6
+	// stemMin is minimum length of word stem in runes
+	stemMin = 3
+)
+
+var ErrBlankQuery = errors.New("Пустой поисковый запрос")
+
+// russianEndings are inflectional endings, longest first, that are
+// stripped during normalisation of russian words
+var russianEndings = []string{
+	"иями", "ями", "ами", "ого", "его", "ому", "ему", "ыми", "ими", "ать", "ять", "ить", "еть",
+	"ой", "ей", "ий", "ый", "ая", "яя", "ое", "ее", "ые", "ие", "ов", "ев", "ам", "ям",
+	"ах", "ях", "ом", "ем", "ую", "юю", "ешь", "ет", "ут", "ют", "ит", "ат", "ят",
+	"а", "я", "о", "е", "ы", "и", "у", "ю", "ь", "й",
+}
+
+// MessageSearchResult is a message found by search with highlighted
+// snippet of text and ids of neighbouring messages of conversation
+type MessageSearchResult struct {
+	Message  *Message      `json:"message"`
+	Snippet  string        `json:"snippet"`
+	Previous bson.ObjectId `json:"previous,omitempty"`
+	Next     bson.ObjectId `json:"next,omitempty"`
+}
+
+type MessageSearchResults []*MessageSearchResult
+
+func (results MessageSearchResults) Prepare(context Context) error {
+	for _, r := range results {
+		if err := r.Message.Prepare(context); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NormalizeWord returns lowercased word with "ё" replaced by "е" and
+// common russian endings stripped
+func NormalizeWord(word string) string {
+	word = strings.Replace(strings.ToLower(word), "ё", "е", -1)
+	for _, ending := range russianEndings {
+		if !strings.HasSuffix(word, ending) {
+			continue
+		}
+		stem := strings.TrimSuffix(word, ending)
+		if utf8.RuneCountInString(stem) >= stemMin {
+			return stem
+		}
+	}
+	return word
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// splitWords splits text to words and separators between them, so that
+// joining of all parts returns original text
+func splitWords(text string) (parts []string, words []bool) {
+	start := 0
+	for i, r := range text {
+		if i == 0 {
+			continue
+		}
+		prev, _ := utf8.DecodeLastRuneInString(text[:i])
+		if isWordRune(prev) != isWordRune(r) {
+			parts = append(parts, text[start:i])
+			start = i
+		}
+	}
+	if start < len(text) {
+		parts = append(parts, text[start:])
+	}
+	for _, part := range parts {
+		r, _ := utf8.DecodeRuneInString(part)
+		words = append(words, isWordRune(r))
+	}
+	return parts, words
+}
+
+// QueryTerms returns normalized words of search query
+func QueryTerms(q string) []string {
+	var terms []string
+	parts, words := splitWords(q)
+	for i, part := range parts {
+		if words[i] {
+			terms = append(terms, NormalizeWord(part))
+		}
+	}
+	return terms
+}
+
+// MessageSnippet returns html-escaped fragment of text around the first
+// word matching query, with all matching words highlighted
+func MessageSnippet(text, q string) string {
+	terms := QueryTerms(q)
+	parts, words := splitWords(text)
+	matches := make([]bool, len(parts))
+	first := -1
+	for i, part := range parts {
+		if !words[i] || !contains(terms, NormalizeWord(part)) {
+			continue
+		}
+		matches[i] = true
+		if first < 0 {
+			first = i
+		}
+	}
+	if first < 0 {
+		first = 0
+	}
+	// each word is followed by separator, so radius in parts is doubled
+	from, to := first-snippetRadius*2, first+snippetRadius*2+1
+	if from < 0 {
+		from = 0
+	}
+	if to > len(parts) {
+		to = len(parts)
+	}
+	var b bytes.Buffer
+	if from > 0 {
+		b.WriteString(SnippetEllipsis)
+	}
+	for i := from; i < to; i++ {
+		if matches[i] {
+			b.WriteString(SnippetHighlightStart + html.EscapeString(parts[i]) + SnippetHighlightEnd)
+			continue
+		}
+		b.WriteString(html.EscapeString(parts[i]))
+	}
+	if to < len(parts) {
+		b.WriteString(SnippetEllipsis)
+	}
+	return strings.TrimSpace(b.String())
+}
@@ -0,0 +1,38 @@
+package models
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMessageSearch(t *testing.T) {
+	Convey("Normalisation", t, func() {
+		So(NormalizeWord("Москва"), ShouldEqual, NormalizeWord("москву"))
+		So(NormalizeWord("Москвой"), ShouldEqual, NormalizeWord("МОСКВЕ"))
+		So(NormalizeWord("ёлка"), ShouldEqual, NormalizeWord("елки"))
+		So(NormalizeWord("поезд"), ShouldEqual, "поезд")
+		So(NormalizeWord("мы"), ShouldEqual, "мы")
+	})
+	Convey("Query terms", t, func() {
+		So(QueryTerms(" поездка, в Москву! "), ShouldResemble, []string{"поездк", "в", "москв"})
+		So(len(QueryTerms(" ,.! ")), ShouldEqual, 0)
+	})
+	Convey("Snippet", t, func() {
+		Convey("Should highlight matching words", func() {
+			So(MessageSnippet("Поедем в Москву завтра?", "москва"), ShouldEqual, "Поедем в <b>Москву</b> завтра?")
+		})
+		Convey("Should escape html", func() {
+			So(MessageSnippet("<i>Москва</i>", "москва"), ShouldEqual, "&lt;i&gt;<b>Москва</b>&lt;/i&gt;")
+		})
+		Convey("Should cut long text around first match", func() {
+			text := "один два три четыре пять шесть семь восемь девять десять Москва " +
+				"один два три четыре пять шесть семь восемь девять десять"
+			snippet := MessageSnippet(text, "москве")
+			So(snippet, ShouldEqual, SnippetEllipsis+"пять шесть семь восемь девять десять <b>Москва</b> один два три четыре пять шесть"+SnippetEllipsis)
+		})
+		Convey("Should return beginning of text without match", func() {
+			So(MessageSnippet("Привет", "пока"), ShouldEqual, "Привет")
+		})
+	})
+}
@@ -0,0 +1,316 @@
+package models
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	ModerationAllow  = "allow"
+	ModerationMask   = "mask"
+	ModerationHold   = "hold"
+	ModerationReject = "reject"
+
+	ModerationStopWords = "stopwords"
+	ModerationPhone     = "phone"
+	ModerationLink      = "link"
+	ModerationMessenger = "messenger"
+	ModerationObscenity = "obscenity"
+
+	ModerationStatus  = "status"
+	ModerationMessage = "message"
+	ModerationAbout   = "about"
+
+	ModerationPending  = "pending"
+	ModerationApproved = "approved"
+	ModerationRejected = "rejected"
+
+	moderationMaskRune = '*'
+	// phoneDigitsMin is minimum amount of digits in phone number
+	phoneDigitsMin = 10
+)
+
+var ErrModerationRejected = errors.New("Текст содержит недопустимое содержимое")
+
+// moderationSeverity orders actions, so the strictest action of matched
+// rules is applied
+var moderationSeverity = map[string]int{
+	ModerationAllow:  0,
+	ModerationMask:   1,
+	ModerationHold:   2,
+	ModerationReject: 3,
+}
+
+var (
+	phoneRegexp     = regexp.MustCompile(`\+?\d[\d\s\-\(\)\.]{8,}\d`)
+	dateRegexp      = regexp.MustCompile(`\b\d{1,2}\.\d{1,2}\.(?:\d{4}|\d{2})\b`)
+	linkRegexp      = regexp.MustCompile(`(?i)(?:https?://|www\.)\S+|(?:\b[a-z0-9][a-z0-9\-]*\.(?:ru|su|com|net|org|info|me|io)\b|[\p{L}\d\-]+\.рф)(?:/\S*)?`)
+	messengerRegexp = regexp.MustCompile(`(?i)@[a-z0-9_]{4,}|t\.me/\S+|telegram|whats\s?app|viber|skype|телеграм\p{L}*|телега|ват?сап\p{L}*|вотсап\p{L}*|вайбер\p{L}*|скайп\p{L}*`)
+)
+
+// obscenityPrefixes are roots of russian obscene words that are matched at
+// the beginning of word
+var obscenityPrefixes = []string{"бля", "еб", "сука", "суки", "шлюх", "мудак", "мудил"}
+
+// obscenityRoots are roots of russian obscene words that are matched at
+// any position of word
+var obscenityRoots = []string{
+	"хуй", "хуе", "хуя", "хую", "хуи", "пизд", "залуп", "пидор", "пидар", "гандон",
+	"заеб", "выеб", "наеб", "уеб", "съеб", "отъеб", "проеб", "долбоеб",
+}
+
+// ModerationPolicy configures actions of moderation rules and list of
+// stop-words
+type ModerationPolicy struct {
+	Actions   map[string]string `json:"actions"`
+	StopWords []string          `json:"stop_words"`
+}
+
+// DefaultModerationPolicy masks links and obscenity and holds contacts for
+// review, so paid contacts can not be bypassed
+func DefaultModerationPolicy() ModerationPolicy {
+	return ModerationPolicy{
+		Actions: map[string]string{
+			ModerationStopWords: ModerationReject,
+			ModerationPhone:     ModerationHold,
+			ModerationLink:      ModerationMask,
+			ModerationMessenger: ModerationHold,
+			ModerationObscenity: ModerationMask,
+		},
+	}
+}
+
+// Validate checks that all actions of policy are known
+func (p ModerationPolicy) Validate() error {
+	for rule, action := range p.Actions {
+		if _, ok := moderationSeverity[action]; !ok {
+			return errors.New("unknown action " + action + " of rule " + rule)
+		}
+	}
+	return nil
+}
+
+// ModerationResult is a result of checking text by moderation rules
+type ModerationResult struct {
+	Action string   `json:"action"`
+	Rules  []string `json:"rules"`
+	Text   string   `json:"text"`
+}
+
+// Moderator checks user-generated texts by rules of policy
+type Moderator struct {
+	policy    ModerationPolicy
+	stopWords []string
+}
+
+func NewModerator(policy ModerationPolicy) *Moderator {
+	m := &Moderator{policy: policy}
+	for _, word := range policy.StopWords {
+		m.stopWords = append(m.stopWords, NormalizeWord(word))
+	}
+	return m
+}
+
+type textSpan struct {
+	start, end int
+}
+
+type spansByStart []textSpan
+
+func (a spansByStart) Len() int {
+	return len(a)
+}
+
+func (a spansByStart) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+}
+
+func (a spansByStart) Less(i, j int) bool {
+	return a[i].start < a[j].start
+}
+
+func regexpSpans(re *regexp.Regexp, text string) []textSpan {
+	var spans []textSpan
+	for _, loc := range re.FindAllStringIndex(text, -1) {
+		spans = append(spans, textSpan{loc[0], loc[1]})
+	}
+	return spans
+}
+
+// phoneSpans returns spans of phone numbers, skipping dates, so ranges
+// of dates are not matched as numbers
+func phoneSpans(text string) []textSpan {
+	var spans []textSpan
+	text = dateRegexp.ReplaceAllStringFunc(text, func(date string) string {
+		return strings.Repeat(" ", len(date))
+	})
+	for _, span := range regexpSpans(phoneRegexp, text) {
+		digits := 0
+		for _, r := range text[span.start:span.end] {
+			if r >= '0' && r <= '9' {
+				digits++
+			}
+		}
+		if digits >= phoneDigitsMin {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+// wordSpans returns spans of words of text that match provided function
+func wordSpans(text string, match func(word string) bool) []textSpan {
+	var spans []textSpan
+	parts, words := splitWords(text)
+	offset := 0
+	for i, part := range parts {
+		if words[i] && match(part) {
+			spans = append(spans, textSpan{offset, offset + len(part)})
+		}
+		offset += len(part)
+	}
+	return spans
+}
+
+// IsObscene returns true if word is russian obscenity
+func IsObscene(word string) bool {
+	word = strings.Replace(strings.ToLower(word), "ё", "е", -1)
+	for _, prefix := range obscenityPrefixes {
+		if strings.HasPrefix(word, prefix) {
+			return true
+		}
+	}
+	for _, root := range obscenityRoots {
+		if strings.Contains(word, root) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Moderator) spans(rule, text string) []textSpan {
+	switch rule {
+	case ModerationStopWords:
+		return wordSpans(text, func(word string) bool {
+			return contains(m.stopWords, NormalizeWord(word))
+		})
+	case ModerationPhone:
+		return phoneSpans(text)
+	case ModerationLink:
+		return regexpSpans(linkRegexp, text)
+	case ModerationMessenger:
+		return regexpSpans(messengerRegexp, text)
+	case ModerationObscenity:
+		return wordSpans(text, IsObscene)
+	}
+	return nil
+}
+
+// maskSpans replaces all runes of spans except the first one with stars
+func maskSpans(text string, spans []textSpan) string {
+	if len(spans) == 0 {
+		return text
+	}
+	sort.Sort(spansByStart(spans))
+	parts := []string{}
+	last := 0
+	for _, span := range spans {
+		if span.end <= last {
+			continue
+		}
+		start := span.start
+		if start < last {
+			start = last
+		} else {
+			parts = append(parts, text[last:start])
+			_, size := utf8.DecodeRuneInString(text[start:])
+			parts = append(parts, text[start:start+size])
+			start += size
+		}
+		parts = append(parts, strings.Repeat(string(moderationMaskRune), utf8.RuneCountInString(text[start:span.end])))
+		last = span.end
+	}
+	parts = append(parts, text[last:])
+	return strings.Join(parts, "")
+}
+
+// Check returns the strictest action of rules that matched text, names of
+// matched rules and text with masked matches of rules with mask action
+func (m *Moderator) Check(text string) ModerationResult {
+	result := ModerationResult{Action: ModerationAllow, Rules: []string{}, Text: text}
+	var masked []textSpan
+	rules := []string{ModerationStopWords, ModerationPhone, ModerationLink, ModerationMessenger, ModerationObscenity}
+	for _, rule := range rules {
+		action, ok := m.policy.Actions[rule]
+		if !ok || action == ModerationAllow {
+			continue
+		}
+		spans := m.spans(rule, text)
+		if len(spans) == 0 {
+			continue
+		}
+		result.Rules = append(result.Rules, rule)
+		if moderationSeverity[action] > moderationSeverity[result.Action] {
+			result.Action = action
+		}
+		if action == ModerationMask {
+			masked = append(masked, spans...)
+		}
+	}
+	result.Text = maskSpans(text, masked)
+	return result
+}
+
+// ModerationItem is a user-generated text held for admin review, that is
+// published only after approval. Target is status for status updates and
+// destination user for messages.
+type ModerationItem struct {
+	Id         bson.ObjectId `json:"id"                    bson:"_id"`
+	User       bson.ObjectId `json:"user"                  bson:"user"`
+	UserObject *User         `json:"user_object,omitempty" bson:"-"`
+	Type       string        `json:"type"                  bson:"type"`
+	Target     bson.ObjectId `json:"target,omitempty"      bson:"target,omitempty"`
+	Text       string        `json:"text"                  bson:"text"`
+	Photo      string        `json:"photo,omitempty"       bson:"photo,omitempty"`
+	Rules      []string      `json:"rules"                 bson:"rules"`
+	State      string        `json:"state"                 bson:"state"`
+	Time       time.Time     `json:"time"                  bson:"time"`
+}
+
+func NewModerationItem(user bson.ObjectId, t string, target bson.ObjectId, result ModerationResult) *ModerationItem {
+	return &ModerationItem{
+		Id:     bson.NewObjectId(),
+		User:   user,
+		Type:   t,
+		Target: target,
+		Text:   result.Text,
+		Rules:  result.Rules,
+		State:  ModerationPending,
+		Time:   time.Now(),
+	}
+}
+
+func (item *ModerationItem) Prepare(context Context) error {
+	item.UserObject = context.DB.Get(item.User)
+	if item.UserObject == nil {
+		return nil
+	}
+	return item.UserObject.Prepare(context)
+}
+
+type ModerationItems []*ModerationItem
+
+func (items ModerationItems) Prepare(context Context) error {
+	for _, item := range items {
+		if err := item.Prepare(context); err != nil {
+			return err
+		}
+	}
+	return nil
+}
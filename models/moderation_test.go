@@ -0,0 +1,80 @@
+package models
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestModeration(t *testing.T) {
+	Convey("Moderator", t, func() {
+		policy := DefaultModerationPolicy()
+		policy.StopWords = []string{"казино"}
+		So(policy.Validate(), ShouldBeNil)
+		m := NewModerator(policy)
+		Convey("Clean text should be allowed", func() {
+			result := m.Check("Ищу попутчицу в Грузию, выезжаем 10 сентября в 8 утра")
+			So(result.Action, ShouldEqual, ModerationAllow)
+			So(result.Rules, ShouldBeEmpty)
+			So(result.Text, ShouldEqual, "Ищу попутчицу в Грузию, выезжаем 10 сентября в 8 утра")
+		})
+		Convey("Phone numbers should be held", func() {
+			for _, text := range []string{"звони +7 (912) 345-67-89", "мой номер 89123456789", "8 912 345 67 89 пиши"} {
+				result := m.Check(text)
+				So(result.Action, ShouldEqual, ModerationHold)
+				So(result.Rules, ShouldResemble, []string{ModerationPhone})
+			}
+		})
+		Convey("Dates should not be matched as phone numbers", func() {
+			for _, text := range []string{"едем 10.09.2024 - 15.09.2024", "с 01.07.2024 по 10.07.2024", "1.7.24-10.7.24"} {
+				result := m.Check(text)
+				So(result.Action, ShouldEqual, ModerationAllow)
+				So(result.Rules, ShouldBeEmpty)
+			}
+			result := m.Check("с 01.07.2024 звони 89123456789")
+			So(result.Rules, ShouldResemble, []string{ModerationPhone})
+		})
+		Convey("Messenger handles should be held", func() {
+			for _, text := range []string{"пиши в телеграм", "мой ник @traveller_88", "есть WhatsApp?", "добавь в вайбере", "t.me/traveller"} {
+				result := m.Check(text)
+				So(result.Action, ShouldEqual, ModerationHold)
+				So(result.Rules, ShouldContain, ModerationMessenger)
+			}
+		})
+		Convey("Links should be masked", func() {
+			result := m.Check("смотри фото на http://example.com/photo и сайт.рф")
+			So(result.Action, ShouldEqual, ModerationMask)
+			So(result.Rules, ShouldResemble, []string{ModerationLink})
+			So(result.Text, ShouldEqual, "смотри фото на h*********************** и с******")
+		})
+		Convey("Obscenity should be masked", func() {
+			result := m.Check("Ну ты и мудак, бля")
+			So(result.Action, ShouldEqual, ModerationMask)
+			So(result.Rules, ShouldResemble, []string{ModerationObscenity})
+			So(result.Text, ShouldEqual, "Ну ты и м****, б**")
+			So(IsObscene("рубля"), ShouldBeFalse)
+			So(IsObscene("Ёбаный"), ShouldBeTrue)
+		})
+		Convey("Stop words should be rejected", func() {
+			result := m.Check("Лучшие казино онлайн")
+			So(result.Action, ShouldEqual, ModerationReject)
+			So(result.Rules, ShouldResemble, []string{ModerationStopWords})
+		})
+		Convey("Strictest action should be applied", func() {
+			result := m.Check("бля, звони 89123456789")
+			So(result.Action, ShouldEqual, ModerationHold)
+			So(result.Rules, ShouldResemble, []string{ModerationPhone, ModerationObscenity})
+			So(result.Text, ShouldEqual, "б**, звони 89123456789")
+		})
+		Convey("Allowed rules should be skipped", func() {
+			policy.Actions[ModerationPhone] = ModerationAllow
+			result := NewModerator(policy).Check("звони 89123456789")
+			So(result.Action, ShouldEqual, ModerationAllow)
+			So(result.Rules, ShouldBeEmpty)
+		})
+		Convey("Unknown actions should be invalid", func() {
+			policy.Actions[ModerationLink] = "ban"
+			So(policy.Validate(), ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,116 @@
+package models
+
+import (
+	"fmt"
+)
+
+const (
+	NotifyInApp = "inapp"
+	NotifyPush  = "push"
+	NotifyEmail = "email"
+
+	SubscriptionLikesVideo = "likes_video"
+)
+
+// NotificationChannels are channels that notifications of event type are
+// delivered with
+type NotificationChannels struct {
+	InApp bool `json:"inapp" bson:"inapp"`
+	Push  bool `json:"push"  bson:"push"`
+	Email bool `json:"email" bson:"email"`
+}
+
+// Enabled returns true if channel is enabled
+func (c NotificationChannels) Enabled(channel string) bool {
+	switch channel {
+	case NotifyInApp:
+		return c.InApp
+	case NotifyPush:
+		return c.Push
+	case NotifyEmail:
+		return c.Email
+	}
+	return false
+}
+
+// Notifications is matrix of notification preferences by event type
+type Notifications map[string]NotificationChannels
+
+// DefaultNotifications are preferences of users that did not change them
+var DefaultNotifications = Notifications{
+	SubscriptionMessages:    {true, true, true},
+	SubscriptionInvites:     {true, true, true},
+	SubscriptionGuests:      {true, false, true},
+	SubscriptionLikesPhoto:  {true, true, true},
+	SubscriptionLikesStatus: {true, true, true},
+	SubscriptionLikesVideo:  {true, true, false},
+	SubscriptionNews:        {true, false, true},
+	SubscriptionTrips:       {true, true, true},
+	SubscriptionReviews:     {true, true, true},
+	SubscriptionOnline:      {false, false, false},
+}
+
+// Validate returns error if matrix has unknown event types
+func (n Notifications) Validate() error {
+	for event := range n {
+		if _, ok := DefaultNotifications[event]; !ok {
+			return ValidationError(fmt.Errorf("bad event type <%s>", event))
+		}
+	}
+	return nil
+}
+
+// legacySubscription returns true if preference of event type can be set
+// with list of subscriptions
+func legacySubscription(event string) bool {
+	for _, v := range append(Subscriptions, OptInSubscriptions...) {
+		if v == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Notifies returns true if user wants notifications of event type to be
+// delivered with channel. Events that are not in matrix are only delivered
+// in app. If user has not set preference for event type, subscriptions
+// are used for email and for opt-in events, and defaults for others.
+func (u *User) Notifies(event, channel string) bool {
+	if c, ok := u.Notifications[event]; ok {
+		return c.Enabled(channel)
+	}
+	defaults, ok := DefaultNotifications[event]
+	if !ok {
+		return channel == NotifyInApp
+	}
+	if u.Subscriptions != nil && legacySubscription(event) {
+		if channel == NotifyEmail {
+			return u.IsSubscribed(event)
+		}
+		for _, v := range OptInSubscriptions {
+			if v == event {
+				return u.IsSubscribed(event)
+			}
+		}
+	}
+	return defaults.Enabled(channel)
+}
+
+// NotificationsMatrix returns preferences of user for all event types
+func (u *User) NotificationsMatrix() Notifications {
+	matrix := make(Notifications)
+	for event := range DefaultNotifications {
+		matrix[event] = NotificationChannels{
+			u.Notifies(event, NotifyInApp),
+			u.Notifies(event, NotifyPush),
+			u.Notifies(event, NotifyEmail),
+		}
+	}
+	return matrix
+}
+
+// NotifiesUpdate returns true if update must be delivered to user with
+// channel
+func (u *User) NotifiesUpdate(update Update, channel string) bool {
+	return u.Notifies(GetEventType(update.Type, update.Target), channel)
+}
@@ -0,0 +1,58 @@
+package models
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestNotifications(t *testing.T) {
+	Convey("Notification preferences", t, func() {
+		u := &User{Id: bson.NewObjectId()}
+		Convey("Should use defaults", func() {
+			So(u.Notifies(SubscriptionMessages, NotifyPush), ShouldBeTrue)
+			So(u.Notifies(SubscriptionGuests, NotifyPush), ShouldBeFalse)
+			So(u.Notifies(SubscriptionOnline, NotifyInApp), ShouldBeFalse)
+			So(u.Notifies(SubscriptionMessages, "sms"), ShouldBeFalse)
+		})
+		Convey("Should deliver unknown events only in app", func() {
+			So(u.Notifies("counters", NotifyInApp), ShouldBeTrue)
+			So(u.Notifies("counters", NotifyPush), ShouldBeFalse)
+			So(u.Notifies("counters", NotifyEmail), ShouldBeFalse)
+		})
+		Convey("Should use subscriptions for email and opt-in events", func() {
+			u.Subscriptions = []string{SubscriptionOnline}
+			So(u.Notifies(SubscriptionMessages, NotifyEmail), ShouldBeFalse)
+			So(u.Notifies(SubscriptionMessages, NotifyInApp), ShouldBeTrue)
+			So(u.Notifies(SubscriptionOnline, NotifyInApp), ShouldBeTrue)
+			So(u.Notifies(SubscriptionOnline, NotifyPush), ShouldBeTrue)
+		})
+		Convey("Should prefer matrix", func() {
+			u.Subscriptions = []string{SubscriptionMessages}
+			u.Notifications = Notifications{SubscriptionMessages: {InApp: true}}
+			So(u.Notifies(SubscriptionMessages, NotifyInApp), ShouldBeTrue)
+			So(u.Notifies(SubscriptionMessages, NotifyPush), ShouldBeFalse)
+			So(u.Notifies(SubscriptionMessages, NotifyEmail), ShouldBeFalse)
+			matrix := u.NotificationsMatrix()
+			So(len(matrix), ShouldEqual, len(DefaultNotifications))
+			So(matrix[SubscriptionMessages], ShouldResemble, NotificationChannels{InApp: true})
+		})
+		Convey("Should use event type of update", func() {
+			u.Notifications = Notifications{SubscriptionLikesPhoto: {}}
+			So(u.NotifiesUpdate(NewUpdate(u.Id, u.Id, UpdateLikes, new(Photo)), NotifyInApp), ShouldBeFalse)
+			So(u.NotifiesUpdate(NewUpdate(u.Id, u.Id, UpdateLikes, new(Status)), NotifyInApp), ShouldBeTrue)
+		})
+		Convey("Should deliver messages regardless of preferences", func() {
+			u.Notifications = Notifications{SubscriptionMessages: {}}
+			So(u.NotifiesUpdate(NewUpdate(u.Id, u.Id, UpdateMessages, new(Message)), NotifyInApp), ShouldBeFalse)
+			So(NewUpdate(u.Id, u.Id, UpdateMessages, new(Message)).IsPayload(), ShouldBeTrue)
+			So(NewUpdate(u.Id, u.Id, UpdateGroupMessages, new(Message)).IsPayload(), ShouldBeTrue)
+			So(NewUpdate(u.Id, u.Id, UpdateLikes, new(Photo)).IsPayload(), ShouldBeFalse)
+		})
+		Convey("Should validate event types", func() {
+			So(Notifications{SubscriptionNews: {}}.Validate(), ShouldBeNil)
+			So(Notifications{"bad": {}}.Validate(), ShouldNotBeNil)
+		})
+	})
+}
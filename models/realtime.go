@@ -1,27 +1,53 @@
 package models
 
 import (
+	"encoding/json"
+	"errors"
 	"log"
 	"time"
 
 	"gopkg.in/mgo.v2/bson"
 )
 
+// Message is a private message of conversation, stored in single copy.
+// Chat and User are set only for copies that are shown to participants.
 type Message struct {
-	Id          bson.ObjectId `json:"id"                     bson:"_id"`
-	Chat        bson.ObjectId `json:"chat"                   bson:"chat"`
-	User        bson.ObjectId `json:"-"                      bson:"user"`
-	Origin      bson.ObjectId `json:"origin"                 bson:"origin"`
-	Destination bson.ObjectId `json:"destination"            bson:"destination"`
-	Read        bool          `json:"read"                   bson:"read"`
-	Time        time.Time     `json:"time"                   bson:"time"`
-	Text        string        `json:"text"                   bson:"text"`
-	Invite      bool          `json:"invite"                 bson:"invite"`
-	Photo       string        `json:"photo"                  bson:"photo"`
-	PhotoUrl    string        `json:"photo_url"              bson:"photo_url"`
-	LastMessage bson.ObjectId `json:"last_message,omitempty" bson:"-"`
+	Id           bson.ObjectId   `json:"id"                     bson:"_id"`
+	Conversation bson.ObjectId   `json:"conversation,omitempty" bson:"conversation,omitempty"`
+	Chat         bson.ObjectId   `json:"chat"                   bson:"chat,omitempty"`
+	User         bson.ObjectId   `json:"-"                      bson:"user,omitempty"`
+	Origin       bson.ObjectId   `json:"origin"                 bson:"origin"`
+	Destination  bson.ObjectId   `json:"destination"            bson:"destination"`
+	Read         bool            `json:"read"                   bson:"read"`
+	Time         time.Time       `json:"time"                   bson:"time"`
+	Text         string          `json:"text"                   bson:"text"`
+	Invite       bool            `json:"invite"                 bson:"invite"`
+	Photo        string          `json:"photo"                  bson:"photo"`
+	PhotoUrl     string          `json:"photo_url"              bson:"photo_url"`
+	Audio        bson.ObjectId   `json:"audio,omitempty"        bson:"audio,omitempty"`
+	AudioObject  *Audio          `json:"audio_object,omitempty" bson:"-"`
+	Video        bson.ObjectId   `json:"video,omitempty"        bson:"video,omitempty"`
+	VideoObject  *Video          `json:"video_object,omitempty" bson:"-"`
+	Processing   bool            `json:"processing"             bson:"processing"`
+	Failed       bool            `json:"failed,omitempty"       bson:"failed,omitempty"`
+	Removed      []bson.ObjectId `json:"-"                      bson:"removed,omitempty"`
+	Edited       bool            `json:"edited"                 bson:"edited"`
+	Unsent       bool            `json:"unsent"                 bson:"unsent"`
+	History      []*MessageEdit  `json:"history,omitempty"      bson:"history,omitempty"`
+	LastMessage  bson.ObjectId   `json:"last_message,omitempty" bson:"-"`
 }
 
+// MessageEdit is a previous text of edited message, kept for moderation
+type MessageEdit struct {
+	Text string    `json:"text" bson:"text"`
+	Time time.Time `json:"time" bson:"time"`
+}
+
+var (
+	ErrMessageNotChangeable = errors.New("Это сообщение нельзя изменить")
+	ErrMessageWindowExpired = errors.New("Время для изменения сообщения истекло")
+)
+
 type Messages []*Message
 
 func (messages Messages) Prepare(context Context) error {
@@ -33,8 +59,28 @@ func (messages Messages) Prepare(context Context) error {
 	return nil
 }
 
-// Prepare sets the url for attachment photo
+// Prepare sets the url for attachment photo, objects of converted audio
+// and video attachments and hides edit history from non-admins
 func (m *Message) Prepare(context Context) error {
+	if !context.IsAdmin {
+		m.History = nil
+	}
+	if m.Audio.Valid() && !m.Processing && m.AudioObject == nil {
+		if audio := context.DB.GetAudio(m.Audio); audio != nil {
+			if err := audio.Prepare(context); err != nil {
+				return err
+			}
+			m.AudioObject = audio
+		}
+	}
+	if m.Video.Valid() && !m.Processing && m.VideoObject == nil {
+		if video := context.DB.GetVideo(m.Video); video != nil {
+			if err := video.Prepare(context); err != nil {
+				return err
+			}
+			m.VideoObject = video
+		}
+	}
 	if len(m.Photo) == 0 {
 		return nil
 	}
@@ -46,45 +92,91 @@ func (m *Message) Prepare(context Context) error {
 	return nil
 }
 
-type Broadcast struct {
-	Text string `json:"text" bson:"text"`
+// HasAttachment returns true if message has audio or video attachment
+func (m *Message) HasAttachment() bool {
+	return m.Audio.Valid() || m.Video.Valid()
+}
+
+// For returns copy of message as it is shown to participant with provided id
+func (m *Message) For(user bson.ObjectId) *Message {
+	c := *m
+	c.User = user
+	c.Chat = m.Destination
+	if user == m.Destination {
+		c.Chat = m.Origin
+	}
+	if c.Invite && c.Text == "" {
+		c.Text = InviteTextDestination
+		if user == m.Origin {
+			c.Text = InviteTextOrigin
+		}
+	}
+	c.Removed = nil
+	return &c
+}
+
+// CanChange returns nil if message can be edited or unsent by its origin
+// at time now, when changes are allowed during window after sending
+func (m *Message) CanChange(now time.Time, window time.Duration) error {
+	if m.Invite || m.Unsent {
+		return ErrMessageNotChangeable
+	}
+	if now.Sub(m.Time) > window {
+		return ErrMessageWindowExpired
+	}
+	return nil
+}
+
+// Edit replaces text of message, keeping previous one in history
+func (m *Message) Edit(text string, now time.Time) {
+	m.History = append(m.History, &MessageEdit{Text: m.Text, Time: now})
+	m.Text = text
+	m.Edited = true
+}
+
+// RemovedFor returns true if participant with provided id removed message
+func (m *Message) RemovedFor(user bson.ObjectId) bool {
+	for _, id := range m.Removed {
+		if id == user {
+			return true
+		}
+	}
+	return false
 }
 
 type Invite Message
 
-func NewInvites(db DataBase, origin, destination bson.ObjectId, textOrigin, textDestination string) (toOrigin, toDestination *Invite) {
-	m1, m2 := newMessagePair(db, origin, destination, "", "", true)
-	m1.Text = textOrigin
-	m2.Text = textDestination
-	atoOrigin := Invite(*m1)
-	atoDestination := Invite(*m2)
-	return &atoOrigin, &atoDestination
-}
-
-func NewMessagePair(db DataBase, origin, destination bson.ObjectId, photo, text string) (toOrigin, toDestination *Message) {
-	return newMessagePair(db, origin, destination, photo, text, false)
-}
-
-func newMessagePair(db DataBase, origin, destination bson.ObjectId, photo, text string, invite bool) (toOrigin, toDestination *Message) {
-	toOrigin = new(Message)
-	toDestination = new(Message)
-	toOrigin.Id = bson.NewObjectId()
-	toDestination.Id = bson.NewObjectId()
-	toOrigin.Time = time.Now()
-	toDestination.Time = toOrigin.Time
-	toOrigin.User = origin
-	toDestination.User = destination
-	toOrigin.Chat = destination
-	toDestination.Chat = origin
-	toOrigin.Origin = origin
-	toDestination.Origin = origin
-	toOrigin.Destination = destination
-	toDestination.Destination = destination
-	toOrigin.Text = text
-	toDestination.Text = text
-	toOrigin.Read = false
-	toOrigin.Photo = photo
-	toDestination.Photo = photo
+const (
+	InviteTextOrigin      = "Вы отправили приглашение в путешествие"
+	InviteTextDestination = "Вас пригласили в путешествие"
+)
+
+// NewInvite returns invite message from origin to destination, text of
+// which depends on participant it is shown to
+func NewInvite(origin, destination bson.ObjectId) *Invite {
+	i := Invite(*NewMessage(origin, destination, "", ""))
+	i.Invite = true
+	return &i
+}
+
+// NewMessage returns message from origin to destination
+func NewMessage(origin, destination bson.ObjectId, photo, text string) *Message {
+	m := new(Message)
+	m.Id = bson.NewObjectId()
+	m.Time = time.Now()
+	m.Origin = origin
+	m.Destination = destination
+	m.Text = text
+	m.Photo = photo
+	return m
+}
+
+// NewMessagePair returns message with copies for both participants, that
+// contain ids of last messages of conversation for each of them
+func NewMessagePair(db DataBase, origin, destination bson.ObjectId, photo, text string) (m, toOrigin, toDestination *Message) {
+	m = NewMessage(origin, destination, photo, text)
+	toOrigin = m.For(origin)
+	toDestination = m.For(destination)
 
 	lastOrigin, err := db.GetLastMessageIdFromUser(origin, destination)
 	if err != nil {
@@ -96,10 +188,6 @@ func newMessagePair(db DataBase, origin, destination bson.ObjectId, photo, text
 	}
 	toOrigin.LastMessage = lastOrigin
 	toDestination.LastMessage = lastDestination
-
-	toOrigin.Invite = invite
-	toDestination.Invite = invite
-
 	return
 }
 
@@ -110,13 +198,67 @@ type RealtimeEvent struct {
 }
 
 type Dialog struct {
-	Id         bson.ObjectId `json:"id"     bson:"_id,omitempty"`
-	Time       time.Time     `json:"time"   bson:"time"`
-	Text       string        `json:"text"   bson:"text"`
-	Origin     bson.ObjectId `json:"-"      bson:"origin,omitempty"`
+	Id         bson.ObjectId `json:"id"       bson:"_id,omitempty"`
+	Time       time.Time     `json:"time"     bson:"time"`
+	Text       string        `json:"text"     bson:"text"`
+	Origin     bson.ObjectId `json:"-"        bson:"origin,omitempty"`
 	User       *User         `json:"user"`
 	OriginUser *User         `json:"origin"`
-	Unread     int           `json:"unread" bson:"unread"`
+	Unread     int           `json:"unread"   bson:"unread"`
+	Archived   bool          `json:"archived" bson:"archived"`
+	Muted      bool          `json:"muted"    bson:"muted"`
+	Pinned     bool          `json:"pinned"   bson:"pinned"`
+}
+
+// RealtimeMetrics is a state of realtime subsystem: amount of connected
+// clients and channel subscriptions, and counters of events
+type RealtimeMetrics struct {
+	Connections   int   `json:"connections"`
+	Subscriptions int   `json:"subscriptions"`
+	Published     int64 `json:"published"`
+	Delivered     int64 `json:"delivered"`
+	Dropped       int64 `json:"dropped"`
+	Disconnected  int64 `json:"disconnected"`
+}
+
+const (
+	// RealtimeProtocol is a version of realtime command protocol
+	RealtimeProtocol = 1
+
+	CommandSendMessage = "send_message"
+	CommandReadMessage = "read_message"
+	CommandReadUpdate  = "read_update"
+	CommandReadUpdates = "read_updates"
+	CommandTyping      = "typing"
+	CommandSubscribe   = "subscribe"
+	CommandPing        = "ping"
+	CommandAuth        = "auth"
+)
+
+// Command is a client action sent through realtime connection. Target is
+// an id of user or object that command is applied to, params are passed
+// as query and payload as json body of corresponding http request.
+type Command struct {
+	Version int               `json:"v"`
+	Id      string            `json:"id"`
+	Type    string            `json:"type"`
+	Target  bson.ObjectId     `json:"target,omitempty"`
+	Params  map[string]string `json:"params,omitempty"`
+	Payload json.RawMessage   `json:"payload,omitempty"`
+}
+
+// Ack is a response to command with same id, containing status and
+// body of corresponding http response
+type Ack struct {
+	Version  int             `json:"v"`
+	Ack      string          `json:"ack"`
+	Status   int             `json:"status"`
+	Response json.RawMessage `json:"response"`
+}
+
+// NewAck returns ack of command with result of handler
+func NewAck(id string, status int, response []byte) *Ack {
+	return &Ack{RealtimeProtocol, id, status, response}
 }
 
 type UnreadCount struct {
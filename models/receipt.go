@@ -0,0 +1,45 @@
+package models
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ReadReceipt notifies origin of messages that they were read by peer
+type ReadReceipt struct {
+	Conversation bson.ObjectId `json:"conversation,omitempty"`
+	Chat         bson.ObjectId `json:"chat"`
+	LastRead     bson.ObjectId `json:"last_read,omitempty"`
+	Message      bson.ObjectId `json:"message,omitempty"`
+	Time         time.Time     `json:"time"`
+}
+
+// Typing notifies peer that user is typing a message
+type Typing struct {
+	Chat bson.ObjectId `json:"chat"`
+	Time time.Time     `json:"time"`
+}
+
+// HidesActivity returns true if user activity must not be revealed to others
+func (u *User) HidesActivity() bool {
+	return u.Invisible && u.Vip
+}
+
+// EphemeralAllowed returns true if ephemeral events about activity of
+// origin can be pushed to destination
+func EphemeralAllowed(origin, destination *User) bool {
+	if origin == nil || destination == nil || origin.Id == destination.Id {
+		return false
+	}
+	if origin.HidesActivity() {
+		return false
+	}
+	return !origin.InBlacklist(destination.Id) && !destination.InBlacklist(origin.Id)
+}
+
+// NewReadReceipt returns receipt about messages of conversation read by
+// reader, up to last read message
+func NewReadReceipt(conversation, reader, lastRead bson.ObjectId) *ReadReceipt {
+	return &ReadReceipt{Conversation: conversation, Chat: reader, LastRead: lastRead, Time: time.Now()}
+}
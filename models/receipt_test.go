@@ -0,0 +1,36 @@
+package models
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestEphemeralAllowed(t *testing.T) {
+	Convey("Ephemeral events", t, func() {
+		a := &User{Id: bson.NewObjectId()}
+		b := &User{Id: bson.NewObjectId()}
+		Convey("Should be allowed between users", func() {
+			So(EphemeralAllowed(a, b), ShouldBeTrue)
+			So(EphemeralAllowed(b, a), ShouldBeTrue)
+		})
+		Convey("Should not be allowed to self or unknown user", func() {
+			So(EphemeralAllowed(a, a), ShouldBeFalse)
+			So(EphemeralAllowed(a, nil), ShouldBeFalse)
+			So(EphemeralAllowed(nil, a), ShouldBeFalse)
+		})
+		Convey("Should respect blacklist of both sides", func() {
+			b.Blacklist = []bson.ObjectId{a.Id}
+			So(EphemeralAllowed(a, b), ShouldBeFalse)
+			So(EphemeralAllowed(b, a), ShouldBeFalse)
+		})
+		Convey("Should not reveal activity of invisible vip", func() {
+			a.Invisible = true
+			So(EphemeralAllowed(a, b), ShouldBeTrue)
+			a.Vip = true
+			So(EphemeralAllowed(a, b), ShouldBeFalse)
+			So(EphemeralAllowed(b, a), ShouldBeTrue)
+		})
+	})
+}
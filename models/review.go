@@ -0,0 +1,171 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	ReviewRatingMin    = 1
+	ReviewRatingMax    = 5
+	ReviewRevealPeriod = time.Hour * 24 * 14
+
+	reviewTextMax    = 2000
+	reviewPrivateMax = 1000
+	reviewDisputeMax = 1000
+)
+
+var (
+	ErrReviewNotAllowed    = errors.New("Отзыв можно оставить только после совместной поездки")
+	ErrReviewSelf          = errors.New("Нельзя оставить отзыв о себе")
+	ErrReviewBlankSubject  = errors.New("Не указана поездка или приглашение")
+	ErrReviewDisputeBlank  = errors.New("Не указана причина жалобы")
+	ErrReviewAlreadyExists = errors.New("Вы уже оставили отзыв об этой поездке")
+)
+
+// Review is a reference that user leaves about other user after
+// completed trip or accepted invitation. Reviews of both sides are
+// revealed at the same time, after both are submitted or after
+// ReviewRevealPeriod. Travel is the trip, or the invitation without trip,
+// so user can review other user only once per journey.
+type Review struct {
+	Id            bson.ObjectId `json:"id"                       bson:"_id"`
+	Author        bson.ObjectId `json:"author"                   bson:"author"`
+	AuthorObject  *User         `json:"author_object,omitempty"  bson:"-"`
+	Target        bson.ObjectId `json:"target"                   bson:"target"`
+	TargetObject  *User         `json:"target_object,omitempty"  bson:"-"`
+	Trip          bson.ObjectId `json:"trip,omitempty"           bson:"trip,omitempty"`
+	Invitation    bson.ObjectId `json:"invitation,omitempty"     bson:"invitation,omitempty"`
+	Travel        bson.ObjectId `json:"-"                        bson:"travel"`
+	Rating        int           `json:"rating"                   bson:"rating"`
+	Text          string        `json:"text"                     bson:"text"`
+	Private       string        `json:"private,omitempty"        bson:"private,omitempty"`
+	Revealed      bool          `json:"revealed"                 bson:"revealed"`
+	Disputed      bool          `json:"disputed"                 bson:"disputed"`
+	DisputeReason string        `json:"dispute_reason,omitempty" bson:"dispute_reason,omitempty"`
+	Time          time.Time     `json:"time"                     bson:"time"`
+	RevealTime    time.Time     `json:"reveal_time"              bson:"reveal_time"`
+}
+
+type Reviews []*Review
+
+// ReviewStats is an aggregated rating of user by revealed reviews
+type ReviewStats struct {
+	Count    int     `json:"count"    bson:"count"`
+	Rating   float64 `json:"rating"   bson:"rating"`
+	Positive int     `json:"positive" bson:"positive"`
+	Negative int     `json:"negative" bson:"negative"`
+}
+
+// ReviewDispute is a complaint of reviewed user about review
+type ReviewDispute struct {
+	Reason string `json:"reason"`
+}
+
+// Validate checks rating and length of texts
+func (r *Review) Validate() error {
+	if r.Rating < ReviewRatingMin || r.Rating > ReviewRatingMax {
+		return fmt.Errorf("Оценка должна быть от %d до %d", ReviewRatingMin, ReviewRatingMax)
+	}
+	if len([]rune(r.Text)) > reviewTextMax {
+		return fmt.Errorf("Длина отзыва не должна превышать %d символов", reviewTextMax)
+	}
+	if len([]rune(r.Private)) > reviewPrivateMax {
+		return fmt.Errorf("Длина личного сообщения не должна превышать %d символов", reviewPrivateMax)
+	}
+	if !r.Trip.Valid() && !r.Invitation.Valid() {
+		return ErrReviewBlankSubject
+	}
+	return nil
+}
+
+// Normalize checks that author and target travelled together in the
+// completed trip or in ended travel of accepted invitation and sets travel
+// and time of review. Exactly one of trip and invitation must be provided.
+func (r *Review) Normalize(trip *Trip, invitation *Invitation, now time.Time) error {
+	if r.Author == r.Target {
+		return ErrReviewSelf
+	}
+	if trip != nil {
+		r.Trip, r.Invitation, r.Travel = trip.Id, "", trip.Id
+		if !trip.Completed(now) {
+			return ErrReviewNotAllowed
+		}
+		if !(trip.User == r.Author || trip.HasParticipant(r.Author)) {
+			return ErrReviewNotAllowed
+		}
+		if !(trip.User == r.Target || trip.HasParticipant(r.Target)) {
+			return ErrReviewNotAllowed
+		}
+	}
+	if invitation != nil {
+		r.Invitation, r.Trip, r.Travel = invitation.Id, "", invitation.Id
+		if invitation.Trip.Valid() {
+			r.Travel = invitation.Trip
+		}
+		if invitation.State != InvitationAccepted || invitation.Other(r.Author) != r.Target {
+			return ErrReviewNotAllowed
+		}
+		if invitation.Origin != r.Author && invitation.Destination != r.Author {
+			return ErrReviewNotAllowed
+		}
+		if invitation.End.IsZero() || !day(invitation.End).Before(day(now)) {
+			return ErrReviewNotAllowed
+		}
+	}
+	if trip == nil && invitation == nil {
+		return ErrReviewBlankSubject
+	}
+	r.Revealed = false
+	r.Disputed = false
+	r.DisputeReason = ""
+	r.Time = now
+	r.RevealTime = now.Add(ReviewRevealPeriod)
+	return nil
+}
+
+// VisibleTo returns true if review can be shown to user with provided id
+func (r *Review) VisibleTo(id bson.ObjectId) bool {
+	return r.Revealed || r.Author == id
+}
+
+// Validate checks reason of dispute
+func (d *ReviewDispute) Validate() error {
+	if len(d.Reason) == 0 {
+		return ErrReviewDisputeBlank
+	}
+	if len([]rune(d.Reason)) > reviewDisputeMax {
+		return fmt.Errorf("Длина жалобы не должна превышать %d символов", reviewDisputeMax)
+	}
+	return nil
+}
+
+// Prepare sets author and target objects, hiding private feedback and
+// dispute reason from users other than author, target and admins
+func (r *Review) Prepare(context Context) error {
+	var viewer bson.ObjectId
+	if context.User != nil {
+		viewer = context.User.Id
+	}
+	if !bool(context.IsAdmin) && viewer != r.Author {
+		r.Private = ""
+	}
+	if !bool(context.IsAdmin) && viewer != r.Target {
+		r.DisputeReason = ""
+	}
+	r.AuthorObject = preparedUser(context, r.AuthorObject, r.Author)
+	r.TargetObject = preparedUser(context, r.TargetObject, r.Target)
+	return nil
+}
+
+func (reviews Reviews) Prepare(context Context) error {
+	for _, r := range reviews {
+		if err := r.Prepare(context); err != nil {
+			return err
+		}
+	}
+	return nil
+}
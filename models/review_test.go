@@ -0,0 +1,87 @@
+package models
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+	"time"
+)
+
+func TestReview(t *testing.T) {
+	now := time.Date(2015, time.June, 10, 15, 0, 0, 0, time.UTC)
+	author, target := bson.NewObjectId(), bson.NewObjectId()
+	Convey("Validate review", t, func() {
+		r := &Review{Author: author, Target: target, Trip: bson.NewObjectId(), Rating: 5}
+		So(r.Validate(), ShouldBeNil)
+		r.Rating = 0
+		So(r.Validate(), ShouldNotBeNil)
+		r.Rating = 6
+		So(r.Validate(), ShouldNotBeNil)
+		r.Rating = 3
+		r.Trip = ""
+		So(r.Validate(), ShouldEqual, ErrReviewBlankSubject)
+	})
+	Convey("Normalize review", t, func() {
+		r := &Review{Author: author, Target: target, Rating: 4}
+		trip := &Trip{Id: bson.NewObjectId(), User: author, Participants: []bson.ObjectId{target},
+			Start: now.AddDate(0, 0, -10), End: now.AddDate(0, 0, -2), Status: TripPlanned}
+		Convey("Completed trip", func() {
+			So(r.Normalize(trip, nil, now), ShouldBeNil)
+			So(r.Trip, ShouldEqual, trip.Id)
+			So(r.Travel, ShouldEqual, trip.Id)
+			So(r.Revealed, ShouldBeFalse)
+			So(r.RevealTime, ShouldResemble, now.Add(ReviewRevealPeriod))
+		})
+		Convey("Trip in progress", func() {
+			trip.End = now
+			So(r.Normalize(trip, nil, now), ShouldEqual, ErrReviewNotAllowed)
+			trip.Status = TripDone
+			So(r.Normalize(trip, nil, now), ShouldBeNil)
+		})
+		Convey("Cancelled trip", func() {
+			trip.Status = TripCancelled
+			So(r.Normalize(trip, nil, now), ShouldEqual, ErrReviewNotAllowed)
+		})
+		Convey("Not a participant", func() {
+			trip.Participants = nil
+			So(r.Normalize(trip, nil, now), ShouldEqual, ErrReviewNotAllowed)
+		})
+		Convey("Self", func() {
+			r.Target = author
+			So(r.Normalize(trip, nil, now), ShouldEqual, ErrReviewSelf)
+		})
+		Convey("Invitation", func() {
+			i := &Invitation{Id: bson.NewObjectId(), Origin: target, Destination: author, State: InvitationPending,
+				End: now.AddDate(0, 0, -1)}
+			So(r.Normalize(nil, i, now), ShouldEqual, ErrReviewNotAllowed)
+			i.State = InvitationAccepted
+			So(r.Normalize(nil, i, now), ShouldBeNil)
+			So(r.Invitation, ShouldEqual, i.Id)
+			So(r.Travel, ShouldEqual, i.Id)
+			i.End = now.AddDate(0, 0, 3)
+			So(r.Normalize(nil, i, now), ShouldEqual, ErrReviewNotAllowed)
+			i.End = time.Time{}
+			So(r.Normalize(nil, i, now), ShouldEqual, ErrReviewNotAllowed)
+			i.End = now.AddDate(0, 0, -1)
+			i.Destination = bson.NewObjectId()
+			So(r.Normalize(nil, i, now), ShouldEqual, ErrReviewNotAllowed)
+			Convey("With trip", func() {
+				i.Destination = author
+				i.Trip = trip.Id
+				So(r.Normalize(nil, i, now), ShouldBeNil)
+				So(r.Travel, ShouldEqual, trip.Id)
+			})
+		})
+	})
+	Convey("Review visibility", t, func() {
+		r := &Review{Author: author, Target: target}
+		So(r.VisibleTo(author), ShouldBeTrue)
+		So(r.VisibleTo(target), ShouldBeFalse)
+		r.Revealed = true
+		So(r.VisibleTo(target), ShouldBeTrue)
+	})
+	Convey("Dispute", t, func() {
+		So((&ReviewDispute{}).Validate(), ShouldEqual, ErrReviewDisputeBlank)
+		So((&ReviewDispute{Reason: "Неправда"}).Validate(), ShouldBeNil)
+	})
+}
@@ -0,0 +1,124 @@
+package models
+
+import (
+	"hash/fnv"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	SpamReasonContacts   = "contacts"
+	SpamReasonDuplicates = "duplicates"
+
+	// SpamShingleSize is amount of words in shingle of text
+	SpamShingleSize = 3
+	// SpamSimilarDistance is maximum hamming distance of simhashes of
+	// near-identical texts
+	SpamSimilarDistance = 3
+)
+
+var ErrorContactsQuota = Error{http.StatusTooManyRequests, "New conversations limit exceeded"}
+
+// SpamFlag marks user that is suspected in spam and is shadow-limited:
+// messages of user are silently hidden from recipients
+type SpamFlag struct {
+	Reason string    `json:"reason" bson:"reason"`
+	Time   time.Time `json:"time"   bson:"time"`
+}
+
+// SpamReport is a user flagged for spam, shown to admins
+type SpamReport struct {
+	User *User     `json:"user"`
+	Flag *SpamFlag `json:"flag"`
+}
+
+type SpamReports []*SpamReport
+
+func (reports SpamReports) Prepare(context Context) error {
+	for _, r := range reports {
+		if err := r.User.Prepare(context); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ShadowLimited returns true if messages of user are hidden from recipients
+func (u *User) ShadowLimited() bool {
+	return u.SpamFlag != nil
+}
+
+// FirstContactQuota returns amount of new conversations that user can start
+// per day, depending on age of account, confirmations and vip status
+func FirstContactQuota(u *User, now time.Time) int {
+	quota := 10
+	switch age := now.Sub(u.Registered); {
+	case age < time.Hour*24:
+		quota = 2
+	case age < time.Hour*24*7:
+		quota = 5
+	}
+	if u.EmailConfirmed {
+		quota += 5
+	}
+	if u.PhoneConfirmed {
+		quota += 10
+	}
+	if u.Vip {
+		quota *= 3
+	}
+	return quota
+}
+
+// Shingles returns hashes of all sequences of SpamShingleSize normalized
+// words of text
+func Shingles(text string) []uint64 {
+	words := QueryTerms(text)
+	if len(words) < SpamShingleSize {
+		return nil
+	}
+	shingles := make([]uint64, 0, len(words)-SpamShingleSize+1)
+	for i := 0; i+SpamShingleSize <= len(words); i++ {
+		h := fnv.New64a()
+		h.Write([]byte(strings.Join(words[i:i+SpamShingleSize], " ")))
+		shingles = append(shingles, h.Sum64())
+	}
+	return shingles
+}
+
+// Simhash returns locality-sensitive hash of text, so that near-identical
+// texts have hashes with small hamming distance. Returns false if text is
+// too short to be compared.
+func Simhash(text string) (uint64, bool) {
+	shingles := Shingles(text)
+	if len(shingles) == 0 {
+		return 0, false
+	}
+	var weights [64]int
+	for _, s := range shingles {
+		for bit := uint(0); bit < 64; bit++ {
+			if s&(1<<bit) != 0 {
+				weights[bit]++
+			} else {
+				weights[bit]--
+			}
+		}
+	}
+	var hash uint64
+	for bit := uint(0); bit < 64; bit++ {
+		if weights[bit] > 0 {
+			hash |= 1 << bit
+		}
+	}
+	return hash, true
+}
+
+// HammingDistance returns amount of different bits of hashes
+func HammingDistance(a, b uint64) int {
+	distance := 0
+	for x := a ^ b; x != 0; x &= x - 1 {
+		distance++
+	}
+	return distance
+}
@@ -0,0 +1,54 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSpam(t *testing.T) {
+	Convey("First contact quota", t, func() {
+		now := time.Now()
+		u := &User{Registered: now.Add(-time.Hour)}
+		fresh := FirstContactQuota(u, now)
+		u.Registered = now.Add(-time.Hour * 24 * 3)
+		week := FirstContactQuota(u, now)
+		u.Registered = now.Add(-time.Hour * 24 * 30)
+		old := FirstContactQuota(u, now)
+		So(fresh, ShouldBeLessThan, week)
+		So(week, ShouldBeLessThan, old)
+		u.EmailConfirmed = true
+		confirmed := FirstContactQuota(u, now)
+		So(confirmed, ShouldBeGreaterThan, old)
+		u.PhoneConfirmed = true
+		So(FirstContactQuota(u, now), ShouldBeGreaterThan, confirmed)
+		u.Vip = true
+		So(FirstContactQuota(u, now), ShouldBeGreaterThan, confirmed)
+	})
+	Convey("Simhash", t, func() {
+		text := "Привет, красавица! Хочешь поехать со мной на море этим летом? Пиши мне скорее"
+		similar := "Привет красавица!!! Хочешь поехать со мной на море этим летом? Пиши мне скорей"
+		other := "Добрый день, видел вашу анкету, тоже планирую поездку в Грузию в сентябре"
+		a, ok := Simhash(text)
+		So(ok, ShouldBeTrue)
+		b, _ := Simhash(similar)
+		c, _ := Simhash(other)
+		So(HammingDistance(a, b), ShouldBeLessThanOrEqualTo, SpamSimilarDistance)
+		So(HammingDistance(a, c), ShouldBeGreaterThan, SpamSimilarDistance)
+		Convey("Short texts should not be compared", func() {
+			_, ok := Simhash("Привет!")
+			So(ok, ShouldBeFalse)
+		})
+	})
+	Convey("Hamming distance", t, func() {
+		So(HammingDistance(0, 0), ShouldEqual, 0)
+		So(HammingDistance(0xF0, 0x0F), ShouldEqual, 8)
+	})
+	Convey("Shadow limit", t, func() {
+		u := &User{}
+		So(u.ShadowLimited(), ShouldBeFalse)
+		u.SpamFlag = &SpamFlag{Reason: SpamReasonDuplicates}
+		So(u.ShadowLimited(), ShouldBeTrue)
+	})
+}
@@ -0,0 +1,368 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	TripPlanned   = "planned"
+	TripActive    = "active"
+	TripDone      = "done"
+	TripCancelled = "cancelled"
+
+	TripPublic    = "public"
+	TripFavorites = "favorites" // visible only for users from owner favorites
+	TripPrivate   = "private"
+
+	TransportAny   = "any"
+	TransportCar   = "car"
+	TransportPlane = "plane"
+	TransportTrain = "train"
+	TransportBus   = "bus"
+	TransportShip  = "ship"
+	TransportHitch = "hitchhiking"
+
+	tripCompanionsMax = 20
+	TripSearchLimit   = 500 // maximum amount of trips ranked in one search
+)
+
+var (
+	TripStatuses     = []string{TripPlanned, TripActive, TripDone, TripCancelled}
+	TripVisibilities = []string{TripPublic, TripFavorites, TripPrivate}
+	Transports       = []string{TransportAny, TransportCar, TransportPlane, TransportTrain, TransportBus,
+		TransportShip, TransportHitch}
+)
+
+// Trip is a planned travel of user to one or more places
+type Trip struct {
+	Id           bson.ObjectId   `json:"id"                     bson:"_id"`
+	User         bson.ObjectId   `json:"user"                   bson:"user"`
+	UserObject   *User           `json:"user_object,omitempty"  bson:"-"`
+	Destinations []string        `json:"destinations"           bson:"destinations"`
+	Start        time.Time       `json:"start"                  bson:"start"`
+	End          time.Time       `json:"end"                    bson:"end"`
+	Flexible     bool            `json:"flexible"               bson:"flexible"`
+	Month        int             `json:"month,omitempty"        bson:"month,omitempty"`
+	Year         int             `json:"year,omitempty"         bson:"year,omitempty"`
+	Budget       uint            `json:"budget,omitempty"       bson:"budget,omitempty"`
+	Transport    string          `json:"transport,omitempty"    bson:"transport,omitempty"`
+	Companions   int             `json:"companions"             bson:"companions"`
+	Visibility   string          `json:"visibility"             bson:"visibility"`
+	Status       string          `json:"status"                 bson:"status"`
+	Description  string          `json:"description,omitempty"  bson:"description,omitempty"`
+	Participants []bson.ObjectId `json:"participants,omitempty" bson:"participants,omitempty"`
+	Time         time.Time       `json:"time"                   bson:"time"`
+
+	// search results
+	Overlap       int     `json:"overlap,omitempty"       bson:"-"`
+	Compatibility float64 `json:"compatibility,omitempty" bson:"-"`
+}
+
+type Trips []*Trip
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func containsId(values []bson.ObjectId, value bson.ObjectId) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// day truncates time to the start of the day
+func day(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// Normalize sets default values and date range of trip, checking
+// fields that do not require database
+func (t *Trip) Normalize(now time.Time) error {
+	if t.Status == "" {
+		t.Status = TripPlanned
+	}
+	if t.Visibility == "" {
+		t.Visibility = TripPublic
+	}
+	if t.Transport == "" {
+		t.Transport = TransportAny
+	}
+	if !contains(TripStatuses, t.Status) {
+		return fmt.Errorf("Неизвестный статус поездки %s", t.Status)
+	}
+	if !contains(TripVisibilities, t.Visibility) {
+		return fmt.Errorf("Неизвестная видимость поездки %s", t.Visibility)
+	}
+	if !contains(Transports, t.Transport) {
+		return fmt.Errorf("Неизвестный транспорт %s", t.Transport)
+	}
+	if t.Companions < 0 || t.Companions > tripCompanionsMax {
+		return fmt.Errorf("Количество попутчиков должно быть от 0 до %d", tripCompanionsMax)
+	}
+	if len(t.Destinations) == 0 {
+		return errors.New("Не указано место назначения")
+	}
+
+	// flexible trip: only month (and optionally year) is known
+	if t.Month != 0 {
+		if t.Month < 1 || t.Month > 12 {
+			return errors.New("Месяц должен быть от 1 до 12")
+		}
+		if t.Year == 0 {
+			t.Year = now.Year()
+			if time.Month(t.Month) < now.Month() {
+				t.Year++
+			}
+		}
+		t.Flexible = true
+		t.Start = time.Date(t.Year, time.Month(t.Month), 1, 0, 0, 0, 0, time.UTC)
+		t.End = t.Start.AddDate(0, 1, -1)
+		return nil
+	}
+
+	t.Flexible = false
+	t.Year = 0
+	if t.Start.IsZero() || t.End.IsZero() {
+		return errors.New("Не указаны даты поездки")
+	}
+	t.Start, t.End = day(t.Start), day(t.End)
+	if t.End.Before(t.Start) {
+		return errors.New("Дата окончания поездки раньше даты начала")
+	}
+	return nil
+}
+
+// Validate normalizes trip and checks that all destinations exist in database
+func (t *Trip) Validate(db DataBase) error {
+	if err := t.Normalize(time.Now()); err != nil {
+		return err
+	}
+	for _, place := range t.Destinations {
+		if !db.CountryExists(place) && !db.CityExists(place) {
+			return fmt.Errorf("Место %s не существует в базе данных", place)
+		}
+	}
+	return nil
+}
+
+// VisibleTo returns true if trip of owner can be shown to user with provided id
+func (t *Trip) VisibleTo(id bson.ObjectId, owner *User) bool {
+	if t.User == id || t.HasParticipant(id) {
+		return true
+	}
+	switch t.Visibility {
+	case TripPublic:
+		return true
+	case TripFavorites:
+		if owner == nil {
+			return false
+		}
+		for _, v := range owner.Favorites {
+			if v == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// HasParticipant returns true if user with provided id takes part in trip
+func (t *Trip) HasParticipant(id bson.ObjectId) bool {
+	for _, v := range t.Participants {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Full returns true if companions limit of trip is reached and user is
+// not participant yet; trip without limit is never full
+func (t *Trip) Full(user bson.ObjectId) bool {
+	if t.Companions == 0 || t.HasParticipant(user) {
+		return false
+	}
+	return len(t.Participants) >= t.Companions
+}
+
+// Completed returns true if trip is marked as done or is over and not cancelled
+func (t *Trip) Completed(now time.Time) bool {
+	if t.Status == TripDone {
+		return true
+	}
+	return t.Status != TripCancelled && day(t.End).Before(day(now))
+}
+
+// Prepare sets the owner user object
+func (t *Trip) Prepare(context Context) error {
+	if t.UserObject == nil {
+		t.UserObject = context.DB.Get(t.User)
+	}
+	if t.UserObject == nil {
+		return nil
+	}
+	if err := t.UserObject.Prepare(context); err != nil {
+		return err
+	}
+	t.UserObject.CleanPrivate()
+	return nil
+}
+
+func (trips Trips) Prepare(context Context) error {
+	for _, trip := range trips {
+		if err := trip.Prepare(context); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OverlapWith returns amount of days that trip shares with provided date range
+func (t *Trip) OverlapWith(start, end time.Time) int {
+	from, to := t.Start, t.End
+	if start.After(from) {
+		from = start
+	}
+	if end.Before(to) {
+		to = end
+	}
+	if to.Before(from) {
+		return 0
+	}
+	return int(to.Sub(from).Hours()/24) + 1
+}
+
+// TripQuery represents filtering query for trips
+type TripQuery struct {
+	Trip         bson.ObjectId `json:"trip"`
+	Destinations []string      `json:"destinations"`
+	Start        time.Time     `json:"start"`
+	End          time.Time     `json:"end"`
+	Month        int           `json:"month"`
+	Year         int           `json:"year"`
+	Transport    string        `json:"transport"`
+	Companions   int           `json:"companions"`
+	Sex          string        `json:"sex"`
+	AgeMin       int           `json:"age_min"`
+	AgeMax       int           `json:"age_max"`
+}
+
+// NewTripQuery returns trip query with parsed fields from url params
+func NewTripQuery(q url.Values) (*TripQuery, error) {
+	query := &TripQuery{}
+	return query, mapToStructValue(q, query)
+}
+
+// FromTrip fills destinations and dates of query from trip
+func (q *TripQuery) FromTrip(t *Trip) {
+	q.Trip = t.Id
+	q.Destinations = t.Destinations
+	q.Start = t.Start
+	q.End = t.End
+	q.Month = t.Month
+	q.Year = t.Year
+	if q.Transport == "" {
+		q.Transport = t.Transport
+	}
+}
+
+// Normalize sets date range of query the same way as for trip
+func (q *TripQuery) Normalize(now time.Time) error {
+	t := &Trip{Destinations: q.Destinations, Start: q.Start, End: q.End, Month: q.Month, Year: q.Year,
+		Transport: q.Transport, Companions: q.Companions}
+	if err := t.Normalize(now); err != nil {
+		return err
+	}
+	q.Start, q.End, q.Transport = t.Start, t.End, t.Transport
+	if q.Sex != "" && q.Sex != SexMale && q.Sex != SexFemale {
+		return fmt.Errorf("Неизвестный пол %s", q.Sex)
+	}
+	return nil
+}
+
+// ToBson generates mongo query for overlapping trips of other users
+func (q *TripQuery) ToBson(user bson.ObjectId) bson.M {
+	query := bson.M{
+		"user":         bson.M{"$ne": user},
+		"destinations": bson.M{"$in": q.Destinations},
+		"start":        bson.M{"$lte": q.End},
+		"end":          bson.M{"$gte": q.Start},
+		"status":       bson.M{"$in": []string{TripPlanned, TripActive}},
+		"visibility":   bson.M{"$ne": TripPrivate},
+	}
+	if q.Transport != "" && q.Transport != TransportAny {
+		query["transport"] = bson.M{"$in": []string{q.Transport, TransportAny}}
+	}
+	if q.Companions > 0 {
+		query["companions"] = bson.M{"$gte": q.Companions}
+	}
+	return query
+}
+
+// Accepts returns true if owner of query accepts user with provided age and sex
+func (q *TripQuery) Accepts(u *User, now time.Time) bool {
+	if q.Sex != "" && u.Sex != q.Sex {
+		return false
+	}
+	age := u.AgeAt(now)
+	if q.AgeMin != 0 && age < q.AgeMin {
+		return false
+	}
+	if q.AgeMax != 0 && age > q.AgeMax {
+		return false
+	}
+	return true
+}
+
+// Rank filters trips found by query for user, removing trips that are not
+// visible or which owners do not like user, and sorts them by overlap length
+// and compatibility. The owners map must contain owners of all trips.
+func (q *TripQuery) Rank(user *User, trips []*Trip, owners map[bson.ObjectId]*User, now time.Time) Trips {
+	result := Trips{}
+	for _, trip := range trips {
+		owner := owners[trip.User]
+		if owner == nil || !trip.VisibleTo(user.Id, owner) {
+			continue
+		}
+		if !owner.Likes(user, now) || !q.Accepts(owner, now) {
+			continue
+		}
+		trip.Overlap = trip.OverlapWith(q.Start, q.End)
+		if trip.Overlap == 0 {
+			continue
+		}
+		trip.Compatibility = Compatibility(user, owner, now)
+		trip.UserObject = owner
+		result = append(result, trip)
+	}
+	sort.Sort(tripsByRelevance(result))
+	return result
+}
+
+type tripsByRelevance Trips
+
+func (t tripsByRelevance) Len() int      { return len(t) }
+func (t tripsByRelevance) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+func (t tripsByRelevance) Less(i, j int) bool {
+	if t[i].Overlap != t[j].Overlap {
+		return t[i].Overlap > t[j].Overlap
+	}
+	if t[i].Compatibility != t[j].Compatibility {
+		return t[i].Compatibility > t[j].Compatibility
+	}
+	return t[i].Start.Before(t[j].Start)
+}
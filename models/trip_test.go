@@ -0,0 +1,165 @@
+package models
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+	"time"
+)
+
+func TestTrip(t *testing.T) {
+	now := time.Date(2015, time.June, 10, 15, 0, 0, 0, time.UTC)
+	Convey("Normalize trip", t, func() {
+		trip := &Trip{Destinations: []string{"Москва"}}
+		Convey("No destinations", func() {
+			trip.Destinations = nil
+			trip.Month = 7
+			So(trip.Normalize(now), ShouldNotBeNil)
+		})
+		Convey("Flexible", func() {
+			trip.Month = 7
+			So(trip.Normalize(now), ShouldBeNil)
+			So(trip.Flexible, ShouldBeTrue)
+			So(trip.Year, ShouldEqual, 2015)
+			So(trip.Start, ShouldResemble, time.Date(2015, time.July, 1, 0, 0, 0, 0, time.UTC))
+			So(trip.End, ShouldResemble, time.Date(2015, time.July, 31, 0, 0, 0, 0, time.UTC))
+			So(trip.Status, ShouldEqual, TripPlanned)
+			So(trip.Visibility, ShouldEqual, TripPublic)
+			So(trip.Transport, ShouldEqual, TransportAny)
+			Convey("Next year", func() {
+				trip.Month = 2
+				trip.Year = 0
+				So(trip.Normalize(now), ShouldBeNil)
+				So(trip.Year, ShouldEqual, 2016)
+			})
+		})
+		Convey("Bad month", func() {
+			trip.Month = 13
+			So(trip.Normalize(now), ShouldNotBeNil)
+		})
+		Convey("Exact dates", func() {
+			trip.Start = now
+			trip.End = now.AddDate(0, 0, 5)
+			So(trip.Normalize(now), ShouldBeNil)
+			So(trip.Flexible, ShouldBeFalse)
+			So(trip.Start, ShouldResemble, time.Date(2015, time.June, 10, 0, 0, 0, 0, time.UTC))
+			Convey("End before start", func() {
+				trip.End = now.AddDate(0, 0, -1)
+				So(trip.Normalize(now), ShouldNotBeNil)
+			})
+			Convey("No dates", func() {
+				trip.End = time.Time{}
+				So(trip.Normalize(now), ShouldNotBeNil)
+			})
+		})
+		Convey("Bad enums", func() {
+			trip.Month = 7
+			Convey("Status", func() {
+				trip.Status = "lol"
+				So(trip.Normalize(now), ShouldNotBeNil)
+			})
+			Convey("Visibility", func() {
+				trip.Visibility = "lol"
+				So(trip.Normalize(now), ShouldNotBeNil)
+			})
+			Convey("Transport", func() {
+				trip.Transport = "lol"
+				So(trip.Normalize(now), ShouldNotBeNil)
+			})
+			Convey("Companions", func() {
+				trip.Companions = 100
+				So(trip.Normalize(now), ShouldNotBeNil)
+			})
+		})
+	})
+	Convey("Trip visibility", t, func() {
+		owner := &User{Id: bson.NewObjectId()}
+		friend := bson.NewObjectId()
+		stranger := bson.NewObjectId()
+		owner.Favorites = []bson.ObjectId{friend}
+		trip := &Trip{User: owner.Id, Visibility: TripPublic}
+		So(trip.VisibleTo(stranger, owner), ShouldBeTrue)
+		trip.Visibility = TripFavorites
+		So(trip.VisibleTo(friend, owner), ShouldBeTrue)
+		So(trip.VisibleTo(stranger, owner), ShouldBeFalse)
+		trip.Visibility = TripPrivate
+		So(trip.VisibleTo(friend, owner), ShouldBeFalse)
+		So(trip.VisibleTo(owner.Id, owner), ShouldBeTrue)
+	})
+	Convey("Trip companions", t, func() {
+		participant := bson.NewObjectId()
+		trip := &Trip{Participants: []bson.ObjectId{participant}}
+		So(trip.Full(bson.NewObjectId()), ShouldBeFalse)
+		trip.Companions = 1
+		So(trip.Full(bson.NewObjectId()), ShouldBeTrue)
+		So(trip.Full(participant), ShouldBeFalse)
+		trip.Companions = 2
+		So(trip.Full(bson.NewObjectId()), ShouldBeFalse)
+	})
+	Convey("Trip matching", t, func() {
+		day := func(d int) time.Time {
+			return time.Date(2015, time.July, d, 0, 0, 0, 0, time.UTC)
+		}
+		trip := &Trip{Start: day(1), End: day(10)}
+		Convey("Overlap", func() {
+			So(trip.OverlapWith(day(5), day(20)), ShouldEqual, 6)
+			So(trip.OverlapWith(day(10), day(10)), ShouldEqual, 1)
+			So(trip.OverlapWith(day(11), day(20)), ShouldEqual, 0)
+		})
+		Convey("Likings", func() {
+			birthday := now.AddDate(-25, 0, -1)
+			user := &User{Id: bson.NewObjectId(), Sex: SexMale, Birthday: birthday}
+			owner := &User{Id: bson.NewObjectId(), Sex: SexFemale, LikingsSex: SexMale}
+			So(owner.Likes(user, now), ShouldBeTrue)
+			owner.LikingsAgeMin = 30
+			So(owner.Likes(user, now), ShouldBeFalse)
+			owner.LikingsAgeMin = 0
+			owner.LikingsSex = SexFemale
+			So(owner.Likes(user, now), ShouldBeFalse)
+			Convey("Compatibility", func() {
+				owner.LikingsSex = ""
+				a := Compatibility(user, owner, now)
+				owner.LikingsSeasons = []string{SeasonSummer}
+				user.LikingsSeasons = []string{SeasonSummer, SeasonWinter}
+				So(Compatibility(user, owner, now), ShouldBeGreaterThan, a)
+			})
+		})
+		Convey("Rank", func() {
+			user := &User{Id: bson.NewObjectId()}
+			friendly := &User{Id: bson.NewObjectId(), LikingsSeasons: []string{SeasonSummer}}
+			user.LikingsSeasons = friendly.LikingsSeasons
+			strict := &User{Id: bson.NewObjectId(), LikingsSex: SexFemale}
+			user.Sex = SexMale
+			short := &Trip{User: friendly.Id, Start: day(8), End: day(20), Visibility: TripPublic}
+			long := &Trip{User: strict.Id, Start: day(1), End: day(20), Visibility: TripPublic}
+			other := &User{Id: bson.NewObjectId()}
+			compatible := &Trip{User: other.Id, Start: day(8), End: day(20), Visibility: TripPublic}
+			hidden := &Trip{User: other.Id, Start: day(1), End: day(20), Visibility: TripFavorites}
+			owners := map[bson.ObjectId]*User{friendly.Id: friendly, strict.Id: strict, other.Id: other}
+			q := &TripQuery{Start: day(1), End: day(10)}
+			result := q.Rank(user, []*Trip{compatible, short, long, hidden}, owners, now)
+			So(len(result), ShouldEqual, 2)
+			So(result[0], ShouldEqual, short)
+			So(result[0].Overlap, ShouldEqual, 3)
+			So(result[1], ShouldEqual, compatible)
+			Convey("Owner filter", func() {
+				q.Sex = SexFemale
+				So(len(q.Rank(user, []*Trip{short}, owners, now)), ShouldEqual, 0)
+			})
+		})
+		Convey("Query", func() {
+			q := &TripQuery{Destinations: []string{"Москва"}, Month: 7}
+			So(q.Normalize(now), ShouldBeNil)
+			So(q.Start, ShouldResemble, day(1))
+			So(q.End, ShouldResemble, day(31))
+			So(q.Transport, ShouldEqual, TransportAny)
+			_, ok := q.ToBson(bson.NewObjectId())["transport"]
+			So(ok, ShouldBeFalse)
+			q.Transport = TransportCar
+			_, ok = q.ToBson(bson.NewObjectId())["transport"]
+			So(ok, ShouldBeTrue)
+			q.Sex = "lol"
+			So(q.Normalize(now), ShouldNotBeNil)
+		})
+	})
+}
@@ -34,6 +34,15 @@ func TestUpdates(t *testing.T) {
 		Convey("Guests", func() {
 			So(GetEventType(UpdateGuests, nil), ShouldEqual, SubscriptionGuests)
 		})
+		Convey("Group messages", func() {
+			So(GetEventType(UpdateGroupMessages, new(GroupMessage)), ShouldEqual, SubscriptionMessages)
+		})
+		Convey("Trips", func() {
+			So(GetEventType(UpdateTrips, new(Trip)), ShouldEqual, SubscriptionTrips)
+		})
+		Convey("Reviews", func() {
+			So(GetEventType(UpdateReviews, new(Review)), ShouldEqual, SubscriptionReviews)
+		})
 
 		Convey("Messages", func() {
 			m := new(Message)
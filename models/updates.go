@@ -13,6 +13,20 @@ const (
 	UpdateLikes    = "likes"
 	UpdateGuests   = SubscriptionGuests
 	UpdateMessages = SubscriptionMessages
+	UpdateTrips    = SubscriptionTrips
+	UpdateInvites  = SubscriptionInvites
+	UpdateReviews  = SubscriptionReviews
+	UpdateNews     = SubscriptionNews
+
+	UpdateGroupMessages = "group_messages"
+
+	// ephemeral updates, that are pushed only to realtime channel
+	UpdateRead              = "read"
+	UpdateTyping            = "typing"
+	UpdateMessageEdit       = "message_edit"
+	UpdateMessageUnsend     = "message_unsend"
+	UpdateMessageAttachment = "message_attachment"
+	UpdateOnline            = SubscriptionOnline
 )
 
 type Update struct {
@@ -29,6 +43,7 @@ type Update struct {
 	Url         string        `json:"url,omitempty"         bson:"-"`
 	Target      interface{}   `json:"target,omitempty"      bson:"target,omitempty"`
 	Time        time.Time     `json:"time"                  bson:"time"`
+	Silent      bool          `json:"silent,omitempty"      bson:"-"`
 }
 
 func (u Update) String() string {
@@ -46,6 +61,30 @@ func (u *Update) Theme() (theme string) {
 	if u.Type == "guests" {
 		theme = fmt.Sprintf("Пользователь %s заходил на вашу страницу", u.UserObject.Name)
 	}
+	if u.Type == "invites" {
+		theme = fmt.Sprintf("Пользователь %s пригласил вас в путешествие", u.UserObject.Name)
+		if i, ok := u.Target.(*Invitation); ok {
+			theme = i.Theme(u.Destination, u.UserObject.Name)
+		}
+	}
+	if u.Type == UpdateGroupMessages {
+		theme = fmt.Sprintf("Пользователь %s написал в групповой чат", u.UserObject.Name)
+	}
+	if u.Type == UpdateReviews {
+		theme = fmt.Sprintf("Пользователь %s оставил вам отзыв", u.UserObject.Name)
+	}
+	if u.Type == UpdateNews {
+		theme = "Новости Попутчиков"
+		if n, ok := u.Target.(*News); ok {
+			theme = n.Title
+		}
+	}
+	if u.Type == UpdateOnline {
+		theme = fmt.Sprintf("Пользователь %s сейчас в сети", u.UserObject.Name)
+	}
+	if u.Type == "trips" {
+		theme = fmt.Sprintf("Пользователь %s едет туда же, куда и вы", u.UserObject.Name)
+	}
 
 	if u.Type == "likes" {
 		var t string
@@ -86,11 +125,21 @@ func NewUpdate(destination, user bson.ObjectId, updateType string, media interfa
 	return *u
 }
 
+// IsPayload returns true if update carries message of conversation, so it
+// is delivered in app regardless of preferences of user
+func (u Update) IsPayload() bool {
+	return u.Type == UpdateMessages || u.Type == UpdateGroupMessages || u.Type == UpdateInvites
+}
+
 func GetEventType(updateType string, media interface{}) string {
+	if updateType == UpdateGroupMessages {
+		return SubscriptionMessages
+	}
 	if media == nil {
 		return updateType
 	}
-	if updateType == SubscriptionInvites || updateType == SubscriptionMessages || updateType == SubscriptionGuests {
+	if updateType == SubscriptionInvites || updateType == SubscriptionMessages || updateType == SubscriptionGuests ||
+		updateType == SubscriptionTrips || updateType == SubscriptionReviews || updateType == SubscriptionNews {
 		return updateType
 	}
 	return fmt.Sprintf("%s_%s", updateType, strings.ToLower(reflect.TypeOf(media).Elem().Name()))
@@ -31,11 +31,16 @@ const (
 	SubscriptionInvites     = "invites"
 	SubscriptionGuests      = "guests"
 	SubscriptionNews        = "news"
+	SubscriptionTrips       = "trips"
+	SubscriptionReviews     = "reviews"
+	SubscriptionOnline      = "online"
 )
 
 var (
 	Subscriptions = []string{SubscriptionLikesPhoto, SubscriptionLikesStatus, SubscriptionMessages,
-		SubscriptionInvites, SubscriptionGuests, SubscriptionNews}
+		SubscriptionInvites, SubscriptionGuests, SubscriptionNews, SubscriptionTrips, SubscriptionReviews}
+	// OptInSubscriptions are not enabled for new users
+	OptInSubscriptions = []string{SubscriptionOnline}
 )
 
 // UserInfo additional user information
@@ -103,6 +108,9 @@ type User struct {
 	VipTill             time.Time       `json:"vip_till"               bson:"vip_till"`
 	Rating              float64         `json:"rating"                 bson:"rating"`
 	Subscriptions       []string        `json:"subscriptions,omitempty"bson:"subscriptions"`
+	Notifications       Notifications   `json:"-"                      bson:"notifications,omitempty"`
+	Digest              string          `json:"digest,omitempty"       bson:"digest,omitempty"`
+	DigestSent          time.Time       `json:"-"                      bson:"digest_sent,omitempty"`
 	Registered          time.Time       `json:"registered,omitempty"   bson:"registered"`
 	Orientation         string          `json:"orientation"            bson:"orientation"`
 	Relations           string          `json:"relations"              bson:"relations"`
@@ -114,6 +122,9 @@ type User struct {
 	Accommodation       string          `json:"accommodation"          bson:"accommodation"`
 	IOsTokens           []string        `json:"ios_tokens,omitempty"   bson:"ios_tokens,omitempty"`
 	AndroidTokens       []string        `json:"android_tokens,omitempty" bson:"android_tokens,omitempty"`
+	CalendarToken       string          `json:"calendar_token,omitempty" bson:"calendar_token,omitempty"`
+	Reviews             *ReviewStats    `json:"reviews,omitempty"      bson:"-"`
+	SpamFlag            *SpamFlag       `json:"-"                      bson:"spam_flag,omitempty"`
 }
 
 type GuestUser struct {
@@ -166,6 +177,7 @@ func (u *User) CleanPrivate() {
 	u.Balance = 0
 	u.AndroidTokens = nil
 	u.IOsTokens = nil
+	u.CalendarToken = ""
 }
 
 func (u *User) SetAvatarUrl(context Context) {
@@ -196,6 +208,63 @@ func diff(t1, t2 time.Time) (years int) {
 	return years
 }
 
+// AgeAt returns age of user at provided time or 0 if birthday is unknown
+func (u *User) AgeAt(now time.Time) int {
+	if u.Birthday.IsZero() || u.Birthday.Unix() == 0 {
+		return 0
+	}
+	return diff(u.Birthday, now)
+}
+
+// Likes returns true if other user matches sex and age from likings of user
+func (u *User) Likes(other *User, now time.Time) bool {
+	if u.LikingsSex != "" && other.Sex != "" && u.LikingsSex != other.Sex {
+		return false
+	}
+	age := other.AgeAt(now)
+	if age == 0 {
+		return true
+	}
+	if u.LikingsAgeMin != 0 && age < u.LikingsAgeMin {
+		return false
+	}
+	if u.LikingsAgeMax != 0 && age > u.LikingsAgeMax {
+		return false
+	}
+	return true
+}
+
+func intersects(a, b []string) bool {
+	for _, v := range a {
+		for _, w := range b {
+			if v == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Compatibility returns value from 0 to 1 showing how well likings
+// of two users match each other
+func Compatibility(a, b *User, now time.Time) float64 {
+	checks := []bool{
+		a.Likes(b, now),
+		b.Likes(a, now),
+		intersects(a.LikingsDestinations, b.LikingsDestinations),
+		intersects(a.LikingsSeasons, b.LikingsSeasons),
+		a.LikingsCountry != "" && a.LikingsCountry == b.LikingsCountry,
+		a.LikingsCity != "" && a.LikingsCity == b.LikingsCity,
+	}
+	matched := 0
+	for _, ok := range checks {
+		if ok {
+			matched++
+		}
+	}
+	return float64(matched) / float64(len(checks))
+}
+
 func (u *User) SetIsFavorite(context Context) {
 	user := context.User
 	if user == nil {
@@ -208,6 +277,26 @@ func (u *User) SetIsFavorite(context Context) {
 	}
 }
 
+// InBlacklist returns true if user with provided id is in blacklist of user
+func (u *User) InBlacklist(id bson.ObjectId) bool {
+	for _, v := range u.Blacklist {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// IsSubscribed returns true if user enabled subscription
+func (u *User) IsSubscribed(subscription string) bool {
+	for _, v := range u.Subscriptions {
+		if v == subscription {
+			return true
+		}
+	}
+	return false
+}
+
 func (u *User) SetIsBlacklisted(context Context) {
 	user := context.User
 	if user == nil {
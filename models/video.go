@@ -20,6 +20,13 @@ type Video struct {
 	Likes         int             `json:"likes"                 bson:"likes"`
 	LikedUsers    []bson.ObjectId `json:"liked_users"           bson:"liked_users,omitempty"`
 	Duration      int64           `json:"duration"              bson:"duration"`
+	Message       bson.ObjectId   `json:"message,omitempty"     bson:"message,omitempty"`
+	Participants  []bson.ObjectId `json:"-"                     bson:"participants,omitempty"`
+}
+
+// AccessibleBy returns true if video can be accessed by user with provided id
+func (v *Video) AccessibleBy(id bson.ObjectId) bool {
+	return len(v.Participants) == 0 || containsId(v.Participants, id)
 }
 
 func (v *Video) Prepare(context Context) error {
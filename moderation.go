@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+
+	. "github.com/ernado/poputchiki/models"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const moderationQueueCount = 20
+
+// NewModeratorFromFile returns moderator with policy from json file, or
+// with default policy if path is blank
+func NewModeratorFromFile(path string) (*Moderator, error) {
+	policy := DefaultModerationPolicy()
+	if path == "" {
+		return NewModerator(policy), nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&policy); err != nil {
+		return nil, err
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	return NewModerator(policy), nil
+}
+
+// moderate checks text of user, returning ValidationError if text is
+// rejected and putting text to review queue if it is held. Returned text
+// is masked according to policy.
+func moderate(db DataBase, moderator *Moderator, user bson.ObjectId, t string, target bson.ObjectId, text string) (string, *ModerationItem, error) {
+	return moderateItem(db, moderator, NewModerationItem(user, t, target, ModerationResult{}), text)
+}
+
+// moderateItem checks text like moderate, putting provided item with
+// masked text to review queue if text is held
+func moderateItem(db DataBase, moderator *Moderator, item *ModerationItem, text string) (string, *ModerationItem, error) {
+	result := moderator.Check(text)
+	switch result.Action {
+	case ModerationReject:
+		log.Println("[moderation]", item.Type, "of", item.User.Hex(), "rejected:", result.Rules)
+		return "", nil, ValidationError(ErrModerationRejected)
+	case ModerationHold:
+		item.Text, item.Rules = result.Text, result.Rules
+		if err := db.AddModerationItem(item); err != nil {
+			return "", nil, BackendError(err)
+		}
+		log.Println("[moderation]", item.Type, "of", item.User.Hex(), "held:", result.Rules)
+		return result.Text, item, nil
+	}
+	return result.Text, nil, nil
+}
+
+// moderateChange checks text that can't wait for review, like edited text
+// of message or caption of attachment, rejecting text that would be held
+func moderateChange(moderator *Moderator, user bson.ObjectId, t string, text string) (string, error) {
+	result := moderator.Check(text)
+	if result.Action == ModerationReject || result.Action == ModerationHold {
+		log.Println("[moderation]", t, "change of", user.Hex(), "rejected:", result.Rules)
+		return "", ValidationError(ErrModerationRejected)
+	}
+	return result.Text, nil
+}
+
+// publishModerationItem publishes approved text on behalf of its author
+func publishModerationItem(db DataBase, updater Updater, channel RealtimeInterface, item *ModerationItem) error {
+	switch item.Type {
+	case ModerationStatus:
+		if item.Target.Valid() {
+			_, err := db.UpdateStatusSecure(item.User, item.Target, item.Text)
+			return err
+		}
+		_, err := db.AddStatus(item.User, item.Text)
+		return err
+	case ModerationAbout:
+		_, err := db.Update(item.User, bson.M{"about": item.Text})
+		return err
+	case ModerationMessage:
+		m, toOrigin, toDestination := NewMessagePair(db, item.User, item.Target, item.Photo, item.Text)
+		// author could be flagged as spammer while message was held
+		if u := db.Get(item.User); u != nil && u.ShadowLimited() {
+			m.Removed = []bson.ObjectId{item.Target}
+		}
+		if err := db.AddMessage(m); err != nil {
+			return err
+		}
+		toOrigin.Conversation = m.Conversation
+		toDestination.Conversation = m.Conversation
+		if err := updater.Push(NewUpdate(m.Origin, m.Origin, UpdateMessages, toOrigin)); err != nil {
+			log.Println("[moderation]", "realtime error", err)
+		}
+		if m.RemovedFor(m.Destination) {
+			return nil
+		}
+		if err := pushToDestination(db, updater, channel, toDestination); err != nil {
+			log.Println("[moderation]", "realtime error", err)
+		}
+	}
+	return nil
+}
+
+// GetModerationQueue returns admin queue of held texts
+func GetModerationQueue(context Context, pagination Pagination) (int, []byte) {
+	if pagination.Count == 0 {
+		pagination.Count = moderationQueueCount
+	}
+	items, count, err := context.DB.GetModerationQueue(pagination)
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	if err := ModerationItems(items).Prepare(context); err != nil {
+		return Render(BackendError(err))
+	}
+	return context.Render(SearchResult{Result: items, Count: count})
+}
+
+// ApproveModerationItem publishes held text; new status is not published
+// if author already added all statuses allowed per day
+func ApproveModerationItem(context Context, id bson.ObjectId, updater Updater, channel RealtimeInterface) (int, []byte) {
+	item, err := context.DB.GetModerationItem(id)
+	if err == mgo.ErrNotFound {
+		return Render(ErrorObjectNotFound)
+	}
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	if item.Type == ModerationStatus && !item.Target.Valid() {
+		u := context.DB.Get(item.User)
+		if u == nil {
+			return Render(ErrorUserNotFound)
+		}
+		reached, err := statusesLimitReached(context.DB, u)
+		if err != nil {
+			return Render(BackendError(err))
+		}
+		if reached {
+			return Render(ErrorInsufficentFunds)
+		}
+	}
+	item, err = context.DB.SetModerationState(id, ModerationApproved)
+	if err == mgo.ErrNotFound {
+		return Render(ErrorObjectNotFound)
+	}
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	if err := publishModerationItem(context.DB, updater, channel, item); err != nil {
+		return Render(BackendError(err))
+	}
+	log.Println("[moderation]", "item", id.Hex(), "approved")
+	return context.Render(item)
+}
+
+// RejectModerationItem removes held text from queue without publishing
+func RejectModerationItem(context Context, id bson.ObjectId) (int, []byte) {
+	item, err := context.DB.SetModerationState(id, ModerationRejected)
+	if err == mgo.ErrNotFound {
+		return Render(ErrorObjectNotFound)
+	}
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	log.Println("[moderation]", "item", id.Hex(), "rejected")
+	return context.Render(item)
+}
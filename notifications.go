@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	. "github.com/ernado/poputchiki/models"
+)
+
+// GetNotifications returns notification preferences of user for every
+// event type and channel
+func GetNotifications(context Context) (int, []byte) {
+	return context.Render(context.User.NotificationsMatrix())
+}
+
+// UpdateNotifications changes notification preferences of user for event
+// types from request, leaving other event types unchanged. Matrix can be
+// sent only as json.
+func UpdateNotifications(db DataBase, r *http.Request, context Context) (int, []byte) {
+	if !strings.Contains(r.Header.Get(ContentTypeHeader), "json") {
+		return Render(ValidationError(errors.New("Notifications must be sent as json")))
+	}
+	notifications := make(Notifications)
+	if err := json.NewDecoder(r.Body).Decode(&notifications); err != nil {
+		return Render(ValidationError(err))
+	}
+	if err := notifications.Validate(); err != nil {
+		return Render(err)
+	}
+	if err := db.SetNotifications(context.User.Id, notifications); err != nil {
+		return Render(BackendError(err))
+	}
+	user := db.Get(context.User.Id)
+	if user == nil {
+		return Render(ErrorUserNotFound)
+	}
+	return context.Render(user.NotificationsMatrix())
+}
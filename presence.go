@@ -0,0 +1,204 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	. "github.com/ernado/poputchiki/models"
+	"github.com/garyburd/redigo/redis"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	PRESENCE_REDIS_KEY  = "presence"
+	PRESENCE_ONLINE_KEY = "online"
+	PRESENCE_SEEN_KEY   = "seen"
+	PRESENCE_API_DEVICE = "api"
+
+	presenceTTL       = 60 * time.Second
+	presenceHeartbeat = 20 * time.Second
+	presenceLimit     = 1
+	presencePeriod    = 10 * time.Minute
+)
+
+// touchScript adds device of user with expiration time, removing expired
+// devices, and returns amount of devices that were alive before
+var touchScript = redis.NewScript(3, `
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[2])
+local alive = redis.call('ZCARD', KEYS[1])
+redis.call('ZADD', KEYS[1], ARGV[3], ARGV[1])
+local last = redis.call('ZREVRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+redis.call('PEXPIRE', KEYS[1], tonumber(last[2]) - tonumber(ARGV[2]))
+redis.call('ZADD', KEYS[2], last[2], ARGV[4])
+redis.call('HSET', KEYS[3], ARGV[4], ARGV[2])
+return alive
+`)
+
+// removeScript removes device of user and returns 1 if user has no alive
+// devices left
+var removeScript = redis.NewScript(3, `
+redis.call('ZREM', KEYS[1], ARGV[1])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[2])
+local last = redis.call('ZREVRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+if #last == 0 then
+	redis.call('ZREM', KEYS[2], ARGV[3])
+	redis.call('HDEL', KEYS[3], ARGV[3])
+	return 1
+end
+redis.call('ZADD', KEYS[2], last[2], ARGV[3])
+redis.call('HSET', KEYS[3], ARGV[3], ARGV[2])
+return 0
+`)
+
+// sweepScript removes users without alive devices and returns pairs of
+// user and time of last activity
+var sweepScript = redis.NewScript(2, `
+local users = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+local result = {}
+for _, user in ipairs(users) do
+	redis.call('ZREM', KEYS[1], user)
+	result[#result + 1] = user
+	result[#result + 1] = redis.call('HGET', KEYS[2], user) or '0'
+	redis.call('HDEL', KEYS[2], user)
+end
+return result
+`)
+
+// Presence tracks devices of users in redis. Every realtime connection and
+// recent api request is a device with ttl, and user is online while any
+// of devices is alive. Online flag and last action of user are saved only
+// when user comes online or goes offline.
+type Presence struct {
+	pool     *redis.Pool
+	db       DataBase
+	realtime Updater
+	push     Updater
+	limiter  *EventLimiter
+}
+
+func NewPresence(pool *redis.Pool, db DataBase, realtime Updater, push Updater) *Presence {
+	return &Presence{pool, db, realtime, push, &EventLimiter{pool}}
+}
+
+func (p *Presence) key(parts ...string) string {
+	return strings.Join(append([]string{redisName, PRESENCE_REDIS_KEY}, parts...), REDIS_SEPARATOR)
+}
+
+func milliseconds(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// Touch marks device of user alive for ttl
+func (p *Presence) Touch(user bson.ObjectId, device string, ttl time.Duration) error {
+	conn := p.pool.Get()
+	defer conn.Close()
+	now := time.Now()
+	alive, err := redis.Int(touchScript.Do(conn, p.key(user.Hex()), p.key(PRESENCE_ONLINE_KEY), p.key(PRESENCE_SEEN_KEY),
+		device, milliseconds(now), milliseconds(now.Add(ttl)), user.Hex()))
+	if err != nil {
+		return err
+	}
+	if alive == 0 {
+		return p.online(user)
+	}
+	return nil
+}
+
+// Remove marks device of user as disconnected
+func (p *Presence) Remove(user bson.ObjectId, device string) error {
+	conn := p.pool.Get()
+	defer conn.Close()
+	now := time.Now()
+	offline, err := redis.Int(removeScript.Do(conn, p.key(user.Hex()), p.key(PRESENCE_ONLINE_KEY), p.key(PRESENCE_SEEN_KEY),
+		device, milliseconds(now), user.Hex()))
+	if err != nil {
+		return err
+	}
+	if offline == 1 {
+		return p.db.SetPresence(user, false, now)
+	}
+	return nil
+}
+
+// Track keeps device of realtime connection alive until done is closed
+func (p *Presence) Track(user bson.ObjectId, done <-chan struct{}) {
+	device := bson.NewObjectId().Hex()
+	if err := p.Touch(user, device, presenceTTL); err != nil {
+		log.Println("[presence]", "error", err)
+	}
+	ticker := time.NewTicker(presenceHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := p.Touch(user, device, presenceTTL); err != nil {
+				log.Println("[presence]", "error", err)
+			}
+		case <-done:
+			if err := p.Remove(user, device); err != nil {
+				log.Println("[presence]", "error", err)
+			}
+			return
+		}
+	}
+}
+
+// Sweep sets users whose devices are expired offline
+func (p *Presence) Sweep() (int, error) {
+	conn := p.pool.Get()
+	defer conn.Close()
+	result, err := redis.Strings(sweepScript.Do(conn, p.key(PRESENCE_ONLINE_KEY), p.key(PRESENCE_SEEN_KEY), milliseconds(time.Now())))
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i+1 < len(result); i += 2 {
+		if !bson.IsObjectIdHex(result[i]) {
+			continue
+		}
+		seen, err := redis.Int64(result[i+1], nil)
+		if err != nil {
+			return 0, err
+		}
+		lastAction := time.Unix(0, seen*int64(time.Millisecond))
+		if err := p.db.SetPresence(bson.ObjectIdHex(result[i]), false, lastAction); err != nil {
+			return 0, err
+		}
+	}
+	return len(result) / 2, nil
+}
+
+// online saves that user came online and notifies users that have user
+// in favorites and are subscribed to it
+func (p *Presence) online(user bson.ObjectId) error {
+	if err := p.db.SetPresence(user, true, time.Now()); err != nil {
+		return err
+	}
+	allowed, err := p.limiter.Allow("online:"+user.Hex(), presenceLimit, presencePeriod)
+	if err != nil || !allowed {
+		return err
+	}
+	u := p.db.Get(user)
+	followers, err := p.db.GetAllUsersWithFavorite(user)
+	if err != nil {
+		return err
+	}
+	for _, follower := range followers {
+		if !EphemeralAllowed(u, follower) {
+			continue
+		}
+		update := NewUpdate(follower.Id, user, UpdateOnline, nil)
+		if follower.Notifies(SubscriptionOnline, NotifyInApp) {
+			if err := p.realtime.Push(update); err != nil {
+				log.Println("[presence]", "realtime error", err)
+			}
+		}
+		if follower.Online || p.push == nil || !follower.Notifies(SubscriptionOnline, NotifyPush) {
+			continue
+		}
+		if err := p.push.Push(update); err != nil {
+			log.Println("[presence]", "push error", err)
+		}
+	}
+	return nil
+}
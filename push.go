@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/ernado/poputchiki/models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	apnsProductionHost  = "https://api.push.apple.com"
+	apnsDevelopmentHost = "https://api.sandbox.push.apple.com"
+	fcmHost             = "https://fcm.googleapis.com"
+	fcmScope            = "https://www.googleapis.com/auth/firebase.messaging"
+	pushLinkScheme      = "poputchiki"
+	pushTitle           = "Попутчики"
+
+	pushTimeout = 10 * time.Second
+	// notifications are sent by workers from queue, out of request path
+	pushWorkers   = 4
+	pushQueueSize = 1000
+	// apple rejects provider tokens that are older than hour
+	apnsTokenTTL = 50 * time.Minute
+	// access tokens of google are refreshed before they expire
+	fcmTokenMargin = time.Minute
+)
+
+var (
+	ErrPushTokenInvalid = errors.New("Push token is invalid")
+	ErrPushKeyInvalid   = errors.New("Push key is invalid")
+	ErrPushQueueFull    = errors.New("Push queue is full")
+	ErrApnsConfig       = errors.New("Key id, team and topic are required for APNs")
+)
+
+// PushMessage is notification that is shown on device
+type PushMessage struct {
+	Title       string
+	Body        string
+	Badge       int
+	Link        string
+	CollapseKey string
+	Type        string
+}
+
+// PushSender delivers notifications to devices of one platform and
+// returns ErrPushTokenInvalid if token of device is not registered anymore
+type PushSender interface {
+	Send(token string, message *PushMessage) error
+}
+
+// pushError returns error of push service response with reason
+func pushError(service string, code int, reason string) error {
+	return fmt.Errorf("%s: bad code %d!=200: %s", service, code, reason)
+}
+
+// signJWT returns json web token with header and claims signed by sign
+func signJWT(header, claims interface{}, sign func(digest []byte) ([]byte, error)) (string, error) {
+	parts := make([]string, 0, 3)
+	for _, v := range []interface{}{header, claims} {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, base64.RawURLEncoding.EncodeToString(data))
+	}
+	digest := sha256.Sum256([]byte(strings.Join(parts, ".")))
+	signature, err := sign(digest[:])
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(append(parts, base64.RawURLEncoding.EncodeToString(signature)), "."), nil
+}
+
+// parsePrivateKey returns key from pem block in PKCS #8 or PKCS #1 format
+func parsePrivateKey(data []byte) (interface{}, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, ErrPushKeyInvalid
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return nil, ErrPushKeyInvalid
+}
+
+// ApnsSender sends notifications to apple devices with http/2 api of APNs,
+// authenticating with provider token signed by key of team
+type ApnsSender struct {
+	client *http.Client
+	host   string
+	topic  string
+	keyId  string
+	teamId string
+	key    *ecdsa.PrivateKey
+
+	mu     sync.Mutex
+	token  string
+	issued time.Time
+}
+
+// NewApnsSender returns sender with .p8 key from apple developer account
+// for application with bundle id topic
+func NewApnsSender(key []byte, keyId, teamId, topic, host string) (*ApnsSender, error) {
+	parsed, err := parsePrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	ecKey, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, ErrPushKeyInvalid
+	}
+	return &ApnsSender{client: &http.Client{Timeout: pushTimeout}, host: host, topic: topic,
+		keyId: keyId, teamId: teamId, key: ecKey}, nil
+}
+
+// providerToken returns cached provider token, issuing new one if it is
+// too old
+func (s *ApnsSender) providerToken(now time.Time) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != "" && now.Sub(s.issued) < apnsTokenTTL {
+		return s.token, nil
+	}
+	header := map[string]string{"alg": "ES256", "kid": s.keyId}
+	claims := map[string]interface{}{"iss": s.teamId, "iat": now.Unix()}
+	token, err := signJWT(header, claims, func(digest []byte) ([]byte, error) {
+		r, sig, err := ecdsa.Sign(rand.Reader, s.key, digest)
+		if err != nil {
+			return nil, err
+		}
+		// signature is concatenation of r and s of fixed size
+		size := (s.key.Curve.Params().BitSize + 7) / 8
+		signature := make([]byte, 2*size)
+		r.FillBytes(signature[:size])
+		sig.FillBytes(signature[size:])
+		return signature, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	s.token, s.issued = token, now
+	return token, nil
+}
+
+func (s *ApnsSender) reset() {
+	s.mu.Lock()
+	s.token = ""
+	s.mu.Unlock()
+}
+
+func (s *ApnsSender) Send(token string, message *PushMessage) error {
+	provider, err := s.providerToken(time.Now())
+	if err != nil {
+		return err
+	}
+	aps := map[string]interface{}{
+		"alert": map[string]string{"title": message.Title, "body": message.Body},
+		"badge": message.Badge,
+		"sound": "default",
+	}
+	payload := map[string]interface{}{"aps": aps, "link": message.Link, "type": message.Type}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.host+"/3/device/"+url.PathEscape(token), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("authorization", "bearer "+provider)
+	req.Header.Set("apns-topic", s.topic)
+	req.Header.Set("apns-push-type", "alert")
+	if message.CollapseKey != "" {
+		req.Header.Set("apns-collapse-id", message.CollapseKey)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	var result struct {
+		Reason string `json:"reason"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	switch result.Reason {
+	case "BadDeviceToken", "Unregistered", "DeviceTokenNotForTopic":
+		return ErrPushTokenInvalid
+	case "ExpiredProviderToken", "InvalidProviderToken":
+		s.reset()
+	}
+	if resp.StatusCode == http.StatusGone {
+		return ErrPushTokenInvalid
+	}
+	return pushError("apns", resp.StatusCode, result.Reason)
+}
+
+// FcmSender sends notifications to android devices with http v1 api of
+// firebase cloud messaging, authenticating with service account
+type FcmSender struct {
+	client   *http.Client
+	host     string
+	tokenUrl string
+	project  string
+	email    string
+	key      *rsa.PrivateKey
+
+	mu      sync.Mutex
+	access  string
+	expires time.Time
+}
+
+// fcmCredentials is json key of google service account
+type fcmCredentials struct {
+	ProjectId   string `json:"project_id"`
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenUri    string `json:"token_uri"`
+}
+
+// NewFcmSender returns sender with json key of service account of firebase
+// project
+func NewFcmSender(credentials []byte, host string) (*FcmSender, error) {
+	c := new(fcmCredentials)
+	if err := json.Unmarshal(credentials, c); err != nil {
+		return nil, err
+	}
+	parsed, err := parsePrivateKey([]byte(c.PrivateKey))
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok || c.ProjectId == "" || c.ClientEmail == "" || c.TokenUri == "" {
+		return nil, ErrPushKeyInvalid
+	}
+	return &FcmSender{client: &http.Client{Timeout: pushTimeout}, host: host, tokenUrl: c.TokenUri,
+		project: c.ProjectId, email: c.ClientEmail, key: key}, nil
+}
+
+// accessToken returns cached oauth2 access token, exchanging signed
+// assertion of service account for new one if it expires
+func (s *FcmSender) accessToken(now time.Time) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.access != "" && now.Add(fcmTokenMargin).Before(s.expires) {
+		return s.access, nil
+	}
+	header := map[string]string{"alg": "RS256", "typ": "JWT"}
+	claims := map[string]interface{}{
+		"iss":   s.email,
+		"scope": fcmScope,
+		"aud":   s.tokenUrl,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}
+	assertion, err := signJWT(header, claims, func(digest []byte) ([]byte, error) {
+		return rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest)
+	})
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+	form.Set("assertion", assertion)
+	resp, err := s.client.PostForm(s.tokenUrl, form)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", pushError("fcm auth", resp.StatusCode, "")
+	}
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	s.access = result.AccessToken
+	s.expires = now.Add(time.Duration(result.ExpiresIn) * time.Second)
+	return s.access, nil
+}
+
+func (s *FcmSender) Send(token string, message *PushMessage) error {
+	access, err := s.accessToken(time.Now())
+	if err != nil {
+		return err
+	}
+	android := map[string]interface{}{
+		"notification": map[string]interface{}{"notification_count": message.Badge},
+	}
+	if message.CollapseKey != "" {
+		android["collapse_key"] = message.CollapseKey
+	}
+	payload := map[string]interface{}{
+		"message": map[string]interface{}{
+			"token":        token,
+			"notification": map[string]string{"title": message.Title, "body": message.Body},
+			"data": map[string]string{
+				"link":  message.Link,
+				"type":  message.Type,
+				"badge": strconv.Itoa(message.Badge),
+			},
+			"android": android,
+		},
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	endpoint := fmt.Sprintf("%s/v1/projects/%s/messages:send", s.host, s.project)
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+access)
+	req.Header.Set(ContentTypeHeader, "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	var result struct {
+		Error struct {
+			Status  string `json:"status"`
+			Message string `json:"message"`
+			Details []struct {
+				ErrorCode string `json:"errorCode"`
+			} `json:"details"`
+		} `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	for _, detail := range result.Error.Details {
+		if detail.ErrorCode == "UNREGISTERED" {
+			return ErrPushTokenInvalid
+		}
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrPushTokenInvalid
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		s.mu.Lock()
+		s.access = ""
+		s.mu.Unlock()
+	}
+	return pushError("fcm", resp.StatusCode, result.Error.Message)
+}
+
+// newPushSenders returns senders for configured platforms, nil if
+// platform is not configured
+func newPushSenders() (ios PushSender, android PushSender, err error) {
+	if apnsKey != "" {
+		if apnsTopic == "" || apnsKeyId == "" || apnsTeamId == "" {
+			return nil, nil, ErrApnsConfig
+		}
+		key, err := ioutil.ReadFile(apnsKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		host := apnsDevelopmentHost
+		if apnsProduction {
+			host = apnsProductionHost
+		}
+		sender, err := NewApnsSender(key, apnsKeyId, apnsTeamId, apnsTopic, host)
+		if err != nil {
+			return nil, nil, err
+		}
+		ios = sender
+	}
+	if fcmCredentialsFile != "" {
+		credentials, err := ioutil.ReadFile(fcmCredentialsFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		sender, err := NewFcmSender(credentials, fcmHost)
+		if err != nil {
+			return nil, nil, err
+		}
+		android = sender
+	}
+	return ios, android, nil
+}
+
+// pushLink returns deep link to screen of application about update
+func pushLink(update Update) string {
+	u := url.URL{Scheme: pushLinkScheme}
+	switch update.Type {
+	case UpdateMessages:
+		u.Host = "user"
+		u.Path = "/" + update.User.Hex() + "/messages"
+	case UpdateGuests, UpdateLikes, UpdateOnline, UpdateReviews:
+		u.Host = "user"
+		u.Path = "/" + update.User.Hex()
+	default:
+		u.Host = "updates"
+		u.RawQuery = url.Values{"type": {update.Type}}.Encode()
+	}
+	return u.String()
+}
+
+// pushCollapseKey returns key that replaces previous notification about
+// events of same type from same user
+func pushCollapseKey(update Update) string {
+	if !update.User.Valid() || update.Type == UpdateNews {
+		return update.Type
+	}
+	return update.Type + ":" + update.User.Hex()
+}
+
+// badge returns amount of unread updates of user
+func badge(db DataBase, user bson.ObjectId) int {
+	counters, err := db.GetUpdatesCount(user)
+	if err != nil {
+		log.Println("[push]", "counters error", err)
+		return 0
+	}
+	n := 0
+	for _, c := range counters {
+		n += c.Count
+	}
+	return n
+}
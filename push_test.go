@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	. "github.com/ernado/poputchiki/models"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// pemKey returns private key encoded as pem block in PKCS #8 format
+func pemKey(key interface{}) []byte {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		panic(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+// parseJWT returns decoded claims of token and verifies signature with
+// verify
+func parseJWT(token string, verify func(digest, signature []byte) bool) (map[string]interface{}, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, false
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !verify(digest[:], signature) {
+		return nil, false
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, false
+	}
+	claims := make(map[string]interface{})
+	return claims, json.Unmarshal(data, &claims) == nil
+}
+
+// fakePush is local push service that records requests
+type fakePush struct {
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   []map[string]interface{}
+}
+
+func (f *fakePush) record(r *http.Request) map[string]interface{} {
+	body := make(map[string]interface{})
+	json.NewDecoder(r.Body).Decode(&body)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r)
+	f.bodies = append(f.bodies, body)
+	return body
+}
+
+func newFakePushServer(handler http.HandlerFunc) *httptest.Server {
+	server := httptest.NewUnstartedServer(handler)
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	return server
+}
+
+// recordingPushSender is push sender that treats some tokens as invalid
+type recordingPushSender struct {
+	invalid  map[string]bool
+	tokens   []string
+	messages []*PushMessage
+}
+
+func (s *recordingPushSender) Send(token string, message *PushMessage) error {
+	if s.invalid[token] {
+		return ErrPushTokenInvalid
+	}
+	s.tokens = append(s.tokens, token)
+	s.messages = append(s.messages, message)
+	return nil
+}
+
+func TestApnsSender(t *testing.T) {
+	Convey("APNs sender", t, func() {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		So(err, ShouldBeNil)
+		fake := new(fakePush)
+		server := newFakePushServer(func(w http.ResponseWriter, r *http.Request) {
+			fake.record(r)
+			switch {
+			case r.ProtoMajor != 2:
+				w.WriteHeader(http.StatusHTTPVersionNotSupported)
+			case strings.HasSuffix(r.URL.Path, "/gone"):
+				w.WriteHeader(http.StatusGone)
+				w.Write([]byte(`{"reason":"Unregistered"}`))
+			case strings.HasSuffix(r.URL.Path, "/bad"):
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"reason":"BadDeviceToken"}`))
+			case strings.HasSuffix(r.URL.Path, "/big"):
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				w.Write([]byte(`{"reason":"PayloadTooLarge"}`))
+			}
+		})
+		defer server.Close()
+		sender, err := NewApnsSender(pemKey(key), "KEY", "TEAM", "ru.poputchiki", server.URL)
+		So(err, ShouldBeNil)
+		sender.client = server.Client()
+		message := &PushMessage{Title: pushTitle, Body: "Привет", Badge: 3, Link: "poputchiki://updates", CollapseKey: "messages:1", Type: UpdateMessages}
+		Convey("Should send notification with provider token", func() {
+			So(sender.Send("device", message), ShouldBeNil)
+			So(sender.Send("device", message), ShouldBeNil)
+			So(len(fake.requests), ShouldEqual, 2)
+			r := fake.requests[0]
+			So(r.ProtoMajor, ShouldEqual, 2)
+			So(r.URL.Path, ShouldEqual, "/3/device/device")
+			So(r.Header.Get("apns-topic"), ShouldEqual, "ru.poputchiki")
+			So(r.Header.Get("apns-collapse-id"), ShouldEqual, "messages:1")
+			So(r.Header.Get("authorization"), ShouldEqual, fake.requests[1].Header.Get("authorization"))
+			claims, ok := parseJWT(strings.TrimPrefix(r.Header.Get("authorization"), "bearer "), func(digest, signature []byte) bool {
+				r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+				return len(signature) == 64 && ecdsa.Verify(&key.PublicKey, digest, r, s)
+			})
+			So(ok, ShouldBeTrue)
+			So(claims["iss"], ShouldEqual, "TEAM")
+			aps := fake.bodies[0]["aps"].(map[string]interface{})
+			So(aps["badge"], ShouldEqual, 3)
+			So(fake.bodies[0]["link"], ShouldEqual, message.Link)
+		})
+		Convey("Should report invalid tokens", func() {
+			So(sender.Send("gone", message), ShouldEqual, ErrPushTokenInvalid)
+			So(sender.Send("bad", message), ShouldEqual, ErrPushTokenInvalid)
+			err := sender.Send("big", message)
+			So(err, ShouldNotBeNil)
+			So(err, ShouldNotEqual, ErrPushTokenInvalid)
+		})
+	})
+}
+
+func TestFcmSender(t *testing.T) {
+	Convey("FCM sender", t, func() {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		So(err, ShouldBeNil)
+		fake := new(fakePush)
+		var mu sync.Mutex
+		issued := 0
+		server := newFakePushServer(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/token" {
+				r.ParseForm()
+				claims, ok := parseJWT(r.PostForm.Get("assertion"), func(digest, signature []byte) bool {
+					return rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest, signature) == nil
+				})
+				if !ok || claims["scope"] != fcmScope {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				mu.Lock()
+				issued++
+				mu.Unlock()
+				w.Write([]byte(`{"access_token":"access","expires_in":3600}`))
+				return
+			}
+			body := fake.record(r)
+			if r.Header.Get("Authorization") != "Bearer access" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if body["message"].(map[string]interface{})["token"] == "gone" {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"error":{"status":"NOT_FOUND","details":[{"errorCode":"UNREGISTERED"}]}}`))
+			}
+		})
+		defer server.Close()
+		credentials, err := json.Marshal(fcmCredentials{"project", "push@project.iam.gserviceaccount.com", string(pemKey(key)), server.URL + "/token"})
+		So(err, ShouldBeNil)
+		sender, err := NewFcmSender(credentials, server.URL)
+		So(err, ShouldBeNil)
+		sender.client = server.Client()
+		message := &PushMessage{Title: pushTitle, Body: "Привет", Badge: 2, Link: "poputchiki://updates", CollapseKey: "guests", Type: UpdateGuests}
+		Convey("Should send notification with access token", func() {
+			So(sender.Send("device", message), ShouldBeNil)
+			So(sender.Send("device", message), ShouldBeNil)
+			So(issued, ShouldEqual, 1)
+			So(fake.requests[0].ProtoMajor, ShouldEqual, 2)
+			So(fake.requests[0].URL.Path, ShouldEqual, "/v1/projects/project/messages:send")
+			m := fake.bodies[0]["message"].(map[string]interface{})
+			So(m["token"], ShouldEqual, "device")
+			So(m["data"].(map[string]interface{})["link"], ShouldEqual, message.Link)
+			So(m["data"].(map[string]interface{})["badge"], ShouldEqual, "2")
+			So(m["android"].(map[string]interface{})["collapse_key"], ShouldEqual, "guests")
+		})
+		Convey("Should report invalid tokens", func() {
+			So(sender.Send("gone", message), ShouldEqual, ErrPushTokenInvalid)
+		})
+		Convey("Should reject bad credentials", func() {
+			_, err := NewFcmSender([]byte(`{"project_id":"project"}`), server.URL)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestPushMessages(t *testing.T) {
+	Convey("Push messages", t, func() {
+		user := bson.NewObjectId()
+		update := NewUpdate(bson.NewObjectId(), user, UpdateMessages, new(Message))
+		So(pushLink(update), ShouldEqual, "poputchiki://user/"+user.Hex()+"/messages")
+		So(pushCollapseKey(update), ShouldEqual, "messages:"+user.Hex())
+		news := NewUpdate(bson.NewObjectId(), user, UpdateNews, nil)
+		So(pushLink(news), ShouldEqual, "poputchiki://updates?type=news")
+		So(pushCollapseKey(news), ShouldEqual, UpdateNews)
+	})
+}
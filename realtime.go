@@ -2,7 +2,6 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
 	"github.com/GeertJohan/go.rice"
 	"github.com/ernado/gotok"
@@ -37,227 +36,295 @@ const (
 	REALTIME_REDIS_KEY   = "realtime"
 	REALTIME_CHANNEL_KEY = "channel"
 	REALTIME_GOLBAL      = "global"
-	RELT_BUFF_SIZE       = 100
-	RELT_WS_BUFF_SIZE    = 10
+	REALTIME_BUFFER_KEY  = "buffer"
+	RELT_WS_BUFF_SIZE    = 64
 	RELT_PING_RATE_MS    = 1000
+	HANDSHAKE_PARM       = "handshake"
+
+	realtimeAuthTimeout = 10 * time.Second
 )
 
-type RealtimeRedis struct {
-	pool  *redis.Pool
-	chans map[bson.ObjectId]ReltChannel
+const (
+	RealtimeBackendRedis  = "redis"
+	RealtimeBackendMemory = "memory"
+)
+
+// Realtime delivers realtime events to websocket and streaming clients
+// through pubsub channels of hub
+type Realtime struct {
+	hub      *Hub
+	presence *Presence
 }
 
-func (realtime *RealtimeRedis) Conn() redis.Conn {
-	return realtime.pool.Get()
+// NewRealtimeRedis returns realtime on redis pubsub with policy for slow
+// clients, that keeps up to size recent events of each user for ttl, or no
+// events if size is 0
+func NewRealtimeRedis(pool *redis.Pool, policy string, size int, ttl time.Duration) *Realtime {
+	prefix := strings.Join([]string{redisName, REALTIME_REDIS_KEY, REALTIME_CHANNEL_KEY}, REDIS_SEPARATOR)
+	var buffer EventBuffer
+	if size > 0 {
+		buffer = &redisEventBuffer{pool, size, ttl}
+	}
+	return &Realtime{hub: NewHub(&redisPubSub{pool}, buffer, prefix, RELT_WS_BUFF_SIZE, policy)}
 }
 
-func (r *RealtimeRedis) Push(update models.Update) error {
-	log.Println("[realtime] pushing", update)
-	conn := r.Conn()
-	defer conn.Close()
-	args := []string{redisName, REALTIME_REDIS_KEY, REALTIME_CHANNEL_KEY, update.Destination.Hex()}
-	key := strings.Join(args, REDIS_SEPARATOR)
-	eJson, err := json.Marshal(update)
-	if err != nil {
-		return err
+// NewRealtimeMemory returns realtime that delivers events only to clients
+// of current process, for single-node deployments and tests
+func NewRealtimeMemory(policy string, size int, ttl time.Duration) *Realtime {
+	var buffer EventBuffer
+	if size > 0 {
+		buffer = newMemoryEventBuffer(size, ttl)
 	}
-	_, err = conn.Do("PUBLISH", key, eJson)
-	if err == nil {
-		log.Println("[realtime] pushed", update)
+	return &Realtime{hub: NewHub(newMemoryPubSub(), buffer, REALTIME_CHANNEL_KEY, RELT_WS_BUFF_SIZE, policy)}
+}
+
+// NewRealtime returns realtime with provided backend
+func NewRealtime(backend string, pool *redis.Pool, policy string, size int, ttl time.Duration) (*Realtime, error) {
+	switch backend {
+	case RealtimeBackendRedis:
+		return NewRealtimeRedis(pool, policy, size, ttl), nil
+	case RealtimeBackendMemory:
+		return NewRealtimeMemory(policy, size, ttl), nil
 	}
-	return err
+	return nil, fmt.Errorf("unknown realtime backend <%s>", backend)
+}
+
+func (r *Realtime) Push(update models.Update) error {
+	log.Println("[realtime] pushing", update)
+	return r.hub.Publish(update)
 }
 
-func (r *RealtimeRedis) PushGlobal(update models.Update) error {
+func (r *Realtime) PushGlobal(update models.Update) error {
 	log.Println("[realtime] pushing global", update)
-	conn := r.Conn()
-	defer conn.Close()
-	args := []string{redisName, REALTIME_REDIS_KEY, REALTIME_CHANNEL_KEY, REALTIME_GOLBAL}
-	key := strings.Join(args, REDIS_SEPARATOR)
-	eJson, err := json.Marshal(update)
+	return r.hub.PublishGlobal(update)
+}
+
+func (r *Realtime) Metrics() models.RealtimeMetrics {
+	return r.hub.Metrics()
+}
+
+// GetRealtimeMetrics returns state of realtime connections for admins
+func GetRealtimeMetrics(realtime RealtimeInterface) (int, []byte) {
+	return Render(realtime.Metrics())
+}
+
+// track keeps user online while connection is open
+func (realtime *Realtime) track(user bson.ObjectId, c *HubConn) {
+	if realtime.presence != nil {
+		go realtime.presence.Track(user, c.Done())
+	}
+}
+
+// realtimeTargets returns users whose events are delivered to client,
+// which are provided by admins in id query parameter
+func realtimeTargets(context Context) ([]bson.ObjectId, bool) {
+	q := context.Request.URL.Query()
+	if !context.IsAdmin || q.Get("id") == "" {
+		return []bson.ObjectId{context.Token.Id}, true
+	}
+	var targets []bson.ObjectId
+	for _, target := range strings.Split(q.Get("id"), ",") {
+		if !bson.IsObjectIdHex(target) {
+			return nil, false
+		}
+		targets = append(targets, bson.ObjectIdHex(target))
+	}
+	return targets, true
+}
+
+// checkOrigin allows websocket connections from origins of allowlist, or
+// only from same host if allowlist is blank. Native clients do not send
+// origin and are allowed.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
 	if err != nil {
-		return err
+		return false
 	}
-	_, err = conn.Do("PUBLISH", key, eJson)
-	if err == nil {
-		log.Println("[realtime] pushed global", update)
+	if realtimeOrigins == "" {
+		return u.Host == r.Host
 	}
-	return err
+	for _, allowed := range strings.Split(realtimeOrigins, ",") {
+		allowed = strings.TrimSpace(allowed)
+		if allowed == "*" || allowed == origin || allowed == u.Host {
+			return true
+		}
+	}
+	return false
 }
 
-func chackOrigin(r *http.Request) bool {
-	return true
+// authenticate reads auth command from first frame of connection and
+// returns context of its token, mapping token for handlers of commands.
+// Tokens that are not found in storage are expired.
+func authenticate(conn *websocket.Conn, injector martini.Context) (Context, error) {
+	conn.SetReadDeadline(time.Now().Add(realtimeAuthTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	cmd := new(Command)
+	if err := conn.ReadJSON(cmd); err != nil {
+		return Context{}, ErrorAuth
+	}
+	if cmd.Version != RealtimeProtocol || cmd.Type != CommandAuth {
+		return Context{}, ErrorAuth
+	}
+	var token *gotok.Token
+	var err error
+	injector.Invoke(func(tokens gotok.Storage) {
+		token, err = tokens.Get(cmd.Params[TOKEN_URL_PARM])
+	})
+	if err != nil {
+		return Context{}, BackendError(err)
+	}
+	if token == nil || !token.Id.Valid() {
+		return Context{}, ErrorAuth
+	}
+	injector.Map(token)
+	for _, wrapper := range []martini.Handler{AdminWrapper, AutoUpdaterWrapper, models.ContextWrapper} {
+		if _, err := injector.Invoke(wrapper); err != nil {
+			return Context{}, BackendError(err)
+		}
+	}
+	context := injector.Get(reflect.TypeOf(Context{})).Interface().(Context)
+	if context.User == nil {
+		return Context{}, ErrorAuth
+	}
+	if err := conn.WriteJSON(NewAck(cmd.Id, http.StatusOK, []byte(`"ok"`))); err != nil {
+		return Context{}, err
+	}
+	return context, nil
 }
 
-func (realtime *RealtimeRedis) RealtimeHandler(w http.ResponseWriter, context Context) (int, []byte) {
+// RealtimeHandler streams events to websocket and executes commands that
+// are sent by client, responding with ack for every command
+func (realtime *Realtime) RealtimeHandler(w http.ResponseWriter, context Context, injector martini.Context) (int, []byte) {
 	r := context.Request
-	t := context.Token
-	admin := context.IsAdmin
-	u := websocket.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 1024, CheckOrigin: chackOrigin}
-	_, ok := w.(http.Hijacker)
+	u := websocket.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 1024, CheckOrigin: checkOrigin}
+	// token is sent in first frame if client requested handshake
+	handshake := context.Token == nil && r.URL.Query().Get(HANDSHAKE_PARM) != ""
+	if !handshake && (context.Token == nil || context.User == nil) {
+		return Render(ErrorAuth)
+	}
+	after, ok := lastEventId(r)
 	if !ok {
-		log.Println("not ok")
+		return Render(ErrorBadId)
 	}
+
 	conn, err := u.Upgrade(w, r, nil)
 	if err != nil {
 		return Render(BackendError(err))
 	}
-
-	q := r.URL.Query()
-	var channels []ReltWSChannel
-	channel := make(chan models.Update)
-	var targets []bson.ObjectId
-	if admin && q.Get("id") != "" {
-		ids := strings.Split(q.Get("id"), ",")
-		for _, target := range ids {
-			if !bson.IsObjectIdHex(target) {
-				return Render(ErrorBadRequest)
-			}
-			targets = append(targets, bson.ObjectIdHex(target))
+	defer conn.Close()
+	if handshake {
+		if context, err = authenticate(conn, injector); err != nil {
+			code, data := Render(err)
+			conn.WriteJSON(NewAck("", code, data))
+			return code, data
 		}
-	} else {
-		targets = append(targets, t.Id)
 	}
-
-	for _, target := range targets {
-		c := realtime.GetWSChannel(target)
-		channels = append(channels, c)
-		go func() {
-			for event := range c.channel {
-				channel <- event
-			}
-		}()
+	t := context.Token
+	targets, ok := realtimeTargets(context)
+	if !ok {
+		code, data := Render(ErrorBadRequest)
+		conn.WriteJSON(NewAck("", code, data))
+		return code, data
 	}
 
-	connClosed := make(chan bool, 10)
+	c, err := realtime.hub.Subscribe(targets...)
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	defer realtime.hub.Unsubscribe(c)
 
-	go func() {
-		<-connClosed
-		for _, c := range channels {
-			realtime.CloseWs(c)
+	realtime.track(t.Id, c)
+	// replaying events that were missed since previous connection
+	missed, err := missedUpdates(context.DB, realtime.hub, targets, after)
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	replayed := make(map[bson.ObjectId]bool)
+	for _, u := range missed {
+		replayed[u.Id] = true
+		if err := u.Prepare(context); err != nil {
+			log.Println("[realtime]", "prepare error", err)
 		}
-		log.Println("connection closed")
-	}()
-
-	conn.WriteJSON(models.NewUpdate(t.Id, t.Id, "token", t))
+		if err := conn.WriteJSON(u); err != nil {
+			return Render("ok")
+		}
+	}
 	conn.SetPongHandler(func(s string) error {
 		log.Println("pong")
 		return nil
 	})
 
+	// acks are written by single writer with events
+	acks := make(chan *Ack, RELT_WS_BUFF_SIZE)
 	go func() {
 		for {
-			time.Sleep(time.Millisecond * RELT_PING_RATE_MS)
-			err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second*5))
+			_, message, err := conn.ReadMessage()
 			if err != nil {
-				connClosed <- true
+				realtime.hub.Unsubscribe(c)
+				return
+			}
+			cmd := new(Command)
+			err = json.Unmarshal(message, cmd)
+			var code int
+			var data []byte
+			if err != nil {
+				code, data = Render(ErrorBadRequest)
+			} else if cmd.Version == RealtimeProtocol && cmd.Type == CommandSubscribe {
+				code, data = subscribeCommand(realtime.hub, c, context, cmd)
+			} else {
+				code, data = executeCommand(injector, context, cmd)
+			}
+			select {
+			case acks <- NewAck(cmd.Id, code, data):
+			case <-c.Done():
 				return
 			}
 		}
 	}()
 
-	process := func(event models.Update) error {
-		log.Println("[realtime] recieved event for", event.Destination.Hex())
-		log.Printf("%+v", event)
-		if err := event.Prepare(context); err != nil {
-			return err
-		}
-		if err := conn.WriteJSON(event); err != nil {
-			connClosed <- true
-			return err
-		}
-		return nil
-	}
-
-	for event := range channel {
-		if err := process(event); err != nil {
-			return Render(BackendError(err))
-		}
-	}
-
-	return Render("ok")
-}
-
-func (realtime *RealtimeRedis) getChannel(id bson.ObjectId) chan models.Update {
-	// creating new channel
-	c := make(chan models.Update, RELT_BUFF_SIZE)
-	conn := realtime.Conn()
-	psc := redis.PubSubConn{}
-	psc.Conn = conn
-	args := []string{redisName, REALTIME_REDIS_KEY, REALTIME_CHANNEL_KEY, id.Hex()}
-	key := strings.Join(args, REDIS_SEPARATOR)
-	log.Println("starting listeting", key)
-	psc.Subscribe(key)
-	args = []string{redisName, REALTIME_REDIS_KEY, REALTIME_CHANNEL_KEY, REALTIME_GOLBAL}
-	psc.Subscribe(strings.Join(args, REDIS_SEPARATOR))
-
 	go func() {
-		defer conn.Close()
+		ticker := time.NewTicker(time.Millisecond * RELT_PING_RATE_MS)
+		defer ticker.Stop()
 		for {
-			switch v := psc.Receive().(type) {
-			case redis.Message:
-				log.Println("[realtime] recieved message")
-				e := new(models.Update)
-				err := json.Unmarshal(v.Data, e)
-				if err != nil {
-					log.Println(err)
-					return
-				}
-				c <- *e
-			case error:
-				log.Println(v)
+			select {
+			case <-ticker.C:
+			case <-c.Done():
+				return
+			}
+			err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second*5))
+			if err != nil {
+				realtime.hub.Unsubscribe(c)
 				return
 			}
 		}
 	}()
-	return c
-}
 
-func pushAll(event models.Update, chans map[bson.ObjectId]chan models.Update) {
-	for _, channel := range chans {
-		channel <- event
-	}
-}
-
-func (realtime *RealtimeRedis) GetReltChannel(id bson.ObjectId) ReltChannel {
-	log.Println("getting realtime channel")
-	c := ReltChannel{make(map[bson.ObjectId](chan models.Update)), realtime.getChannel(id)}
-	go func() {
-		for event := range c.events {
-			go pushAll(event, c.chans)
+	for {
+		select {
+		case event := <-c.Updates():
+			if replayed[event.Id] {
+				delete(replayed, event.Id)
+				continue
+			}
+			log.Println("[realtime] recieved event for", event.Destination.Hex())
+			if err := event.Prepare(context); err != nil {
+				return Render(BackendError(err))
+			}
+			if err := conn.WriteJSON(event); err != nil {
+				return Render("ok")
+			}
+		case ack := <-acks:
+			if err := conn.WriteJSON(ack); err != nil {
+				return Render("ok")
+			}
+		case <-c.Done():
+			return Render("ok")
 		}
-	}()
-	return c
-}
-
-func (realtime *RealtimeRedis) GetWSChannel(id bson.ObjectId) ReltWSChannel {
-	log.Println("getting websocket channel for", id.Hex())
-	c := make(chan models.Update, RELT_WS_BUFF_SIZE)
-	_, ok := realtime.chans[id]
-	if !ok {
-		log.Println("realtime channel not found, creating")
-		realtime.chans[id] = realtime.GetReltChannel(id)
 	}
-	wsid := bson.NewObjectId()
-	realtime.chans[id].chans[wsid] = c
-	return ReltWSChannel{id: wsid, user: id, channel: c}
-}
-
-func (realtime *RealtimeRedis) CloseWs(c ReltWSChannel) {
-	log.Println("closing realtime channel")
-	delete(realtime.chans[c.user].chans, c.id)
-}
-
-type ReltWSChannel struct {
-	id            bson.ObjectId
-	user          bson.ObjectId
-	channel       chan models.Update
-	subscriptions []bson.ObjectId
-}
-
-type ReltChannel struct {
-	chans  map[bson.ObjectId](chan models.Update)
-	events chan models.Update
 }
 
 type RealtimeUpdater struct {
@@ -274,44 +341,100 @@ type EmailUpdater struct {
 	adapter   *weed.Adapter
 }
 
+// PushNotificationsUpdater sends notifications about updates to devices
+// of users from queue, so pushing does not wait for push services
 type PushNotificationsUpdater struct {
 	db      models.DataBase
 	adapter *weed.Adapter
+	ios     PushSender
+	android PushSender
+	queue   chan models.Update
 }
 
-func (e *PushNotificationsUpdater) Push(update models.Update) error {
-	user := e.db.Get(update.Destination)
-	if len(user.IOsTokens) == 0 && len(user.AndroidTokens) == 0 {
-		log.Println("[updates]", "no tokens")
-		return nil
+// NewPushNotificationsUpdater returns updater with started workers
+func NewPushNotificationsUpdater(db models.DataBase, adapter *weed.Adapter, ios, android PushSender) *PushNotificationsUpdater {
+	e := &PushNotificationsUpdater{db, adapter, ios, android, make(chan models.Update, pushQueueSize)}
+	for i := 0; i < pushWorkers; i++ {
+		go e.work()
+	}
+	return e
+}
+
+func (e *PushNotificationsUpdater) work() {
+	for update := range e.queue {
+		if err := e.Send(update); err != nil {
+			log.Println("[push]", "error", err)
+		}
 	}
-	u := url.URL{}
-	u.Host = "cydev.ru"
-	u.Scheme = "https"
-	u.Path = fmt.Sprintf("/%s/push", "poputchiki")
-	q := u.Query()
+}
+
+// message returns notification about update with amount of unread
+// updates as badge
+func (e *PushNotificationsUpdater) message(update models.Update) *PushMessage {
 	context := Context{}
 	context.DB = e.db
 	context.Storage = e.adapter
 	if err := update.Prepare(context); err != nil {
-		log.Println("[email]", err)
+		log.Println("[push]", err)
 	}
-	q.Add("message", update.Theme())
-	for _, token := range user.IOsTokens {
-		q.Add("appleid", token)
+	return &PushMessage{
+		Title:       pushTitle,
+		Body:        update.Theme(),
+		Badge:       badge(e.db, update.Destination),
+		Link:        pushLink(update),
+		CollapseKey: pushCollapseKey(update),
+		Type:        update.Type,
 	}
-	for _, token := range user.AndroidTokens {
-		q.Add("googleid", token)
+}
+
+// send delivers message to every token with sender, removing tokens that
+// are not registered anymore
+func (e *PushNotificationsUpdater) send(sender PushSender, user bson.ObjectId, tokens []string, message *PushMessage,
+	remove func(id bson.ObjectId, token string) error) (err error) {
+	if sender == nil {
+		return nil
 	}
-	u.RawQuery = q.Encode()
-	resp, err := http.Post(u.String(), "text/html", nil)
-	if err != nil {
-		return err
+	for _, token := range tokens {
+		sendErr := sender.Send(token, message)
+		if sendErr == ErrPushTokenInvalid {
+			log.Println("[push]", "removing invalid token of", user.Hex())
+			sendErr = remove(user, token)
+		}
+		if sendErr != nil {
+			log.Println("[push]", "error", sendErr)
+			err = sendErr
+		}
 	}
-	if resp.StatusCode != http.StatusOK {
-		return errors.New(fmt.Sprintf("Bad code %s!=200", resp.StatusCode))
+	return err
+}
+
+// Push queues notification about update, dropping it if queue is full
+func (e *PushNotificationsUpdater) Push(update models.Update) error {
+	select {
+	case e.queue <- update:
+		return nil
+	default:
+		return ErrPushQueueFull
 	}
-	return nil
+}
+
+// Send delivers notification about update to all devices of user
+func (e *PushNotificationsUpdater) Send(update models.Update) error {
+	user := e.db.Get(update.Destination)
+	if user == nil || !user.NotifiesUpdate(update, models.NotifyPush) {
+		return nil
+	}
+	if len(user.IOsTokens) == 0 && len(user.AndroidTokens) == 0 {
+		log.Println("[updates]", "no tokens")
+		return nil
+	}
+	message := e.message(update)
+	iosErr := e.send(e.ios, user.Id, user.IOsTokens, message, e.db.RemoveIosToken)
+	androidErr := e.send(e.android, user.Id, user.AndroidTokens, message, e.db.RemoveAndroidToken)
+	if iosErr != nil {
+		return iosErr
+	}
+	return androidErr
 }
 
 func (e *EmailUpdater) GetTemplate(update models.Update) (template string, err error) {
@@ -323,6 +446,10 @@ func (e *EmailUpdater) GetTemplate(update models.Update) (template string, err e
 func (e *EmailUpdater) Push(update models.Update) error {
 	log.Println("[email]", "pushing")
 	u := e.db.Get(update.Destination)
+	if u == nil || !u.NotifiesUpdate(update, models.NotifyEmail) {
+		log.Println("[email]", "not subscribed")
+		return nil
+	}
 	context := Context{}
 	context.DB = e.db
 	context.Storage = e.adapter
@@ -371,9 +498,14 @@ func (u *RealtimeUpdater) Push(update models.Update) error {
 		return err
 	}
 
-	if err := u.realtime.Push(update); err != nil {
-		log.Println("[updates]", "realtime error", err)
-		return err
+	// preferences only control notifications about messages, not delivery
+	inApp := target != nil && target.NotifiesUpdate(update, models.NotifyInApp)
+	if inApp || update.IsPayload() {
+		update.Silent = !inApp
+		if err := u.realtime.Push(update); err != nil {
+			log.Println("[updates]", "realtime error", err)
+			return err
+		}
 	}
 
 	if dublicate {
@@ -383,21 +515,10 @@ func (u *RealtimeUpdater) Push(update models.Update) error {
 	if err := u.push.Push(update); err != nil {
 		log.Println("[updates] push", err)
 	}
-	if !target.Online {
-		log.Println("[updates]", "user offline")
-		subscription := models.GetEventType(update.Type, update.Target)
-		subscribed, err := u.db.UserIsSubscribed(update.Destination, subscription)
-		if err != nil {
-			log.Println(err)
-			return err
-		}
-		subscribed = true
-		if subscribed && u.email != nil {
-			log.Println("[updates]", "sending email")
-			return u.email.Push(update)
-		} else {
-			log.Println("[updates]", "not subscribed")
-		}
+	// digests check preferences of user for email channel
+	if target != nil && !target.Online && u.email != nil {
+		log.Println("[updates]", "user offline, sending email")
+		return u.email.Push(update)
 	}
 	log.Println("[updates]", "handled", update)
 	return nil
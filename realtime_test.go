@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/ernado/poputchiki/models"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// receive returns next event of connection or false if there were no
+// events for second
+func receive(c *HubConn) (Update, bool) {
+	select {
+	case u := <-c.Updates():
+		return u, true
+	case <-time.After(time.Second):
+		return Update{}, false
+	}
+}
+
+// testRealtimeBackend is a suite that every realtime backend must pass
+func testRealtimeBackend(t *testing.T, name string, newRealtime func() *Realtime) {
+	Convey(name, t, func() {
+		realtime := newRealtime()
+		hub := realtime.hub
+		user, other := bson.NewObjectId(), bson.NewObjectId()
+		a, err := hub.Subscribe(user)
+		So(err, ShouldBeNil)
+		b, err := hub.Subscribe(user)
+		So(err, ShouldBeNil)
+		c, err := hub.Subscribe(other)
+		So(err, ShouldBeNil)
+		Reset(func() {
+			hub.Unsubscribe(a)
+			hub.Unsubscribe(b)
+			hub.Unsubscribe(c)
+		})
+		Convey("Events should be delivered to every connection of user", func() {
+			update := NewUpdate(user, other, "test", nil)
+			So(realtime.Push(update), ShouldBeNil)
+			for _, conn := range []*HubConn{a, b} {
+				u, ok := receive(conn)
+				So(ok, ShouldBeTrue)
+				So(u.Id, ShouldEqual, update.Id)
+				So(u.Type, ShouldEqual, "test")
+			}
+			Convey("And only to them", func() {
+				So(len(c.Updates()), ShouldEqual, 0)
+			})
+		})
+		Convey("Global events should be delivered to all connections", func() {
+			update := NewUpdate("", user, UpdateNews, nil)
+			So(realtime.PushGlobal(update), ShouldBeNil)
+			for _, conn := range []*HubConn{a, b, c} {
+				u, ok := receive(conn)
+				So(ok, ShouldBeTrue)
+				So(u.Id, ShouldEqual, update.Id)
+			}
+		})
+		Convey("Events should be delivered in order", func() {
+			var ids []bson.ObjectId
+			for i := 0; i < 5; i++ {
+				update := NewUpdate(other, user, "test", nil)
+				ids = append(ids, update.Id)
+				So(realtime.Push(update), ShouldBeNil)
+			}
+			for _, id := range ids {
+				u, ok := receive(c)
+				So(ok, ShouldBeTrue)
+				So(u.Id, ShouldEqual, id)
+			}
+		})
+		Convey("Recent events should be buffered", func() {
+			first := NewUpdate(other, user, UpdateTyping, nil)
+			second := NewUpdate(other, user, UpdateTyping, nil)
+			So(realtime.Push(first), ShouldBeNil)
+			So(realtime.Push(second), ShouldBeNil)
+			updates, err := hub.Buffered([]bson.ObjectId{other}, first.Id)
+			So(err, ShouldBeNil)
+			So(len(updates), ShouldEqual, 1)
+			So(updates[0].Id, ShouldEqual, second.Id)
+		})
+		Convey("Subscriptions should be released", func() {
+			So(realtime.Metrics().Connections, ShouldEqual, 3)
+			So(realtime.Metrics().Subscriptions, ShouldEqual, 3)
+			hub.Unsubscribe(a)
+			hub.Unsubscribe(b)
+			hub.Unsubscribe(c)
+			So(realtime.Metrics().Connections, ShouldEqual, 0)
+			So(realtime.Metrics().Subscriptions, ShouldEqual, 0)
+			select {
+			case <-a.Done():
+			default:
+				t.Error("connection is not closed")
+			}
+		})
+	})
+}
+
+func TestRealtimeMemory(t *testing.T) {
+	testRealtimeBackend(t, "Memory realtime", func() *Realtime {
+		return NewRealtimeMemory(HubDisconnectSlow, 10, time.Minute)
+	})
+}
+
+func TestRealtimeRedis(t *testing.T) {
+	redisName = "poputchiki_test_realtime"
+	pool := newPool()
+	testRealtimeBackend(t, "Redis realtime", func() *Realtime {
+		return NewRealtimeRedis(pool, HubDisconnectSlow, 10, time.Minute)
+	})
+}
+
+func TestRealtimeAuth(t *testing.T) {
+	Convey("Realtime connections", t, func() {
+		Convey("Origin should be checked", func() {
+			r, _ := http.NewRequest("GET", "http://poputchiki.ru/api/realtime", nil)
+			defer func(origins string) { realtimeOrigins = origins }(realtimeOrigins)
+			realtimeOrigins = ""
+			So(checkOrigin(r), ShouldBeTrue)
+			r.Header.Set("Origin", "http://poputchiki.ru")
+			So(checkOrigin(r), ShouldBeTrue)
+			r.Header.Set("Origin", "http://evil.com")
+			So(checkOrigin(r), ShouldBeFalse)
+			realtimeOrigins = "https://app.poputchiki.ru, m.poputchiki.ru"
+			r.Header.Set("Origin", "https://app.poputchiki.ru")
+			So(checkOrigin(r), ShouldBeTrue)
+			r.Header.Set("Origin", "http://m.poputchiki.ru")
+			So(checkOrigin(r), ShouldBeTrue)
+			r.Header.Set("Origin", "http://poputchiki.ru")
+			So(checkOrigin(r), ShouldBeFalse)
+			realtimeOrigins = "*"
+			r.Header.Set("Origin", "http://evil.com")
+			So(checkOrigin(r), ShouldBeTrue)
+		})
+		Convey("Anonymous connections should be rejected", func() {
+			realtime := NewRealtimeMemory(HubDisconnectSlow, 10, time.Minute)
+			r, _ := http.NewRequest("GET", "http://poputchiki.ru/api/realtime", nil)
+			w := httptest.NewRecorder()
+			code, _ := realtime.RealtimeHandler(w, Context{Request: r}, nil)
+			So(code, ShouldEqual, http.StatusUnauthorized)
+			So(realtime.Metrics().Connections, ShouldEqual, 0)
+		})
+	})
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	. "github.com/ernado/poputchiki/models"
+	"github.com/garyburd/redigo/redis"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	REALTIME_LIMIT_KEY = "limit"
+
+	typingLimit    = 1
+	typingPeriod   = time.Second * 3
+	receiptsLimit  = 60
+	receiptsPeriod = time.Minute
+)
+
+// EventLimiter throttles ephemeral realtime events with redis counters
+type EventLimiter struct {
+	pool *redis.Pool
+}
+
+// Allow counts event with provided key and returns false if more than
+// limit events with same key happened during period
+func (l *EventLimiter) Allow(key string, limit int, period time.Duration) (bool, error) {
+	conn := l.pool.Get()
+	defer conn.Close()
+	key = strings.Join([]string{redisName, REALTIME_REDIS_KEY, REALTIME_LIMIT_KEY, key}, REDIS_SEPARATOR)
+	conn.Send("MULTI")
+	conn.Send("SET", key, 0, "PX", int64(period/time.Millisecond), "NX")
+	conn.Send("INCR", key)
+	reply, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return false, err
+	}
+	n, err := redis.Int(reply[1], nil)
+	if err != nil {
+		return false, err
+	}
+	return n <= limit, nil
+}
+
+// pushReadReceipt notifies origin of messages that reader have read them.
+// Receipts are not persisted and are silently dropped if reader hides
+// activity, one of users is blacklisted or limit is exceeded.
+func pushReadReceipt(db DataBase, realtime RealtimeInterface, limiter *EventLimiter, reader *User, origin bson.ObjectId, receipt *ReadReceipt) {
+	if !EphemeralAllowed(reader, db.Get(origin)) {
+		return
+	}
+	allowed, err := limiter.Allow("read:"+reader.Id.Hex()+":"+origin.Hex(), receiptsLimit, receiptsPeriod)
+	if err != nil {
+		log.Println("[realtime]", "limiter error", err)
+		return
+	}
+	if !allowed {
+		return
+	}
+	if err := realtime.Push(NewUpdate(origin, reader.Id, UpdateRead, receipt)); err != nil {
+		log.Println("[realtime]", "read receipt error", err)
+	}
+}
+
+// SendTyping pushes ephemeral typing event to user with provided id
+func SendTyping(context Context, destination bson.ObjectId, realtime RealtimeInterface, limiter *EventLimiter) (int, []byte) {
+	user := context.DB.Get(destination)
+	if user == nil {
+		return Render(ErrorUserNotFound)
+	}
+	if user.InBlacklist(context.User.Id) {
+		return Render(ErrorBlacklisted)
+	}
+	if !EphemeralAllowed(context.User, user) {
+		return Render("ok")
+	}
+	allowed, err := limiter.Allow("typing:"+context.User.Id.Hex()+":"+destination.Hex(), typingLimit, typingPeriod)
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	if !allowed {
+		return Render(ErrorTooManyRequests)
+	}
+	typing := &Typing{Chat: context.User.Id, Time: time.Now()}
+	if err := realtime.Push(NewUpdate(destination, context.User.Id, UpdateTyping, typing)); err != nil {
+		return Render(BackendError(err))
+	}
+	return Render("ok")
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/ernado/poputchiki/activities"
+	. "github.com/ernado/poputchiki/models"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	reviewsCount      = 20
+	reviewsRevealTick = time.Minute * 10
+)
+
+// revealReview makes review public and notifies reviewed user, doing
+// nothing if review is already revealed
+func revealReview(db DataBase, u Updater, review *Review, now time.Time) {
+	err := db.RevealReview(review.Id, now)
+	if err == mgo.ErrNotFound {
+		return
+	}
+	if err != nil {
+		log.Println("[reviews]", "reveal error", err)
+		return
+	}
+	pushed := *review
+	pushed.Revealed = true
+	pushed.RevealTime = now
+	pushed.Private = ""
+	if err := u.Push(NewUpdate(review.Target, review.Author, UpdateReviews, &pushed)); err != nil {
+		log.Println("[reviews]", "update error", err)
+	}
+}
+
+// revealCounterReviews reveals review and review of the other side
+// if both are submitted
+func revealCounterReviews(db DataBase, u Updater, review *Review) {
+	counter, err := db.GetCounterReview(review)
+	if err == mgo.ErrNotFound {
+		return
+	}
+	if err != nil {
+		log.Println("[reviews]", "error", err)
+		return
+	}
+	now := time.Now()
+	revealReview(db, u, review, now)
+	revealReview(db, u, counter, now)
+}
+
+// getReview returns review with provided id if it is visible for current user
+func getReview(context Context, id bson.ObjectId) (*Review, error) {
+	review, err := context.DB.GetReview(id)
+	if err != nil {
+		return nil, err
+	}
+	if !bool(context.IsAdmin) && !review.VisibleTo(context.User.Id) {
+		return nil, mgo.ErrNotFound
+	}
+	return review, nil
+}
+
+// AddReview creates review of current user about other user after
+// completed trip or accepted invitation
+func AddReview(context Context, parser Parser, u Updater, engine activities.Handler) (int, []byte) {
+	db := context.DB
+	review := new(Review)
+	if err := parser.Parse(review); err != nil {
+		return Render(ValidationError(err))
+	}
+	review.Author = context.User.Id
+	if err := review.Validate(); err != nil {
+		return Render(ValidationError(err))
+	}
+	target := db.Get(review.Target)
+	if target == nil {
+		return Render(ErrorUserNotFound)
+	}
+	if target.InBlacklist(review.Author) {
+		return Render(ErrorBlacklisted)
+	}
+	var (
+		trip       *Trip
+		invitation *Invitation
+		err        error
+	)
+	if review.Trip.Valid() {
+		trip, err = db.GetTrip(review.Trip)
+	} else {
+		invitation, err = db.GetInvitation(review.Invitation)
+	}
+	if err == mgo.ErrNotFound {
+		return Render(ErrorObjectNotFound)
+	}
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	if err := review.Normalize(trip, invitation, time.Now()); err != nil {
+		return Render(ValidationError(err))
+	}
+	review, err = db.AddReview(review)
+	if mgo.IsDup(err) {
+		return Render(ValidationError(ErrReviewAlreadyExists))
+	}
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	engine.Handle(activities.Review)
+	go revealCounterReviews(db, u, review)
+	return context.Render(review)
+}
+
+func GetReview(context Context, id bson.ObjectId) (int, []byte) {
+	review, err := getReview(context, id)
+	if err == mgo.ErrNotFound {
+		return Render(ErrorObjectNotFound)
+	}
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	return context.Render(review)
+}
+
+// GetReviews returns reviews written by current user, including hidden ones
+func GetReviews(context Context, pagination Pagination) (int, []byte) {
+	if pagination.Count == 0 {
+		pagination.Count = reviewsCount
+	}
+	reviews, count, err := context.DB.GetAuthorReviews(context.User.Id, pagination)
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	if err := Reviews(reviews).Prepare(context); err != nil {
+		return Render(BackendError(err))
+	}
+	return context.Render(SearchResult{Result: reviews, Count: count})
+}
+
+// GetUserReviews returns revealed reviews about user
+func GetUserReviews(context Context, id bson.ObjectId, pagination Pagination) (int, []byte) {
+	user := context.DB.Get(id)
+	if user == nil {
+		return Render(ErrorUserNotFound)
+	}
+	if context.User != nil && user.InBlacklist(context.User.Id) {
+		return Render(ErrorBlacklisted)
+	}
+	if pagination.Count == 0 {
+		pagination.Count = reviewsCount
+	}
+	reviews, count, err := context.DB.GetUserReviews(id, pagination)
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	if err := Reviews(reviews).Prepare(context); err != nil {
+		return Render(BackendError(err))
+	}
+	return context.Render(SearchResult{Result: reviews, Count: count})
+}
+
+// DisputeReview marks revealed review about current user as disputed,
+// passing it to the admin review queue
+func DisputeReview(context Context, id bson.ObjectId, parser Parser) (int, []byte) {
+	dispute := new(ReviewDispute)
+	if err := parser.Parse(dispute); err != nil {
+		return Render(ValidationError(err))
+	}
+	if err := dispute.Validate(); err != nil {
+		return Render(ValidationError(err))
+	}
+	review, err := getReview(context, id)
+	if err == mgo.ErrNotFound {
+		return Render(ErrorObjectNotFound)
+	}
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	if review.Target != context.User.Id {
+		return Render(ErrorNotAllowed)
+	}
+	if err := context.DB.SetReviewDispute(id, context.User.Id, dispute.Reason); err != nil {
+		return Render(BackendError(err))
+	}
+	log.Println("[reviews]", "review", id.Hex(), "disputed by", context.User.Id.Hex())
+	review.Disputed = true
+	review.DisputeReason = dispute.Reason
+	return context.Render(review)
+}
+
+// GetDisputedReviews returns admin queue of disputed reviews
+func GetDisputedReviews(context Context, pagination Pagination) (int, []byte) {
+	if pagination.Count == 0 {
+		pagination.Count = reviewsCount
+	}
+	reviews, count, err := context.DB.GetDisputedReviews(pagination)
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	if err := Reviews(reviews).Prepare(context); err != nil {
+		return Render(BackendError(err))
+	}
+	return context.Render(SearchResult{Result: reviews, Count: count})
+}
+
+// ResolveReviewDispute keeps disputed review, removing it from admin queue
+func ResolveReviewDispute(context Context, id bson.ObjectId) (int, []byte) {
+	err := context.DB.ResolveReviewDispute(id)
+	if err == mgo.ErrNotFound {
+		return Render(ErrorObjectNotFound)
+	}
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	return Render("ok")
+}
+
+func RemoveReview(context Context, id bson.ObjectId) (int, []byte) {
+	err := context.DB.RemoveReview(id)
+	if err == mgo.ErrNotFound {
+		return Render(ErrorObjectNotFound)
+	}
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	return Render("ok")
+}
+
+// ReviewsCycle reveals reviews that were not answered during reveal period
+func (a *Application) ReviewsCycle() {
+	a.newCycle("reviews", reviewsRevealTick, func(_ chan bool) {
+		now := time.Now()
+		reviews, err := a.db.GetUnrevealedReviews(now)
+		if err != nil {
+			log.Println("[reviews]", "error", err)
+			return
+		}
+		for _, review := range reviews {
+			revealReview(a.db, a.updater, review, now)
+		}
+	})
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/ernado/poputchiki/models"
+	"github.com/garyburd/redigo/redis"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	SPAM_REDIS_KEY = "spam"
+
+	spamContactsTTL = time.Hour * 48
+	// users that tried to contact more than quota multiplied by this ratio
+	// of distinct users per day are flagged
+	spamContactsFlagRatio = 2
+	spamTextsTTL          = time.Hour * 24
+	spamTextsKept         = 100
+	// amount of recipients of near-identical texts that makes user a spammer
+	spamRecipientsMax = 10
+	spamReportsCount  = 20
+)
+
+// textsScript stores entry of text sent by user, keeping only recent ones,
+// and returns entries that were stored before
+var textsScript = redis.NewScript(1, `
+local entries = redis.call('LRANGE', KEYS[1], 0, -1)
+redis.call('LPUSH', KEYS[1], ARGV[1])
+redis.call('LTRIM', KEYS[1], 0, tonumber(ARGV[2]) - 1)
+redis.call('EXPIRE', KEYS[1], ARGV[3])
+return entries
+`)
+
+// SpamFilter limits amount of conversations that users start per day and
+// detects near-identical texts sent to many recipients, keeping counters
+// in redis
+type SpamFilter struct {
+	pool *redis.Pool
+}
+
+func (f *SpamFilter) key(parts ...string) string {
+	return strings.Join(append([]string{redisName, SPAM_REDIS_KEY}, parts...), REDIS_SEPARATOR)
+}
+
+// countContact counts attempt of user to start conversation with
+// destination and returns amount of distinct users that user tried to
+// contact during the day, so repeated attempts are counted once
+func (f *SpamFilter) countContact(user, destination bson.ObjectId, now time.Time) (int, error) {
+	conn := f.pool.Get()
+	defer conn.Close()
+	key := f.key("contacts", user.Hex(), now.Format("2006-01-02"))
+	conn.Send("MULTI")
+	conn.Send("SADD", key, destination.Hex())
+	conn.Send("SCARD", key)
+	conn.Send("EXPIRE", key, int64(spamContactsTTL/time.Second))
+	reply, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return 0, err
+	}
+	return redis.Int(reply[1], nil)
+}
+
+// similarRecipients stores simhash of text sent by user to destination and
+// returns amount of other recipients of near-identical texts
+func (f *SpamFilter) similarRecipients(user, destination bson.ObjectId, hash uint64) (int, error) {
+	conn := f.pool.Get()
+	defer conn.Close()
+	key := f.key("texts", user.Hex())
+	entry := strconv.FormatUint(hash, 16) + REDIS_SEPARATOR + destination.Hex()
+	entries, err := redis.Strings(textsScript.Do(conn, key, entry, spamTextsKept, int64(spamTextsTTL/time.Second)))
+	if err != nil {
+		return 0, err
+	}
+	recipients := make(map[string]bool)
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, REDIS_SEPARATOR, 2)
+		if len(parts) != 2 || parts[1] == destination.Hex() {
+			continue
+		}
+		h, err := strconv.ParseUint(parts[0], 16, 64)
+		if err != nil {
+			continue
+		}
+		if HammingDistance(h, hash) <= SpamSimilarDistance {
+			recipients[parts[1]] = true
+		}
+	}
+	return len(recipients), nil
+}
+
+// flag shadow-limits user, passing it to admin review
+func (f *SpamFilter) flag(db DataBase, user *User, reason string) error {
+	log.Println("[spam]", "user", user.Id.Hex(), "flagged:", reason)
+	user.SpamFlag = &SpamFlag{Reason: reason, Time: time.Now()}
+	return db.SetSpamFlag(user.Id, user.SpamFlag)
+}
+
+// Check returns true if message from origin to destination must be hidden
+// from destination, flagging origin if it behaves like spammer. Returns
+// ErrorContactsQuota if origin exceeded quota of new conversations.
+func (f *SpamFilter) Check(db DataBase, origin *User, destination bson.ObjectId, text string) (bool, error) {
+	if origin.ShadowLimited() {
+		return true, nil
+	}
+	now := time.Now()
+	_, err := db.GetConversation(origin.Id, destination)
+	if err != nil && err != mgo.ErrNotFound {
+		return false, err
+	}
+	if err == mgo.ErrNotFound {
+		quota := FirstContactQuota(origin, now)
+		n, err := f.countContact(origin.Id, destination, now)
+		if err != nil {
+			return false, err
+		}
+		if n > quota*spamContactsFlagRatio {
+			return true, f.flag(db, origin, SpamReasonContacts)
+		}
+		if n > quota {
+			return false, ErrorContactsQuota
+		}
+	}
+	hash, ok := Simhash(text)
+	if !ok {
+		return false, nil
+	}
+	n, err := f.similarRecipients(origin.Id, destination, hash)
+	if err != nil {
+		return false, err
+	}
+	if n+1 >= spamRecipientsMax {
+		return true, f.flag(db, origin, SpamReasonDuplicates)
+	}
+	return false, nil
+}
+
+// GetSpamReports returns admin queue of users flagged for spam
+func GetSpamReports(context Context, pagination Pagination) (int, []byte) {
+	if pagination.Count == 0 {
+		pagination.Count = spamReportsCount
+	}
+	reports, count, err := context.DB.GetSpamReports(pagination)
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	if err := SpamReports(reports).Prepare(context); err != nil {
+		return Render(BackendError(err))
+	}
+	return context.Render(SearchResult{Result: reports, Count: count})
+}
+
+// RemoveSpamFlag lifts shadow limit of user after admin review
+func RemoveSpamFlag(context Context, id bson.ObjectId) (int, []byte) {
+	err := context.DB.RemoveSpamFlag(id)
+	if err == mgo.ErrNotFound {
+		return Render(ErrorUserNotFound)
+	}
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	log.Println("[spam]", "user", id.Hex(), "unflagged")
+	return Render("ok")
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	. "github.com/ernado/poputchiki/models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	LAST_EVENT_ID_HEADER = "Last-Event-ID"
+	LAST_EVENT_ID_PARM   = "last_event_id"
+	SINCE_PARM           = "since"
+	POLL_TIMEOUT_PARM    = "timeout"
+
+	sseHeartbeat       = 15 * time.Second
+	sseRetry           = 3 * time.Second
+	pollTimeout        = 25 * time.Second
+	pollTimeoutMax     = 60 * time.Second
+	realtimeReplayMax  = 500
+	realtimeStreamType = "text/event-stream"
+)
+
+var ErrStreamingUnsupported = errors.New("Streaming is not supported")
+
+// lastEventId returns id of last update that client received, from
+// Last-Event-ID header that is sent by EventSource on reconnect, from query
+// parameter or from since parameter, that is update id or time in RFC 3339
+func lastEventId(r *http.Request) (bson.ObjectId, bool) {
+	q := r.URL.Query()
+	id := r.Header.Get(LAST_EVENT_ID_HEADER)
+	if id == "" {
+		id = q.Get(LAST_EVENT_ID_PARM)
+	}
+	if id == "" {
+		id = q.Get(SINCE_PARM)
+	}
+	if id == "" {
+		return "", true
+	}
+	if bson.IsObjectIdHex(id) {
+		return bson.ObjectIdHex(id), true
+	}
+	if since, err := time.Parse(time.RFC3339, id); err == nil {
+		return bson.NewObjectIdWithTime(since), true
+	}
+	return "", false
+}
+
+type updatesByTime []*Update
+
+func (u updatesByTime) Len() int {
+	return len(u)
+}
+
+func (u updatesByTime) Swap(i, j int) {
+	u[i], u[j] = u[j], u[i]
+}
+
+func (u updatesByTime) Less(i, j int) bool {
+	if u[i].Time.Equal(u[j].Time) {
+		return u[i].Id < u[j].Id
+	}
+	return u[i].Time.Before(u[j].Time)
+}
+
+// missedUpdates returns updates of users that were published after last
+// update received by client: persisted ones and ephemeral ones from buffer
+// of hub, without duplicates and oldest first
+func missedUpdates(db DataBase, hub *Hub, users []bson.ObjectId, after bson.ObjectId) ([]*Update, error) {
+	if !after.Valid() {
+		return []*Update{}, nil
+	}
+	persisted, err := db.GetUpdatesAfter(users, after, realtimeReplayMax)
+	if err != nil {
+		return nil, err
+	}
+	buffered, err := hub.Buffered(users, after)
+	if err != nil {
+		// persisted updates are still replayed without buffer
+		log.Println("[realtime]", "buffer error", err)
+	}
+	updates := persisted
+	seen := make(map[bson.ObjectId]bool)
+	for _, u := range persisted {
+		seen[u.Id] = true
+	}
+	// persisted updates are truncated, so buffered ones after them are left
+	// for next resume from last persisted update
+	var last bson.ObjectId
+	if len(persisted) == realtimeReplayMax {
+		last = persisted[len(persisted)-1].Id
+	}
+	for _, u := range buffered {
+		if last.Valid() && u.Id > last {
+			continue
+		}
+		if !seen[u.Id] {
+			seen[u.Id] = true
+			updates = append(updates, u)
+		}
+	}
+	sort.Sort(updatesByTime(updates))
+	return updates, nil
+}
+
+// writeEvent writes update as server-sent event with update id, so client
+// can resume from it
+func writeEvent(w io.Writer, u *Update) error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\ndata: %s\n\n", u.Id.Hex(), data)
+	return err
+}
+
+// EventStreamHandler streams events as server-sent events for clients that
+// can not use websockets, resuming from Last-Event-ID
+func (realtime *Realtime) EventStreamHandler(w http.ResponseWriter, context Context) {
+	if context.Token == nil {
+		code, data := Render(ErrorAuth)
+		http.Error(w, string(data), code)
+		return
+	}
+	targets, ok := realtimeTargets(context)
+	if !ok {
+		code, data := Render(ErrorBadRequest)
+		http.Error(w, string(data), code)
+		return
+	}
+	after, ok := lastEventId(context.Request)
+	if !ok {
+		code, data := Render(ErrorBadId)
+		http.Error(w, string(data), code)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		code, data := Render(BackendError(ErrStreamingUnsupported))
+		http.Error(w, string(data), code)
+		return
+	}
+	// subscribing before replay, so no events are lost between them
+	c, err := realtime.hub.Subscribe(targets...)
+	if err != nil {
+		code, data := Render(BackendError(err))
+		http.Error(w, string(data), code)
+		return
+	}
+	defer realtime.hub.Unsubscribe(c)
+	realtime.track(context.Token.Id, c)
+	missed, err := missedUpdates(context.DB, realtime.hub, targets, after)
+	if err != nil {
+		code, data := Render(BackendError(err))
+		http.Error(w, string(data), code)
+		return
+	}
+
+	w.Header().Set("Content-Type", realtimeStreamType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", sseRetry/time.Millisecond)
+	replayed := make(map[bson.ObjectId]bool)
+	for _, u := range missed {
+		replayed[u.Id] = true
+		if err := u.Prepare(context); err != nil {
+			log.Println("[realtime]", "prepare error", err)
+		}
+		if err := writeEvent(w, u); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	var closed <-chan bool
+	if notifier, ok := w.(http.CloseNotifier); ok {
+		closed = notifier.CloseNotify()
+	}
+	ticker := time.NewTicker(sseHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case event := <-c.Updates():
+			if replayed[event.Id] {
+				delete(replayed, event.Id)
+				continue
+			}
+			if err := event.Prepare(context); err != nil {
+				log.Println("[realtime]", "prepare error", err)
+			}
+			if err := writeEvent(w, &event); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if _, err := io.WriteString(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case <-c.Done():
+			return
+		case <-closed:
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// PollHandler returns missed updates or waits for next events up to
+// timeout, returning empty list if there were no events
+func (realtime *Realtime) PollHandler(context Context) (int, []byte) {
+	if context.Token == nil {
+		return Render(ErrorAuth)
+	}
+	targets, ok := realtimeTargets(context)
+	if !ok {
+		return Render(ErrorBadRequest)
+	}
+	after, ok := lastEventId(context.Request)
+	if !ok {
+		return Render(ErrorBadId)
+	}
+	timeout := pollTimeout
+	if v := context.Request.URL.Query().Get(POLL_TIMEOUT_PARM); v != "" {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds < 0 {
+			return Render(ErrorBadRequest)
+		}
+		timeout = time.Duration(seconds) * time.Second
+		if timeout > pollTimeoutMax {
+			timeout = pollTimeoutMax
+		}
+	}
+	c, err := realtime.hub.Subscribe(targets...)
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	defer realtime.hub.Unsubscribe(c)
+	updates, err := missedUpdates(context.DB, realtime.hub, targets, after)
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	if len(updates) == 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case event := <-c.Updates():
+			updates = append(updates, &event)
+		case <-timer.C:
+		case <-c.Done():
+		}
+		// events that are already queued are returned in same response
+		for drained := false; !drained; {
+			select {
+			case event := <-c.Updates():
+				updates = append(updates, &event)
+			default:
+				drained = true
+			}
+		}
+	}
+	for _, u := range updates {
+		if err := u.Prepare(context); err != nil {
+			log.Println("[realtime]", "prepare error", err)
+		}
+	}
+	return context.Render(updates)
+}
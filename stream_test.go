@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ernado/gotok"
+	. "github.com/ernado/poputchiki/models"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// updatesDB is a DataBase that returns persisted updates
+type updatesDB struct {
+	DataBase
+	updates []*Update
+}
+
+func (db *updatesDB) Get(id bson.ObjectId) *User {
+	return &User{Id: id}
+}
+
+func (db *updatesDB) GetPhoto(id bson.ObjectId) (*Photo, error) {
+	return nil, mgo.ErrNotFound
+}
+
+func (db *updatesDB) GetUpdatesAfter(destinations []bson.ObjectId, after bson.ObjectId, count int) ([]*Update, error) {
+	var updates []*Update
+	for _, u := range db.updates {
+		if u.Id > after && len(updates) < count {
+			updates = append(updates, u)
+		}
+	}
+	return updates, nil
+}
+
+// blankStorage is a storage with blank urls of files
+type blankStorage struct {
+	StorageAdapter
+}
+
+func (s blankStorage) URL(fid string) (string, error) {
+	return "", nil
+}
+
+// renderFunc renders values with function
+type renderFunc func(value interface{}) (int, []byte)
+
+func (f renderFunc) Render(value interface{}) (int, []byte) {
+	return f(value)
+}
+
+func TestEventStream(t *testing.T) {
+	Convey("Event stream", t, func() {
+		id := bson.NewObjectId()
+		Convey("Last event id should be read from header or query", func() {
+			r, _ := http.NewRequest("GET", "/api/realtime/sse", nil)
+			after, ok := lastEventId(r)
+			So(ok, ShouldBeTrue)
+			So(after.Valid(), ShouldBeFalse)
+			r.Header.Set(LAST_EVENT_ID_HEADER, id.Hex())
+			after, ok = lastEventId(r)
+			So(ok, ShouldBeTrue)
+			So(after, ShouldEqual, id)
+			r, _ = http.NewRequest("GET", "/api/realtime/poll?last_event_id="+id.Hex(), nil)
+			after, ok = lastEventId(r)
+			So(ok, ShouldBeTrue)
+			So(after, ShouldEqual, id)
+			r.Header.Set(LAST_EVENT_ID_HEADER, "bad")
+			_, ok = lastEventId(r)
+			So(ok, ShouldBeFalse)
+		})
+		Convey("Since should be update id or time", func() {
+			r, _ := http.NewRequest("GET", "/api/realtime?since=2015-03-01T10:00:00Z", nil)
+			after, ok := lastEventId(r)
+			So(ok, ShouldBeTrue)
+			So(after.Time().Equal(time.Date(2015, 3, 1, 10, 0, 0, 0, time.UTC)), ShouldBeTrue)
+			r, _ = http.NewRequest("GET", "/api/realtime?since=yesterday", nil)
+			_, ok = lastEventId(r)
+			So(ok, ShouldBeFalse)
+		})
+		Convey("Updates should be ordered by time", func() {
+			now := time.Now()
+			a := &Update{Id: bson.NewObjectId(), Time: now}
+			b := &Update{Id: bson.NewObjectId(), Time: now}
+			c := &Update{Id: bson.NewObjectId(), Time: now.Add(-time.Second)}
+			updates := []*Update{b, a, c}
+			sort.Sort(updatesByTime(updates))
+			So(updates, ShouldResemble, []*Update{c, a, b})
+		})
+		Convey("Missed updates should not skip events after truncated replay", func() {
+			db := new(updatesDB)
+			after := bson.NewObjectId()
+			for i := 0; i < realtimeReplayMax; i++ {
+				u := NewUpdate(id, id, UpdateMessages, nil)
+				db.updates = append(db.updates, &u)
+			}
+			realtime := NewRealtimeMemory(HubDisconnectSlow, 10, time.Minute)
+			buffered := NewUpdate(id, id, UpdateTyping, nil)
+			So(realtime.hub.Publish(buffered), ShouldBeNil)
+			missed, err := missedUpdates(db, realtime.hub, []bson.ObjectId{id}, after)
+			So(err, ShouldBeNil)
+			So(len(missed), ShouldEqual, realtimeReplayMax)
+			So(missed[len(missed)-1].Id, ShouldEqual, db.updates[realtimeReplayMax-1].Id)
+			Convey("And include them when replay is complete", func() {
+				db.updates = db.updates[1:]
+				missed, err := missedUpdates(db, realtime.hub, []bson.ObjectId{id}, after)
+				So(err, ShouldBeNil)
+				So(len(missed), ShouldEqual, realtimeReplayMax)
+				So(missed[len(missed)-1].Id, ShouldEqual, buffered.Id)
+			})
+		})
+		Convey("Events should have update id", func() {
+			u := NewUpdate(id, id, UpdateTyping, nil)
+			buff := new(bytes.Buffer)
+			So(writeEvent(buff, &u), ShouldBeNil)
+			So(buff.String(), ShouldStartWith, "id: "+u.Id.Hex()+"\ndata: {")
+			So(strings.HasSuffix(buff.String(), "}\n\n"), ShouldBeTrue)
+			So(strings.Count(buff.String(), "\n"), ShouldEqual, 3)
+		})
+	})
+}
+
+func TestEventStreamHandlers(t *testing.T) {
+	Convey("Event stream handlers", t, func() {
+		user := bson.NewObjectId()
+		token := &gotok.Token{Id: user}
+		db := new(updatesDB)
+		realtime := NewRealtimeMemory(HubDisconnectSlow, 10, time.Minute)
+		after := bson.NewObjectId()
+		missed := NewUpdate(user, user, UpdateMessages, nil)
+		db.updates = []*Update{&missed}
+		buffered := NewUpdate(user, user, UpdateTyping, nil)
+		So(realtime.hub.Publish(buffered), ShouldBeNil)
+		context := func(r *http.Request, t *gotok.Token) Context {
+			return Context{DB: db, Storage: blankStorage{}, Request: r, Token: t, Renderer: renderFunc(Render)}
+		}
+		Convey("Stream should resume from Last-Event-ID", func() {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				realtime.EventStreamHandler(w, context(r, token))
+			}))
+			defer server.Close()
+			r, _ := http.NewRequest("GET", server.URL, nil)
+			r.Header.Set(LAST_EVENT_ID_HEADER, after.Hex())
+			res, err := http.DefaultClient.Do(r)
+			So(err, ShouldBeNil)
+			defer res.Body.Close()
+			So(res.StatusCode, ShouldEqual, http.StatusOK)
+			So(res.Header.Get("Content-Type"), ShouldEqual, realtimeStreamType)
+			reader := bufio.NewReader(res.Body)
+			var ids []string
+			for len(ids) < 2 {
+				line, err := reader.ReadString('\n')
+				So(err, ShouldBeNil)
+				if strings.HasPrefix(line, "id: ") {
+					ids = append(ids, strings.TrimSpace(strings.TrimPrefix(line, "id: ")))
+				}
+			}
+			So(ids, ShouldResemble, []string{missed.Id.Hex(), buffered.Id.Hex()})
+		})
+		Convey("Poll should return buffered events", func() {
+			db.updates = nil
+			r, _ := http.NewRequest("GET", "/api/realtime/poll?timeout=0&last_event_id="+after.Hex(), nil)
+			code, data := realtime.PollHandler(context(r, token))
+			So(code, ShouldEqual, http.StatusOK)
+			var updates []*Update
+			So(json.Unmarshal(data, &updates), ShouldBeNil)
+			So(len(updates), ShouldEqual, 1)
+			So(updates[0].Id, ShouldEqual, buffered.Id)
+		})
+		Convey("Anonymous requests should be rejected", func() {
+			r, _ := http.NewRequest("GET", "/api/realtime/poll", nil)
+			code, _ := realtime.PollHandler(context(r, nil))
+			So(code, ShouldEqual, http.StatusUnauthorized)
+			w := httptest.NewRecorder()
+			realtime.EventStreamHandler(w, context(r, nil))
+			So(w.Code, ShouldEqual, http.StatusUnauthorized)
+		})
+	})
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	. "github.com/ernado/poputchiki/models"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	tripSearchCount      = 20
+	tripNotificationsMax = 50 // maximum amount of owners notified about new trip
+)
+
+// getTrip returns trip with provided id if it is visible for current user
+func getTrip(context Context, id bson.ObjectId) (*Trip, error) {
+	trip, err := context.DB.GetTrip(id)
+	if err != nil {
+		return nil, err
+	}
+	if context.IsAdmin {
+		return trip, nil
+	}
+	owner := context.DB.Get(trip.User)
+	if !trip.VisibleTo(context.User.Id, owner) {
+		return nil, mgo.ErrNotFound
+	}
+	trip.UserObject = owner
+	return trip, nil
+}
+
+// tripOwner returns id of user that is allowed to modify trip
+func tripOwner(context Context, id bson.ObjectId) (bson.ObjectId, error) {
+	if !context.IsAdmin {
+		return context.User.Id, nil
+	}
+	trip, err := context.DB.GetTrip(id)
+	if err != nil {
+		return "", err
+	}
+	return trip.User, nil
+}
+
+// notifyOverlappingTrips pushes updates about new trip to owners of overlapping
+// trips and about their trips to the owner of new one
+func notifyOverlappingTrips(db DataBase, u Updater, trip *Trip) {
+	if trip.Visibility == TripPrivate {
+		return
+	}
+	owner := db.Get(trip.User)
+	if owner == nil {
+		return
+	}
+	query := new(TripQuery)
+	query.FromTrip(trip)
+	trips, err := db.SearchTrips(query, trip.User)
+	if err != nil {
+		log.Println("[trips]", "overlapping search error", err)
+		return
+	}
+	notified := map[bson.ObjectId]bool{}
+	for _, other := range trips {
+		if len(notified) >= tripNotificationsMax {
+			return
+		}
+		if notified[other.User] {
+			continue
+		}
+		otherOwner := db.Get(other.User)
+		if otherOwner == nil || otherOwner.InBlacklist(owner.Id) || owner.InBlacklist(otherOwner.Id) {
+			continue
+		}
+		notified[other.User] = true
+		if trip.VisibleTo(other.User, owner) {
+			if err := u.Push(NewUpdate(other.User, trip.User, UpdateTrips, trip)); err != nil {
+				log.Println("[trips]", "update error", err)
+			}
+		}
+		if other.VisibleTo(trip.User, otherOwner) {
+			if err := u.Push(NewUpdate(trip.User, other.User, UpdateTrips, other)); err != nil {
+				log.Println("[trips]", "update error", err)
+			}
+		}
+	}
+}
+
+// AddTrip creates new trip of current user
+func AddTrip(context Context, parser Parser, u Updater) (int, []byte) {
+	trip := new(Trip)
+	if err := parser.Parse(trip); err != nil {
+		return Render(ValidationError(err))
+	}
+	trip.User = context.User.Id
+	if err := trip.Validate(context.DB); err != nil {
+		return Render(ValidationError(err))
+	}
+	trip, err := context.DB.AddTrip(trip)
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	go notifyOverlappingTrips(context.DB, u, trip)
+	return context.Render(trip)
+}
+
+func GetTrip(context Context, id bson.ObjectId) (int, []byte) {
+	trip, err := getTrip(context, id)
+	if err == mgo.ErrNotFound {
+		return Render(ErrorObjectNotFound)
+	}
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	return context.Render(trip)
+}
+
+func UpdateTrip(context Context, id bson.ObjectId, parser Parser) (int, []byte) {
+	trip := new(Trip)
+	if err := parser.Parse(trip); err != nil {
+		return Render(ValidationError(err))
+	}
+	if err := trip.Validate(context.DB); err != nil {
+		return Render(ValidationError(err))
+	}
+	owner, err := tripOwner(context, id)
+	if err == mgo.ErrNotFound {
+		return Render(ErrorObjectNotFound)
+	}
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	trip, err = context.DB.UpdateTripSecure(owner, id, trip)
+	if err == mgo.ErrNotFound {
+		return Render(ErrorObjectNotFound)
+	}
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	return context.Render(trip)
+}
+
+func RemoveTrip(context Context, id bson.ObjectId) (int, []byte) {
+	owner, err := tripOwner(context, id)
+	if err == mgo.ErrNotFound {
+		return Render(ErrorObjectNotFound)
+	}
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	err = context.DB.RemoveTripSecure(owner, id)
+	if err == mgo.ErrNotFound {
+		return Render(ErrorObjectNotFound)
+	}
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	return Render("ok")
+}
+
+// GetUserTrips returns trips of user that are visible for current user
+func GetUserTrips(context Context, id bson.ObjectId) (int, []byte) {
+	owner := context.DB.Get(id)
+	if owner == nil {
+		return Render(ErrorUserNotFound)
+	}
+	var viewer bson.ObjectId
+	if context.User != nil {
+		viewer = context.User.Id
+	}
+	if owner.InBlacklist(viewer) {
+		return Render(ErrorBlacklisted)
+	}
+	trips, err := context.DB.GetUserTrips(id)
+	if err != nil && err != mgo.ErrNotFound {
+		return Render(BackendError(err))
+	}
+	visible := Trips{}
+	for _, trip := range trips {
+		if bool(context.IsAdmin) || trip.VisibleTo(viewer, owner) {
+			trip.UserObject = owner
+			visible = append(visible, trip)
+		}
+	}
+	return context.Render(visible)
+}
+
+// SearchTrips returns trips of other users overlapping with provided
+// destinations and dates or with trip of current user, most relevant first
+func SearchTrips(context Context, pagination Pagination, r *http.Request) (int, []byte) {
+	query, err := NewTripQuery(r.URL.Query())
+	if err != nil {
+		return Render(ValidationError(err))
+	}
+	if query.Trip.Valid() {
+		trip, err := getTrip(context, query.Trip)
+		if err == mgo.ErrNotFound {
+			return Render(ErrorObjectNotFound)
+		}
+		if err != nil {
+			return Render(BackendError(err))
+		}
+		query.FromTrip(trip)
+	}
+	now := time.Now()
+	if err := query.Normalize(now); err != nil {
+		return Render(ValidationError(err))
+	}
+	trips, err := context.DB.SearchTrips(query, context.User.Id)
+	if err != nil {
+		return Render(BackendError(err))
+	}
+	owners := map[bson.ObjectId]*User{}
+	for _, trip := range trips {
+		if _, ok := owners[trip.User]; ok {
+			continue
+		}
+		owner := context.DB.Get(trip.User)
+		if owner != nil && owner.InBlacklist(context.User.Id) {
+			owner = nil
+		}
+		owners[trip.User] = owner
+	}
+	result := query.Rank(context.User, trips, owners, now)
+	count := len(result)
+	if pagination.Count == 0 {
+		pagination.Count = tripSearchCount
+	}
+	if pagination.Offset > count {
+		pagination.Offset = count
+	}
+	end := pagination.Offset + pagination.Count
+	if end > count {
+		end = count
+	}
+	result = result[pagination.Offset:end]
+	if err := result.Prepare(context); err != nil {
+		return Render(BackendError(err))
+	}
+	return context.Render(SearchResult{Result: result, Count: count})
+}
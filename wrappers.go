@@ -72,9 +72,13 @@ func Render(value interface{}) (int, []byte) {
 	}
 }
 
-func SetOnlineWrapper(db models.DataBase, t *gotok.Token) {
-	go db.SetOnline(t.Id)
-	go db.SetLastActionNow(t.Id)
+// SetOnlineWrapper keeps user online while api requests are made
+func SetOnlineWrapper(presence *Presence, t *gotok.Token) {
+	go func() {
+		if err := presence.Touch(t.Id, PRESENCE_API_DEVICE, OfflineTimeout); err != nil {
+			log.Println("[presence]", "error", err)
+		}
+	}()
 }
 
 func PaginationWrapper(c martini.Context, r *http.Request) {